@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/pipeline"
+)
+
+// agentPath 是 agent 接收快照的路径
+const agentPath = "/v1/snapshot"
+
+// agentResponse 是 agent 对一次推送的应答
+type agentResponse struct {
+	Outcome string `json:"outcome"` // applied、unchanged、rejected 或 failed
+	Error   string `json:"error,omitempty"`
+	IPv4    int    `json:"ipv4"`
+	IPv6    int    `json:"ipv6"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// agentGuards 是 agent 在应用推送的数据前检查的本地条件
+type agentGuards struct {
+	minIPv4, minIPv6 int
+	protect          []netip.Prefix
+}
+
+// check 检查快照中的网段数不少于下限，且没有网段与受保护的网段重叠
+func (g agentGuards) check(classified *pipeline.Classified) error {
+	if n := len(classified.IPv4); n < g.minIPv4 {
+		return fmt.Errorf("%d IPv4 ranges, fewer than -min-ipv4 %d", n, g.minIPv4)
+	}
+	if n := len(classified.IPv6); n < g.minIPv6 {
+		return fmt.Errorf("%d IPv6 ranges, fewer than -min-ipv6 %d", n, g.minIPv6)
+	}
+	protected := iprange.FromPrefixes(g.protect)
+	for _, entries := range [][]pipeline.Entry{classified.IPv4, classified.IPv6} {
+		for _, e := range entries {
+			if len(iprange.Intersect([]iprange.Range{iprange.FromPrefix(e.Prefix)}, protected)) > 0 {
+				return fmt.Errorf("%s (%s) overlaps a protected network", e.Prefix, strings.Join(e.Categories, ","))
+			}
+		}
+	}
+	return nil
+}
+
+// runAgent 在本地监听，接收其他主机推送的快照并应用到本机的集合，返回退出码
+func runAgent(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" agent", flag.ExitOnError)
+	defineFlags(fs)
+	listen := fs.String("listen", "", "Listen on unix:///path (socket mode 0660) or tcp://host:port (requires -tls-cert and -tls-key).")
+	tokenFile := fs.String("token-file", "", "File containing the shared token pushers send as 'Authorization: Bearer <token>' (required for tcp://).")
+	certFile := fs.String("tls-cert", "", "TLS certificate for a tcp:// listener.")
+	keyFile := fs.String("tls-key", "", "TLS private key for a tcp:// listener.")
+	maxBody := fs.Int64("max-body", 8<<20, "Reject pushed documents larger than this many bytes.")
+	var guards agentGuards
+	fs.IntVar(&guards.minIPv4, "min-ipv4", 1, "Reject pushed data with fewer IPv4 ranges.")
+	fs.IntVar(&guards.minIPv6, "min-ipv6", 0, "Reject pushed data with fewer IPv6 ranges.")
+	protect := fs.String("protect", "", "Comma-separated CIDRs that pushed data must never overlap, e.g. internal networks.")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if profile == profileAll {
+		log.Printf("ERROR: agent applies to one profile; use -profile <name>")
+		return exitFailure
+	}
+	if confirmPrompt && !assumeYes {
+		log.Printf("ERROR: agent cannot prompt for confirmation; drop -confirm or add -yes")
+		return exitFailure
+	}
+	if err := validate(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	for _, item := range splitList(*protect) {
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			log.Printf("ERROR: -protect: %v", err)
+			return exitFailure
+		}
+		guards.protect = append(guards.protect, p.Masked())
+	}
+	if *maxBody <= 0 {
+		log.Printf("ERROR: -max-body must be positive")
+		return exitFailure
+	}
+	var token string
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Printf("ERROR: read token: %v", err)
+			return exitFailure
+		}
+		if token = strings.TrimSpace(string(data)); token == "" {
+			log.Printf("ERROR: %s is empty", *tokenFile)
+			return exitFailure
+		}
+	}
+	if err := preflight(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+
+	ln, err := agentListener(*listen, token, *certFile, *keyFile)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	auditAction = "agent"
+	a := &agent{token: token, maxBody: *maxBody, guards: guards}
+	srv := &http.Server{Handler: a, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	logInfo("Agent listening on %s for pushed snapshots.", *listen)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	logInfo("Agent stopped.")
+	return 0
+}
+
+// agentListener 按 -listen 打开监听。unix 套接字依靠文件权限限制访问，tcp 必须使用 TLS 和令牌
+func agentListener(listen, token, certFile, keyFile string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(listen, "unix://"); ok {
+		if path == "" {
+			return nil, errors.New("-listen unix:// needs a socket path")
+		}
+		// 只删除上次运行留下的套接字文件，仍能连接说明另一个 agent 正在使用
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("another agent is already listening on %s", path)
+			}
+			os.Remove(path)
+		}
+		// 套接字创建时就是 0660，不存在先创建再 chmod 的窗口
+		old := syscall.Umask(0o117)
+		ln, err := net.Listen("unix", path)
+		syscall.Umask(old)
+		return ln, err
+	}
+	addr, ok := strings.CutPrefix(listen, "tcp://")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("invalid -listen %q (want unix:///path or tcp://host:port)", listen)
+	}
+	if certFile == "" || keyFile == "" || token == "" {
+		return nil, errors.New("a tcp:// listener requires -tls-cert, -tls-key and -token-file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+}
+
+// agent 处理推送请求，同一时间只应用一个快照
+type agent struct {
+	token   string
+	maxBody int64
+	guards  agentGuards
+	mu      sync.Mutex
+}
+
+func (a *agent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != agentPath {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.token != "" {
+		got, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+			log.Printf("WARNING: rejected push from %s: bad or missing token", req.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var snap pipeline.Snapshot
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, a.maxBody))
+	if err := dec.Decode(&snap); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAgentResponse(w, http.StatusRequestEntityTooLarge, agentResponse{Outcome: "rejected", Error: fmt.Sprintf("document larger than %d bytes", a.maxBody)})
+			return
+		}
+		writeAgentResponse(w, http.StatusBadRequest, agentResponse{Outcome: "rejected", Error: "decode snapshot: " + err.Error()})
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status, resp := a.apply(req.Context(), &snap)
+	logInfo("Push from %s (%s, fetched %s): %s", req.RemoteAddr, snap.Source, snap.FetchedAt.Format(time.RFC3339), resp.Outcome)
+	writeAgentResponse(w, status, resp)
+}
+
+// apply 检查本地条件后应用快照，返回 HTTP 状态码和应答
+func (a *agent) apply(ctx context.Context, snap *pipeline.Snapshot) (int, agentResponse) {
+	if len(snap.Categories) == 0 {
+		return http.StatusUnprocessableEntity, agentResponse{Outcome: "rejected", Error: "snapshot has no categories"}
+	}
+	classified := pipeline.Classify(snap.Categories)
+	resp := agentResponse{IPv4: len(classified.IPv4), IPv6: len(classified.IPv6)}
+	if err := a.guards.check(classified); err != nil {
+		resp.Outcome, resp.Error = "rejected", err.Error()
+		log.Printf("WARNING: rejected pushed snapshot: %v", err)
+		return http.StatusUnprocessableEntity, resp
+	}
+	opts := buildOptions()
+	opts.TrackChanges = true
+	res, err := pipeline.ApplySnapshot(ctx, opts, snap)
+	finish(opts, res, err)
+	var guard *pipeline.GuardError
+	switch {
+	case errors.As(err, &guard):
+		resp.Outcome, resp.Error = "rejected", err.Error()
+		return http.StatusUnprocessableEntity, resp
+	case err != nil:
+		resp.Outcome, resp.Error = "failed", err.Error()
+		return http.StatusInternalServerError, resp
+	}
+	resp.Added, resp.Removed = len(res.Added), len(res.Removed)
+	resp.Outcome = "unchanged"
+	if res.Applied {
+		saveSnapshot(snap)
+		if res.Changed() {
+			resp.Outcome = "applied"
+		}
+	}
+	return http.StatusOK, resp
+}
+
+func writeAgentResponse(w http.ResponseWriter, status int, resp agentResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
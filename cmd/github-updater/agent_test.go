@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAgentListenerUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := agentListener("unix://"+path, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o660 {
+		t.Errorf("socket mode %o, want 660", perm)
+	}
+
+	// 正在使用的套接字不会被第二个 agent 删除
+	if ln2, err := agentListener("unix://"+path, "", "", ""); err == nil || !strings.Contains(err.Error(), "already listening") {
+		if ln2 != nil {
+			ln2.Close()
+		}
+		t.Fatalf("second listener: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("first listener no longer reachable: %v", err)
+	}
+	conn.Close()
+
+	// 异常退出留下的套接字文件被替换
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = agentListener("unix://"+path, "", "", "")
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+}
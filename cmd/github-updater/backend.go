@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"github-updater/pkg/awssg"
+	"github-updater/pkg/awswaf"
+	"github-updater/pkg/firewalld"
+	"github-updater/pkg/ipset"
+	"github-updater/pkg/pf"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// flagUse 表示某个参数是否被使用，用于列出与 -backend 冲突的参数
+type flagUse struct {
+	name string
+	on   bool
+}
+
+// checkBackend 检查 -backend 的值以及与所选执行方式冲突的参数
+func checkBackend() error {
+	if pfAnchor != "" && backend != "pf" {
+		return fmt.Errorf("-pf-anchor requires -backend pf")
+	}
+	if (awsGroups != "" || awsPrefixLists != "" || awsRegion != "") && backend != "aws" {
+		return fmt.Errorf("-aws-security-groups, -aws-prefix-lists and -aws-region require -backend aws")
+	}
+	if wafIPSetARNs != "" && backend != "awswaf" {
+		return fmt.Errorf("-ipset-arn requires -backend awswaf")
+	}
+	var (
+		reason    string
+		conflicts []flagUse
+	)
+	switch backend {
+	case "netlink":
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("-backend netlink is only available on Linux")
+		}
+		reason = "only manages plain address sets"
+		conflicts = []flagUse{
+			{"chain", chain.Name != ""}, {"rule-chain", len(ruleChainSpecs) > 0}, {"ports", ports != ""},
+			{"verdict-map", verdictMap != ""}, {"append", appendMode}, {"set-gc-interval", setAttrs.GCInterval > 0},
+			{"set-policy", setAttrs.Policy != ""}, {"plan", planMode}, {"reconcile", reconcileMode},
+			{"out", outPath != ""}, {"remote", remoteHosts != ""},
+		}
+	case "ipset":
+		reason = "replaces whole hash:net sets outside nftables"
+		conflicts = nftOnlyFlags()
+		if err := checkSetNames(ipset.MaxNameLen - len(ipset.TempSuffix)); err != nil {
+			return err
+		}
+	case "firewalld":
+		// 集合由用户在区域或富规则中引用，不安装规则
+		reason = "maintains firewalld ipsets"
+		conflicts = append(nftOnlyFlags(), flagUse{"chain", chain.Name != ""})
+		if err := checkSetNames(ipset.MaxNameLen); err != nil {
+			return err
+		}
+	case "pf":
+		reason = "replaces a pf table"
+		conflicts = append(nftOnlyFlags(), flagUse{"chain", chain.Name != ""})
+		if pfTable == "" || len(pfTable) > pf.MaxTableLen {
+			return fmt.Errorf("-pf-table must be 1 to %d characters", pf.MaxTableLen)
+		}
+	case "aws":
+		reason = "syncs AWS security groups and prefix lists"
+		// -ports 决定安全组规则的端口
+		for _, c := range nftOnlyFlags() {
+			if c.name != "ports" {
+				conflicts = append(conflicts, c)
+			}
+		}
+		conflicts = append(conflicts, flagUse{"chain", chain.Name != ""})
+		if err := checkAWSTargets(); err != nil {
+			return err
+		}
+	case "awswaf":
+		reason = "replaces AWS WAF IP sets"
+		conflicts = append(nftOnlyFlags(), flagUse{"chain", chain.Name != ""})
+		if _, err := wafIPSets(); err != nil {
+			return err
+		}
+	default:
+		if _, err := parseBackend("-backend", backend); err != nil {
+			return fmt.Errorf("-backend: unknown backend %q (want nft, nft:/path/to/nft, netlink, ipset, firewalld, pf, aws or awswaf)", backend)
+		}
+		return nil
+	}
+	var used []string
+	for _, c := range conflicts {
+		if c.on {
+			used = append(used, "-"+c.name)
+		}
+	}
+	if len(used) > 0 {
+		return fmt.Errorf("-backend %s %s and cannot be combined with %s", backend, reason, strings.Join(used, ", "))
+	}
+	return nil
+}
+
+// nftOnlyFlags 是只对 nftables 有意义的参数，不使用 nftables 的执行方式都不接受
+func nftOnlyFlags() []flagUse {
+	return []flagUse{
+		{"rule-chain", len(ruleChainSpecs) > 0}, {"rule-iifname", ruleIifname != ""}, {"rule-oifname", ruleOifname != ""},
+		{"ports", ports != ""}, {"verdict-map", verdictMap != ""}, {"append", appendMode},
+		{"element-timeout", setAttrs.Timeout > 0}, {"set-gc-interval", setAttrs.GCInterval > 0},
+		{"set-policy", setAttrs.Policy != ""}, {"constant", setAttrs.Constant}, {"comments", withComments},
+		{"element-comments", elemComments}, {"preserve-unmanaged", preserve}, {"recreate-sets", recreateSets},
+		{"repair-sets", repairSets}, {"separate-families", separateFams}, {"clean-family-mismatch", cleanFamilies},
+		{"verify", verify}, {"post-check", postCheck != ""}, {"shadow", shadowBackend != ""},
+		{"plan", planMode}, {"monitor", monitorMode}, {"print-fingerprint", printFP}, {"reconcile", reconcileMode},
+		{"out", outPath != ""}, {"remote", remoteHosts != ""},
+	}
+}
+
+// checkSetNames 检查 -set-v4 和 -set-v6 作为 ipset 名称的长度，ipset 后端还要留出临时集合的后缀
+func checkSetNames(maxLen int) error {
+	for _, name := range []string{setV4, setV6} {
+		if len(name) > maxLen {
+			return fmt.Errorf("-backend %s: set name %q is too long (at most %d characters)", backend, name, maxLen)
+		}
+	}
+	return nil
+}
+
+// checkAWSTargets 检查 -backend aws 的安全组和前缀列表
+func checkAWSTargets() error {
+	groups, lists := splitList(awsGroups), splitList(awsPrefixLists)
+	if len(groups) == 0 && len(lists) == 0 {
+		return fmt.Errorf("-backend aws requires -aws-security-groups and/or -aws-prefix-lists")
+	}
+	for _, id := range groups {
+		if !strings.HasPrefix(id, "sg-") {
+			return fmt.Errorf("-aws-security-groups: %q is not a security group ID (sg-...)", id)
+		}
+	}
+	for _, id := range lists {
+		if !strings.HasPrefix(id, "pl-") {
+			return fmt.Errorf("-aws-prefix-lists: %q is not a prefix list ID (pl-...)", id)
+		}
+	}
+	if ports != "" && len(groups) == 0 {
+		return fmt.Errorf("-ports only applies to -aws-security-groups")
+	}
+	if awsGroupRules <= 0 {
+		return fmt.Errorf("-aws-rules-per-group must be positive")
+	}
+	return nil
+}
+
+// wafIPSets 解析 -ipset-arn
+func wafIPSets() ([]awswaf.IPSet, error) {
+	var sets []awswaf.IPSet
+	for _, s := range splitList(wafIPSetARNs) {
+		set, err := awswaf.ParseARN(s)
+		if err != nil {
+			return nil, fmt.Errorf("-ipset-arn: %w", err)
+		}
+		sets = append(sets, set)
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("-backend awswaf requires -ipset-arn")
+	}
+	return sets, nil
+}
+
+// altBackend 返回代替 nftables 的执行方式，使用 nftables（包括 netlink）时为 nil
+func altBackend() pipeline.Backend {
+	switch backend {
+	case "ipset":
+		return &ipset.Backend{IPv4Set: setV4, IPv6Set: setV6, Chain: chain.Name, Comment: managedMarker}
+	case "firewalld":
+		return &firewalld.Backend{IPv4Set: setV4, IPv6Set: setV6}
+	case "pf":
+		return &pf.Backend{Table: pfTable, Anchor: pfAnchor, File: openState().File(state.PfTableFile)}
+	case "aws":
+		portList, _ := parsePorts(ports)
+		return &awssg.Backend{Region: awsRegion, SecurityGroups: splitList(awsGroups), PrefixLists: splitList(awsPrefixLists),
+			Ports: portList, Description: managedMarker, RulesPerGroup: awsGroupRules}
+	case "awswaf":
+		sets, _ := wafIPSets()
+		return &awswaf.Backend{Sets: sets}
+	}
+	return nil
+}
+
+// targetName 描述 -backend 修改的对象，用于日志
+func targetName() string {
+	switch backend {
+	case "ipset":
+		return "ipsets"
+	case "firewalld":
+		return "firewalld ipsets"
+	case "pf":
+		return "pf table " + pfTable
+	case "aws":
+		return "AWS security groups and prefix lists"
+	case "awswaf":
+		return "AWS WAF IP sets"
+	}
+	return "nftables sets"
+}
+
+// dryRunBackend 是 -dry-run 在 altBackend 上的实现：按现状输出将要执行的命令，返回退出码
+func dryRunBackend(opts pipeline.Options) int {
+	ctx := context.Background()
+	classified, res, err := pipeline.Fetch(ctx, opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	v4, v6 := pipeline.Prefixes(classified.IPv4), pipeline.Prefixes(classified.IPv6)
+	var script string
+	switch b := opts.Backend.(type) {
+	case *ipset.Backend:
+		updates, _, err := b.Updates(ctx, v4, v6)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		script = ipset.Script(updates...)
+	case *firewalld.Backend:
+		changes, _, err := b.Changes(ctx, v4, v6)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		script = firewalld.Script(changes...)
+	case *pf.Backend:
+		script = pf.Contents(v4, v6)
+		logInfo("Would write %s and run: pfctl %s", b.File, strings.Join(b.Command("replace", "-f", b.File), " "))
+	case *awssg.Backend:
+		plan, _, err := b.Plan(ctx, v4, v6)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		var w strings.Builder
+		plan.WriteTo(&w)
+		script = w.String()
+	case *awswaf.Backend:
+		changes, _, err := b.Changes(ctx, v4, v6)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		script = awswaf.Describe(changes...)
+	}
+	os.Stdout.WriteString(script)
+	logInfo("Dry run: %d IPv4 and %d IPv6 prefixes, nothing was applied.", res.IPv4Count, res.IPv6Count)
+	return 0
+}
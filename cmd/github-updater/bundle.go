@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// runBundle 在联网的机器上生成可以直接用 nft -f 应用的独立脚本和 .sha256 校验文件，
+// 供无法访问网络的主机使用。数据没有变化时不改写已有的文件
+func runBundle(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" bundle", flag.ExitOnError)
+	defineFlags(fs)
+	out := fs.String("o", "", "Write the script to this file (a .sha256 file is written next to it), or - for stdout.")
+	destroy := fs.Bool("destroy", false, "Start the script with 'destroy set' for both sets so changed set attributes apply (target needs nft 1.0.8+).")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if *out == "" {
+		log.Printf("ERROR: bundle requires -o")
+		return exitFailure
+	}
+	if profile == profileAll {
+		log.Printf("ERROR: bundle writes one profile at a time; use -profile <name>")
+		return exitFailure
+	}
+	if setAttrs.Constant && !*destroy {
+		log.Printf("ERROR: constant sets cannot be flushed; bundle -constant requires -destroy")
+		return exitFailure
+	}
+	if err := validate(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+
+	opts := buildOptions()
+	opts.Nft = &nft.Client{Executor: nft.OfflineExecutor{}}
+	opts.TrackChanges, opts.Verify, opts.Confirm = false, false, nil
+	script, res, err := pipeline.Render(context.Background(), opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	t := opts.Target
+	var body bytes.Buffer
+	if *destroy {
+		fmt.Fprintf(&body, "add table %s %s\n", t.Family, t.TableName)
+		fmt.Fprintf(&body, "destroy set %s %s %s\n", t.Family, t.TableName, t.IPv4SetName)
+		fmt.Fprintf(&body, "destroy set %s %s %s\n\n", t.Family, t.TableName, t.IPv6SetName)
+	}
+	body.WriteString(script)
+	if !bytes.HasSuffix(body.Bytes(), []byte("\n")) {
+		body.WriteByte('\n')
+	}
+
+	if *out == "-" {
+		os.Stdout.Write(bundleHeader(t, time.Now()))
+		os.Stdout.Write(body.Bytes())
+		return 0
+	}
+	if old, err := os.ReadFile(*out); err == nil && bytes.Equal(bundleBody(old), body.Bytes()) {
+		logInfo("%s is up to date (%d IPv4, %d IPv6 prefixes).", *out, res.IPv4Count, res.IPv6Count)
+		if _, err := os.Stat(*out + ".sha256"); err == nil {
+			return 0
+		}
+		return writeBundle(*out, old)
+	}
+	data := append(bundleHeader(t, time.Now()), body.Bytes()...)
+	if code := writeBundle(*out, data); code != 0 {
+		return code
+	}
+	logInfo("Wrote %s (%d IPv4, %d IPv6 prefixes); apply with: nft -f %s", *out, res.IPv4Count, res.IPv6Count, filepath.Base(*out))
+	return 0
+}
+
+// bundleHeader 返回脚本开头的注释，以空行结束
+func bundleHeader(t nft.Target, at time.Time) []byte {
+	return []byte(fmt.Sprintf("# github-updater bundle for %s/%s (%s, %s)\n# generated at %s\n\n",
+		t.Family, t.TableName, t.IPv4SetName, t.IPv6SetName, at.UTC().Format(time.RFC3339)))
+}
+
+// bundleBody 去掉 bundleHeader 生成的注释，用于判断数据是否变化
+func bundleBody(data []byte) []byte {
+	if _, body, ok := bytes.Cut(data, []byte("\n\n")); ok && bytes.HasPrefix(data, []byte("# github-updater bundle ")) {
+		return body
+	}
+	return data
+}
+
+// writeBundle 原子地写入脚本和 sha256sum -c 格式的校验文件
+func writeBundle(path string, data []byte) int {
+	sum := fmt.Sprintf("%x  %s\n", sha256.Sum256(data), filepath.Base(path))
+	if err := state.WriteFile(path, data, 0o644); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if err := state.WriteFile(path+".sha256", []byte(sum), 0o644); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetAdmin 是 CAP_NET_ADMIN 的编号，修改 nftables 只需要这一项能力
+const capNetAdmin = 12
+
+// readCaps 从 /proc/self/status 读取 CapEff、CapAmb 和 CapBnd 等能力位图，无法读取时返回 nil
+func readCaps() map[string]uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	caps := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok || !strings.HasPrefix(key, "Cap") {
+			continue
+		}
+		if bits, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64); err == nil {
+			caps[key] = bits
+		}
+	}
+	return caps
+}
+
+// preflight 在修改防火墙之前检查 nft 子进程能否获得 CAP_NET_ADMIN，而不是要求 euid 为 0。
+// 非 root 时能力必须在 ambient 集合中才会被 nft 继承（systemd 的 AmbientCapabilities）。
+// -backend netlink 在本进程中修改规则集，有效集合中有这项能力即可。
+// 写入文件、通过 SSH 应用或 -dry-run 时不需要；无法读取能力时不做检查
+func preflight() error {
+	if outPath != "" || remoteHosts != "" || dryRun {
+		return nil
+	}
+	switch backend {
+	case "firewalld", "pf", "aws", "awswaf":
+		// firewalld 按 polkit 授权，pf 不涉及 Linux 能力，aws 和 awswaf 使用 AWS 凭据
+		return nil
+	}
+	caps := readCaps()
+	if caps == nil {
+		return nil
+	}
+	has := func(set string) bool { return caps[set]&(1<<capNetAdmin) != 0 }
+	switch {
+	case os.Geteuid() == 0:
+		if !has("CapBnd") {
+			return fmt.Errorf("CAP_NET_ADMIN is not in the capability bounding set (CapBnd %016x); nft cannot modify the ruleset", caps["CapBnd"])
+		}
+	case has("CapAmb"), backend == "netlink" && has("CapEff"):
+	case has("CapEff"):
+		return fmt.Errorf("CAP_NET_ADMIN is effective for uid %d but not ambient, so the nft child process will not inherit it; grant it with AmbientCapabilities=CAP_NET_ADMIN", os.Geteuid())
+	default:
+		return fmt.Errorf("running as uid %d without CAP_NET_ADMIN (CapEff %016x); run as root or grant it with AmbientCapabilities=CAP_NET_ADMIN", os.Geteuid(), caps["CapEff"])
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github-updater/pkg/nft"
+)
+
+// specList 是可重复的参数，每次出现（或分号分隔的每一项）追加一个链描述。
+// 链描述本身含有逗号，配置文件中写作列表，环境变量中用分号分隔
+type specList []string
+
+func (l *specList) String() string { return strings.Join(*l, ";") }
+
+func (l *specList) Set(s string) error {
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// ruleChains 返回挂载引用规则的全部链：-chain 指定的链在前，随后是 -rule-chain 的各项，无法解析的项被跳过并报告错误
+func ruleChains() ([]nft.ChainConfig, error) {
+	var chains []nft.ChainConfig
+	if chain.Name != "" {
+		c := chain
+		c.InInterfaces, c.OutInterfaces = splitList(ruleIifname), splitList(ruleOifname)
+		chains = append(chains, c)
+	}
+	var errs []error
+	for _, spec := range ruleChainSpecs {
+		c, err := parseChainSpec(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		chains = append(chains, c)
+	}
+	return chains, errors.Join(errs...)
+}
+
+// parseChainSpec 解析 -rule-chain 的 name[:key=value]... 写法。指定 hook 时链不存在会被创建，
+// 未指定的 type/priority/policy 取 filter/0/accept；不指定 hook 时链必须已经存在
+func parseChainSpec(spec string) (nft.ChainConfig, error) {
+	fields := strings.Split(spec, ":")
+	c := nft.ChainConfig{Name: strings.TrimSpace(fields[0]), Match: chain.Match}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return c, fmt.Errorf("-rule-chain %q: want key=value, got %q", spec, field)
+		}
+		switch key {
+		case "hook":
+			c.Hook = value
+		case "type":
+			c.Type = value
+		case "priority":
+			c.Priority = value
+		case "policy":
+			c.Policy = value
+		case "verdict":
+			c.Verdict = value
+		case "ports":
+			ports, err := parsePorts(value)
+			if err != nil {
+				return c, fmt.Errorf("-rule-chain %q: %w", spec, err)
+			}
+			c.Ports = ports
+		case "family":
+			c.AddressFamily = value
+		case "iifname":
+			c.InInterfaces = splitList(value)
+		case "oifname":
+			c.OutInterfaces = splitList(value)
+		default:
+			return c, fmt.Errorf("-rule-chain %q: unknown key %q", spec, key)
+		}
+	}
+	if c.Hook == "" && (c.Type != "" || c.Priority != "" || c.Policy != "") {
+		return c, fmt.Errorf("-rule-chain %q: type, priority and policy only apply to a chain created with hook", spec)
+	}
+	if c.Hook != "" {
+		c.Type = cmp.Or(c.Type, "filter")
+		c.Priority = cmp.Or(c.Priority, "0")
+		c.Policy = cmp.Or(c.Policy, "accept")
+	}
+	return c, nil
+}
+
+// validateChains 检查全部链的配置
+func validateChains() []error {
+	var errs []error
+	chains, err := ruleChains()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	seen := make(map[string]bool)
+	for _, c := range chains {
+		if err := nft.ValidateChain(c); err != nil {
+			errs = append(errs, err)
+		}
+		if seen[c.Name] {
+			errs = append(errs, fmt.Errorf("chain %s is configured more than once", c.Name))
+		}
+		seen[c.Name] = true
+		if len(c.Ports) > 0 && ports != "" {
+			errs = append(errs, fmt.Errorf("chain %s: per-chain ports cannot be combined with -ports", c.Name))
+		}
+		// vmap 规则的动作由映射元素决定
+		if verdictMap != "" && (len(c.Ports) > 0 || c.Verdict != "") {
+			errs = append(errs, fmt.Errorf("chain %s: per-chain ports and verdicts cannot be combined with -verdict-map", c.Name))
+		}
+	}
+	return errs
+}
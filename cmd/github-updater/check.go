@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+)
+
+// runCheck 只读地比较集合和最近一次应用的数据，有偏差时以 exitDrift 退出
+func runCheck(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args, check)
+}
+
+// check 检查当前 profile 的集合
+func check() int {
+	snap, err := loadSnapshot()
+	if err != nil {
+		log.Printf("ERROR: read last applied data: %v", err)
+		return exitFailure
+	}
+	opts := buildOptions()
+	classified := pipeline.Classify(snap.Categories)
+	classified.Verdicts = snap.Verdicts
+	drifts, err := pipeline.CheckDrift(context.Background(), opts, classified)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	drifted := false
+	for _, d := range drifts {
+		if m := nft.CommentManager(d.Comment); m != "" && m != opts.Target.ManagedMarker() {
+			log.Printf("WARNING: set %s has comment %q; it is managed by %s", d.Set, d.Comment, m)
+		}
+		switch {
+		case !d.Exists:
+			fmt.Printf("%s: missing\n", d.Set)
+		case d.Drifted():
+			fmt.Printf("%s: %d ranges missing, %d unexpected\n", d.Set, len(d.Missing), len(d.Unexpected))
+		default:
+			fmt.Printf("%s: ok\n", d.Set)
+		}
+		drifted = drifted || d.Drifted()
+	}
+	if drifted {
+		log.Printf("Drift detected against data applied at %s.", snap.FetchedAt.Local().Format(time.RFC3339))
+		return exitDrift
+	}
+	return 0
+}
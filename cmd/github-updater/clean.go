@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// runClean 删除 -chain 和 -rule-chain 中本工具添加的全部引用规则，集合和链保持不变，返回退出码
+func runClean(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args, clean)
+}
+
+// clean 删除当前 profile 的受管理规则
+func clean() int {
+	if err := preflight(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	ctx := context.Background()
+	opts := buildOptions()
+	t := opts.Target
+	if len(opts.Chains) == 0 {
+		log.Printf("ERROR: clean requires -chain or -rule-chain")
+		return exitFailure
+	}
+	nftc := localNft()
+
+	var b strings.Builder
+	total := 0
+	counts := make(map[string]int)
+	for _, ch := range opts.Chains {
+		handles, err := nftc.ManagedRules(ctx, t.Family, t.TableName, ch.Name, t.ManagedMarker())
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		for _, h := range handles {
+			fmt.Fprintf(&b, "delete rule %s %s %s handle %d\n", t.Family, t.TableName, ch.Name, h)
+		}
+		counts[ch.Name] = len(handles)
+		total += len(handles)
+	}
+	if total == 0 {
+		logInfo("No managed rules found in %s/%s, nothing to clean.", t.Family, t.TableName)
+		return 0
+	}
+
+	ok, err := ask(fmt.Sprintf("Delete %d managed rules from %d chains in %s/%s? Traffic matched by these rules will fall through to the rest of the chain.", total, len(counts), t.Family, t.TableName), "")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if !ok {
+		logInfo("Aborted, rules left unchanged.")
+		return 0
+	}
+	sets := []string{t.IPv4SetName, t.IPv6SetName}
+	if err := nftc.Apply(ctx, b.String()); err != nil {
+		appendAudit(auditEntry{Action: "clean", Outcome: "failed", Sets: sets, Error: err.Error()})
+		log.Printf("ERROR: %v", err)
+		return exitApply
+	}
+	appendAudit(auditEntry{Action: "clean", Outcome: "cleaned", Sets: sets, Removed: total})
+	for _, ch := range opts.Chains {
+		if counts[ch.Name] > 0 {
+			fmt.Printf("Cleaned %s/%s chain %s: %d rules removed\n", t.Family, t.TableName, ch.Name, counts[ch.Name])
+		}
+	}
+	return 0
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix 是所有参数对应环境变量的前缀，例如 -chain-type 对应 GITHUB_UPDATER_CHAIN_TYPE
+const envPrefix = "GITHUB_UPDATER_"
+
+// 参数值的来源，优先级 flag > env > profile > config > preset > default
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceProfile = "profile"
+	sourceConfig  = "config"
+	sourcePreset  = "preset"
+	sourceDefault = "default"
+)
+
+// profileAll 表示依次运行配置文件中的全部 profile
+const profileAll = "all"
+
+// profileNames 是配置文件中定义的 profile，按文件中的顺序
+var profileNames []string
+
+// secretFlags 中的参数在输出配置时会被隐去
+var secretFlags = map[string]bool{
+	"notify-slack-webhook":  true,
+	"notify-telegram-token": true,
+}
+
+// fileIgnoredFlags 只能通过命令行或环境变量指定
+var fileIgnoredFlags = map[string]bool{"config": true, "print-config": true, "profile": true, "validate-config": true}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadSettings 解析命令行参数，再依次用环境变量和配置文件补齐未指定的参数，
+// 返回每个参数的来源以及累积的全部错误。
+func loadSettings(fs *flag.FlagSet, args []string) (map[string]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return settle(fs)
+}
+
+// loadProfile 重新定义全部参数（恢复默认值）并以指定的 profile 加载配置，
+// 用于 -profile all 时依次处理每个 profile
+func loadProfile(args []string, name string) (map[string]string, error) {
+	fs := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Set("profile", name)
+	return settle(fs)
+}
+
+// settle 用环境变量和配置文件补齐命令行未指定的参数
+func settle(fs *flag.FlagSet) (map[string]string, error) {
+	sources, err := applyEnv(fs)
+	errs := []error{err}
+	if configPath != "" {
+		errs = append(errs, applyConfigFile(fs, configPath, sources))
+	} else if profile != "" {
+		errs = append(errs, errors.New("-profile requires -config"))
+	}
+	if hooksOnly {
+		errs = append(errs, applyHooksOnly(fs, sources))
+	}
+	// 常驻运行时默认只在期望网段变化后才修改集合
+	if daemon && sources["skip-unchanged"] == sourceDefault {
+		fs.Set("skip-unchanged", "true")
+		sources["skip-unchanged"] = sourcePreset
+	}
+	return sources, errors.Join(errs...)
+}
+
+// hooksOnlyDefaults 是 -hooks-only 预设的参数值，只填充仍为默认值的参数
+var hooksOnlyDefaults = map[string]string{
+	"categories": "hooks",
+	"set-v4":     "github_hooks_ipv4",
+	"set-v6":     "github_hooks_ipv6",
+}
+
+// applyHooksOnly 应用 -hooks-only 预设；显式指定了其他分类时报错
+func applyHooksOnly(fs *flag.FlagSet, sources map[string]string) error {
+	if sources["categories"] != sourceDefault && categories != "hooks" {
+		return fmt.Errorf("-hooks-only conflicts with -categories %s", categories)
+	}
+	for name, value := range hooksOnlyDefaults {
+		if sources[name] == sourceDefault {
+			fs.Set(name, value)
+			sources[name] = sourcePreset
+		}
+	}
+	return nil
+}
+
+// applyEnv 对命令行未指定的参数使用对应环境变量的值，返回每个参数的来源。
+// 环境变量通过 flag.Value.Set 解析，布尔值和时长的格式与命令行完全一致。
+func applyEnv(fs *flag.FlagSet) (map[string]string, error) {
+	sources := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = sourceFlag })
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			sources[f.Name] = sourceDefault
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), err))
+			return
+		}
+		sources[f.Name] = sourceEnv
+	})
+	return sources, errors.Join(errs...)
+}
+
+// applyConfigFile 读取 YAML 配置文件（扩展名为 .toml 时按 TOML 读取，见 parseTOML），键名与命令行参数相同（如 chain-type: filter），
+// 只填充仍为默认值的参数。profiles 下的每一项是同样格式的映射，选中的 profile 优先于顶层的值；
+// sources 定义数据来源及接收它们的 profile，见 parseSources。
+// 未知的键和无法解析的值全部累积后一起返回。
+func applyConfigFile(fs *flag.FlagSet, path string, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		toml, err := parseTOML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		doc = *toml
+	} else if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: top level must be a mapping", path, root.Line)
+	}
+
+	var (
+		errs     []error
+		top      []*yaml.Node
+		profiles = make(map[string]*yaml.Node)
+	)
+	profileNames, sourceDefs = nil, nil
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+		if key.Value == "sources" {
+			defs, sourceErrs := parseSources(path, node)
+			sourceDefs = defs
+			errs = append(errs, sourceErrs...)
+			continue
+		}
+		if key.Value != "profiles" {
+			top = append(top, key, node)
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("%s:%d: profiles must be a mapping of profile names", path, node.Line))
+			continue
+		}
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			name, body := node.Content[j], node.Content[j+1]
+			if body.Kind != yaml.MappingNode || name.Value == profileAll {
+				errs = append(errs, fmt.Errorf("%s:%d: invalid profile %q", path, name.Line, name.Value))
+				continue
+			}
+			profiles[name.Value] = body
+			profileNames = append(profileNames, name.Value)
+		}
+	}
+
+	switch {
+	case len(profiles) == 0 && profile != "":
+		errs = append(errs, fmt.Errorf("-profile %s given but %s defines no profiles", profile, path))
+	case len(profiles) > 0 && profile == "":
+		errs = append(errs, fmt.Errorf("%s defines profiles (%s); select one with -profile or use -profile all", path, strings.Join(profileNames, ", ")))
+	case profile != "" && profile != profileAll && profiles[profile] == nil:
+		errs = append(errs, fmt.Errorf("unknown profile %q (defined: %s)", profile, strings.Join(profileNames, ", ")))
+	}
+	errs = append(errs, checkRouting(path, sourceDefs, profileNames)...)
+	if body := profiles[profile]; body != nil {
+		errs = append(errs, applyMapping(fs, path, body.Content, sources, sourceProfile))
+	}
+	errs = append(errs, applyMapping(fs, path, top, sources, sourceConfig))
+	return errors.Join(errs...)
+}
+
+// applyMapping 把 YAML 映射的键值对（交替排列）应用到仍为默认值的参数上
+func applyMapping(fs *flag.FlagSet, path string, content []*yaml.Node, sources map[string]string, source string) error {
+	var errs []error
+	for i := 0; i+1 < len(content); i += 2 {
+		key, node := content[i], content[i+1]
+		f := fs.Lookup(key.Value)
+		if f == nil || fileIgnoredFlags[key.Value] {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %q", path, key.Line, key.Value))
+			continue
+		}
+		values, err := scalarValues(node)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %v", path, node.Line, key.Value, err))
+			continue
+		}
+		if sources[f.Name] != sourceDefault {
+			continue // 被命令行、环境变量或 profile 覆盖
+		}
+		for _, v := range values {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, node.Line, v, key.Value, err))
+			}
+		}
+		sources[f.Name] = source
+	}
+	return errors.Join(errs...)
+}
+
+// scalarValues 接受标量或标量列表（对应可重复的参数）
+func scalarValues(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, errors.New("list items must be scalars")
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	}
+	return nil, errors.New("value must be a scalar or a list of scalars")
+}
+
+// printConfig 以 YAML 输出生效的配置，每项的来源写在行尾注释中，敏感参数被隐去。
+// 有记录时在末尾注释中给出最近一次应用的期望网段哈希
+func printConfig(w io.Writer, fs *flag.FlagSet, sources map[string]string) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	fs.VisitAll(func(f *flag.Flag) {
+		if fileIgnoredFlags[f.Name] {
+			return
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.Value.String(), LineComment: sources[f.Name]}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value.Tag = "!!bool"
+		}
+		if secretFlags[f.Name] && value.Value != "" {
+			value.Value = "[REDACTED]"
+		}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, value)
+	})
+	if h := loadHash(); h != "" {
+		root.FootComment = "desired-set hash of the last applied run: " + h
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
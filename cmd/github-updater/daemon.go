@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github-updater/pkg/fetch"
+)
+
+// runDaemon 常驻运行，按 -interval 定期更新；本地输入文件（-meta-file、-extra-file、
+// -exclude-file）变化或收到 SIGHUP 时立即更新（重新读取这些文件）。收到 SIGINT/SIGTERM 时退出
+func runDaemon(args []string, run func() int) int {
+	interval, debounce := daemonInterval, watchDebounce
+	files := watchedFiles(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	changed := make(chan string, 1)
+	if len(files) > 0 {
+		if err := watchFiles(ctx, files, debounce, changed); err != nil {
+			log.Printf("WARNING: cannot watch input files, relying on -interval only: %v", err)
+		} else {
+			logVerbose("Watching %v for changes.", files)
+		}
+	}
+	logInfo("Running as a daemon, refreshing every %s.", interval)
+	next := interval
+
+	// systemd Type=notify：首次成功后 READY=1，按 WATCHDOG_USEC 发送看门狗
+	wd := &watchdog{interval: watchdogInterval()}
+	if wd.interval > 0 {
+		logVerbose("systemd watchdog enabled, interval %s.", wd.interval)
+		go wd.run(ctx)
+	}
+	ready := false
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logInfo("Shutting down.")
+			sdNotify("STOPPING=1")
+			return 0
+		case <-timer.C:
+		case name := <-changed:
+			logInfo("%s changed, refreshing.", name)
+			timer.Stop()
+		case <-hup:
+			logInfo("SIGHUP received, reloading input files and refreshing.")
+			timer.Stop()
+		case <-hosts.wait():
+			// 主机名的 TTL 到期：地址不变时只安排下一次解析，变化时只更新受影响的地址族，不影响 -interval
+			names, fam := hosts.check(ctx)
+			if len(names) == 0 {
+				continue
+			}
+			logInfo("DNS records of %s changed, refreshing %s.", strings.Join(names, ", "), orAll(fam))
+			onlyFamily = fam
+			wd.begin()
+			if code := updateProfiles(args, run); code != 0 {
+				log.Printf("Partial update failed (exit code %d).", code)
+			}
+			wd.end()
+			onlyFamily = ""
+			continue
+		}
+		wd.begin()
+		code := updateProfiles(args, run)
+		wd.end()
+		next = paceInterval(interval, next)
+		now := time.Now().Format(time.RFC3339)
+		if code == exitFetchPolicy && onFetchFailure == "fail" {
+			log.Printf("Fetch failed and -on-fetch-failure is fail, stopping.")
+			sdNotify("STOPPING=1")
+			return code
+		}
+		if code != 0 && code != exitPending {
+			log.Printf("Update failed (exit code %d), retrying in %s.", code, next)
+			sdNotify(fmt.Sprintf("STATUS=Last update failed at %s (exit code %d), retrying in %s", now, code, next))
+		} else {
+			status := fmt.Sprintf("STATUS=Last update succeeded at %s, next in %s", now, next)
+			if code == exitPending {
+				status = fmt.Sprintf("STATUS=Upstream changes pending since %s check, next in %s", now, next)
+			}
+			if !ready {
+				status += "\nREADY=1"
+				ready = true
+			}
+			if wd.interval > 0 {
+				status += "\nWATCHDOG=1"
+			}
+			sdNotify(status)
+		}
+		timer.Reset(next)
+	}
+}
+
+// lastRateLimit 是最近一次响应中的请求配额
+var lastRateLimit *fetch.RateLimit
+
+// paceInterval 按 -rate-limit-target 和最近的配额计算下一次刷新的间隔，与上次的间隔 prev 不同时记录
+func paceInterval(interval, prev time.Duration) time.Duration {
+	next := rateLimitInterval(interval, lastRateLimit, rateLimitPct, time.Now())
+	// 元素有超时时不能等到元素过期，最多延长到 -interval 与超时的中点
+	if t := setAttrs.Timeout; t > 0 && next >= t {
+		next = interval + (t-interval)/2
+	}
+	switch {
+	case next == prev:
+	case next > interval:
+		rl := lastRateLimit
+		logInfo("Rate limit budget low (%d of %d requests left until %s), refreshing every %s instead of %s.",
+			rl.Remaining, rl.Limit, rl.Reset.Local().Format(time.TimeOnly), next.Round(time.Second), interval)
+	default:
+		logInfo("Rate limit budget recovered, refreshing every %s again.", interval)
+	}
+	return next
+}
+
+// rateLimitInterval 返回不使本窗口已用的请求超过配额 target% 的最短间隔（不短于 interval）：
+// 把剩余的可用次数平均分配到窗口结束前，已经用完时等到窗口重置。target 为 0 或没有配额时返回 interval
+func rateLimitInterval(interval time.Duration, rl *fetch.RateLimit, target int, now time.Time) time.Duration {
+	if target <= 0 || rl == nil {
+		return interval
+	}
+	untilReset := rl.Reset.Sub(now)
+	if untilReset <= 0 {
+		return interval
+	}
+	allowed := rl.Limit*target/100 - (rl.Limit - rl.Remaining)
+	if allowed <= 0 {
+		return max(interval, untilReset+time.Second)
+	}
+	return max(interval, untilReset/time.Duration(allowed))
+}
+
+// watchedFiles 收集需要监视的本地输入文件，-profile all 时包括所有 profile 的文件
+func watchedFiles(args []string) []string {
+	collect := func(files []string) []string {
+		for _, f := range append([]string{metaFile, excludeFile}, extraFiles...) {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+		return files
+	}
+	if profile != profileAll {
+		return collect(nil)
+	}
+	var files []string
+	for _, name := range profileNames {
+		if err := switchProfile(args, name); err == nil {
+			files = collect(files)
+		}
+	}
+	restoreTopLevel(args)
+	return files
+}
+
+// watchFiles 监视文件所在的目录（编辑器和原子写入会替换文件本身），
+// 文件变化后 debounce 时间内没有新的变化才发送文件名，避免连续写入时反复更新
+func watchFiles(ctx context.Context, files []string, debounce time.Duration, changed chan<- string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	targets := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		targets[abs] = true
+		if dir := filepath.Dir(abs); !dirs[dir] {
+			if err := w.Add(dir); err != nil {
+				w.Close()
+				return err
+			}
+			dirs[dir] = true
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		var (
+			pending *time.Timer
+			fire    <-chan time.Time
+			last    string
+		)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !targets[filepath.Clean(ev.Name)] || ev.Op == fsnotify.Chmod {
+					continue
+				}
+				last = ev.Name
+				if pending == nil {
+					pending = time.NewTimer(debounce)
+					fire = pending.C
+				} else {
+					pending.Reset(debounce)
+				}
+			case <-fire:
+				pending, fire = nil, nil
+				select {
+				case changed <- last:
+				default: // 已有未处理的通知
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("WARNING: file watcher: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// orAll 描述局部更新的地址族
+func orAll(family string) string {
+	if family == "" {
+		return "both sets"
+	}
+	return "the " + family + " set"
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github-updater/pkg/pipeline"
+)
+
+// setDiff 是 diff 子命令中一个集合的差异
+type setDiff struct {
+	Set     string         `json:"set"`
+	Exists  bool           `json:"exists"`
+	Add     []netip.Prefix `json:"add"`               // 上游有而集合中没有
+	Remove  []netip.Prefix `json:"remove"`            // 集合中有而上游没有
+	Kept    bool           `json:"kept"`              // Remove 中的网段在更新时会被保留（-preserve-unmanaged/-append）
+	Comment string         `json:"comment,omitempty"` // 集合的 comment
+
+	Notes map[string]string `json:"notes,omitempty"` // -explain-diff 时 Add 和 Remove 中网段的说明
+	notes pipeline.Notes
+}
+
+// runDiff 获取上游数据并与内核中的集合比较，输出更新时会发生的变化，不修改防火墙。
+// 只需要 nft list 的权限
+func runDiff(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args, diffSets)
+}
+
+// diffSets 比较当前 profile 的集合，-diff-exit 时有差异以 exitDiff 退出
+func diffSets() int {
+	ctx := context.Background()
+	opts := buildOptions()
+	classified, _, err := pipeline.Fetch(ctx, opts)
+	var drifts []pipeline.SetDrift
+	if err == nil {
+		drifts, err = pipeline.CheckDrift(ctx, opts, classified)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+
+	kept := opts.PreserveUnmanaged || opts.Append
+	diffs := make([]setDiff, 0, len(drifts))
+	changed := false
+	for _, d := range drifts {
+		sd := setDiff{Set: d.Set, Exists: d.Exists, Add: d.Missing, Remove: d.Unexpected, Kept: kept, Comment: d.Comment}
+		sd.notes = diffNotes(classified, d.Notes)
+		for _, p := range append(slices.Clone(d.Missing), d.Unexpected...) {
+			if note := sd.notes.Lookup(p); note != "" {
+				if sd.Notes == nil {
+					sd.Notes = make(map[string]string)
+				}
+				sd.Notes[p.String()] = note
+			}
+		}
+		if sd.Add == nil {
+			sd.Add = []netip.Prefix{}
+		}
+		if sd.Remove == nil {
+			sd.Remove = []netip.Prefix{}
+		}
+		diffs = append(diffs, sd)
+		changed = changed || !d.Exists || len(d.Missing) > 0 || (!kept && len(d.Unexpected) > 0)
+	}
+	if jsonOut {
+		writeJSON(struct {
+			Family string    `json:"family"`
+			Table  string    `json:"table"`
+			Sets   []setDiff `json:"sets"`
+		}{family, table, diffs})
+	} else {
+		for _, d := range diffs {
+			status := fmt.Sprintf("+%d -%d", len(d.Add), len(d.Remove))
+			switch {
+			case !d.Exists:
+				status = fmt.Sprintf("missing, would be created with %d prefixes", len(d.Add))
+			case len(d.Remove) > 0 && d.Kept:
+				status += " (live-only prefixes are kept)"
+			}
+			fmt.Printf("%s %s %s: %s\n", family, table, d.Set, status)
+			pipeline.Diff{Added: d.Add, Removed: d.Remove}.WriteAnnotated(os.Stdout, d.notes)
+		}
+	}
+	if !changed {
+		logVerbose("Live sets match upstream.")
+		return 0
+	}
+	if diffExit {
+		return exitDiff
+	}
+	return 0
+}
+
+// diffNotes 在 -explain-diff 时返回差异中网段的说明：新增的网段取本次获取的分类，
+// 移除的网段取上次应用的快照中的分类，都没有时用集合中元素的注释。未开启时返回 nil
+func diffNotes(classified *pipeline.Classified, live pipeline.Notes) pipeline.Notes {
+	if !explainDiff {
+		return nil
+	}
+	notes := make(pipeline.Notes)
+	notes.AddEntries(classified.IPv4)
+	notes.AddEntries(classified.IPv6)
+	if snap, err := loadSnapshot(); err == nil {
+		notes.AddCategories(snap.Categories)
+	} else {
+		logVerbose("No last applied snapshot to explain removed prefixes: %v", err)
+	}
+	notes.Fill(live)
+	return notes
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github-updater/pkg/fetch"
+)
+
+// hostState 是一个主机名最近一次解析的地址以及下一次解析的时间
+type hostState struct {
+	addrs []netip.Addr
+	next  time.Time
+}
+
+// hostSchedule 按记录的 TTL 安排主机名来源的重新解析（-daemon），只在地址变化时触发更新
+type hostSchedule map[string]*hostState
+
+// hosts 记录本进程中解析过的全部主机名
+var hosts = hostSchedule{}
+
+// dnsDelay 把 TTL 限制在 -dns-min-ttl 和 -dns-max-ttl 之间
+func dnsDelay(ttl time.Duration) time.Duration {
+	return min(max(ttl, dnsMinTTL), dnsMaxTTL)
+}
+
+// record 在更新中解析成功后保存地址，并在 TTL 到期时安排下一次解析
+func (s hostSchedule) record(res *fetch.Resolution) {
+	s[res.Host] = &hostState{addrs: res.Addrs, next: time.Now().Add(dnsDelay(res.TTL))}
+}
+
+// wait 返回在最早的主机名到期时触发的通道，没有主机名时为 nil（永不触发）
+func (s hostSchedule) wait() <-chan time.Time {
+	var next time.Time
+	for _, h := range s {
+		if next.IsZero() || h.next.Before(next) {
+			next = h.next
+		}
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(next))
+}
+
+// check 重新解析已到期的主机名，返回地址发生变化的主机名以及需要更新的地址族：
+// 只有一个地址族变化时为 "ipv4" 或 "ipv6"，两者都变化时为空字符串。
+// 变化的主机名不更新记录，由随后的更新重新解析并记录，更新失败时下次检查仍会发现变化
+func (s hostSchedule) check(ctx context.Context) (changed []string, family string) {
+	resolver := &fetch.Resolver{Server: dnsResolver}
+	now := time.Now()
+	var v4, v6 bool
+	for host, h := range s {
+		if h.next.After(now) {
+			continue
+		}
+		res, err := resolver.Resolve(ctx, host)
+		if err != nil {
+			log.Printf("WARNING: %v; retrying in %s", err, dnsMinTTL)
+			h.next = now.Add(dnsMinTTL)
+			continue
+		}
+		if slices.Equal(res.Addrs, h.addrs) {
+			logVerbose("DNS records of %s unchanged, next check in %s.", host, dnsDelay(res.TTL))
+			h.next = now.Add(dnsDelay(res.TTL))
+			continue
+		}
+		for _, a := range symmetricDiff(h.addrs, res.Addrs) {
+			v4 = v4 || a.Is4()
+			v6 = v6 || a.Is6()
+		}
+		h.next = now.Add(dnsMinTTL)
+		changed = append(changed, host)
+	}
+	sort.Strings(changed)
+	switch {
+	case v4 && !v6:
+		family = "ipv4"
+	case v6 && !v4:
+		family = "ipv6"
+	}
+	return changed, family
+}
+
+// symmetricDiff 返回只出现在 a 或 b 之一中的地址，a 和 b 均已排序
+func symmetricDiff(a, b []netip.Addr) []netip.Addr {
+	var diff []netip.Addr
+	for _, x := range a {
+		if _, found := slices.BinarySearchFunc(b, x, netip.Addr.Compare); !found {
+			diff = append(diff, x)
+		}
+	}
+	for _, x := range b {
+		if _, found := slices.BinarySearchFunc(a, x, netip.Addr.Compare); !found {
+			diff = append(diff, x)
+		}
+	}
+	return diff
+}
+
+// validHostname 粗略检查主机名的写法
+func validHostname(h string) bool {
+	h = strings.TrimSuffix(h, ".")
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	if _, err := netip.ParseAddr(h); err == nil {
+		return false // 地址应该写在 cidr-file 中
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
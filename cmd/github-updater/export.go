@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// exportFormats 把期望网段格式化为各导出格式的文件内容
+var exportFormats = map[string]func(v4, v6 []netip.Prefix) ([]byte, error){
+	"plain":   exportLines("", ""),
+	"haproxy": exportLines("", ""), // haproxy 的 acl -f 文件每行一个网段
+	"nginx":   exportLines("allow ", ";"),
+	"define":  exportDefine,
+	"env":     exportEnv,
+	"json": func(v4, v6 []netip.Prefix) ([]byte, error) {
+		doc := struct {
+			GeneratedAt time.Time      `json:"generated_at"`
+			IPv4        []netip.Prefix `json:"ipv4"`
+			IPv6        []netip.Prefix `json:"ipv6"`
+		}{time.Now().UTC(), v4, v6}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		return append(data, '\n'), err
+	},
+}
+
+func exportLines(prefix, suffix string) func(v4, v6 []netip.Prefix) ([]byte, error) {
+	return func(v4, v6 []netip.Prefix) ([]byte, error) {
+		var b strings.Builder
+		b.WriteString("# generated by github-updater\n")
+		for _, p := range append(append([]netip.Prefix(nil), v4...), v6...) {
+			b.WriteString(prefix + p.String() + suffix + "\n")
+		}
+		return []byte(b.String()), nil
+	}
+}
+
+// exportDefine 输出可由 nft include 的 define github_v4 = { ... }。
+// nft 不接受空的匿名集合，没有网段的地址族只写一行注释
+func exportDefine(v4, v6 []netip.Prefix) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("# generated by github-updater\n")
+	for _, d := range []struct {
+		name     string
+		prefixes []netip.Prefix
+	}{{"github_v4", v4}, {"github_v6", v6}} {
+		if len(d.prefixes) == 0 {
+			fmt.Fprintf(&b, "# %s: no ranges\n", d.name)
+			continue
+		}
+		fmt.Fprintf(&b, "define %s = {\n", d.name)
+		for i, p := range d.prefixes {
+			b.WriteString("\t" + p.String())
+			if i < len(d.prefixes)-1 {
+				b.WriteByte(',')
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString("}\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// exportEnv 输出 shell 可以 source 的 GITHUB_V4=...、GITHUB_V6=...，网段以逗号分隔
+func exportEnv(v4, v6 []netip.Prefix) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("# generated by github-updater\n")
+	for _, d := range []struct {
+		name     string
+		prefixes []netip.Prefix
+	}{{"GITHUB_V4", v4}, {"GITHUB_V6", v6}} {
+		parts := make([]string, len(d.prefixes))
+		for i, p := range d.prefixes {
+			parts[i] = p.String()
+		}
+		fmt.Fprintf(&b, "%s=%s\n", d.name, strings.Join(parts, ","))
+	}
+	return []byte(b.String()), nil
+}
+
+// parseExports 解析 -export 的 format:path[:optional] 列表
+func parseExports(s string) ([]pipeline.Exporter, error) {
+	var exporters []pipeline.Exporter
+	for _, item := range splitList(s) {
+		format, path, ok := strings.Cut(item, ":")
+		format = strings.ToLower(format)
+		render := exportFormats[format]
+		if !ok || render == nil {
+			return nil, fmt.Errorf("-export: invalid output %q (want format:path with format plain, nginx, haproxy, json, define or env)", item)
+		}
+		required := true
+		if p, ok := strings.CutSuffix(path, ":optional"); ok {
+			path, required = p, false
+		}
+		if path == "" {
+			return nil, fmt.Errorf("-export: %q has no path", item)
+		}
+		exporters = append(exporters, pipeline.Exporter{
+			Name:     format + ":" + path,
+			Required: required,
+			Write: func(_ context.Context, classified *pipeline.Classified) error {
+				data, err := render(pipeline.Prefixes(classified.IPv4), pipeline.Prefixes(classified.IPv6))
+				if err != nil {
+					return err
+				}
+				return state.WriteFile(path, data, 0o644)
+			},
+		})
+	}
+	return exporters, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+)
+
+// liveFingerprint 读取受管理集合的实际内容并计算指纹，见 nft.Fingerprint
+func liveFingerprint(ctx context.Context, opts pipeline.Options) (string, error) {
+	nftc := opts.Nft
+	if nftc == nil {
+		nftc = localNft()
+	}
+	t := opts.Target
+	names := []string{t.IPv4SetName, t.IPv6SetName}
+	sets := make(map[string]*nft.Set)
+	for _, name := range names {
+		set, err := nftc.ListSet(ctx, t.Family, t.TableName, name)
+		if errors.Is(err, nft.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		sets[name] = set
+	}
+	return nft.Fingerprint(t.Family, t.TableName, names, sets), nil
+}
+
+// runFingerprint 输出集合当前状态的指纹（-print-fingerprint），格式与 sha256sum 相同，返回退出码
+func runFingerprint(opts pipeline.Options) int {
+	fp, err := liveFingerprint(context.Background(), opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	name := opts.Target.Family + "/" + opts.Target.TableName
+	if profile != "" {
+		name = profile
+	}
+	fmt.Printf("%s  %s\n", fp, name)
+	return 0
+}
+
+// statusFingerprint 返回写入状态文件和指标的指纹。-out 和 -remote 时本机的集合不是更新的目标，返回空字符串
+func statusFingerprint(opts pipeline.Options) string {
+	if outPath != "" || remoteHosts != "" || opts.Backend != nil {
+		return ""
+	}
+	fp, err := liveFingerprint(context.Background(), opts)
+	if err != nil {
+		logVerbose("Not recording the ruleset fingerprint: %v", err)
+		return ""
+	}
+	return fp
+}
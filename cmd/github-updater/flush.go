@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github-updater/pkg/nft"
+)
+
+// runFlush 在一个事务中清空受管理的集合（不删除），用于紧急切断 GitHub 的访问，返回退出码
+func runFlush(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args, flush)
+}
+
+// flush 清空当前 profile 的集合
+func flush() int {
+	if err := preflight(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	ctx := context.Background()
+	t := buildOptions().Target
+	nftc := localNft()
+
+	var (
+		names []string
+		sets  []*nft.Set
+	)
+	counts := make(map[string]int)
+	total := 0
+	for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+		set, err := nftc.ListSet(ctx, t.Family, t.TableName, name)
+		if errors.Is(err, nft.ErrNotFound) {
+			logVerbose("Set %s does not exist, nothing to flush.", name)
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		names = append(names, name)
+		sets = append(sets, set)
+		counts[name] = len(set.Elements)
+		total += len(set.Elements)
+	}
+	if len(names) == 0 {
+		logInfo("No managed sets found in %s/%s, nothing to flush.", t.Family, t.TableName)
+		return 0
+	}
+
+	ok, err := ask(fmt.Sprintf("Flush %d elements from %d sets in %s/%s? Traffic allowed by these sets will be cut off.", total, len(names), t.Family, t.TableName), "")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if !ok {
+		logInfo("Aborted, sets left unchanged.")
+		return 0
+	}
+	if err := nftc.FlushSets(ctx, sets...); err != nil {
+		appendAudit(auditEntry{Action: "flush", Outcome: "failed", Sets: names, Error: err.Error()})
+		log.Printf("ERROR: %v", err)
+		return exitApply
+	}
+	appendAudit(auditEntry{Action: "flush", Outcome: "flushed", Sets: names, Removed: total})
+	for _, name := range names {
+		fmt.Printf("Flushed %s/%s %s: %d elements removed\n", t.Family, t.TableName, name, counts[name])
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github-updater/pkg/state"
+)
+
+// historyEntry 是 history 输出的一条记录，-profile all 时带上所属 profile
+type historyEntry struct {
+	Profile string `json:"profile,omitempty"`
+	auditEntry
+}
+
+// runHistory 从审计日志中列出最近的运行，最新的在前
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" history", flag.ExitOnError)
+	defineFlags(fs)
+	limit := fs.Int("n", 20, "Show at most this many entries (0 for all).")
+	since := fs.Duration("since", 0, "Only show entries newer than this (e.g. 24h).")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+
+	names := []string{profile}
+	if profile == profileAll {
+		names = profileNames
+	}
+	var entries []historyEntry
+	for _, name := range names {
+		dir := stateDir
+		if name != "" {
+			dir = filepath.Join(stateDir, "profiles", name)
+		}
+		read, err := readAudit(filepath.Join(dir, state.AuditFile))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		for _, e := range read {
+			if *since > 0 && time.Since(e.Time) > *since {
+				continue
+			}
+			entries = append(entries, historyEntry{Profile: name, auditEntry: e})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[:*limit]
+	}
+
+	if jsonOut {
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		writeJSON(entries)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPROFILE\tACTION\tOUTCOME\tSETS\tCHANGES\tDURATION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.RFC3339), orDash(e.Profile), e.Action, orDash(e.Outcome),
+			orDash(strings.Join(e.Sets, ",")), historyChanges(e.auditEntry), historyDuration(e.DurationMS))
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return 0
+}
+
+// readAudit 读取审计日志，损坏或被截断的行跳过并警告
+func readAudit(path string) ([]auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("WARNING: %s:%d: skipping corrupt entry: %v", path, line, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// historyChanges 格式化新增和移除数，未跟踪变化时显示 -
+func historyChanges(e auditEntry) string {
+	if e.Changed == nil && e.Added == 0 && e.Removed == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("+%d/-%d", e.Added, e.Removed)
+}
+
+func historyDuration(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github-updater/pkg/pipeline"
+)
+
+// runHook 通过 sh -c 执行钩子命令，env 追加到当前环境变量之后
+func runHook(ctx context.Context, command string, env map[string]string) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = os.Stderr // 标准输出留给 -json 等机器可读输出
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q: %w", command, err)
+	}
+	return nil
+}
+
+// hookEnv 返回描述本次运行的环境变量，res 为 nil 时只包含阶段信息
+func hookEnv(phase string, opts pipeline.Options, res *pipeline.Result) map[string]string {
+	t := opts.Target
+	env := map[string]string{
+		"UPDATER_PHASE":    phase,
+		"UPDATER_FAMILY":   t.Family,
+		"UPDATER_TABLE":    t.TableName,
+		"UPDATER_IPV4_SET": t.IPv4SetName,
+		"UPDATER_IPV6_SET": t.IPv6SetName,
+		"UPDATER_BACKEND":  "nft",
+	}
+	if opts.Nft != nil {
+		env["UPDATER_BACKEND"] = opts.Nft.Backend()
+	}
+	if opts.Backend != nil {
+		env["UPDATER_BACKEND"] = opts.Backend.Name()
+	}
+	if res == nil {
+		return env
+	}
+	changed := "unknown"
+	if opts.TrackChanges {
+		changed = strconv.FormatBool(res.Changed())
+	}
+	env["UPDATER_IPV4_COUNT"] = strconv.Itoa(res.IPv4Count)
+	env["UPDATER_IPV6_COUNT"] = strconv.Itoa(res.IPv6Count)
+	env["UPDATER_APPLIED"] = strconv.FormatBool(res.Applied)
+	env["UPDATER_CHANGED"] = changed
+	env["UPDATER_ADDED"] = strconv.Itoa(len(res.Added))
+	env["UPDATER_REMOVED"] = strconv.Itoa(len(res.Removed))
+	env["UPDATER_SOURCE"] = res.Source
+	return env
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github-updater/pkg/ipset"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// importState 把迁移前由其他工具维护的 ipset 或 nft 集合的内容写入状态目录，
+// 作为首次应用前的“上次应用”状态，使首次运行报告真实的变化
+func importState() int {
+	if loadHash() != "" && !force {
+		log.Printf("ERROR: %s already records an applied state; use -force to overwrite it", profileStateDir())
+		return exitFailure
+	}
+	var prefixes []netip.Prefix
+	for _, name := range splitList(importIpset) {
+		ps, err := (&ipset.Backend{}).List(context.Background(), name)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		logInfo("Read %d entries from ipset %s.", len(ps), name)
+		prefixes = append(prefixes, ps...)
+	}
+	for _, ref := range splitList(importNft) {
+		ps, err := readNftSet(ref)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		logInfo("Read %d prefixes from nft set %s.", len(ps), ref)
+		prefixes = append(prefixes, ps...)
+	}
+	if len(prefixes) == 0 {
+		log.Printf("ERROR: nothing to import")
+		return exitFailure
+	}
+
+	data, err := json.MarshalIndent(prefixes, "", "  ")
+	if err == nil {
+		err = openState().WriteFile(state.ImportedFile, data)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	saveHash(pipeline.HashPrefixes(prefixes))
+	logInfo("Imported %d prefixes into %s; the next update reports changes against them.", len(prefixes), profileStateDir())
+	return 0
+}
+
+// readNftSet 通过 nft -j list set 读取 family/table/set 形式指定的集合
+func readNftSet(ref string) ([]netip.Prefix, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid nft set %q, want family/table/set", ref)
+	}
+	set, err := localNft().ListSet(context.Background(), parts[0], parts[1], parts[2])
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for _, r := range set.Ranges() {
+		prefixes = append(prefixes, r.Prefixes()...)
+	}
+	return prefixes, nil
+}
+
+// loadImported 读取尚未被首次应用取代的导入内容
+func loadImported() []netip.Prefix {
+	data, err := os.ReadFile(filepath.Join(profileStateDir(), state.ImportedFile))
+	if err != nil {
+		return nil
+	}
+	var prefixes []netip.Prefix
+	if err := json.Unmarshal(data, &prefixes); err != nil {
+		log.Printf("WARNING: ignoring %s: %v", state.ImportedFile, err)
+		return nil
+	}
+	return prefixes
+}
+
+// clearImported 在首次成功应用后删除导入内容
+func clearImported() {
+	if err := os.Remove(openState().File(state.ImportedFile)); err != nil && !os.IsNotExist(err) {
+		logVerbose("Cannot remove %s: %v", state.ImportedFile, err)
+	}
+}
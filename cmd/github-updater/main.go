@@ -0,0 +1,1147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github-updater/pkg/awssg"
+	"github-updater/pkg/fetch"
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// version 在构建时通过 -ldflags "-X main.version=..." 设置
+var version = "dev"
+
+var (
+	configPath     string
+	profile        string
+	family         string
+	table          string
+	setV4          string
+	setV6          string
+	metaURL        string
+	categories     string
+	hooksOnly      bool
+	metaFile       string
+	extraFiles     listFlag
+	excludeFile    string
+	daemon         bool
+	monitorMode    bool
+	planMode       bool
+	dryRun         bool
+	printFP        bool
+	cpuProfile     string
+	memProfile     string
+	reconcileMode  bool
+	managedMarker  string
+	daemonInterval time.Duration
+	rateLimitPct   int
+	watchDebounce  time.Duration
+	verbose        bool
+	confirmPrompt  bool
+	assumeYes      bool
+	chain          nft.ChainConfig
+	ruleChainSpecs specList
+	ruleIifname    string
+	ruleOifname    string
+	withComments   bool
+	elemComments   bool
+	waitNetwork    time.Duration
+	staleMaxAge    time.Duration
+	staleDate      bool
+	preserve       bool
+	verify         bool
+	trace          bool
+	printCfg       bool
+	baseline       string
+	diffExit       bool
+	explainDiff    bool
+	remoteHosts    string
+	outPath        string
+	outTimeout     time.Duration
+	postCheck      string
+	skipUnchanged  bool
+	importIpset    string
+	importNft      string
+	textfile       string
+	recreateSets   bool
+	appendMode     bool
+	separateFams   bool
+	shadowBackend  string
+	backend        string
+	pfTable        string
+	pfAnchor       string
+	awsGroups      string
+	awsPrefixLists string
+	awsRegion      string
+	awsGroupRules  int
+	wafIPSetARNs   string
+	exportSpecs    string
+	exportAfter    bool
+	auditLog       string
+	onEmpty        string
+	onFetchFailure string
+	missingCat     string
+	maxRedirects   int
+	httpsRedirects bool
+	dnsResolver    string
+	dnsMinTTL      time.Duration
+	dnsMaxTTL      time.Duration
+	onlyFamily     string // 主机名来源的地址变化时只更新的地址族，见 hostSchedule.check
+	pruneStale     string
+	validateFile   string
+	repairSets     bool
+	fullResync     int
+	cleanFamilies  bool
+	quiet          bool
+	jsonOut        bool
+	banner         bool
+	stateDir       string
+	statusFile     string
+	hashExtras     bool
+	ports          string
+	verdictMap     string
+	setAttrs       nft.SetAttrs
+	reapplyAge     time.Duration
+	force          bool
+	allPartial     bool
+	preHook        string
+	postHook       string
+	postHookFatal  bool
+
+	slackWebhook   string
+	telegramToken  string
+	telegramChatID string
+	notifyInterval time.Duration
+	notifyState    string
+	emailTo        string
+	emailFrom      string
+	emailOn        string
+	emailMaxLines  int
+	smtpServer     string
+	smtpStartTLS   bool
+	smtpCredsFile  string
+
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+func logVerbose(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// logInfo 输出常规信息，-quiet 时不输出
+func logInfo(format string, v ...interface{}) {
+	if !quiet {
+		log.Printf(format, v...)
+	}
+}
+
+// stdLogger 把流程日志输出到标准 log
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{})   { logInfo(format, v...) }
+func (stdLogger) Verbosef(format string, v ...interface{}) { logVerbose(format, v...) }
+func (stdLogger) Warnf(format string, v ...interface{})    { log.Printf("WARNING: "+format, v...) }
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	defineFlags(flag.CommandLine)
+
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "":
+		os.Exit(runUpdate(args))
+	case "config":
+		os.Exit(runConfig(args))
+	case "state":
+		os.Exit(runState(args))
+	case "reapply":
+		os.Exit(runReapply(args))
+	case "flush":
+		os.Exit(runFlush(args))
+	case "clean":
+		os.Exit(runClean(args))
+	case "check":
+		os.Exit(runCheck(args))
+	case "diff":
+		os.Exit(runDiff(args))
+	case "history":
+		os.Exit(runHistory(args))
+	case "install-systemd":
+		os.Exit(runInstallSystemd(args))
+	case "show":
+		os.Exit(runShow(args))
+	case "bundle":
+		os.Exit(runBundle(args))
+	case "snapshot":
+		os.Exit(runSnapshot(args))
+	case "agent":
+		os.Exit(runAgent(args))
+	case "push":
+		os.Exit(runPush(args))
+	case "restore":
+		os.Exit(runRestore(args))
+	default:
+		log.Fatalf("ERROR: unknown command %q", command)
+	}
+}
+
+func defineFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "Load settings from this YAML file, or TOML when it ends in .toml (keys are flag names; flags and env override it).")
+	fs.StringVar(&validateFile, "validate-config", "", "Statically validate this config file (every profile with -profile all), report all problems at once and exit non-zero on any; no network or firewall access.")
+	fs.StringVar(&profile, "profile", "", "Use this profile from the config file's profiles section ('all' runs every profile in turn).")
+	fs.BoolVar(&allPartial, "profile-all-partial", false, "With -profile all, still apply the profiles that fetched successfully when others fail.")
+	fs.StringVar(&family, "family", "inet", "nftables family of the table holding the sets.")
+	fs.StringVar(&table, "table", "filter", "nftables table holding the sets.")
+	fs.StringVar(&setV4, "set-v4", "github_actions_ipv4", "Name of the IPv4 set.")
+	fs.StringVar(&setV6, "set-v6", "github_actions_ipv6", "Name of the IPv6 set.")
+	fs.StringVar(&metaURL, "url", fetch.DefaultURL, "URL of the GitHub meta API (or a compatible mirror).")
+	fs.StringVar(&categories, "categories", strings.Join(fetch.DefaultCategories, ","), "Comma-separated meta categories to allow (e.g. actions,hooks,web).")
+	fs.BoolVar(&hooksOnly, "hooks-only", false, "Preset for allowing GitHub webhooks: -categories hooks with sets github_hooks_ipv4/github_hooks_ipv6 unless named explicitly.")
+	fs.StringVar(&setAttrs.Policy, "set-policy", "", "Set policy: performance or memory (nft default when empty).")
+	fs.DurationVar(&setAttrs.Timeout, "element-timeout", 0, "Create the sets with this default element timeout, so elements expire unless refreshed (0 disables).")
+	fs.DurationVar(&setAttrs.GCInterval, "set-gc-interval", 0, "Garbage collection interval for expired elements; only affects when they leave memory and listings, not matching (requires -element-timeout, nft 0.9.4+).")
+	fs.BoolVar(&setAttrs.Constant, "constant", false, "Create the sets with the constant flag; on change they are deleted and recreated in the same transaction, rebuilding the -chain rules that reference them (nft 0.9.0+).")
+	fs.StringVar(&metaFile, "meta-file", "", "Read the meta document from this local file instead of -url.")
+	extraFiles, ruleChainSpecs = nil, nil
+	fs.Var(&extraFiles, "extra-file", "File of additional CIDRs (one per line) added to the sets as category 'extra'. Repeatable (or comma-separated); files are merged in the order given.")
+	fs.StringVar(&excludeFile, "exclude-file", "", "File of CIDRs (one per line) removed from the fetched ranges.")
+	fs.BoolVar(&daemon, "daemon", false, "Keep running and refresh every -interval; local input files are watched and trigger an immediate refresh.")
+	fs.BoolVar(&monitorMode, "monitor", false, "Only fetch and report the difference to the live sets (log, notifications, exit code 12); never apply. Usable with -daemon.")
+	fs.BoolVar(&planMode, "plan", false, "Check the generated script with nft -c, run it against a copy of the table in a scratch network namespace and print a unified diff of the table's JSON before and after; never apply.")
+	fs.BoolVar(&dryRun, "dry-run", false, "Print the nft script an update would run against the live ruleset and exit; old sets are not cleaned up and nothing is applied.")
+	fs.BoolVar(&reconcileMode, "reconcile", false, "After a successful update, delete rules and sets carrying -managed-marker that no profile in the configuration wants anymore.")
+	fs.StringVar(&managedMarker, "managed-marker", nft.RuleComment, "Marker identifying objects managed by this tool: the comment of its rules, the 'managed by' comment of tables and sets it creates, and the BEGIN/END lines of generated scripts.")
+	fs.BoolVar(&printFP, "print-fingerprint", false, "Print the fingerprint of the managed sets' current contents (see README) and exit; nothing is fetched or applied.")
+	fs.StringVar(&dnsResolver, "dns-resolver", "", "DNS server (host[:port]) for hostname sources; the first nameserver in /etc/resolv.conf when empty.")
+	fs.DurationVar(&dnsMinTTL, "dns-min-ttl", 30*time.Second, "With -daemon, re-resolve hostname sources no sooner than this after the last resolution, whatever the TTL.")
+	fs.DurationVar(&dnsMaxTTL, "dns-max-ttl", time.Hour, "With -daemon, re-resolve hostname sources at least this often, whatever the TTL.")
+	fs.StringVar(&onEmpty, "on-empty", "", "When the fetched data has no valid ranges: fail, or keep the current sets with a warning (default keep with -daemon, fail otherwise).")
+	fs.IntVar(&maxRedirects, "max-redirects", 10, "Follow at most this many HTTP redirects when fetching (0 refuses any redirect).")
+	fs.BoolVar(&httpsRedirects, "redirect-https-only", false, "Refuse HTTP redirects to non-HTTPS URLs when fetching.")
+	fs.StringVar(&missingCat, "missing-category", "skip", "When a requested category is absent from the meta response: skip it, fail, or stale (reuse its ranges from the last applied data).")
+	fs.StringVar(&onFetchFailure, "on-fetch-failure", "keep", "When fetching fails: keep the current sets, flush them (fail closed, exit code 16) or fail (exit code 16, -daemon stops).")
+	fs.DurationVar(&daemonInterval, "interval", 6*time.Hour, "Refresh interval in -daemon mode.")
+	fs.IntVar(&rateLimitPct, "rate-limit-target", 0, "In -daemon mode, lengthen -interval as needed to keep the used share of the API rate limit (X-RateLimit-* headers) under this percentage, e.g. 50 (0 disables).")
+	fs.DurationVar(&watchDebounce, "watch-debounce", 2*time.Second, "In -daemon mode, wait this long after the last change to a watched file before refreshing.")
+	fs.BoolVar(&verbose, "v", false, "Enable verbose output.")
+	fs.BoolVar(&quiet, "quiet", false, "Only log warnings and errors (suppresses the run summary).")
+	fs.BoolVar(&jsonOut, "json", false, "Print the run summary as JSON to stdout.")
+	fs.BoolVar(&banner, "banner", true, "After a successful apply, print a one-line result to stdout when it is a terminal (skipped with -quiet and -json).")
+	fs.StringVar(&stateDir, "state-dir", state.DefaultDir, "Directory for persistent state (notification timestamps, last run record); created with mode 0750.")
+	fs.StringVar(&auditLog, "audit-log", "", "Also append every audit record (updates, reapply, flush, restore) as one JSON line to this file; it is never truncated.")
+	fs.BoolVar(&hashExtras, "hash-extras", true, "Include -extra-file ranges in the desired-set hash; when false, \"changed\" compares that hash with the last applied one, so editing extras does not count as a change.")
+	fs.BoolVar(&skipUnchanged, "skip-unchanged", false, "Skip cleanup and apply when the desired-set hash equals the last applied one and the live sets still match the recorded fingerprint (default true with -daemon, whose first run always applies).")
+	fs.IntVar(&fullResync, "full-resync-every", 0, "With -skip-unchanged, force a real apply after this many consecutive skipped runs, repairing sets changed by hand (0 never forces).")
+	fs.StringVar(&importIpset, "import-state-from-ipset", "", "Comma-separated ipsets maintained by a previous tool; record their entries as the last applied state, so the first update reports real changes, then exit.")
+	fs.StringVar(&importNft, "import-state-from-nft", "", "Like -import-state-from-ipset for nft sets given as family/table/set.")
+	fs.StringVar(&textfile, "textfile", "", "After every run, atomically write metrics to this .prom file for the node_exporter textfile collector.")
+	fs.StringVar(&statusFile, "status-file", "", "Status file for external monitoring, rewritten atomically after every run (default <state-dir>/status.json).")
+	fs.BoolVar(&confirmPrompt, "confirm", false, "Show the planned changes and ask for confirmation before applying.")
+	fs.BoolVar(&assumeYes, "yes", false, "Answer yes to all confirmation prompts (for non-interactive use).")
+	fs.StringVar(&chain.Name, "chain", "", "Create this chain if missing and attach accept rules for the sets (disabled when empty).")
+	fs.StringVar(&chain.Type, "chain-type", "filter", "Type of the auto-created chain.")
+	fs.StringVar(&chain.Match, "rule-match", nft.MatchAuto, "Address match of the auto-created rules: auto (meta nfproto guard in inet tables), plain (ip/ip6 saddr only) or nfproto (always guarded).")
+	fs.StringVar(&ruleIifname, "rule-iifname", "", "Comma-separated input interfaces the auto-created rules are limited to (iifname match, eth* wildcards allowed).")
+	fs.StringVar(&ruleOifname, "rule-oifname", "", "Comma-separated output interfaces the auto-created rules are limited to (oifname match).")
+	fs.StringVar(&chain.Hook, "chain-hook", "input", "Hook of the auto-created chain.")
+	fs.StringVar(&chain.Priority, "chain-priority", "0", "Priority of the auto-created chain (number or standard name like filter).")
+	fs.StringVar(&chain.Policy, "chain-policy", "accept", "Policy of the auto-created chain (accept or drop).")
+	fs.Var(&ruleChainSpecs, "rule-chain", "Also attach rules for the sets to this chain, given as name[:hook=H][:type=T][:priority=P][:policy=P][:verdict=V][:ports=80,443][:family=ipv4|ipv6][:iifname=I][:oifname=O]; without hook the chain must already exist. Repeatable (';'-separated in env).")
+	fs.BoolVar(&withComments, "comments", false, "Annotate each set element with the GitHub meta category it came from.")
+	fs.BoolVar(&elemComments, "element-comments", false, "Mark each set element with a \"gh-<category> <fetch date>\" comment; with -preserve-unmanaged, marked elements are treated as managed and removed when no longer wanted.")
+	fs.DurationVar(&waitNetwork, "wait-for-network", 0, "Wait up to this long for the meta host to become reachable before fetching (0 disables).")
+	fs.DurationVar(&staleMaxAge, "stale-max-age", 0, "Treat a meta response whose Age header exceeds this as a stale CDN cache: retry once with Cache-Control: no-cache, then fail the fetch without applying (0 disables).")
+	fs.BoolVar(&staleDate, "stale-date", false, "Treat a meta response whose Date header is older than the last seen one as stale, like -stale-max-age.")
+	fs.BoolVar(&preserve, "preserve-unmanaged", false, "Keep elements added to the sets by hand (not part of GitHub's ranges) across updates; ranges applied by the last run and no longer listed are removed.")
+	fs.BoolVar(&appendMode, "append", false, "Never remove elements already in the sets; ranges GitHub no longer lists are kept (see -prune-stale).")
+	fs.StringVar(&pruneStale, "prune-stale", "", "With -append and -element-comments, delete elements whose marker date is older than this (e.g. 30d or 720h) and that are absent from the current fetch.")
+	fs.BoolVar(&verify, "verify", false, "Re-read the sets after applying and check every range is present.")
+	fs.StringVar(&postCheck, "post-check", "", "After applying, send a HEAD request (e.g. url=https://api.github.com/meta,timeout=5s, or 'on' for these defaults) and restore the previous set contents if it fails.")
+	fs.BoolVar(&trace, "trace", false, "Log HTTP request/response details and DNS/connect/TLS timings (secrets redacted).")
+	fs.StringVar(&cpuProfile, "profile-cpu", "", "Write a pprof CPU profile of the run to this file.")
+	fs.StringVar(&memProfile, "profile-mem", "", "Write a pprof heap profile to this file when the run ends.")
+	fs.BoolVar(&printCfg, "print-config", false, "Print the effective configuration and where each value came from, then exit.")
+	fs.StringVar(&baseline, "baseline", "", "Compare fetched ranges against this file of CIDRs and print the diff without touching the firewall.")
+	fs.BoolVar(&diffExit, "diff-exit", false, "With -baseline, -plan or the diff command, exit non-zero when there are differences.")
+	fs.BoolVar(&explainDiff, "explain-diff", false, "With -baseline or the diff command, annotate each added or removed prefix with its category, from the fetched data, the last applied snapshot or the element comment (best effort).")
+	fs.StringVar(&slackWebhook, "notify-slack-webhook", "", "Post a message to this Slack incoming webhook when the sets change or the update fails.")
+	fs.StringVar(&telegramToken, "notify-telegram-token", "", "Telegram bot token for change/failure notifications (requires -notify-telegram-chat-id).")
+	fs.StringVar(&telegramChatID, "notify-telegram-chat-id", "", "Telegram chat ID to send notifications to.")
+	fs.DurationVar(&notifyInterval, "notify-interval", time.Hour, "Send at most one notification of each kind (change/failure) per interval (0 disables rate limiting).")
+	fs.StringVar(&notifyState, "notify-state", "", "File remembering when notifications were last sent, so rate limiting works across runs (default <state-dir>/notify-state.json).")
+	fs.BoolVar(&recreateSets, "recreate-sets", false, "Delete the sets after a successful fetch and recreate them, so changed set attributes take effect (by default missing sets are created and existing ones flushed).")
+	fs.StringVar(&exportSpecs, "export", "", "Comma-separated outputs written concurrently with the nft apply, as format:path[:optional] with format plain, nginx, haproxy, json, define (nft define) or env (shell variables); a failed required output fails the run.")
+	fs.BoolVar(&exportAfter, "export-after-apply", false, "Write the -export outputs only after the sets were applied successfully, so they reflect what got applied.")
+	fs.StringVar(&shadowBackend, "shadow", "", "After a successful apply, write the same contents with this backend (nft, nft:/path/to/nft or netlink) into sets named <set>_shadow and log any difference from the applied sets.")
+	fs.BoolVar(&separateFams, "separate-families", false, "Update the IPv4 and IPv6 sets in two separate transactions, so a failure in one family does not roll back the other.")
+	fs.BoolVar(&repairSets, "repair-sets", false, "When an existing set's type or flags differ from the configuration, delete and recreate it in the update transaction, rebuilding the -chain rules that reference it (by default the update fails with an explanation).")
+	fs.BoolVar(&cleanFamilies, "clean-family-mismatch", false, "Delete sets with the configured names that exist in a different family (asks first with -confirm).")
+	fs.StringVar(&emailTo, "notify-email-to", "", "Comma-separated recipients of summary emails (requires -smtp-server).")
+	fs.StringVar(&emailFrom, "notify-email-from", "", "Sender address of summary emails (default github-updater@<hostname>).")
+	fs.StringVar(&emailOn, "notify-email-on", "change,failure,pending", "Which events trigger an email: change, failure and/or pending (changes found by -monitor).")
+	fs.IntVar(&emailMaxLines, "notify-email-max-lines", 50, "Maximum number of per-set diff lines included in an email.")
+	fs.StringVar(&smtpServer, "smtp-server", "", "SMTP relay as host:port.")
+	fs.BoolVar(&smtpStartTLS, "smtp-starttls", true, "Require STARTTLS when talking to the SMTP relay.")
+	fs.StringVar(&smtpCredsFile, "smtp-credentials-file", "", "File containing 'username:password' for SMTP authentication.")
+	fs.StringVar(&verdictMap, "verdict-map", "", "Build 'addr : verdict' maps instead of sets and reference them with vmap rules; sources without their own verdict map to this one (e.g. \"jump github_in\").")
+	fs.StringVar(&ports, "ports", "", "Comma-separated destination ports; build 'addr . inet_service' sets so the ranges are only allowed to these ports (needs nft 0.9.4+).")
+	fs.DurationVar(&reapplyAge, "reapply-max-age", 7*24*time.Hour, "reapply refuses cached data older than this unless -force is given (0 disables the check).")
+	fs.BoolVar(&force, "force", false, "With reapply, apply cached data even when it is older than -reapply-max-age.")
+	fs.StringVar(&preHook, "pre-hook", "", "Shell command run before updating; a non-zero exit aborts the run.")
+	fs.StringVar(&postHook, "post-hook", "", "Shell command run after a successful update, with UPDATER_* variables describing the run.")
+	fs.BoolVar(&postHookFatal, "post-hook-fatal", false, "Exit non-zero when the post-hook fails (by default the failure is only logged).")
+	fs.StringVar(&outPath, "out", "", "Write the generated nft script to this file or named pipe instead of running nft (each cycle in -daemon mode).")
+	fs.DurationVar(&outTimeout, "out-timeout", 30*time.Second, "With -out naming a pipe, give up when no reader opens it within this time (0 waits forever).")
+	fs.StringVar(&backend, "backend", "nft", "How to apply the sets locally: nft, nft:/path/to/nft, netlink to talk to the kernel directly without the nft binary, ipset to maintain hash:net ipsets (with -chain, also iptables/ip6tables ACCEPT rules), firewalld to maintain firewalld ipsets (permanent and runtime) through firewall-cmd, pf to replace a pf table with pfctl, aws to sync AWS security groups or managed prefix lists, or awswaf to replace AWS WAFv2 IP sets, instead of nftables sets; see README.")
+	fs.StringVar(&pfTable, "pf-table", "github_actions", "With -backend pf, the pf table holding both IPv4 and IPv6 ranges.")
+	fs.StringVar(&pfAnchor, "pf-anchor", "", "With -backend pf, the anchor containing -pf-table (default: the main ruleset).")
+	fs.StringVar(&awsGroups, "aws-security-groups", "", "With -backend aws, comma-separated security group IDs receiving one ingress rule per range (and per -ports port), filled in order as each group's rule quota runs out.")
+	fs.StringVar(&awsPrefixLists, "aws-prefix-lists", "", "With -backend aws, comma-separated managed prefix list IDs; each receives the ranges of its address family.")
+	fs.StringVar(&awsRegion, "aws-region", "", "AWS region for -backend aws (default: from the AWS environment and shared config).")
+	fs.StringVar(&wafIPSetARNs, "ipset-arn", "", "With -backend awswaf, comma-separated ARNs of WAFv2 IP sets; each is replaced with the ranges of its IP address version.")
+	fs.IntVar(&awsGroupRules, "aws-rules-per-group", awssg.DefaultRulesPerGroup, "With -aws-security-groups, ingress rules each group may hold per address family, including rules not managed by this tool.")
+	fs.StringVar(&remoteHosts, "remote", "", "Comma-separated hosts to apply the sets to over SSH (ssh host nft -f -) instead of locally.")
+}
+
+// validate 执行不依赖网络和 nft 的静态检查，返回全部错误
+func validate() error {
+	var errs []error
+	if diffExit && baseline == "" && !planMode {
+		errs = append(errs, errors.New("-diff-exit requires -baseline or -plan"))
+	}
+	if baseline != "" {
+		if _, err := fetch.ReadCIDRFile(baseline); err != nil {
+			errs = append(errs, fmt.Errorf("baseline: %w", err))
+		}
+	}
+	if err := (nft.Target{Family: family, TableName: table, IPv4SetName: setV4, IPv6SetName: setV6}).Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, validateChains()...)
+	if chain.Name == "" && (ruleIifname != "" || ruleOifname != "") {
+		errs = append(errs, errors.New("-rule-iifname and -rule-oifname require -chain"))
+	}
+	if (emailTo == "") != (smtpServer == "") {
+		errs = append(errs, errors.New("-notify-email-to and -smtp-server must be set together"))
+	}
+	for _, kind := range splitList(emailOn) {
+		if kind != "change" && kind != "failure" && kind != "pending" {
+			errs = append(errs, fmt.Errorf("invalid -notify-email-on value %q", kind))
+		}
+	}
+	if len(splitList(categories)) == 0 {
+		errs = append(errs, errors.New("-categories must name at least one category"))
+	}
+	for _, name := range splitList(categories) {
+		if !fetch.ValidCategory(name) {
+			errs = append(errs, fmt.Errorf("unknown category %q in -categories", name))
+		}
+	}
+	if err := nft.ValidMatch(chain.Match); err != nil {
+		errs = append(errs, err)
+	}
+	if err := setAttrs.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if daemon && setAttrs.Timeout > 0 && setAttrs.Timeout <= daemonInterval {
+		errs = append(errs, fmt.Errorf("-element-timeout %s must be longer than -interval %s, or the sets empty out between refreshes", setAttrs.Timeout, daemonInterval))
+	}
+	if setAttrs.GCInterval > setAttrs.Timeout && setAttrs.Timeout > 0 {
+		log.Printf("WARNING: -set-gc-interval %s is longer than -element-timeout %s; expired elements stop matching on time but stay listed until the next garbage collection", setAttrs.GCInterval, setAttrs.Timeout)
+	}
+	if _, err := parsePorts(ports); err != nil {
+		errs = append(errs, err)
+	}
+	if ports != "" && preserve {
+		errs = append(errs, errors.New("-ports cannot be combined with -preserve-unmanaged"))
+	}
+	if verdictMap != "" {
+		if err := nft.ValidVerdict(verdictMap); err != nil {
+			errs = append(errs, fmt.Errorf("-verdict-map: %w", err))
+		}
+		if ports != "" || preserve || appendMode || setAttrs.Constant || recreateSets {
+			errs = append(errs, errors.New("-verdict-map cannot be combined with -ports, -preserve-unmanaged, -append, -constant or -recreate-sets"))
+		}
+	}
+	if daemon && confirmPrompt && !assumeYes {
+		errs = append(errs, errors.New("-daemon cannot prompt for confirmation; drop -confirm or add -yes"))
+	}
+	if daemon && (baseline != "" || remoteHosts != "") {
+		errs = append(errs, errors.New("-daemon cannot be combined with -baseline or -remote"))
+	}
+	if monitorMode && (baseline != "" || remoteHosts != "") {
+		errs = append(errs, errors.New("-monitor cannot be combined with -baseline or -remote"))
+	}
+	if printFP && (daemon || monitorMode || planMode || baseline != "" || remoteHosts != "" || outPath != "") {
+		errs = append(errs, errors.New("-print-fingerprint reads the local sets and cannot be combined with -daemon, -monitor, -plan, -baseline, -remote or -out"))
+	}
+	if err := nft.ValidMarker(managedMarker); err != nil {
+		errs = append(errs, err)
+	}
+	if reconcileMode && (daemon || monitorMode || planMode || printFP || baseline != "" || remoteHosts != "" || outPath != "") {
+		errs = append(errs, errors.New("-reconcile changes the local ruleset after an update and cannot be combined with -daemon, -monitor, -plan, -print-fingerprint, -baseline, -remote or -out"))
+	}
+	if planMode && (daemon || monitorMode || baseline != "" || remoteHosts != "" || outPath != "") {
+		errs = append(errs, errors.New("-plan cannot be combined with -daemon, -monitor, -baseline, -remote or -out"))
+	}
+	if dryRun && (daemon || monitorMode || planMode || printFP || reconcileMode || baseline != "" || remoteHosts != "" || outPath != "") {
+		errs = append(errs, errors.New("-dry-run cannot be combined with -daemon, -monitor, -plan, -print-fingerprint, -reconcile, -baseline, -remote or -out"))
+	}
+	if outPath != "" && (remoteHosts != "" || verify || preserve) {
+		errs = append(errs, errors.New("-out cannot be combined with -remote, -verify or -preserve-unmanaged, which need the live sets"))
+	}
+	if _, err := parsePostCheck(postCheck); err != nil {
+		errs = append(errs, err)
+	}
+	if postCheck != "" && (ports != "" || outPath != "" || remoteHosts != "") {
+		errs = append(errs, errors.New("-post-check cannot be combined with -ports, -out or -remote"))
+	}
+	if stale, err := parseDays(pruneStale); err != nil {
+		errs = append(errs, fmt.Errorf("-prune-stale: %w", err))
+	} else if stale > 0 && (!appendMode || !elemComments) {
+		errs = append(errs, errors.New("-prune-stale requires -append and -element-comments"))
+	}
+	if appendMode && (preserve || ports != "" || outPath != "") {
+		errs = append(errs, errors.New("-append cannot be combined with -preserve-unmanaged (it already keeps every element), -ports or -out"))
+	}
+	if dnsMinTTL <= 0 || dnsMaxTTL < dnsMinTTL {
+		errs = append(errs, fmt.Errorf("-dns-min-ttl must be positive and not above -dns-max-ttl (got %s and %s)", dnsMinTTL, dnsMaxTTL))
+	}
+	if onEmpty != "" && onEmpty != "fail" && onEmpty != "keep" {
+		errs = append(errs, fmt.Errorf("invalid -on-empty %q (want fail or keep)", onEmpty))
+	}
+	if maxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("-max-redirects must not be negative (got %d)", maxRedirects))
+	}
+	if missingCat != "skip" && missingCat != "fail" && missingCat != "stale" {
+		errs = append(errs, fmt.Errorf("invalid -missing-category %q (want skip, fail or stale)", missingCat))
+	}
+	if onFetchFailure != "keep" && onFetchFailure != "flush" && onFetchFailure != "fail" {
+		errs = append(errs, fmt.Errorf("invalid -on-fetch-failure %q (want keep, flush or fail)", onFetchFailure))
+	}
+	if _, err := parseExports(exportSpecs); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkBackend(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseShadow(shadowBackend); err != nil {
+		errs = append(errs, err)
+	} else if shadowBackend != "" && (outPath != "" || remoteHosts != "") {
+		errs = append(errs, errors.New("-shadow cannot be combined with -out or -remote"))
+	}
+	if separateFams && (setAttrs.Constant || outPath != "") {
+		errs = append(errs, errors.New("-separate-families cannot be combined with -constant or -out"))
+	}
+	if setAttrs.Constant && (postCheck != "" || outPath != "") {
+		errs = append(errs, errors.New("-constant cannot be combined with -post-check or -out: constant sets cannot be restored or replaced without the live sets"))
+	}
+	if err := validTextfile(); err != nil {
+		errs = append(errs, err)
+	}
+	if staleMaxAge < 0 {
+		errs = append(errs, errors.New("-stale-max-age must not be negative"))
+	}
+	if (staleMaxAge > 0 || staleDate) && metaFile != "" {
+		errs = append(errs, errors.New("-stale-max-age and -stale-date check HTTP headers and cannot be combined with -meta-file"))
+	}
+	if fullResync < 0 {
+		errs = append(errs, errors.New("-full-resync-every must not be negative"))
+	}
+	if daemon && daemonInterval <= 0 {
+		errs = append(errs, errors.New("-interval must be positive"))
+	}
+	if rateLimitPct < 0 || rateLimitPct > 100 {
+		errs = append(errs, fmt.Errorf("-rate-limit-target must be between 0 and 100 (got %d)", rateLimitPct))
+	}
+	var exclude []iprange.Range
+	if excludeFile != "" {
+		if prefixes, err := fetch.ReadCIDRFile(excludeFile); err != nil {
+			errs = append(errs, err)
+		} else {
+			exclude = iprange.FromPrefixes(prefixes)
+		}
+	}
+	for _, f := range extraFiles {
+		extra, err := fetch.ReadCIDRFile(f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// 同一地址既要加入又要排除，意图矛盾
+		if overlap := iprange.ToPrefixes(iprange.Intersect(iprange.FromPrefixes(extra), exclude)); len(overlap) > 0 {
+			errs = append(errs, fmt.Errorf("-extra-file %s and -exclude-file %s overlap in %d ranges (first: %s); remove them from one of the files",
+				f, excludeFile, len(overlap), overlap[0]))
+		}
+	}
+	errs = append(errs, validateSources()...)
+	if (telegramToken == "") != (telegramChatID == "") {
+		errs = append(errs, errors.New("-notify-telegram-token and -notify-telegram-chat-id must be set together"))
+	}
+	return errors.Join(errs...)
+}
+
+// runConfig 处理 config 子命令
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: github-updater config validate [-config file] [flags]")
+		return exitFailure
+	}
+	sources, err := loadSettings(flag.CommandLine, args[1:])
+	logRouting()
+	if err != nil || profile != profileAll {
+		return validateConfig(sources, err, "")
+	}
+	code := 0
+	for _, name := range profileNames {
+		sources, err := loadProfile(args[1:], name)
+		if c := validateConfig(sources, err, name); c != 0 {
+			code = c
+		}
+	}
+	return code
+}
+
+// validateConfig 输出全部错误，没有错误时输出生效的配置。name 为 profile 名称，可以为空
+func validateConfig(sources map[string]string, err error, name string) int {
+	prefix := ""
+	if name != "" {
+		prefix = "profile " + name + ": "
+	}
+	err = errors.Join(err, validate())
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "ERROR: %s%s\n", prefix, line)
+		}
+		return exitFailure
+	}
+	if name != "" {
+		fmt.Printf("# profile: %s\n", name)
+	}
+	if err := printConfig(os.Stdout, flag.CommandLine, sources); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return 0
+}
+
+func runUpdate(args []string) int {
+	// -validate-config 等价于 config validate -config <file>
+	flag.CommandLine.Parse(args)
+	if validateFile != "" {
+		return runConfig(append([]string{"validate"}, append(args, "-config", validateFile)...))
+	}
+	extraFiles, ruleChainSpecs = nil, nil // 下面再次解析时可重复的参数会重新追加
+	sources, err := loadSettings(flag.CommandLine, args)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	logRouting()
+	if printCfg {
+		if err := printConfig(os.Stdout, flag.CommandLine, sources); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return 0
+	}
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer stopProfiling()
+	if importIpset != "" || importNft != "" {
+		return forProfiles(args, importState)
+	}
+	if daemon {
+		if profile != profileAll {
+			if err := validate(); err != nil {
+				log.Printf("ERROR: %v", err)
+				return exitFailure
+			}
+		}
+		return runDaemon(args, update)
+	}
+	run := forProfiles
+	if baseline == "" && remoteHosts == "" {
+		run = updateProfiles
+	}
+	if code := run(args, update); code != 0 || !reconcileMode {
+		return code
+	}
+	return reconcile(args)
+}
+
+// update 执行一次更新，返回退出码
+func update() int {
+	if err := validate(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+
+	if baseline == "" {
+		if err := preflight(); err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+	}
+	logVerbose("Starting GitHub Actions IP update...")
+
+	opts := buildOptions()
+	if printFP {
+		return runFingerprint(opts)
+	}
+	if monitorMode {
+		return monitor(opts)
+	}
+	if planMode {
+		return planRuleset(opts)
+	}
+	if dryRun {
+		return dryRunScript(opts)
+	}
+	if baseline != "" {
+		return runBaselineDiff(opts)
+	}
+	if remoteHosts != "" {
+		return runRemote(opts, splitList(remoteHosts))
+	}
+
+	if code := runPreHook(opts); code != 0 {
+		return code
+	}
+	announcePending()
+	res, err := pipeline.Run(context.Background(), opts)
+	if err == nil && res.Applied && res.Snapshot != nil {
+		saveSnapshot(res.Snapshot)
+	}
+	if err == nil && res.Applied {
+		clearPending()
+	}
+	return finish(opts, res, err)
+}
+
+// buildOptions 根据参数构造流程选项
+func buildOptions() pipeline.Options {
+	portList, _ := parsePorts(ports)
+	stale, _ := parseDays(pruneStale)
+	shadow, _ := parseShadow(shadowBackend)
+	exporters, _ := parseExports(exportSpecs)
+	chains, _ := ruleChains()
+
+	client := metaClient()
+	var previous *pipeline.Snapshot
+	if missingCat == "stale" || preserve {
+		previous, _ = loadSnapshot() // -preserve-unmanaged 据此区分 GitHub 已撤回的网段和手工添加的元素
+	}
+	var check func(context.Context) error
+	if spec, _ := parsePostCheck(postCheck); spec != nil {
+		check = spec.check
+	}
+	imported := loadImported() // 有导入内容（首次应用前）时总是跟踪变化
+	nftc := localNft()
+	if outPath != "" {
+		nftc = &nft.Client{Executor: nft.FileExecutor{Path: outPath, FIFOTimeout: outTimeout}}
+	}
+	opts := pipeline.Options{
+		Client:  client,
+		Sources: pipelineSources(),
+		Nft:     nftc,
+		Target: nft.Target{
+			Family:      family,
+			TableName:   table,
+			IPv4SetName: setV4,
+			IPv6SetName: setV6,
+			Marker:      managedMarker,
+		},
+		Chains:          chains,
+		Comments:        withComments,
+		ElementComments: elemComments,
+		Confirm:         confirm,
+		Logger:          stdLogger{},
+
+		PreserveUnmanaged:   preserve,
+		Append:              appendMode,
+		SeparateFamilies:    separateFams,
+		Shadow:              shadow,
+		Exporters:           exporters,
+		ExportAfterApply:    exportAfter,
+		PruneStale:          stale,
+		CleanFamilyMismatch: cleanFamilies,
+		RecreateSets:        recreateSets,
+		RepairSets:          repairSets,
+		TrackChanges:        !dryRun && (len(notifiers()) > 0 || bannerEnabled() || len(imported) > 0),
+		Verify:              verify,
+		WaitForNetwork:      waitNetwork,
+		Ports:               portList,
+		VerdictMap:          verdictMap,
+		SetAttrs:            setAttrs,
+		ExtraFiles:          extraFiles,
+		ExcludeFile:         excludeFile,
+		Version:             version,
+		HashIgnoreExtras:    !hashExtras,
+		PreviousHash:        previousHash(),
+		PostCheck:           check,
+		KeepOnEmpty:         onEmpty == "keep" || (onEmpty == "" && daemon),
+		FlushOnFetchFailure: onFetchFailure == "flush",
+		MissingCategory:     missingCat,
+		Previous:            previous,
+		OnlyFamily:          onlyFamily,
+		AssumeLive:          imported,
+		Backend:             altBackend(),
+	}
+	opts.SkipIfHash = skipHash(opts)
+	return opts
+}
+
+// metaClient 根据参数构造获取 meta 文档的客户端
+func metaClient() *fetch.Client {
+	client := &fetch.Client{URL: metaURL, File: metaFile, Categories: splitList(categories), MaxAge: staleMaxAge}
+	setRedirects(client)
+	if staleDate {
+		client.NotBefore = loadMetaDate()
+	}
+	if trace {
+		client.Trace = log.Printf
+	}
+	return client
+}
+
+// setRedirects 把 -max-redirects 和 -redirect-https-only 应用到客户端
+func setRedirects(c *fetch.Client) {
+	c.MaxRedirects = maxRedirects
+	if maxRedirects == 0 {
+		c.MaxRedirects = -1
+	}
+	c.HTTPSRedirectsOnly = httpsRedirects
+}
+
+// finish 发送通知、输出摘要和结果，返回退出码
+func finish(opts pipeline.Options, res *pipeline.Result, err error) int {
+	notifyResult("", opts.Target, res, err)
+	if res != nil {
+		logInfo("Phase timings: %s", res.Phases)
+		s := res.Summary(opts.TrackChanges, err)
+		reportSummary(s)
+		auditRun(opts, s, err)
+	}
+	if staleDate && res != nil {
+		saveMetaDate(res.MetaDate)
+	}
+	if res != nil && res.RateLimit != nil {
+		lastRateLimit = res.RateLimit
+	}
+	total := bytesTotal(res)
+	fp := statusFingerprint(opts)
+	writeStatus(opts, res, err, total, fp)
+	writeTextfile(opts, res, err, total, fp)
+	if err == nil && res.Applied {
+		appliedSinceStart[profileStateDir()] = true
+		if fp != "" {
+			saveFingerprint(fp)
+		}
+	}
+	if err == nil && res.Applied && res.Hash != "" {
+		saveHash(res.Hash)
+		clearImported()
+	}
+	if skipUnchanged && err == nil && (res.Applied || res.Skipped) {
+		recordSkip(res.Skipped)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		if code := fetchFailurePolicy(res, err); code != 0 {
+			return code
+		}
+		return exitCode(err)
+	}
+	if res.Skipped || res.Kept {
+		return 0
+	}
+	if !res.Applied {
+		logInfo("Aborted, no changes applied.")
+		return 0
+	}
+
+	logInfo("Successfully updated %s.", targetName())
+	printBanner(res, opts.TrackChanges)
+	if postHook != "" {
+		if err := runHook(context.Background(), postHook, hookEnv("post", opts, res)); err != nil {
+			if postHookFatal {
+				log.Printf("ERROR: post-hook failed: %v", err)
+				return exitHook
+			}
+			log.Printf("WARNING: post-hook failed: %v", err)
+		}
+	}
+	return 0
+}
+
+// fetchFailurePolicy 在获取失败时输出 -on-fetch-failure 的处理结果，flush 和 fail 返回 exitFetchPolicy
+func fetchFailurePolicy(res *pipeline.Result, err error) int {
+	var fetchErr *pipeline.FetchError
+	if !errors.As(err, &fetchErr) {
+		return 0
+	}
+	switch onFetchFailure {
+	case "flush":
+		if res != nil && res.Flushed {
+			log.Printf("ERROR: -on-fetch-failure flush: the sets have been emptied and stay empty until a fetch succeeds")
+		} else {
+			log.Printf("ERROR: -on-fetch-failure flush: no sets were flushed")
+		}
+		return exitFetchPolicy
+	case "fail":
+		log.Printf("ERROR: -on-fetch-failure fail: the sets keep their current contents, giving up")
+		return exitFetchPolicy
+	}
+	log.Printf("WARNING: -on-fetch-failure keep: the sets keep their current contents")
+	return 0
+}
+
+// bannerEnabled 表示是否打印结果行，打印时需要跟踪变化以给出新增和移除数
+func bannerEnabled() bool {
+	return banner && !quiet && !jsonOut && !dryRun && isTerminal(os.Stdout)
+}
+
+// printBanner 交互运行时在标准输出打印一行结果
+func printBanner(res *pipeline.Result, trackChanges bool) {
+	if !bannerEnabled() {
+		return
+	}
+	line := fmt.Sprintf("✓ GitHub allowlist updated: %s IPv4 + %s IPv6 ranges", groupDigits(res.IPv4Count), groupDigits(res.IPv6Count))
+	if trackChanges {
+		line += fmt.Sprintf(" (%s added, %s removed)", groupDigits(len(res.Added)), groupDigits(len(res.Removed)))
+	}
+	fmt.Println(line)
+}
+
+// groupDigits 以千位分隔符格式化整数，例如 3,421
+func groupDigits(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// runPreHook 执行 -pre-hook，失败时返回非零退出码
+func runPreHook(opts pipeline.Options) int {
+	if preHook == "" {
+		return 0
+	}
+	if err := runHook(context.Background(), preHook, hookEnv("pre", opts, nil)); err != nil {
+		log.Printf("ERROR: pre-hook failed, aborting: %v", err)
+		return exitHook
+	}
+	return 0
+}
+
+// reportSummary 在 info 级别输出运行摘要，-json 时同时以 JSON 写到标准输出
+func reportSummary(s pipeline.Summary) {
+	logInfo("%s", s.Text())
+	saveLastRun(s)
+	switch {
+	case !jsonOut:
+	case profileSummaries != nil:
+		profileSummaries[profile] = s
+	default:
+		writeJSON(s)
+	}
+}
+
+// writeJSON 把 v 以缩进的 JSON 写到标准输出
+func writeJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("ERROR: encode summary: %v", err)
+	}
+}
+
+// 退出码，见 README
+const (
+	exitFailure     = 1
+	exitFetch       = 3
+	exitDecode      = 4
+	exitGuard       = 5
+	exitRender      = 6
+	exitApply       = 7
+	exitVerify      = 8
+	exitDiff        = 9
+	exitDrift       = 10
+	exitHook        = 11
+	exitPending     = 12
+	exitPostCheck   = 13
+	exitExport      = 14
+	exitPush        = 15
+	exitFetchPolicy = 16
+)
+
+// exitCode 把流程错误映射为退出码
+func exitCode(err error) int {
+	var (
+		fetchErr  *pipeline.FetchError
+		decodeErr *pipeline.DecodeError
+		guardErr  *pipeline.GuardError
+		renderErr *pipeline.RenderError
+		applyErr  *pipeline.ApplyError
+		verifyErr *pipeline.VerifyError
+		checkErr  *pipeline.PostCheckError
+		exportErr *pipeline.ExportError
+	)
+	switch {
+	case errors.As(err, &fetchErr):
+		return exitFetch
+	case errors.As(err, &decodeErr):
+		return exitDecode
+	case errors.As(err, &guardErr):
+		return exitGuard
+	case errors.As(err, &renderErr):
+		return exitRender
+	case errors.As(err, &applyErr):
+		return exitApply
+	case errors.As(err, &verifyErr):
+		return exitVerify
+	case errors.As(err, &checkErr):
+		return exitPostCheck
+	case errors.As(err, &exportErr):
+		return exitExport
+	}
+	return exitFailure
+}
+
+// runBaselineDiff 只读地比较获取到的网段和 baseline 文件，返回退出码
+func runBaselineDiff(opts pipeline.Options) int {
+	want, err := fetch.ReadCIDRFile(baseline)
+	if err != nil {
+		log.Printf("ERROR: read baseline: %v", err)
+		return exitFailure
+	}
+	classified, _, err := pipeline.Fetch(context.Background(), opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	diff := pipeline.DiffPrefixes(want, classified.All())
+	diff.WriteAnnotated(os.Stdout, diffNotes(classified, nil))
+	if diff.Empty() {
+		logVerbose("Fetched ranges match baseline %s.", baseline)
+		return 0
+	}
+	logInfo("Fetched ranges differ from baseline %s: %d added, %d removed.", baseline, len(diff.Added), len(diff.Removed))
+	if diffExit {
+		return exitDiff
+	}
+	return 0
+}
+
+// runRemote 在本机获取一次数据，然后依次通过 SSH 应用到每台主机，返回退出码
+func runRemote(opts pipeline.Options, hosts []string) int {
+	ctx := context.Background()
+	classified, fetched, err := pipeline.Fetch(ctx, opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		if fetched != nil {
+			reportSummary(fetched.Summary(false, err))
+		}
+		return exitCode(err)
+	}
+	logInfo("Fetched ranges (IPv4: %d, IPv6: %d), applying to %d remote hosts.", fetched.IPv4Count, fetched.IPv6Count, len(hosts))
+
+	// 汇总所有主机的结果
+	summary := fetched.Summary(opts.TrackChanges, nil)
+	summary.Backends = nil
+	summary.Applied = true
+	var errs []error
+	code := 0
+	for _, host := range hosts {
+		hostOpts := opts
+		hostOpts.Nft = &nft.Client{Executor: nft.SSHExecutor{Host: host}}
+		hostOpts.Confirm = func(question, plan string) (bool, error) {
+			return confirm(fmt.Sprintf("[%s] %s", host, question), plan)
+		}
+		res, err := pipeline.ApplyClassified(ctx, hostOpts, classified)
+		notifyResult(host, opts.Target, res, err)
+		summary.Backends = append(summary.Backends, res.Backend)
+		summary.DurationMS += res.Duration.Milliseconds()
+		for _, w := range res.Warnings {
+			summary.Warnings = append(summary.Warnings, fmt.Sprintf("[%s] %s", host, w))
+		}
+		summary.Applied = summary.Applied && res.Applied
+		if opts.TrackChanges && res.Changed() {
+			*summary.Changed = true
+			summary.Added += len(res.Added)
+			summary.Removed += len(res.Removed)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+		}
+		switch {
+		case err != nil:
+			log.Printf("Remote %s: FAILED: %v", host, err)
+			if code == 0 {
+				code = exitCode(err)
+			}
+		case !res.Applied:
+			logInfo("Remote %s: skipped, no changes applied.", host)
+		default:
+			logInfo("Remote %s: updated.", host)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		summary.Error = err.Error()
+	}
+	reportSummary(summary)
+	return code
+}
+
+// parsePorts 解析 -ports 的端口列表
+func parsePorts(s string) ([]uint16, error) {
+	var list []uint16
+	seen := make(map[uint64]bool)
+	for _, item := range splitList(s) {
+		port, err := strconv.ParseUint(item, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q in -ports", item)
+		}
+		if !seen[port] {
+			seen[port] = true
+			list = append(list, uint16(port))
+		}
+	}
+	return list, nil
+}
+
+// parseShadow 解析 -shadow 指定的执行方式，空字符串表示不使用
+func parseShadow(s string) (*nft.Client, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return parseBackend("-shadow", s)
+}
+
+// parseBackend 解析 -backend 和 -shadow 的值：nft、nft:/path/to/nft 或 netlink
+func parseBackend(name, s string) (*nft.Client, error) {
+	if s == "netlink" {
+		return &nft.Client{Executor: nft.NetlinkExecutor{}}, nil
+	}
+	if tool, path, _ := strings.Cut(s, ":"); tool == "nft" {
+		return &nft.Client{Executor: nft.ExecExecutor{Path: path}}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown backend %q (want nft, nft:/path/to/nft or netlink)", name, s)
+}
+
+// localNft 返回按 -backend 修改本机规则集的客户端
+func localNft() *nft.Client {
+	c, err := parseBackend("-backend", backend)
+	if err != nil {
+		return &nft.Client{}
+	}
+	return c
+}
+
+// parseDays 解析时长，除 time.ParseDuration 的写法外还接受以天为单位的 "30d"，空字符串为 0
+func parseDays(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.ParseUint(n, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// listFlag 是可重复的参数，每次出现（或逗号分隔的每一项）按顺序追加一个值。
+// 配置文件中写作列表，环境变量中用逗号分隔
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, splitList(s)...)
+	return nil
+}
+
+// splitList 拆分逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// confirm 在 -confirm 模式下展示计划并向用户确认，默认回答为否。
+// 未开启 -confirm 或指定了 -yes 时直接放行。
+func confirm(question, plan string) (bool, error) {
+	if !confirmPrompt {
+		return true, nil
+	}
+	if !assumeYes && !isTerminal(os.Stdin) {
+		return false, errors.New("stdin is not a terminal, cannot prompt for confirmation; drop -confirm or use -yes")
+	}
+	return ask(question, plan)
+}
+
+// ask 无论是否开启 -confirm 都要求确认，用于 flush 等破坏性操作，-yes 时直接放行
+func ask(question, plan string) (bool, error) {
+	if plan != "" {
+		fmt.Println(plan)
+	}
+	if assumeYes {
+		return true, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return false, errors.New("stdin is not a terminal, cannot prompt for confirmation; use -yes")
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil && answer == "" {
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// isTerminal 表示 f 是否为终端。/dev/null 等字符设备不算
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// runMainEnv 非空时测试二进制直接作为 github-updater 运行，见 runCLI
+const runMainEnv = "GH_UPDATER_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		os.Args = append([]string{"github-updater"}, strings.Split(os.Getenv("GH_UPDATER_TEST_ARGS"), "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI 在子进程中以 args 运行 main，返回标准输出和退出码。
+// 子进程不继承 GITHUB_UPDATER_* 环境变量，避免本机的设置影响结果
+func runCLI(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GITHUB_UPDATER_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, runMainEnv+"=1", "GH_UPDATER_TEST_ARGS="+strings.Join(args, "\n"), "PATH=")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Logf("stderr:\n%s", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestDryRunGolden(t *testing.T) {
+	meta, err := filepath.Abs("testdata/meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("table: github\nset-v4: gh4\nset-v6: gh6\ncategories: [hooks, git]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 没有权限的用户运行的 nft：查询都因 EPERM 失败
+	nftStub := filepath.Join(t.TempDir(), "nft")
+	if err := os.WriteFile(nftStub, []byte("#!/bin/sh\necho 'Error: Could not process rule: Operation not permitted' >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"default", nil},
+		{"categories", []string{"-categories", "hooks,web,api"}},
+		{"hooks-only-comments", []string{"-hooks-only", "-comments"}},
+		{"ports", []string{"-ports", "443,22"}},
+		{"verdict-map", []string{"-verdict-map", "accept", "-family", "ip", "-table", "gh"}},
+		{"config-file", []string{"-config", config}},
+		{"pf", []string{"-backend", "pf", "-pf-table", "github"}},
+		{"unprivileged-chain", []string{"-backend", "nft:" + nftStub, "-chain", "input"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-meta-file", meta, "-dry-run", "-state-dir", t.TempDir()}, tt.args...)
+			out, code := runCLI(t, args...)
+			if code != 0 {
+				t.Fatalf("exit code %d", code)
+			}
+			golden := filepath.Join("testdata", "dry-run-"+tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(out), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != string(want) {
+				t.Errorf("output differs from %s:\n%s\nwant:\n%s", golden, out, want)
+			}
+		})
+	}
+}
+
+func TestDryRunExitCodes(t *testing.T) {
+	meta, err := filepath.Abs("testdata/meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"missing meta file", []string{"-meta-file", filepath.Join(t.TempDir(), "missing.json"), "-dry-run"}, exitFetch},
+		{"unknown backend", []string{"-meta-file", meta, "-dry-run", "-backend", "bogus"}, exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(tt.args, "-state-dir", t.TempDir())
+			if _, code := runCLI(t, args...); code != tt.code {
+				t.Errorf("exit code %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestConfirmWithoutTerminal(t *testing.T) {
+	// /dev/null 是字符设备但不是终端
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if isTerminal(null) {
+		t.Fatalf("%s is reported as a terminal", os.DevNull)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = null
+	defer func() { os.Stdin, confirmPrompt, assumeYes = stdin, false, false }()
+
+	confirmPrompt = true
+	ok, err := confirm("Apply?", "")
+	if ok || err == nil || !strings.Contains(err.Error(), "drop -confirm or use -yes") {
+		t.Errorf("confirm = %v, %v", ok, err)
+	}
+	assumeYes = true
+	if ok, err := confirm("Apply?", ""); !ok || err != nil {
+		t.Errorf("confirm with -yes = %v, %v", ok, err)
+	}
+}
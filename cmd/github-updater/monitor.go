@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"github-updater/pkg/notify"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// pendingChanges 是 -monitor 发现但尚未应用的变化，写入 pending.json
+type pendingChanges struct {
+	FirstDetected time.Time      `json:"first_detected"`
+	LastChecked   time.Time      `json:"last_checked"`
+	Added         []netip.Prefix `json:"added"`
+	Removed       []netip.Prefix `json:"removed"`
+}
+
+// monitor 获取数据并与内核中的集合比较，只报告差异，从不应用。
+// 有差异时记录到 pending.json 并以 exitPending 退出
+func monitor(opts pipeline.Options) int {
+	ctx := context.Background()
+	classified, _, err := pipeline.Fetch(ctx, opts)
+	var drifts []pipeline.SetDrift
+	if err == nil {
+		drifts, err = pipeline.CheckDrift(ctx, opts, classified)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		notifyResult("", opts.Target, nil, err)
+		return exitCode(err)
+	}
+
+	var added, removed []netip.Prefix
+	for _, d := range drifts {
+		added = append(added, d.Missing...)
+		if !opts.PreserveUnmanaged {
+			removed = append(removed, d.Unexpected...)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		logInfo("No upstream changes pending.")
+		clearPending()
+		return 0
+	}
+
+	now := time.Now().UTC()
+	p := pendingChanges{FirstDetected: now, LastChecked: now, Added: added, Removed: removed}
+	prev, _ := loadPending()
+	if prev != nil {
+		p.FirstDetected = prev.FirstDetected
+	}
+	savePending(p)
+	logInfo("Upstream changes pending, not applied: +%d/-%d prefixes (first detected at %s).",
+		len(added), len(removed), p.FirstDetected.Local().Format(time.RFC3339))
+	for _, q := range added {
+		logVerbose("  + %s", q)
+	}
+	for _, q := range removed {
+		logVerbose("  - %s", q)
+	}
+
+	// 相同的差异只通知一次
+	if prev == nil || !slices.Equal(prev.Added, added) || !slices.Equal(prev.Removed, removed) {
+		if ns := notifiers(); len(ns) > 0 {
+			host, _ := os.Hostname()
+			res := &pipeline.Result{Added: added, Removed: removed}
+			sendNotification(ns, notify.Event{
+				Host:    host,
+				Target:  opts.Target.Family + "/" + opts.Target.TableName,
+				Sets:    []string{opts.Target.IPv4SetName, opts.Target.IPv6SetName},
+				Added:   len(added),
+				Removed: len(removed),
+				Pending: true,
+				Changes: setChanges(opts.Target, res),
+			})
+		}
+	}
+	return exitPending
+}
+
+// loadPending 读取尚未应用的变化，不存在时返回 nil
+func loadPending() (*pendingChanges, error) {
+	data, err := os.ReadFile(openState().File(state.PendingFile))
+	if err != nil {
+		return nil, err
+	}
+	var p pendingChanges
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func savePending(p pendingChanges) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = openState().WriteFile(state.PendingFile, data)
+	}
+	if err != nil {
+		logVerbose("Not recording pending changes: %v", err)
+	}
+}
+
+func clearPending() {
+	if err := os.Remove(openState().File(state.PendingFile)); err != nil && !os.IsNotExist(err) {
+		logVerbose("Cannot remove %s: %v", state.PendingFile, err)
+	}
+}
+
+// announcePending 在正常更新前说明 -monitor 曾发现的变化
+func announcePending() {
+	if p, err := loadPending(); err == nil {
+		logInfo("Applying changes first detected at %s (+%d/-%d prefixes when last checked).",
+			p.FirstDetected.Local().Format(time.RFC3339), len(p.Added), len(p.Removed))
+	}
+}
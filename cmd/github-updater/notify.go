@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/notify"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+const notifyTimeout = 10 * time.Second
+
+var notifyLimiter *notify.Limiter
+
+// notifiers 返回根据参数配置的通知渠道
+func notifiers() []notify.Notifier {
+	client := &http.Client{Timeout: notifyTimeout}
+	var ns []notify.Notifier
+	if slackWebhook != "" {
+		ns = append(ns, &notify.Slack{WebhookURL: slackWebhook, Client: client})
+	}
+	if telegramToken != "" && telegramChatID != "" {
+		ns = append(ns, &notify.Telegram{Token: telegramToken, ChatID: telegramChatID, Client: client})
+	}
+	if emailTo != "" && smtpServer != "" {
+		ns = append(ns, notify.OnlyKinds(emailNotifier(), splitList(emailOn)...))
+	}
+	return ns
+}
+
+func emailNotifier() *notify.Email {
+	m := &notify.Email{
+		Server:       smtpServer,
+		From:         emailFrom,
+		To:           splitList(emailTo),
+		StartTLS:     smtpStartTLS,
+		MaxDiffLines: emailMaxLines,
+	}
+	if m.From == "" {
+		host, _ := os.Hostname()
+		m.From = "github-updater@" + host
+	}
+	if smtpCredsFile != "" {
+		data, err := os.ReadFile(smtpCredsFile)
+		if err != nil {
+			log.Printf("WARNING: cannot read SMTP credentials: %v", err)
+		} else {
+			line, _, _ := strings.Cut(string(data), "\n")
+			m.Username, m.Password, _ = strings.Cut(strings.TrimSpace(line), ":")
+		}
+	}
+	return m
+}
+
+// setChanges 按集合拆分变化明细
+func setChanges(target nft.Target, res *pipeline.Result) []notify.SetChange {
+	v4 := notify.SetChange{Set: target.IPv4SetName}
+	v6 := notify.SetChange{Set: target.IPv6SetName}
+	for _, p := range res.Added {
+		if p.Addr().Is4() {
+			v4.Added = append(v4.Added, p.String())
+		} else {
+			v6.Added = append(v6.Added, p.String())
+		}
+	}
+	for _, p := range res.Removed {
+		if p.Addr().Is4() {
+			v4.Removed = append(v4.Removed, p.String())
+		} else {
+			v6.Removed = append(v6.Removed, p.String())
+		}
+	}
+	return []notify.SetChange{v4, v6}
+}
+
+// notifyResult 在集合变化或更新失败时发送通知，host 为空表示本机。
+// 通知是尽力而为的，失败只记录日志。
+func notifyResult(host string, target nft.Target, res *pipeline.Result, err error) {
+	ns := notifiers()
+	if len(ns) == 0 {
+		return
+	}
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	e := notify.Event{
+		Host:   host,
+		Target: target.Family + "/" + target.TableName,
+		Sets:   []string{target.IPv4SetName, target.IPv6SetName},
+		Err:    err,
+	}
+	if res != nil {
+		e.Added, e.Removed = len(res.Added), len(res.Removed)
+		e.Changes = setChanges(target, res)
+	}
+	if err == nil && (res == nil || !res.Applied || !res.Changed()) {
+		return
+	}
+	sendNotification(ns, e)
+}
+
+// sendNotification 经过限流后通过所有渠道发送事件
+func sendNotification(ns []notify.Notifier, e notify.Event) {
+	if notifyLimiter == nil {
+		path := notifyState
+		if path == "" {
+			path = openState().File(state.NotifyFile)
+		}
+		notifyLimiter = &notify.Limiter{Interval: notifyInterval, Path: path}
+	}
+	if !notifyLimiter.Allow(e.Kind(), time.Now()) {
+		logVerbose("Skipping %s notification, one was sent within the last %s.", e.Kind(), notifyInterval)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	for _, n := range ns {
+		if err := n.Notify(ctx, e); err != nil {
+			log.Printf("WARNING: notification failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+)
+
+// dryRunScript 执行 -dry-run：按内核中的现状生成脚本并输出到标准输出，不清理旧集合也不应用，返回退出码
+func dryRunScript(opts pipeline.Options) int {
+	if opts.Backend != nil {
+		return dryRunBackend(opts)
+	}
+	opts.Confirm = nil
+	// 审阅脚本时通常还没有授予权限，无法读取规则集时按空规则集生成
+	opts.Nft = &nft.Client{Executor: &nft.UnprivilegedExecutor{Executor: opts.Nft.Executor, Warn: func(err error) {
+		log.Printf("WARNING: cannot read the ruleset (%v); rendering against an empty ruleset", err)
+	}}}
+	script, res, err := pipeline.Render(context.Background(), opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	if script == "" {
+		logInfo("Nothing to apply, %s/%s is unchanged.", family, table)
+		return 0
+	}
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	os.Stdout.WriteString(script)
+	logInfo("Dry run: %d IPv4 and %d IPv6 prefixes, nothing was applied.", res.IPv4Count, res.IPv6Count)
+	return 0
+}
+
+// planRuleset 执行 -plan：输出脚本在临时命名空间中执行前后整个表的差异，返回退出码
+func planRuleset(opts pipeline.Options) int {
+	plan, err := pipeline.PlanRuleset(context.Background(), opts)
+	if err != nil {
+		if plan.Payload != "" {
+			fmt.Print(plan.Payload)
+		}
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	if plan.Payload == "" {
+		logInfo("Nothing to apply, %s/%s is unchanged.", family, table)
+		return 0
+	}
+	before, err := tableLines(plan.Before)
+	if err == nil {
+		var after []string
+		after, err = tableLines(plan.After)
+		if err == nil {
+			return printPlan(plan, before, after)
+		}
+	}
+	log.Printf("ERROR: parse nft -j output: %v", err)
+	return exitFailure
+}
+
+// printPlan 输出差异，-diff-exit 时表有变化以 exitDiff 退出
+func printPlan(plan *pipeline.RulesetPlan, before, after []string) int {
+	var diff bytes.Buffer
+	writeUnified(&diff, "before "+family+" "+table, "after "+family+" "+table, diffLines(before, after), 3)
+	if jsonOut {
+		writeJSON(struct {
+			Family string `json:"family"`
+			Table  string `json:"table"`
+			Script string `json:"script"`
+			Diff   string `json:"diff"`
+		}{family, table, plan.Payload, diff.String()})
+	} else {
+		logVerbose("Script passed nft -c:\n%s", plan.Payload)
+		os.Stdout.Write(diff.Bytes())
+	}
+	if diff.Len() == 0 {
+		logInfo("The script leaves %s/%s unchanged.", family, table)
+		return 0
+	}
+	if diffExit {
+		return exitDiff
+	}
+	return 0
+}
+
+// tableLines 把 nft -j list table 的输出格式化为每个对象一段缩进的 JSON，去掉带版本号的 metainfo。
+// 空输出（表不存在）返回 nil
+func tableLines(data []byte) ([]string, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	var doc struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, obj := range doc.Nftables {
+		if _, ok := obj["metainfo"]; ok {
+			continue
+		}
+		out, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.Split(string(out), "\n")...)
+	}
+	return lines, nil
+}
+
+// edit 是行差异中的一行：' ' 不变，'-' 删除，'+' 新增
+type edit struct {
+	op   byte
+	line string
+}
+
+// diffLines 用 Myers 算法计算 a 到 b 的最短编辑序列，只保存每一步用到的对角线，内存与差异大小的平方成正比
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	if n+m == 0 {
+		return nil
+	}
+	limit := n + m
+	v := make([]int, 2*limit+2)
+	off := limit
+	var trace [][]int
+search:
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// 从终点沿保存的对角线回溯
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d] // 第 d 步之前的状态，下标 k+d 对应对角线 k
+		k := x - y
+		var pk int
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := prev[pk+d]
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			edits = append(edits, edit{' ', a[x]})
+		}
+		if x == px {
+			y--
+			edits = append(edits, edit{'+', b[y]})
+		} else {
+			x--
+			edits = append(edits, edit{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, edit{' ', a[x]})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// writeUnified 以 diff -u 的格式输出带 context 行上下文的差异，没有变化时不输出
+func writeUnified(w io.Writer, from, to string, edits []edit, context int) {
+	// 每个编辑之前在 a、b 中的行号
+	pos := make([][2]int, len(edits)+1)
+	for i, e := range edits {
+		pos[i+1] = pos[i]
+		if e.op != '+' {
+			pos[i+1][0]++
+		}
+		if e.op != '-' {
+			pos[i+1][1]++
+		}
+	}
+	header := false
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		// 合并相隔不超过 2*context 行的变化
+		start := max(i-context, 0)
+		end := i
+		for j := i; j < len(edits) && j <= end+2*context; j++ {
+			if edits[j].op != ' ' {
+				end = j
+			}
+		}
+		stop := min(end+context+1, len(edits))
+		if !header {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+			header = true
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(pos[start][0], pos[stop][0]-pos[start][0]), hunkRange(pos[start][1], pos[stop][1]-pos[start][1]))
+		for _, e := range edits[start:stop] {
+			fmt.Fprintf(w, "%c%s\n", e.op, e.line)
+		}
+		i = stop
+	}
+}
+
+// hunkRange 返回 diff -u 中 "起始行,行数" 的写法
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
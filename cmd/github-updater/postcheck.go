@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// postCheckSpec 是 -post-check 的解析结果
+type postCheckSpec struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// parsePostCheck 解析 "url=...,timeout=5s" 形式的 -post-check，空字符串表示不检查。
+// 省略的键使用默认值，"on" 等价于全部使用默认值
+func parsePostCheck(s string) (*postCheckSpec, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec := &postCheckSpec{URL: "https://api.github.com/meta", Timeout: 5 * time.Second}
+	if s == "on" {
+		return spec, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("-post-check: %q is not key=value", kv)
+		}
+		switch key {
+		case "url":
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return nil, fmt.Errorf("-post-check: invalid url %q", value)
+			}
+			spec.URL = value
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("-post-check: invalid timeout %q", value)
+			}
+			spec.Timeout = d
+		default:
+			return nil, fmt.Errorf("-post-check: unknown key %q (want url or timeout)", key)
+		}
+	}
+	return spec, nil
+}
+
+// check 发送一个不带认证的 HEAD 请求。只要收到 HTTP 响应（包括 403 等状态码）就说明
+// 网络仍然可达，只有连接、TLS 或超时错误视为失败
+func (p *postCheckSpec) check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HEAD %s: %w", p.URL, err)
+	}
+	resp.Body.Close()
+	logVerbose("Post-apply check: HEAD %s returned %s.", p.URL, resp.Status)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiling 按 -profile-cpu / -profile-mem 开始记录 pprof 数据，返回的函数结束 CPU 记录并写出堆的快照
+func startProfiling() (func(), error) {
+	var cpu *os.File
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return nil, fmt.Errorf("create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("start CPU profile: %w", err)
+		}
+		cpu = f
+	}
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				log.Printf("WARNING: write CPU profile: %v", err)
+			} else {
+				logVerbose("CPU profile written to %s.", cpuProfile)
+			}
+		}
+		if memProfile != "" {
+			if err := writeHeapProfile(memProfile); err != nil {
+				log.Printf("WARNING: write memory profile: %v", err)
+			} else {
+				logVerbose("Memory profile written to %s.", memProfile)
+			}
+		}
+	}, nil
+}
+
+// writeHeapProfile 写出堆的快照，之前先做一次 GC 使统计反映运行结束时仍在使用的内存
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github-updater/pkg/fetch"
+	"github-updater/pkg/pipeline"
+)
+
+// profileSummaries 在 -profile all 时收集各 profile 的摘要，最后一起以 JSON 输出
+var profileSummaries map[string]pipeline.Summary
+
+// switchProfile 切换日志前缀并重新加载 name 的配置
+func switchProfile(args []string, name string) error {
+	log.SetPrefix("[" + name + "] ")
+	stateStore, notifyLimiter = nil, nil
+	_, err := loadProfile(args, name)
+	return err
+}
+
+// restoreTopLevel 恢复 -profile all 时的顶层配置，供下一轮（例如常驻模式）使用
+func restoreTopLevel(args []string) {
+	log.SetPrefix("")
+	stateStore, notifyLimiter = nil, nil
+	loadProfile(args, profileAll)
+}
+
+// collectSummaries 开始收集各 profile 的摘要，返回的函数结束收集、恢复顶层配置并在 -json 时输出
+func collectSummaries(args []string) func() {
+	wantJSON := jsonOut
+	profileSummaries = make(map[string]pipeline.Summary)
+	return func() {
+		restoreTopLevel(args)
+		if wantJSON && len(profileSummaries) > 0 {
+			writeJSON(struct {
+				Profiles map[string]pipeline.Summary `json:"profiles"`
+			}{profileSummaries})
+		}
+		profileSummaries = nil
+	}
+}
+
+// forProfiles 在已加载配置的基础上执行 run；-profile all 时依次为每个 profile
+// 重新加载配置并执行，日志带上 profile 名称。返回第一个非零退出码
+func forProfiles(args []string, run func() int) int {
+	if profile != profileAll {
+		return run()
+	}
+	defer collectSummaries(args)()
+	code := 0
+	for _, name := range profileNames {
+		c := exitFailure
+		if err := switchProfile(args, name); err != nil {
+			log.Printf("ERROR: %v", err)
+		} else {
+			c = run()
+		}
+		if c != 0 && code == 0 {
+			code = c
+		}
+	}
+	return code
+}
+
+// fetchKey 返回区分 meta 获取的键：除分类外参数都相同的客户端得到同一个键
+func fetchKey(c *fetch.Client) string {
+	k := *c
+	k.Categories, k.Trace = nil, nil
+	return fmt.Sprintf("%+v", k)
+}
+
+// sharedFetches 为 -profile all 的各 profile 准备共用的获取：从同一 meta 地址（或文件）
+// 以相同参数获取的 profile 只请求一次，按它们需要的全部分类获取。使用 -source 的 profile 不共用
+func sharedFetches(args []string) map[string]*pipeline.SharedFetch {
+	shared := make(map[string]*pipeline.SharedFetch)
+	for _, name := range profileNames {
+		if switchProfile(args, name) != nil || len(pipelineSources()) > 0 {
+			continue
+		}
+		key := fetchKey(metaClient())
+		if shared[key] == nil {
+			shared[key] = &pipeline.SharedFetch{}
+		}
+		shared[key].Add(splitList(categories)...)
+	}
+	return shared
+}
+
+// updateProfiles 与 forProfiles 相同，但 -profile all 时先获取所有 profile 的数据，
+// 再把全部集合合并到一个 nft 事务中应用，避免部分 profile 已更新、部分失败的中间状态。
+// 有 profile 获取失败时默认全部不应用，-profile-all-partial 时仍应用其余 profile。
+// 数据来源相同的 profile 共用一次获取，见 sharedFetches
+func updateProfiles(args []string, run func() int) int {
+	if profile != profileAll {
+		return run()
+	}
+	if monitorMode || planMode || separateFams || exportSpecs != "" {
+		return forProfiles(args, run) // 不应用、本来就分开应用或需要与导出并发，无需合并事务
+	}
+	partial := allPartial
+	defer collectSummaries(args)()
+
+	type pending struct {
+		name string
+		opts pipeline.Options
+		plan *pipeline.Plan
+	}
+	var (
+		ctx    = context.Background()
+		shared = sharedFetches(args)
+		plans  []pending
+		code   int
+	)
+	fail := func(c int) {
+		if code == 0 {
+			code = c
+		}
+	}
+	for _, name := range profileNames {
+		if err := switchProfile(args, name); err != nil {
+			log.Printf("ERROR: %v", err)
+			fail(exitFailure)
+			continue
+		}
+		if err := validate(); err != nil {
+			log.Printf("ERROR: %v", err)
+			fail(exitFailure)
+			continue
+		}
+		opts := buildOptions()
+		if len(opts.Sources) == 0 {
+			opts.Shared = shared[fetchKey(opts.Client)]
+		}
+		if c := runPreHook(opts); c != 0 {
+			fail(c)
+			continue
+		}
+		plan, err := pipeline.Prepare(ctx, opts)
+		if err != nil {
+			fail(finish(opts, plan.Result, err))
+			continue
+		}
+		announcePending()
+		plans = append(plans, pending{name, opts, plan})
+	}
+	log.SetPrefix("")
+	if code != 0 && !partial {
+		log.Printf("ERROR: %d of %d profiles failed, not applying the other %d (use -profile-all-partial to apply them anyway)", len(profileNames)-len(plans), len(profileNames), len(plans))
+		return code
+	}
+	if len(plans) == 0 {
+		return code
+	}
+
+	list := make([]*pipeline.Plan, len(plans))
+	for i, p := range plans {
+		list[i] = p.plan
+	}
+	logInfo("Applying %d profiles in one transaction.", len(list))
+	errs := pipeline.ApplyPlans(ctx, confirm, list)
+	for i, p := range plans {
+		if err := switchProfile(args, p.name); err != nil {
+			log.Printf("ERROR: %v", err)
+			fail(exitFailure)
+			continue
+		}
+		res := p.plan.Result
+		if errs[i] == nil && res.Applied && res.Snapshot != nil {
+			saveSnapshot(res.Snapshot)
+		}
+		if errs[i] == nil && res.Applied {
+			clearPending()
+		}
+		if c := finish(p.opts, res, errs[i]); c != 0 {
+			fail(c)
+		}
+	}
+	return code
+}
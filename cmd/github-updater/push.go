@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github-updater/pkg/pipeline"
+)
+
+// runPush 获取并处理网段后把快照推送给 -to 中的每个 agent，本机的 nftables 不变，返回退出码
+func runPush(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" push", flag.ExitOnError)
+	defineFlags(fs)
+	to := fs.String("to", "", "Comma-separated agents: unix:///path or https://host:port.")
+	tokenFile := fs.String("token-file", "", "File containing the shared token sent as 'Authorization: Bearer <token>'.")
+	caFile := fs.String("ca-file", "", "PEM file with the CA certificates that sign the agents' TLS certificates (default: system roots).")
+	timeout := fs.Duration("push-timeout", 2*time.Minute, "Give up on an agent that has not answered within this time, including its nft apply.")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	targets := splitList(*to)
+	if len(targets) == 0 {
+		log.Printf("ERROR: push requires -to")
+		return exitFailure
+	}
+	if profile == profileAll {
+		log.Printf("ERROR: push sends one profile's data at a time; use -profile <name>")
+		return exitFailure
+	}
+	var token string
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Printf("ERROR: read token: %v", err)
+			return exitFailure
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	var roots *x509.CertPool
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Printf("ERROR: read CA file: %v", err)
+			return exitFailure
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			log.Printf("ERROR: no certificates found in %s", *caFile)
+			return exitFailure
+		}
+	}
+
+	ctx := context.Background()
+	_, res, err := pipeline.Fetch(ctx, buildOptions())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitCode(err)
+	}
+	body, err := json.Marshal(res.Snapshot)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	logVerbose("Pushing %d IPv4 and %d IPv6 ranges (%d bytes) to %d agents.", res.IPv4Count, res.IPv6Count, len(body), len(targets))
+
+	failed := 0
+	for _, target := range targets {
+		resp, err := pushSnapshot(ctx, target, token, roots, body, *timeout)
+		if err != nil {
+			log.Printf("ERROR: push to %s: %v", target, err)
+			failed++
+			continue
+		}
+		logInfo("Agent %s: %s (IPv4 %d, IPv6 %d, +%d/-%d).", target, resp.Outcome, resp.IPv4, resp.IPv6, resp.Added, resp.Removed)
+	}
+	if failed > 0 {
+		log.Printf("ERROR: %d of %d agents did not apply the pushed data", failed, len(targets))
+		return exitPush
+	}
+	return 0
+}
+
+// pushSnapshot 把快照 POST 给一个 agent，agent 拒绝或应用失败时返回带原因的错误
+func pushSnapshot(ctx context.Context, target, token string, roots *x509.CertPool, body []byte, timeout time.Duration) (*agentResponse, error) {
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}
+	url := strings.TrimSuffix(target, "/") + agentPath
+	if path, ok := strings.CutPrefix(target, "unix://"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		url = "http://agent" + agentPath
+	} else if !strings.HasPrefix(target, "https://") {
+		return nil, errors.New("want unix:///path or https://host:port")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	var ar agentResponse
+	if json.Unmarshal(data, &ar) != nil {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &ar, fmt.Errorf("%s: %s: %s", resp.Status, ar.Outcome, ar.Error)
+	}
+	return &ar, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"time"
+
+	"github-updater/pkg/pipeline"
+)
+
+// runReapply 不访问网络，把状态目录中最近一次应用的数据重新应用，返回退出码
+func runReapply(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	auditAction = "reapply"
+	return forProfiles(args, reapply)
+}
+
+// reapply 重新应用当前 profile 缓存的数据
+func reapply() int {
+	if err := validate(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	snap, err := loadSnapshot()
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("ERROR: no cached data in %s; run a normal update first", profileStateDir())
+		return exitFailure
+	}
+	if err != nil {
+		log.Printf("ERROR: read cached data: %v", err)
+		return exitFailure
+	}
+	age := snap.Age(time.Now()).Round(time.Second)
+	if reapplyAge > 0 && age > reapplyAge {
+		if !force {
+			log.Printf("ERROR: cached data is %s old (fetched %s), older than -reapply-max-age %s; use -force to apply it anyway", age, snap.FetchedAt.Local().Format(time.RFC3339), reapplyAge)
+			return exitFailure
+		}
+		log.Printf("WARNING: cached data is %s old, applying anyway because of -force", age)
+	}
+	logInfo("Reapplying cached data from %s, fetched %s (%s ago); the network is not used.", snap.Source, snap.FetchedAt.Local().Format(time.RFC3339), age)
+
+	if err := preflight(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	opts := buildOptions()
+	if code := runPreHook(opts); code != 0 {
+		return code
+	}
+	res, err := pipeline.ApplySnapshot(context.Background(), opts, snap)
+	return finish(opts, res, err)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+)
+
+// desired 是配置中使用同一管理标记的全部集合和链
+type desired struct {
+	sets   map[nft.SetRef]bool
+	chains map[string]bool // "family table chain"
+}
+
+// desiredObjects 按管理标记收集配置期望存在的集合和链。配置定义了 profile 时收集所有 profile，
+// 避免删除其他 profile 管理的对象；结束后恢复当前的配置
+func desiredObjects(args []string) (map[string]*desired, error) {
+	want := make(map[string]*desired)
+	add := func(opts pipeline.Options) {
+		t := opts.Target
+		d := want[t.ManagedMarker()]
+		if d == nil {
+			d = &desired{sets: make(map[nft.SetRef]bool), chains: make(map[string]bool)}
+			want[t.ManagedMarker()] = d
+		}
+		for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+			d.sets[nft.SetRef{Family: t.Family, Table: t.TableName, Name: name}] = true
+		}
+		for _, ch := range opts.Chains {
+			d.chains[t.Family+" "+t.TableName+" "+ch.Name] = true
+		}
+	}
+	if len(profileNames) == 0 {
+		add(buildOptions())
+		return want, nil
+	}
+	current := profile
+	defer func() {
+		if current == profileAll {
+			restoreTopLevel(args)
+		} else {
+			switchProfile(args, current)
+			log.SetPrefix("")
+		}
+	}()
+	for _, name := range slices.Clone(profileNames) {
+		if err := switchProfile(args, name); err != nil {
+			return nil, err
+		}
+		add(buildOptions())
+	}
+	return want, nil
+}
+
+// reconcile 删除带有管理标记、但配置已不再需要的规则和集合（例如改名或删除的集合、移除的链中的规则），返回退出码
+func reconcile(args []string) int {
+	want, err := desiredObjects(args)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	ctx := context.Background()
+	nftc := localNft()
+
+	var (
+		b     strings.Builder
+		stale []string
+	)
+	for _, marker := range slices.Sorted(maps.Keys(want)) {
+		d := want[marker]
+		m, err := nftc.ListManaged(ctx, marker)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		// 先删除规则，引用集合的规则存在时集合无法删除
+		for _, r := range m.Rules {
+			chain := r.Family + " " + r.Table + " " + r.Chain
+			if d.chains[chain] && d.sets[nft.SetRef{Family: r.Family, Table: r.Table, Name: r.Set}] {
+				continue
+			}
+			fmt.Fprintf(&b, "delete rule %s handle %d\n", chain, r.Handle)
+			stale = append(stale, fmt.Sprintf("rule in chain %s referencing @%s (handle %d)", chain, r.Set, r.Handle))
+		}
+		for _, s := range m.Sets {
+			if d.sets[s.SetRef] {
+				continue
+			}
+			if chains := m.Unmanaged[s.SetRef]; len(chains) > 0 {
+				log.Printf("WARNING: keeping %s %s marked %s: still referenced by rules without the marker in chains %s", s.Keyword(), s.SetRef, marker, strings.Join(chains, ", "))
+				continue
+			}
+			fmt.Fprintf(&b, "delete %s %s\n", s.Keyword(), s.SetRef)
+			stale = append(stale, s.Keyword()+" "+s.SetRef.String())
+		}
+	}
+	if len(stale) == 0 {
+		logInfo("Reconcile: no leftover managed objects.")
+		return 0
+	}
+	for _, s := range stale {
+		logInfo("Reconcile: %s is managed by this tool but no longer configured.", s)
+	}
+
+	ok, err := ask(fmt.Sprintf("Delete %d leftover managed objects?", len(stale)), b.String())
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if !ok {
+		logInfo("Aborted, leftover objects kept.")
+		return 0
+	}
+	if err := nftc.Apply(ctx, b.String()); err != nil {
+		appendAudit(auditEntry{Action: "reconcile", Outcome: "failed", Error: err.Error()})
+		log.Printf("ERROR: %v", err)
+		return exitApply
+	}
+	appendAudit(auditEntry{Action: "reconcile", Outcome: "reconciled", Removed: len(stale)})
+	logInfo("Reconcile: deleted %d leftover managed objects.", len(stale))
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify 向 systemd 的 NOTIFY_SOCKET 发送状态（见 sd_notify(3)），
+// 不是由 systemd 以 Type=notify 启动时什么也不做
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // 抽象命名空间
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		logVerbose("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logVerbose("sd_notify: %v", err)
+	}
+}
+
+// watchdogInterval 返回 systemd 要求的看门狗间隔，未启用或不是发给本进程时返回 0
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog 在两次更新之间按看门狗间隔的一半发送 WATCHDOG=1。
+// 一次更新持续超过看门狗间隔时停止发送，由 systemd 判定卡死并重启服务
+type watchdog struct {
+	interval time.Duration
+	busy     atomic.Int64 // 正在进行的更新的开始时间（UnixNano），空闲时为 0
+}
+
+func (w *watchdog) run(ctx context.Context) {
+	t := time.NewTicker(w.interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if start := w.busy.Load(); start == 0 || time.Since(time.Unix(0, start)) < w.interval {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}
+}
+
+func (w *watchdog) begin() { w.busy.Store(time.Now().UnixNano()) }
+
+func (w *watchdog) end() { w.busy.Store(0) }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github-updater/pkg/nft"
+)
+
+// runShow 显示受管理集合的定义、元素数和 comment
+func runShow(args []string) int {
+	if _, err := loadSettings(flag.CommandLine, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args, show)
+}
+
+// show 显示当前 profile 的集合
+func show() int {
+	t := buildOptions().Target
+	nftc := localNft()
+	code := 0
+	for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+		set, err := nftc.ListSet(context.Background(), t.Family, t.TableName, name)
+		if errors.Is(err, nft.ErrNotFound) {
+			fmt.Printf("%s %s %s: missing\n", t.Family, t.TableName, name)
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			code = exitFailure
+			continue
+		}
+		fmt.Printf("%s %s %s: type %s, %d elements\n", t.Family, t.TableName, name, set.Type, len(set.Elements))
+		if set.Comment != "" {
+			fmt.Printf("  comment: %s\n", set.Comment)
+		}
+	}
+	return code
+}
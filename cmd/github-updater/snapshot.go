@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// runSnapshot 把受管理集合的实际内容保存为与状态目录快照相同格式的文件，返回退出码
+func runSnapshot(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" snapshot", flag.ExitOnError)
+	defineFlags(fs)
+	out := fs.String("o", "", "Write the snapshot to this file, or - for stdout.")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if *out == "" {
+		log.Printf("ERROR: snapshot requires -o")
+		return exitFailure
+	}
+	if profile == profileAll {
+		log.Printf("ERROR: snapshot saves one profile at a time; use -profile <name>")
+		return exitFailure
+	}
+
+	t := buildOptions().Target
+	snap, err := pipeline.TakeSnapshot(context.Background(), localNft(), t)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	data = append(data, '\n')
+	if *out == "-" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := state.WriteFile(*out, data, 0o640); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	logInfo("Saved %d prefixes in %s and %d in %s to %s.", len(snap.Sets[t.IPv4SetName]), t.IPv4SetName, len(snap.Sets[t.IPv6SetName]), t.IPv6SetName, *out)
+	return 0
+}
+
+// runRestore 在一个事务中把集合恢复为 snapshot 保存的内容，不访问网络，返回退出码
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" restore", flag.ExitOnError)
+	defineFlags(fs)
+	in := fs.String("i", "", "Read the snapshot written by 'snapshot -o' from this file.")
+	if _, err := loadSettings(fs, args); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if *in == "" {
+		log.Printf("ERROR: restore requires -i")
+		return exitFailure
+	}
+	if profile == profileAll {
+		log.Printf("ERROR: restore applies one profile at a time; use -profile <name>")
+		return exitFailure
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	var snap pipeline.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		log.Printf("ERROR: %s: %v", *in, err)
+		return exitFailure
+	}
+
+	if err := preflight(); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	t := buildOptions().Target
+	sets, err := snap.SetElements(t)
+	if err != nil {
+		log.Printf("ERROR: %s: %v", *in, err)
+		return exitFailure
+	}
+	total := 0
+	var names []string
+	for _, s := range sets {
+		total += len(s.Elements)
+		names = append(names, s.Name)
+	}
+	ok, err := ask(fmt.Sprintf("Replace the contents of %s in %s/%s with %d prefixes saved at %s?",
+		strings.Join(names, " and "), t.Family, t.TableName, total, snap.FetchedAt.Local().Format(time.RFC3339)), "")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if !ok {
+		logInfo("Aborted, sets left unchanged.")
+		return 0
+	}
+	if err := pipeline.RestoreSnapshot(context.Background(), localNft(), t, &snap); err != nil {
+		appendAudit(auditEntry{Action: "restore", Outcome: "failed", Sets: names, Error: err.Error()})
+		log.Printf("ERROR: %v", err)
+		return exitApply
+	}
+	appendAudit(auditEntry{Action: "restore", Outcome: "restored", Sets: names, Added: total})
+	logInfo("Restored %d prefixes from %s.", total, *in)
+	return 0
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github-updater/pkg/fetch"
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// sourceDef 是配置文件 sources 中的一项：一个数据来源以及接收它的 profile（目标）
+type sourceDef struct {
+	Name       string
+	URL        string   // meta 文档地址，为空时使用 -url
+	MetaFile   string   // 从本地文件读取 meta 文档
+	Categories []string // meta 分类，为空时使用默认分类
+	CIDRFile   string   // 每行一个 CIDR 的文件，与 meta 来源二选一
+	Hostnames  []string // 解析这些主机名的 A/AAAA 记录，与其他来源三选一
+	Family     string   // 可选，来源适用的 nft 地址族
+	Targets    []string // 接收该来源的 profile
+	Exporters  []string // 获取成功后另外写出该来源网段的文件
+	Verdict    string   // -verdict-map 中该来源网段的动作，为空时使用 -verdict-map 的值
+}
+
+// sourceDefs 是配置文件中定义的来源，按文件中的顺序
+var sourceDefs []sourceDef
+
+// parseSources 解析 sources 映射，未知的键和取值错误全部返回
+func parseSources(path string, node *yaml.Node) ([]sourceDef, []error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, []error{fmt.Errorf("%s:%d: sources must be a mapping of source names", path, node.Line)}
+	}
+	var (
+		defs []sourceDef
+		errs []error
+	)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, body := node.Content[i], node.Content[i+1]
+		if body.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("%s:%d: invalid source %q", path, name.Line, name.Value))
+			continue
+		}
+		def := sourceDef{Name: name.Value}
+		for j := 0; j+1 < len(body.Content); j += 2 {
+			key, value := body.Content[j], body.Content[j+1]
+			values, err := scalarValues(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: source %s: %s: %v", path, value.Line, def.Name, key.Value, err))
+				continue
+			}
+			var list []string
+			for _, v := range values {
+				list = append(list, splitList(v)...)
+			}
+			switch key.Value {
+			case "url":
+				def.URL = value.Value
+			case "meta-file":
+				def.MetaFile = value.Value
+			case "cidr-file":
+				def.CIDRFile = value.Value
+			case "family":
+				def.Family = value.Value
+			case "hostnames":
+				def.Hostnames = list
+			case "categories":
+				def.Categories = list
+			case "targets":
+				def.Targets = list
+			case "exporters":
+				def.Exporters = list
+			case "verdict":
+				def.Verdict = value.Value
+			default:
+				errs = append(errs, fmt.Errorf("%s:%d: source %s: unknown key %q", path, key.Line, def.Name, key.Value))
+			}
+		}
+		if def.CIDRFile != "" && (def.URL != "" || def.MetaFile != "" || len(def.Categories) > 0) {
+			errs = append(errs, fmt.Errorf("%s:%d: source %s: cidr-file cannot be combined with url, meta-file or categories", path, name.Line, def.Name))
+		}
+		if len(def.Hostnames) > 0 && (def.CIDRFile != "" || def.URL != "" || def.MetaFile != "" || len(def.Categories) > 0) {
+			errs = append(errs, fmt.Errorf("%s:%d: source %s: hostnames cannot be combined with cidr-file, url, meta-file or categories", path, name.Line, def.Name))
+		}
+		for _, h := range def.Hostnames {
+			if !validHostname(h) {
+				errs = append(errs, fmt.Errorf("%s:%d: source %s: invalid hostname %q", path, name.Line, def.Name, h))
+			}
+		}
+		for _, c := range def.Categories {
+			if !fetch.ValidCategory(c) {
+				errs = append(errs, fmt.Errorf("%s:%d: source %s: unknown category %q", path, name.Line, def.Name, c))
+			}
+		}
+		if def.Family != "" && def.Family != "ip" && def.Family != "ip6" && def.Family != "inet" {
+			errs = append(errs, fmt.Errorf("%s:%d: source %s: invalid family %q (want ip, ip6 or inet)", path, name.Line, def.Name, def.Family))
+		}
+		if def.Verdict != "" {
+			if err := nft.ValidVerdict(def.Verdict); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: source %s: %w", path, name.Line, def.Name, err))
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs, errs
+}
+
+// checkRouting 检查来源与 profile 之间的路由：目标必须存在，每个 profile 至少接收一个来源，
+// 同一目标的来源声明的地址族不能互相冲突
+func checkRouting(path string, defs []sourceDef, profiles []string) []error {
+	var errs []error
+	known := make(map[string]bool, len(profiles))
+	for _, p := range profiles {
+		known[p] = true
+	}
+	type claim struct{ source, family string }
+	families := make(map[string]claim)
+	received := make(map[string]bool)
+	for _, def := range defs {
+		switch {
+		case len(profiles) == 0 && len(def.Targets) > 0:
+			errs = append(errs, fmt.Errorf("%s: source %s lists targets but the file defines no profiles", path, def.Name))
+		case len(profiles) > 0 && len(def.Targets) == 0:
+			errs = append(errs, fmt.Errorf("%s: source %s has no targets (profiles: %s)", path, def.Name, strings.Join(profiles, ", ")))
+		}
+		for _, t := range def.Targets {
+			if !known[t] {
+				errs = append(errs, fmt.Errorf("%s: source %s targets unknown profile %q", path, def.Name, t))
+				continue
+			}
+			received[t] = true
+			if def.Family == "" {
+				continue
+			}
+			if c, ok := families[t]; ok && c.family != def.Family {
+				errs = append(errs, fmt.Errorf("%s: target %s receives sources %s (family %s) and %s (family %s) with conflicting families",
+					path, t, c.source, c.family, def.Name, def.Family))
+				continue
+			}
+			families[t] = claim{def.Name, def.Family}
+		}
+	}
+	if len(defs) > 0 {
+		for _, p := range profiles {
+			if !received[p] {
+				errs = append(errs, fmt.Errorf("%s: profile %s receives no source", path, p))
+			}
+		}
+	}
+	return errs
+}
+
+// routedSources 返回路由到当前 profile 的来源，没有 profile 时为全部来源
+func routedSources() []sourceDef {
+	if profile == "" || profile == profileAll {
+		return sourceDefs
+	}
+	var defs []sourceDef
+	for _, def := range sourceDefs {
+		for _, t := range def.Targets {
+			if t == profile {
+				defs = append(defs, def)
+				break
+			}
+		}
+	}
+	return defs
+}
+
+// validateSources 静态检查路由到当前 profile 的来源
+func validateSources() []error {
+	var errs []error
+	for _, def := range routedSources() {
+		if def.Family != "" && def.Family != family {
+			errs = append(errs, fmt.Errorf("source %s is for family %s but the target uses -family %s", def.Name, def.Family, family))
+		}
+		if def.CIDRFile != "" {
+			if _, err := fetch.ReadCIDRFile(def.CIDRFile); err != nil {
+				errs = append(errs, fmt.Errorf("source %s: %w", def.Name, err))
+			}
+		}
+		if def.Verdict != "" && verdictMap == "" {
+			errs = append(errs, fmt.Errorf("source %s sets a verdict but the target does not use -verdict-map", def.Name))
+		}
+	}
+	return errs
+}
+
+// pipelineSources 把路由到当前 profile 的来源转换为流程选项
+func pipelineSources() []pipeline.Source {
+	var sources []pipeline.Source
+	for _, def := range routedSources() {
+		src := pipeline.Source{Name: def.Name, File: def.CIDRFile, Verdict: def.Verdict}
+		switch {
+		case len(def.Hostnames) > 0:
+			src.Hosts = def.Hostnames
+			src.Resolver = &fetch.Resolver{Server: dnsResolver}
+			src.Resolved = hosts.record
+		case def.CIDRFile == "":
+			src.Client = &fetch.Client{URL: def.URL, File: def.MetaFile, Categories: def.Categories, MaxAge: staleMaxAge}
+			if src.Client.URL == "" {
+				src.Client.URL = metaURL
+			}
+			setRedirects(src.Client)
+			if trace {
+				src.Client.Trace = log.Printf
+			}
+		}
+		if len(def.Exporters) > 0 {
+			src.Export = exportSource(def)
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// exportSource 把来源的网段（每行一个 CIDR）原子地写到每个 exporter 文件，失败只警告
+func exportSource(def sourceDef) func([]netip.Prefix) {
+	return func(prefixes []netip.Prefix) {
+		var b strings.Builder
+		for _, p := range prefixes {
+			b.WriteString(p.String() + "\n")
+		}
+		for _, path := range def.Exporters {
+			if err := state.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+				log.Printf("WARNING: source %s: could not export to %s: %v", def.Name, path, err)
+			}
+		}
+	}
+}
+
+// logRouting 在 -v 时输出解析后的 来源 → 目标 路由，便于在应用前发现配置错误
+func logRouting() {
+	if !verbose || len(sourceDefs) == 0 {
+		return
+	}
+	lines := []string{"Source routing:"}
+	for _, def := range sourceDefs {
+		from := def.CIDRFile
+		if len(def.Hostnames) > 0 {
+			from = "dns " + strings.Join(def.Hostnames, ",")
+		}
+		if from == "" {
+			from = def.MetaFile
+		}
+		if from == "" {
+			from = def.URL
+		}
+		if from == "" {
+			from = metaURL
+		}
+		line := fmt.Sprintf("  %s (%s", def.Name, from)
+		if len(def.Categories) > 0 {
+			line += " " + strings.Join(def.Categories, ",")
+		}
+		if def.Family != "" {
+			line += ", family " + def.Family
+		}
+		if def.Verdict != "" {
+			line += ", verdict " + def.Verdict
+		}
+		targets := "(this config)"
+		if len(def.Targets) > 0 {
+			targets = strings.Join(def.Targets, ", ")
+		}
+		line += ") -> " + targets
+		if len(def.Exporters) > 0 {
+			line += "; exports " + strings.Join(def.Exporters, ", ")
+		}
+		lines = append(lines, line)
+	}
+	log.Print(strings.Join(lines, "\n"))
+}
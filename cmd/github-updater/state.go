@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+var stateStore *state.Dir
+
+// profileStateDir 返回当前 profile 的状态目录，各 profile 的状态互不影响
+func profileStateDir() string {
+	if profile == "" {
+		return stateDir
+	}
+	return filepath.Join(stateDir, "profiles", profile)
+}
+
+// openState 在首次使用时打开状态目录，不可写时只警告一次并降级
+func openState() *state.Dir {
+	if stateStore == nil {
+		d, err := state.Open(profileStateDir())
+		if err != nil {
+			log.Printf("WARNING: %v; notification rate limiting and the last-run record will not be persisted", err)
+		}
+		stateStore = d
+	}
+	return stateStore
+}
+
+// lastRun 是写入 last-run.json 的内容
+type lastRun struct {
+	pipeline.Summary
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// saveLastRun 记录最近一次运行的摘要，失败不影响本次运行
+func saveLastRun(s pipeline.Summary) {
+	data, err := json.MarshalIndent(lastRun{Summary: s, FinishedAt: time.Now().UTC()}, "", "  ")
+	if err == nil {
+		err = openState().WriteFile(state.LastRunFile, data)
+	}
+	if err != nil {
+		logVerbose("Not recording last run: %v", err)
+	}
+}
+
+// runStatus 是状态文件的内容，供外部监控使用，字段见 README
+type runStatus struct {
+	Success bool           `json:"success"`
+	Time    time.Time      `json:"time"`
+	Applied bool           `json:"applied"`
+	Target  string         `json:"target"`
+	Sets    map[string]int `json:"sets"`           // 每个集合的期望网段数
+	Hash    string         `json:"hash,omitempty"` // 期望网段的哈希
+	Changed *bool          `json:"changed"`        // 未跟踪变化时为 null
+	Added   int            `json:"added"`
+	Removed int            `json:"removed"`
+	Error   string         `json:"error,omitempty"`
+
+	BytesReceived int64 `json:"bytes_received"`       // 本次从网络读取的响应体字节数
+	BytesTotal    int64 `json:"bytes_received_total"` // 累计值，跨运行和重启保留
+
+	Fingerprint string `json:"fingerprint,omitempty"` // 运行结束时集合实际内容的指纹，见 nft.Fingerprint
+}
+
+// statusPath 返回状态文件的路径
+func statusPath() string {
+	if statusFile != "" {
+		return statusFile
+	}
+	return openState().File(state.StatusFile)
+}
+
+// bytesTotal 返回包括本次在内累计从网络读取的字节数，之前的累计值取自上一次的状态文件
+func bytesTotal(res *pipeline.Result) int64 {
+	var prev runStatus
+	if data, err := os.ReadFile(statusPath()); err == nil {
+		json.Unmarshal(data, &prev)
+	}
+	if res == nil {
+		return prev.BytesTotal
+	}
+	return prev.BytesTotal + res.FetchedBytes
+}
+
+// writeStatus 在每次运行（包括失败）后原子地覆盖状态文件，失败只警告
+func writeStatus(opts pipeline.Options, res *pipeline.Result, runErr error, total int64, fingerprint string) {
+	t := opts.Target
+	st := runStatus{
+		Success:    runErr == nil,
+		Time:       time.Now().UTC(),
+		Target:     t.Family + "/" + t.TableName,
+		Sets:       map[string]int{t.IPv4SetName: 0, t.IPv6SetName: 0},
+		BytesTotal: total,
+
+		Fingerprint: fingerprint,
+	}
+	if res != nil {
+		s := res.Summary(opts.TrackChanges, runErr)
+		st.Applied, st.Changed, st.Added, st.Removed, st.Hash = s.Applied, s.Changed, s.Added, s.Removed, s.Hash
+		st.Sets[t.IPv4SetName], st.Sets[t.IPv6SetName] = res.IPv4Count, res.IPv6Count
+		st.BytesReceived = res.FetchedBytes
+	}
+	if runErr != nil {
+		st.Error = runErr.Error()
+	}
+	path := statusPath()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err == nil {
+		err = state.WriteFile(path, data, 0o644)
+	}
+	if err != nil {
+		log.Printf("WARNING: could not write status file: %v", err)
+	}
+}
+
+// saveHash 记录最近一次成功应用的期望网段哈希
+func saveHash(hash string) {
+	if err := openState().WriteFile(state.HashFile, []byte(hash+"\n")); err != nil {
+		logVerbose("Not recording desired-set hash: %v", err)
+	}
+}
+
+// loadHash 读取最近一次成功应用的期望网段哈希，没有时返回空字符串
+func loadHash() string {
+	data, err := os.ReadFile(filepath.Join(profileStateDir(), state.HashFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// previousHash 在 -hash-extras=false 或 -out 时返回用于判断变化的上次哈希，
+// -out 无法读取集合现有内容，只能与上次写出的数据比较
+func previousHash() string {
+	if hashExtras && outPath == "" {
+		return ""
+	}
+	return loadHash()
+}
+
+// appliedSinceStart 记录本进程中已经成功应用过的 profile（按状态目录区分）
+var appliedSinceStart = make(map[string]bool)
+
+// skipHash 在 -skip-unchanged 时返回上次应用的哈希，数据相同的运行将被跳过。
+// -daemon 启动后每个 profile 第一次运行总是应用；集合的实际内容与上次应用后记录的指纹不同时
+// （例如重启或 nft flush ruleset 之后）也应用。连续跳过 -full-resync-every 次后同样强制应用一次
+func skipHash(opts pipeline.Options) string {
+	if !skipUnchanged {
+		return ""
+	}
+	if daemon && !appliedSinceStart[profileStateDir()] {
+		return ""
+	}
+	hash := loadHash()
+	if hash == "" {
+		return ""
+	}
+	if fullResync > 0 && loadSkips() >= fullResync {
+		return ""
+	}
+	if !liveSetsMatch(opts) {
+		return ""
+	}
+	return hash
+}
+
+// liveSetsMatch 比较集合的实际内容与上次应用后记录的指纹。-out、-remote 和其他后端的目标
+// 不是本机的集合，无法读取，只比较哈希
+func liveSetsMatch(opts pipeline.Options) bool {
+	if outPath != "" || remoteHosts != "" || opts.Backend != nil {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(profileStateDir(), state.FingerprintFile))
+	if err != nil {
+		return false
+	}
+	fp, err := liveFingerprint(context.Background(), opts)
+	if err != nil {
+		logVerbose("Cannot read the live sets, applying: %v", err)
+		return false
+	}
+	if want := strings.TrimSpace(string(data)); fp != want {
+		logInfo("Live sets differ from the last apply (fingerprint %.12s, recorded %.12s), applying.", fp, want)
+		return false
+	}
+	return true
+}
+
+// saveFingerprint 记录成功应用后集合实际内容的指纹
+func saveFingerprint(fp string) {
+	if err := openState().WriteFile(state.FingerprintFile, []byte(fp+"\n")); err != nil {
+		logVerbose("Not recording the applied fingerprint: %v", err)
+	}
+}
+
+// loadMetaDate 读取见过的最新 meta 响应的 Date，没有时返回零值
+func loadMetaDate() time.Time {
+	data, err := os.ReadFile(filepath.Join(profileStateDir(), state.MetaDateFile))
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	return t
+}
+
+// saveMetaDate 在 date 比已记录的更新时记录它，之后更早的响应视为过期
+func saveMetaDate(date time.Time) {
+	if date.IsZero() || !date.After(loadMetaDate()) {
+		return
+	}
+	if err := openState().WriteFile(state.MetaDateFile, []byte(date.UTC().Format(time.RFC3339)+"\n")); err != nil {
+		logVerbose("Not recording the meta response date: %v", err)
+	}
+}
+
+// loadSkips 读取上次应用后跳过的次数
+func loadSkips() int {
+	data, err := os.ReadFile(filepath.Join(profileStateDir(), state.SkipsFile))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
+
+// recordSkip 在跳过时递增计数，应用后清零
+func recordSkip(skipped bool) {
+	var err error
+	n := 0
+	if prev := loadSkips(); !skipped && fullResync > 0 && prev >= fullResync {
+		logInfo("Forced a full resync after %d skipped runs.", prev)
+	}
+	if skipped {
+		n = loadSkips() + 1
+		err = openState().WriteFile(state.SkipsFile, []byte(strconv.Itoa(n)+"\n"))
+	} else if err = os.Remove(openState().File(state.SkipsFile)); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		logVerbose("Not recording skipped runs: %v", err)
+	}
+	if !skipped {
+		return
+	}
+	switch {
+	case fullResync > 0 && n >= fullResync:
+		logInfo("Desired sets unchanged since the last apply, skipped (the next run is a full resync).")
+	case fullResync > 0:
+		logInfo("Desired sets unchanged since the last apply, skipped (full resync after %d more skipped runs).", fullResync-n)
+	default:
+		logInfo("Desired sets unchanged since the last apply, skipped.")
+	}
+}
+
+// saveSnapshot 保存本次应用的数据，供 reapply 在没有网络时使用
+func saveSnapshot(snap *pipeline.Snapshot) {
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = openState().WriteFile(state.SnapshotFile, data)
+	}
+	if err != nil {
+		logVerbose("Not saving snapshot for reapply: %v", err)
+	}
+}
+
+// loadSnapshot 读取最近一次应用的数据
+func loadSnapshot() (*pipeline.Snapshot, error) {
+	data, err := os.ReadFile(openState().File(state.SnapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	var snap pipeline.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", state.SnapshotFile, err)
+	}
+	return &snap, nil
+}
+
+// auditEntry 是审计日志中的一条记录
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Sets       []string  `json:"sets"`
+	Changed    *bool     `json:"changed,omitempty"` // 未跟踪变化时为空
+	Added      int       `json:"added,omitempty"`
+	Removed    int       `json:"removed"`
+	Pruned     int       `json:"pruned,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+
+	Host       string   `json:"host,omitempty"`
+	User       string   `json:"user,omitempty"`
+	UID        int      `json:"uid"`
+	Categories []string `json:"categories,omitempty"`
+	IPv4       int      `json:"ipv4,omitempty"`
+	IPv6       int      `json:"ipv6,omitempty"`
+	Backend    string   `json:"backend,omitempty"`
+	ConfigHash string   `json:"config_hash,omitempty"` // 生效配置（不含敏感参数）的哈希，用于关联配置变更
+
+	OnFetchFailure string `json:"on_fetch_failure,omitempty"` // 获取失败时生效的 -on-fetch-failure 策略
+}
+
+// auditAction 是 finish 写入审计日志时使用的动作名
+var auditAction = "update"
+
+// auditRun 把一次更新的结果写入审计日志
+func auditRun(opts pipeline.Options, s pipeline.Summary, err error) {
+	e := auditEntry{
+		Action:     auditAction,
+		Outcome:    "aborted",
+		Changed:    s.Changed,
+		Added:      s.Added,
+		Removed:    s.Removed,
+		Pruned:     s.Pruned,
+		DurationMS: s.DurationMS,
+		Categories: s.Categories,
+		IPv4:       s.IPv4,
+		IPv6:       s.IPv6,
+	}
+	if len(s.Backends) > 0 {
+		e.Backend = s.Backends[0]
+	}
+	var fetchErr *pipeline.FetchError
+	if errors.As(err, &fetchErr) {
+		e.OnFetchFailure = onFetchFailure
+	}
+	switch {
+	case s.Flushed:
+		e.Outcome, e.Error = "flushed", err.Error()
+	case err != nil:
+		e.Outcome, e.Error = "failed", err.Error()
+	case s.Skipped:
+		e.Outcome = "skipped"
+	case s.Kept:
+		e.Outcome = "kept"
+	case s.Applied && s.Changed != nil && !*s.Changed:
+		e.Outcome = "unchanged"
+	case s.Applied:
+		e.Outcome = "applied"
+	}
+	if s.Applied || s.Flushed {
+		e.Sets = []string{opts.Target.IPv4SetName, opts.Target.IPv6SetName}
+	}
+	appendAudit(e)
+}
+
+// appendAudit 追加一条审计记录，指定了 -audit-log 时同时追加到该文件，失败时只警告
+func appendAudit(e auditEntry) {
+	e.Time = time.Now().UTC()
+	e.Host, _ = os.Hostname()
+	e.UID = os.Getuid()
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	e.ConfigHash = configHash()
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = openState().AppendLine(state.AuditFile, data)
+	}
+	if err != nil {
+		log.Printf("WARNING: could not write audit log: %v", err)
+	}
+	if auditLog != "" && data != nil {
+		if err := state.AppendLine(auditLog, data); err != nil {
+			log.Printf("WARNING: could not write audit log %s: %v", auditLog, err)
+		}
+	}
+}
+
+// configHash 返回生效参数（不含敏感参数和只影响本次调用的参数）的 sha256 前 12 位
+func configHash() string {
+	h := sha256.New()
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] || fileIgnoredFlags[f.Name] {
+			return
+		}
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value)
+	})
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// runState 处理 state 子命令
+func runState(args []string) int {
+	if len(args) == 0 || args[0] != "clear" {
+		fmt.Fprintln(os.Stderr, "usage: github-updater state clear [-state-dir dir]")
+		return exitFailure
+	}
+	if _, err := loadSettings(flag.CommandLine, args[1:]); err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return forProfiles(args[1:], clearState)
+}
+
+// clearState 清理当前 profile 的状态目录
+func clearState() int {
+	removed, err := state.Clear(profileStateDir())
+	for _, name := range removed {
+		fmt.Printf("removed %s\n", name)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/nft"
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+func TestSkipHash(t *testing.T) {
+	defer func(skip, d bool, full int, dir, p string) {
+		skipUnchanged, daemon, fullResync, stateDir, profile = skip, d, full, dir, p
+		stateStore = nil
+		clear(appliedSinceStart)
+	}(skipUnchanged, daemon, fullResync, stateDir, profile)
+
+	const v4 = `{"nftables": [{"set": {"family": "inet", "table": "filter", "name": "gh4", "type": "ipv4_addr", "flags": ["interval"], "elem": [{"prefix": {"addr": "192.30.252.0", "len": 22}}]}}]}`
+	// live 为 nil 时集合不存在，例如重启或 nft flush ruleset 之后
+	optsFor := func(live map[string]string) pipeline.Options {
+		rec := &nft.Recorder{Respond: func(args []string, stdin string) ([]byte, error) {
+			if out, ok := live[args[len(args)-1]]; ok && args[2] == "set" {
+				return []byte(out), nil
+			}
+			return []byte("Error: No such file or directory\n"), errors.New("exit status 1")
+		}}
+		return pipeline.Options{
+			Nft:    &nft.Client{Executor: rec},
+			Target: nft.Target{Family: "inet", TableName: "filter", IPv4SetName: "gh4", IPv6SetName: "gh6"},
+		}
+	}
+	applied := optsFor(map[string]string{"gh4": v4})
+	fp, err := liveFingerprint(context.Background(), applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		daemon      bool
+		appliedOnce bool // 本进程中已经应用过
+		fingerprint string
+		skips       int
+		fullResync  int
+		opts        pipeline.Options
+		want        bool
+	}{
+		{name: "daemon first cycle", daemon: true, fingerprint: fp, opts: applied},
+		{name: "daemon later cycle", daemon: true, appliedOnce: true, fingerprint: fp, opts: applied, want: true},
+		{name: "timer run", fingerprint: fp, opts: applied, want: true},
+		{name: "sets flushed", daemon: true, appliedOnce: true, fingerprint: fp, opts: optsFor(nil)},
+		{name: "sets changed by hand", fingerprint: fp, opts: optsFor(map[string]string{"gh4": strings.Replace(v4, `"len": 22`, `"len": 23`, 1)})},
+		{name: "no recorded fingerprint", opts: applied},
+		{name: "full resync due", fingerprint: fp, skips: 3, fullResync: 3, opts: applied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateDir, profile, stateStore = t.TempDir(), "", nil
+			skipUnchanged, daemon, fullResync = true, tt.daemon, tt.fullResync
+			clear(appliedSinceStart)
+			if tt.appliedOnce {
+				appliedSinceStart[stateDir] = true
+			}
+			saveHash("abc")
+			if tt.fingerprint != "" {
+				saveFingerprint(tt.fingerprint)
+			}
+			if tt.skips > 0 {
+				if err := os.WriteFile(filepath.Join(stateDir, state.SkipsFile), []byte(strconv.Itoa(tt.skips)+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := skipHash(tt.opts); (got == "abc") != tt.want {
+				t.Errorf("skipHash = %q, want skip %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// unitName 是生成的 systemd 单元的名称（不含后缀）
+const unitName = "github-updater"
+
+// installOnlyFlags 只影响 install-systemd 本身，不写入 ExecStart
+var installOnlyFlags = map[string]bool{"write": true, "force": true, "daemon-reload": true, "interval": true, "user": true}
+
+// runInstallSystemd 生成加固的 oneshot 服务和对应的定时器，
+// -write - 时输出到标准输出，否则写入指定目录
+func runInstallSystemd(args []string) int {
+	fs := flag.NewFlagSet(flag.CommandLine.Name()+" install-systemd", flag.ExitOnError)
+	defineFlags(fs)
+	write := fs.String("write", "-", "Directory to write the unit files to, or - for stdout.")
+	reload := fs.Bool("daemon-reload", false, "Run systemctl daemon-reload after writing the unit files.")
+	user := fs.String("user", "", "Run the service as this unprivileged user with only CAP_NET_ADMIN (AmbientCapabilities) instead of root.")
+	sources, err := loadSettings(fs, args)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	if daemon {
+		log.Printf("ERROR: install-systemd generates a oneshot service driven by a timer; drop -daemon")
+		return exitFailure
+	}
+	if daemonInterval <= 0 {
+		log.Printf("ERROR: -interval must be positive")
+		return exitFailure
+	}
+
+	execStart, err := execStartLine(fs, sources)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return exitFailure
+	}
+	files := []struct{ name, content string }{
+		{unitName + ".service", serviceUnit(execStart, writablePaths(), *user)},
+		{unitName + ".timer", timerUnit(daemonInterval)},
+	}
+
+	if *write == "-" {
+		for i, f := range files {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n%s", f.name, f.content)
+		}
+		return 0
+	}
+	if !force {
+		for _, f := range files {
+			path := filepath.Join(*write, f.name)
+			if _, err := os.Stat(path); err == nil {
+				log.Printf("ERROR: %s already exists; use -force to overwrite", path)
+				return exitFailure
+			}
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(*write, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0o644); err != nil {
+			log.Printf("ERROR: %v", err)
+			return exitFailure
+		}
+		logInfo("Wrote %s.", path)
+	}
+	if *reload {
+		if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+			log.Printf("ERROR: systemctl daemon-reload: %v - %s", err, strings.TrimSpace(string(out)))
+			return exitFailure
+		}
+		logInfo("Reloaded systemd; enable with: systemctl enable --now %s.timer", unitName)
+	} else {
+		logInfo("Run systemctl daemon-reload, then: systemctl enable --now %s.timer", unitName)
+	}
+	return 0
+}
+
+// execStartLine 用当前可执行文件和命令行上指定的参数构造 ExecStart，配置文件路径转为绝对路径。
+// 来自配置文件的值由服务运行时重新读取，不重复写入
+func execStartLine(fs *flag.FlagSet, sources map[string]string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("locate executable: %w", err)
+	}
+	words := []string{exe}
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		if installOnlyFlags[f.Name] || sources[f.Name] != sourceFlag {
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "config" {
+			if value, err = filepath.Abs(value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		words = append(words, "-"+f.Name+"="+value)
+	})
+	for i, w := range words {
+		words[i] = systemdQuote(w)
+	}
+	return strings.Join(words, " "), errors.Join(errs...)
+}
+
+// systemdQuote 在需要时按 systemd 的规则给参数加双引号，% 需写成 %% 以免被当作说明符
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;$") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$")
+	return `"` + r.Replace(s) + `"`
+}
+
+// writablePaths 返回 ProtectSystem=strict 下需要写入的目录：状态目录以及单独指定的状态、审计和指标文件所在的目录
+func writablePaths() string {
+	paths := []string{systemdQuote(stateDir)}
+	seen := map[string]bool{stateDir: true}
+	for _, file := range []string{statusFile, notifyState, auditLog, textfile} {
+		if dir := filepath.Dir(file); file != "" && !seen[dir] {
+			seen[dir] = true
+			paths = append(paths, systemdQuote(dir))
+		}
+	}
+	return strings.Join(paths, " ")
+}
+
+// serviceUnit 生成服务单元。user 非空时以该用户运行，只通过 AmbientCapabilities 授予 CAP_NET_ADMIN，
+// StateDirectory 由 systemd 创建并归该用户所有
+func serviceUnit(execStart, writable, user string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `[Unit]
+Description=Update nftables sets with GitHub IP ranges
+Wants=network-online.target
+After=network-online.target nftables.service
+
+[Service]
+Type=oneshot
+ExecStart=%s
+StateDirectory=%s
+ProtectSystem=strict
+ReadWritePaths=%s
+ProtectHome=true
+PrivateTmp=true
+PrivateDevices=true
+NoNewPrivileges=true
+CapabilityBoundingSet=CAP_NET_ADMIN
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX AF_NETLINK
+ProtectKernelModules=true
+ProtectControlGroups=true
+LockPersonality=true
+`, execStart, unitName, writable)
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\nAmbientCapabilities=CAP_NET_ADMIN\n", user)
+	}
+	return b.String()
+}
+
+func timerUnit(interval time.Duration) string {
+	// 随机延迟为间隔的十分之一，避免大量主机同时请求 meta API
+	delay := interval / 10
+	return fmt.Sprintf(`[Unit]
+Description=Run %s every %s
+
+[Timer]
+OnBootSec=1min
+OnUnitActiveSec=%s
+RandomizedDelaySec=%s
+
+[Install]
+WantedBy=timers.target
+`, unitName, interval, systemdDuration(interval), systemdDuration(delay))
+}
+
+// systemdDuration 把时长格式化为 systemd 接受的秒数
+func systemdDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d.Round(time.Second)/time.Second))
+}
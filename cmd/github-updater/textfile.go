@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github-updater/pkg/pipeline"
+	"github-updater/pkg/state"
+)
+
+// textfilePath 返回当前 profile 的指标文件路径，profile 非空时在文件名中加上 profile 名称，
+// 避免 -profile all 时互相覆盖
+func textfilePath() string {
+	if profile == "" {
+		return textfile
+	}
+	ext := filepath.Ext(textfile)
+	return strings.TrimSuffix(textfile, ext) + "-" + profile + ext
+}
+
+// writeTextfile 以 node_exporter textfile collector 的格式原子地写出本次运行的指标，失败只警告
+func writeTextfile(opts pipeline.Options, res *pipeline.Result, runErr error, bytesTotal int64, fingerprint string) {
+	if textfile == "" {
+		return
+	}
+	t := opts.Target
+	labels := fmt.Sprintf(`family=%q,table=%q`, t.Family, t.TableName)
+	if profile != "" {
+		labels += fmt.Sprintf(`,profile=%q`, profile)
+	}
+	var b strings.Builder
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %v\n", name, help, name, name, labels, value)
+	}
+	gauge("github_nft_last_run_timestamp", "Unix time the last run finished.", time.Now().Unix())
+	gauge("github_nft_last_run_success", "Whether the last run succeeded.", boolMetric(runErr == nil))
+	fmt.Fprintf(&b, "# HELP github_nft_fetched_bytes_total Response body bytes received from the network across all runs.\n# TYPE github_nft_fetched_bytes_total counter\ngithub_nft_fetched_bytes_total{%s} %d\n", labels, bytesTotal)
+	if fingerprint != "" {
+		fmt.Fprintf(&b, "# HELP github_nft_fingerprint_info Fingerprint of the managed sets' contents after the last run.\n# TYPE github_nft_fingerprint_info gauge\n")
+		fmt.Fprintf(&b, "github_nft_fingerprint_info{%s,fingerprint=%q} 1\n", labels, fingerprint)
+	}
+	if res != nil {
+		s := res.Summary(opts.TrackChanges, runErr)
+		gauge("github_nft_last_run_applied", "Whether the last run applied the sets.", boolMetric(s.Applied))
+		gauge("github_nft_last_run_duration_seconds", "Duration of the last run.", res.Duration.Seconds())
+		gauge("github_nft_last_run_added", "Prefixes added by the last run.", s.Added)
+		gauge("github_nft_last_run_removed", "Prefixes removed by the last run.", s.Removed)
+		gauge("github_nft_last_run_fetched_bytes", "Response body bytes received by the last run.", s.Bytes)
+		gauge("github_nft_last_run_warnings", "Warnings raised by the last run.", len(s.Warnings))
+		fmt.Fprintf(&b, "# HELP github_nft_set_prefixes Desired prefixes per set in the last run.\n# TYPE github_nft_set_prefixes gauge\n")
+		fmt.Fprintf(&b, "github_nft_set_prefixes{%s,set=%q} %d\n", labels, t.IPv4SetName, res.IPv4Count)
+		fmt.Fprintf(&b, "github_nft_set_prefixes{%s,set=%q} %d\n", labels, t.IPv6SetName, res.IPv6Count)
+		if len(res.Phases.Timings) > 0 {
+			fmt.Fprintf(&b, "# HELP github_nft_phase_duration_seconds Duration of each phase of the last run.\n# TYPE github_nft_phase_duration_seconds gauge\n")
+			for _, p := range res.Phases.Timings {
+				fmt.Fprintf(&b, "github_nft_phase_duration_seconds{%s,phase=%q} %v\n", labels, p.Name, p.Duration.Seconds())
+			}
+		}
+	}
+
+	path := textfilePath()
+	if err := state.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		log.Printf("WARNING: could not write metrics textfile: %v", err)
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// validTextfile 检查 -textfile 的扩展名，node_exporter 只读取 .prom 文件
+func validTextfile() error {
+	if textfile != "" && filepath.Ext(textfile) != ".prom" {
+		return fmt.Errorf("-textfile %s: node_exporter only reads files ending in .prom", textfile)
+	}
+	if textfile != "" {
+		if _, err := os.Stat(filepath.Dir(textfile)); err != nil {
+			return fmt.Errorf("-textfile: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// parseTOML 把 TOML 配置文件转换为与 YAML 相同的节点树，之后按同样的规则应用。
+// 值由 go-toml 解码；键的顺序和行号另外从语法树中取得，报错时与 YAML 一样指向所在的行
+func parseTOML(data []byte) (*yaml.Node, error) {
+	var doc map[string]interface{}
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		var de *toml.DecodeError
+		if errors.As(err, &de) {
+			row, _ := de.Position()
+			return nil, fmt.Errorf("line %d: %s", row, strings.TrimPrefix(de.Error(), "toml: "))
+		}
+		// 重复的键和表不带位置
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "toml: "))
+	}
+	keys := tomlKeyPositions(data)
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{tomlNode(doc, nil, keys, 1)}}, nil
+}
+
+// tomlKeyPos 是键第一次出现的行号和在文件中的次序
+type tomlKeyPos struct{ line, order int }
+
+// tomlKeyPositions 返回每个键（以 \x00 连接的完整路径）第一次出现的位置，
+// 包括表头和带点的键中的各级名称以及内联表中的键
+func tomlKeyPositions(data []byte) map[string]tomlKeyPos {
+	keys := make(map[string]tomlKeyPos)
+	var p unstable.Parser
+	p.Reset(data)
+	var table []string
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			table = recordTOMLKey(&p, keys, nil, e.Key())
+		case unstable.KeyValue:
+			recordTOMLValue(&p, keys, recordTOMLKey(&p, keys, table, e.Key()), e.Value())
+		}
+	}
+	return keys
+}
+
+// recordTOMLKey 记录 prefix 下带点的键的各级名称，返回完整路径
+func recordTOMLKey(p *unstable.Parser, keys map[string]tomlKeyPos, prefix []string, it unstable.Iterator) []string {
+	path := slices.Clone(prefix)
+	for it.Next() {
+		path = append(path, string(it.Node().Data))
+		if id := strings.Join(path, "\x00"); keys[id] == (tomlKeyPos{}) {
+			keys[id] = tomlKeyPos{line: p.Shape(it.Node().Raw).Start.Line, order: len(keys) + 1}
+		}
+	}
+	return path
+}
+
+// recordTOMLValue 记录内联表中的键
+func recordTOMLValue(p *unstable.Parser, keys map[string]tomlKeyPos, path []string, v *unstable.Node) {
+	if v.Kind != unstable.InlineTable {
+		return
+	}
+	it := v.Children()
+	for it.Next() {
+		if kv := it.Node(); kv.Kind == unstable.KeyValue {
+			recordTOMLValue(p, keys, recordTOMLKey(p, keys, path, kv.Key()), kv.Value())
+		}
+	}
+}
+
+// tomlNode 把解码后的值转换为 YAML 节点，映射的键按在文件中出现的顺序排列。
+// line 是值所在的行（键的行号），找不到位置的键沿用它
+func tomlNode(v interface{}, path []string, keys map[string]tomlKeyPos, line int) *yaml.Node {
+	scalar := func(tag, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value, Line: line}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		node := &yaml.Node{Kind: yaml.MappingNode, Line: line}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		pos := func(name string) tomlKeyPos { return keys[strings.Join(append(slices.Clone(path), name), "\x00")] }
+		slices.SortFunc(names, func(a, b string) int {
+			if c := pos(a).order - pos(b).order; c != 0 {
+				return c
+			}
+			return strings.Compare(a, b)
+		})
+		for _, name := range names {
+			keyLine := pos(name).line
+			if keyLine == 0 {
+				keyLine = line
+			}
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name, Line: keyLine},
+				tomlNode(v[name], append(slices.Clone(path), name), keys, keyLine))
+		}
+		return node
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Line: line}
+		for _, item := range v {
+			node.Content = append(node.Content, tomlNode(item, path, keys, line))
+		}
+		return node
+	case string:
+		return scalar("!!str", v)
+	case bool:
+		return scalar("!!bool", strconv.FormatBool(v))
+	case int64:
+		return scalar("!!int", strconv.FormatInt(v, 10))
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return scalar("!!float", ".nan")
+		case math.IsInf(v, 1):
+			return scalar("!!float", ".inf")
+		case math.IsInf(v, -1):
+			return scalar("!!float", "-.inf")
+		}
+		return scalar("!!float", strconv.FormatFloat(v, 'g', -1, 64))
+	case time.Time:
+		return scalar("!!timestamp", v.Format(time.RFC3339Nano))
+	}
+	// 不带时区的日期和时间
+	return scalar("!!str", fmt.Sprint(v))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseTOML(t *testing.T) {
+	data := `# 注释
+chain = "github"   # 行尾注释
+extra-file = [
+  "/etc/a.txt",  # 数组中的注释
+  '/etc/b.txt',
+]
+max-body = 1_048_576
+retries = 0x1f
+ratio = 0.5
+verify = true
+note = "tab\there \u00e9"
+raw = 'C:\path'
+text = """
+two
+lines"""
+dotted.key = "x"
+
+[profiles.github]
+set-v4 = "github_v4"
+limits = { min = 3, nested = { max = 9 } }
+
+[sources."meta data"]
+url = "https://api.github.com/meta"
+`
+	doc, err := parseTOML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `chain: github
+extra-file:
+    - /etc/a.txt
+    - /etc/b.txt
+max-body: 1048576
+retries: 31
+ratio: 0.5
+verify: true
+note: "tab\there é"
+raw: C:\path
+text: |-
+    two
+    lines
+dotted:
+    key: x
+profiles:
+    github:
+        set-v4: github_v4
+        limits:
+            min: 3
+            nested:
+                max: 9
+sources:
+    meta data:
+        url: https://api.github.com/meta
+`
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	// 键的行号用于配置错误的提示
+	root := doc.Content[0]
+	lines := map[string]int{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		lines[root.Content[i].Value] = root.Content[i].Line
+	}
+	for key, line := range map[string]int{"chain": 2, "extra-file": 3, "max-body": 7, "dotted": 16, "profiles": 18, "sources": 22} {
+		if lines[key] != line {
+			t.Errorf("%s on line %d, want %d", key, lines[key], line)
+		}
+	}
+	github := root.Content[len(root.Content)-3].Content[1]
+	if set := github.Content[0]; set.Value != "set-v4" || set.Line != 19 || github.Content[1].Line != 19 {
+		t.Errorf("set-v4 key %q on line %d, value on line %d, want line 19", set.Value, set.Line, github.Content[1].Line)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name, data string
+		want       string // 错误信息的开头
+	}{
+		{"leading zero", "chain = \"x\"\nretries = 007\n", "line 2:"},
+		{"go escape", `chain = "\x41"`, "line 1:"},
+		{"bare string", "chain = github", "line 1:"},
+		{"duplicate key", "chain = \"a\"\nchain = \"b\"\n", "key chain is already defined"},
+		{"duplicate table", "[profiles.a]\nx = 1\n[profiles.a]\ny = 2\n", "table a already exists"},
+		{"unterminated array", "extra-file = [\"a\",\n", "line "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.data))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("error = %v, want prefix %q", err, tt.want)
+			}
+		})
+	}
+}
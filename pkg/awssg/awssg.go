@@ -0,0 +1,478 @@
+// Package awssg 把网段同步到 AWS 安全组的入站规则或托管前缀列表（managed prefix list）。
+package awssg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// DefaultRulesPerGroup 是安全组入站规则的默认配额，IPv4 和 IPv6 分别计算
+const DefaultRulesPerGroup = 60
+
+// maxPrefixListChanges 是一次 ModifyManagedPrefixList 最多添加或删除的条目数
+const maxPrefixListChanges = 100
+
+// prefixListPoll 是等待前缀列表修改完成时查询的间隔
+var prefixListPoll = 2 * time.Second
+
+// EC2API 是 Backend 用到的 EC2 接口，*ec2.Client 实现了它
+type EC2API interface {
+	DescribeSecurityGroupRules(context.Context, *ec2.DescribeSecurityGroupRulesInput, ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error)
+	AuthorizeSecurityGroupIngress(context.Context, *ec2.AuthorizeSecurityGroupIngressInput, ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	RevokeSecurityGroupIngress(context.Context, *ec2.RevokeSecurityGroupIngressInput, ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	DescribeManagedPrefixLists(context.Context, *ec2.DescribeManagedPrefixListsInput, ...func(*ec2.Options)) (*ec2.DescribeManagedPrefixListsOutput, error)
+	GetManagedPrefixListEntries(context.Context, *ec2.GetManagedPrefixListEntriesInput, ...func(*ec2.Options)) (*ec2.GetManagedPrefixListEntriesOutput, error)
+	ModifyManagedPrefixList(context.Context, *ec2.ModifyManagedPrefixListInput, ...func(*ec2.Options)) (*ec2.ModifyManagedPrefixListOutput, error)
+}
+
+// Backend 把期望网段同步到安全组和/或托管前缀列表，实现 pipeline.Backend。
+// 只修改描述（Description）为 Description 的规则和条目，其他规则和条目保持不变但占用配额
+type Backend struct {
+	// Client 为空时按默认的凭据链和 Region 创建
+	Client EC2API
+	Region string
+	// SecurityGroups 中的安全组依次容纳规则，一个组的配额用完后放入下一个
+	SecurityGroups []string
+	// PrefixLists 是托管前缀列表，按各自的地址族写入 IPv4 或 IPv6 网段
+	PrefixLists   []string
+	Ports         []uint16 // 每个端口一条 TCP 规则，为空时放行全部协议和端口
+	Description   string
+	RulesPerGroup int // 每个安全组每个地址族可用的入站规则数，0 时使用 DefaultRulesPerGroup
+}
+
+// Rule 是安全组中的一条入站规则
+type Rule struct {
+	GroupID  string
+	ID       string // 已有规则的 ID，新规则为空
+	Prefix   netip.Prefix
+	Protocol string // "tcp" 或 "-1"（全部）
+	FromPort int32
+	ToPort   int32
+}
+
+// PrefixListChange 是对一个托管前缀列表的修改
+type PrefixListChange struct {
+	ID     string
+	Add    []netip.Prefix
+	Remove []netip.Prefix
+}
+
+// Plan 是一次同步需要的全部修改：先撤销规则腾出配额，再添加规则，最后修改前缀列表
+type Plan struct {
+	Revoke      []Rule
+	Authorize   []Rule
+	PrefixLists []PrefixListChange
+}
+
+// WriteTo 以每行一项的格式输出修改，用于 -dry-run
+func (p *Plan) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	for _, r := range p.Revoke {
+		fmt.Fprintf(&b, "%s: revoke %s %s\n", r.GroupID, r.Prefix, r.ports())
+	}
+	for _, r := range p.Authorize {
+		fmt.Fprintf(&b, "%s: authorize %s %s\n", r.GroupID, r.Prefix, r.ports())
+	}
+	for _, c := range p.PrefixLists {
+		for _, pfx := range c.Remove {
+			fmt.Fprintf(&b, "%s: remove %s\n", c.ID, pfx)
+		}
+		for _, pfx := range c.Add {
+			fmt.Fprintf(&b, "%s: add %s\n", c.ID, pfx)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (r Rule) ports() string {
+	if r.Protocol == "-1" {
+		return "all"
+	}
+	if r.FromPort == r.ToPort {
+		return fmt.Sprintf("%s/%d", r.Protocol, r.FromPort)
+	}
+	return fmt.Sprintf("%s/%d-%d", r.Protocol, r.FromPort, r.ToPort)
+}
+
+// key 标识规则的内容，不含所在的安全组和 ID
+func (r Rule) key() string { return r.Prefix.String() + " " + r.ports() }
+
+// Name 实现 pipeline.Backend
+func (b *Backend) Name() string { return "aws" }
+
+// Apply 实现 pipeline.Backend
+func (b *Backend) Apply(ctx context.Context, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	plan, previous, err := b.Plan(ctx, v4, v6)
+	if err != nil {
+		return nil, err
+	}
+	return previous, b.Execute(ctx, plan)
+}
+
+// Flush 实现 pipeline.Backend：删除本工具添加的全部规则和条目
+func (b *Backend) Flush(ctx context.Context) ([]netip.Prefix, error) {
+	return b.Apply(ctx, nil, nil)
+}
+
+// Plan 读取安全组和前缀列表的现状，返回同步到 v4、v6 需要的修改以及本工具管理的现有网段。
+// 安全组的配额容纳不下全部规则时返回错误，不做任何修改
+func (b *Backend) Plan(ctx context.Context, v4, v6 []netip.Prefix) (*Plan, []netip.Prefix, error) {
+	client, err := b.client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan := &Plan{}
+	seen := make(map[netip.Prefix]bool)
+	var previous []netip.Prefix
+	record := func(p netip.Prefix) {
+		if !seen[p] {
+			seen[p] = true
+			previous = append(previous, p)
+		}
+	}
+	if len(b.SecurityGroups) > 0 {
+		if err := b.planGroups(ctx, client, plan, v4, v6, record); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, id := range b.PrefixLists {
+		c, err := b.planPrefixList(ctx, client, id, v4, v6, record)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan.PrefixLists = append(plan.PrefixLists, c)
+	}
+	return plan, previous, nil
+}
+
+// planGroups 保留仍然需要的已有规则，撤销其余本工具添加的规则，把缺少的规则依次放入有剩余配额的安全组
+func (b *Backend) planGroups(ctx context.Context, client EC2API, plan *Plan, v4, v6 []netip.Prefix, record func(netip.Prefix)) error {
+	var want []Rule
+	for _, p := range append(append([]netip.Prefix(nil), v4...), v6...) {
+		if len(b.Ports) == 0 {
+			want = append(want, Rule{Prefix: p, Protocol: "-1", FromPort: -1, ToPort: -1})
+			continue
+		}
+		for _, port := range b.Ports {
+			want = append(want, Rule{Prefix: p, Protocol: "tcp", FromPort: int32(port), ToPort: int32(port)})
+		}
+	}
+	wanted := make(map[string]bool, len(want))
+	for _, r := range want {
+		wanted[r.key()] = true
+	}
+
+	existing, err := b.describeRules(ctx, client)
+	if err != nil {
+		return err
+	}
+	// used[组][是否 IPv6] 是组中已经占用的规则数
+	used := make(map[string]*[2]int, len(b.SecurityGroups))
+	for _, g := range b.SecurityGroups {
+		used[g] = &[2]int{}
+	}
+	kept := make(map[string]bool)
+	for _, r := range existing {
+		if !r.managed {
+			used[r.GroupID][0] += r.weight[0]
+			used[r.GroupID][1] += r.weight[1]
+			continue
+		}
+		record(r.Prefix)
+		if k := r.key(); wanted[k] && !kept[k] {
+			kept[k] = true
+			used[r.GroupID][family(r.Prefix)]++
+			continue
+		}
+		plan.Revoke = append(plan.Revoke, r.Rule)
+	}
+
+	limit := b.RulesPerGroup
+	if limit <= 0 {
+		limit = DefaultRulesPerGroup
+	}
+	missing := 0
+	for _, r := range want {
+		if kept[r.key()] {
+			continue
+		}
+		placed := false
+		for _, g := range b.SecurityGroups {
+			if n := &used[g][family(r.Prefix)]; *n < limit {
+				*n++
+				r.GroupID = g
+				plan.Authorize = append(plan.Authorize, r)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d rules do not fit into %d security groups with %d rules per group and address family; add more groups or raise the limit after increasing the quota",
+			missing, len(want), len(b.SecurityGroups), limit)
+	}
+	return nil
+}
+
+// groupRule 是读取到的一条入站规则，managed 表示由本工具添加且能够识别，
+// weight 是它占用的 IPv4 和 IPv6 配额
+type groupRule struct {
+	Rule
+	managed bool
+	weight  [2]int
+}
+
+func (b *Backend) describeRules(ctx context.Context, client EC2API) ([]groupRule, error) {
+	var rules []groupRule
+	in := &ec2.DescribeSecurityGroupRulesInput{
+		Filters:    []types.Filter{{Name: aws.String("group-id"), Values: b.SecurityGroups}},
+		MaxResults: aws.Int32(1000),
+	}
+	for {
+		out, err := client.DescribeSecurityGroupRules(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("describe security group rules: %w", err)
+		}
+		for _, sr := range out.SecurityGroupRules {
+			if aws.ToBool(sr.IsEgress) {
+				continue
+			}
+			r := groupRule{Rule: Rule{
+				GroupID:  aws.ToString(sr.GroupId),
+				ID:       aws.ToString(sr.SecurityGroupRuleId),
+				Protocol: aws.ToString(sr.IpProtocol),
+				FromPort: aws.ToInt32(sr.FromPort),
+				ToPort:   aws.ToInt32(sr.ToPort),
+			}}
+			cidr := aws.ToString(sr.CidrIpv4)
+			if cidr == "" {
+				cidr = aws.ToString(sr.CidrIpv6)
+			}
+			p, err := netip.ParsePrefix(cidr)
+			switch {
+			case err != nil:
+				// 引用其他安全组或前缀列表的规则，两个地址族都按一条计算
+				r.weight = [2]int{1, 1}
+			case aws.ToString(sr.Description) == b.Description:
+				r.Prefix, r.managed = p, true
+			default:
+				r.weight[family(p)] = 1
+			}
+			rules = append(rules, r)
+		}
+		if aws.ToString(out.NextToken) == "" {
+			return rules, nil
+		}
+		in.NextToken = out.NextToken
+	}
+}
+
+// planPrefixList 按前缀列表的地址族计算需要添加和删除的条目。
+// 已有相同网段的条目（即使不是本工具添加的）不再添加；总数超过 MaxEntries 时返回错误
+func (b *Backend) planPrefixList(ctx context.Context, client EC2API, id string, v4, v6 []netip.Prefix, record func(netip.Prefix)) (PrefixListChange, error) {
+	c := PrefixListChange{ID: id}
+	pl, err := describePrefixList(ctx, client, id)
+	if err != nil {
+		return c, err
+	}
+	want := v4
+	if aws.ToString(pl.AddressFamily) == "IPv6" {
+		want = v6
+	}
+	wanted := make(map[netip.Prefix]bool, len(want))
+	for _, p := range want {
+		wanted[p] = true
+	}
+	entries := make(map[netip.Prefix]bool)
+	total := 0
+	in := &ec2.GetManagedPrefixListEntriesInput{PrefixListId: aws.String(id), MaxResults: aws.Int32(100)}
+	for {
+		out, err := client.GetManagedPrefixListEntries(ctx, in)
+		if err != nil {
+			return c, fmt.Errorf("get entries of prefix list %s: %w", id, err)
+		}
+		for _, e := range out.Entries {
+			total++
+			p, err := netip.ParsePrefix(aws.ToString(e.Cidr))
+			if err != nil {
+				continue
+			}
+			entries[p] = true
+			if aws.ToString(e.Description) == b.Description {
+				record(p)
+				if !wanted[p] {
+					c.Remove = append(c.Remove, p)
+				}
+			}
+		}
+		if aws.ToString(out.NextToken) == "" {
+			break
+		}
+		in.NextToken = out.NextToken
+	}
+	for _, p := range want {
+		if !entries[p] {
+			c.Add = append(c.Add, p)
+		}
+	}
+	if n, limit := total-len(c.Remove)+len(c.Add), int(aws.ToInt32(pl.MaxEntries)); n > limit {
+		return c, fmt.Errorf("prefix list %s would need %d entries but allows at most %d; increase its max entries", id, n, limit)
+	}
+	return c, nil
+}
+
+// Execute 按 Plan 修改安全组和前缀列表。安全组的修改按组批量提交，中途失败时已提交的修改保留
+func (b *Backend) Execute(ctx context.Context, plan *Plan) error {
+	client, err := b.client(ctx)
+	if err != nil {
+		return err
+	}
+	revoke := make(map[string][]string)
+	var order []string
+	for _, r := range plan.Revoke {
+		if revoke[r.GroupID] == nil {
+			order = append(order, r.GroupID)
+		}
+		revoke[r.GroupID] = append(revoke[r.GroupID], r.ID)
+	}
+	for _, g := range order {
+		if _, err := client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId: aws.String(g), SecurityGroupRuleIds: revoke[g],
+		}); err != nil {
+			return fmt.Errorf("revoke %d rules from %s: %w", len(revoke[g]), g, err)
+		}
+	}
+
+	// 同一个组、同一组端口的网段放进一个 IpPermission 一次提交
+	type permKey struct{ group, ports string }
+	perms := make(map[permKey]*types.IpPermission)
+	var keys []permKey
+	for _, r := range plan.Authorize {
+		k := permKey{r.GroupID, r.ports()}
+		perm := perms[k]
+		if perm == nil {
+			perm = &types.IpPermission{IpProtocol: aws.String(r.Protocol)}
+			if r.Protocol != "-1" {
+				perm.FromPort, perm.ToPort = aws.Int32(r.FromPort), aws.Int32(r.ToPort)
+			}
+			perms[k] = perm
+			keys = append(keys, k)
+		}
+		if r.Prefix.Addr().Is4() {
+			perm.IpRanges = append(perm.IpRanges, types.IpRange{CidrIp: aws.String(r.Prefix.String()), Description: aws.String(b.Description)})
+		} else {
+			perm.Ipv6Ranges = append(perm.Ipv6Ranges, types.Ipv6Range{CidrIpv6: aws.String(r.Prefix.String()), Description: aws.String(b.Description)})
+		}
+	}
+	for _, k := range keys {
+		perm := perms[k]
+		if _, err := client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId: aws.String(k.group), IpPermissions: []types.IpPermission{*perm},
+		}); err != nil {
+			return fmt.Errorf("authorize %d rules in %s: %w", len(perm.IpRanges)+len(perm.Ipv6Ranges), k.group, err)
+		}
+	}
+
+	for _, c := range plan.PrefixLists {
+		if err := b.modifyPrefixList(ctx, client, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modifyPrefixList 分批修改前缀列表。每次修改都要带上当前版本号，并等到上一次修改完成
+func (b *Backend) modifyPrefixList(ctx context.Context, client EC2API, c PrefixListChange) error {
+	add, remove := c.Add, c.Remove
+	for len(add) > 0 || len(remove) > 0 {
+		pl, err := waitPrefixList(ctx, client, c.ID)
+		if err != nil {
+			return err
+		}
+		in := &ec2.ModifyManagedPrefixListInput{PrefixListId: aws.String(c.ID), CurrentVersion: pl.Version}
+		for _, p := range remove[:min(len(remove), maxPrefixListChanges)] {
+			in.RemoveEntries = append(in.RemoveEntries, types.RemovePrefixListEntry{Cidr: aws.String(p.String())})
+		}
+		for _, p := range add[:min(len(add), maxPrefixListChanges)] {
+			in.AddEntries = append(in.AddEntries, types.AddPrefixListEntry{Cidr: aws.String(p.String()), Description: aws.String(b.Description)})
+		}
+		if _, err := client.ModifyManagedPrefixList(ctx, in); err != nil {
+			return fmt.Errorf("modify prefix list %s: %w", c.ID, err)
+		}
+		remove, add = remove[len(in.RemoveEntries):], add[len(in.AddEntries):]
+	}
+	_, err := waitPrefixList(ctx, client, c.ID)
+	return err
+}
+
+// waitPrefixList 等待前缀列表没有进行中的修改，返回其最新状态
+func waitPrefixList(ctx context.Context, client EC2API, id string) (*types.ManagedPrefixList, error) {
+	for {
+		pl, err := describePrefixList(ctx, client, id)
+		if err != nil {
+			return nil, err
+		}
+		switch pl.State {
+		case types.PrefixListStateModifyFailed, types.PrefixListStateCreateFailed:
+			return nil, fmt.Errorf("prefix list %s is in state %s: %s", id, pl.State, aws.ToString(pl.StateMessage))
+		case types.PrefixListStateCreateInProgress, types.PrefixListStateModifyInProgress:
+		default:
+			return pl, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for prefix list %s: %w", id, ctx.Err())
+		case <-time.After(prefixListPoll):
+		}
+	}
+}
+
+func describePrefixList(ctx context.Context, client EC2API, id string) (*types.ManagedPrefixList, error) {
+	out, err := client.DescribeManagedPrefixLists(ctx, &ec2.DescribeManagedPrefixListsInput{PrefixListIds: []string{id}})
+	if err != nil {
+		return nil, fmt.Errorf("describe prefix list %s: %w", id, err)
+	}
+	if len(out.PrefixLists) == 0 {
+		return nil, errors.New("prefix list " + id + " not found")
+	}
+	return &out.PrefixLists[0], nil
+}
+
+// client 返回 Client，为空时按默认配置创建并保存
+func (b *Backend) client(ctx context.Context) (EC2API, error) {
+	if b.Client != nil {
+		return b.Client, nil
+	}
+	var opts []func(*config.LoadOptions) error
+	if b.Region != "" {
+		opts = append(opts, config.WithRegion(b.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS configuration: %w", err)
+	}
+	b.Client = ec2.NewFromConfig(cfg)
+	return b.Client, nil
+}
+
+// family 返回网段的地址族下标：IPv4 为 0，IPv6 为 1
+func family(p netip.Prefix) int {
+	if p.Addr().Is4() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,330 @@
+package awssg
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const marker = "github-updater"
+
+// fakePrefixList 是 fakeEC2 中的一个托管前缀列表
+type fakePrefixList struct {
+	family  string
+	max     int32
+	version int64
+	entries [][]types.PrefixListEntry // 按页返回
+	busy    int                       // 之后多少次查询仍返回修改进行中
+}
+
+// fakeEC2 实现 EC2API，规则和前缀列表的条目按页返回，NextToken 是下一页的下标
+type fakeEC2 struct {
+	rules    [][]types.SecurityGroupRule
+	lists    map[string]*fakePrefixList
+	calls    []string
+	modified []*ec2.ModifyManagedPrefixListInput
+}
+
+func nextToken(page, pages int) *string {
+	if page+1 >= pages {
+		return nil
+	}
+	return aws.String(strconv.Itoa(page + 1))
+}
+
+func pageOf(token *string) int {
+	n, _ := strconv.Atoi(aws.ToString(token))
+	return n
+}
+
+func (f *fakeEC2) DescribeSecurityGroupRules(ctx context.Context, in *ec2.DescribeSecurityGroupRulesInput, _ ...func(*ec2.Options)) (*ec2.DescribeSecurityGroupRulesOutput, error) {
+	page := pageOf(in.NextToken)
+	f.calls = append(f.calls, fmt.Sprintf("DescribeSecurityGroupRules %d", page))
+	if len(f.rules) == 0 {
+		return &ec2.DescribeSecurityGroupRulesOutput{}, nil
+	}
+	return &ec2.DescribeSecurityGroupRulesOutput{SecurityGroupRules: f.rules[page], NextToken: nextToken(page, len(f.rules))}, nil
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupIngress(ctx context.Context, in *ec2.AuthorizeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	f.calls = append(f.calls, "AuthorizeSecurityGroupIngress "+aws.ToString(in.GroupId))
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngress(ctx context.Context, in *ec2.RevokeSecurityGroupIngressInput, _ ...func(*ec2.Options)) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	f.calls = append(f.calls, "RevokeSecurityGroupIngress "+aws.ToString(in.GroupId)+" "+strings.Join(in.SecurityGroupRuleIds, ","))
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeManagedPrefixLists(ctx context.Context, in *ec2.DescribeManagedPrefixListsInput, _ ...func(*ec2.Options)) (*ec2.DescribeManagedPrefixListsOutput, error) {
+	id := in.PrefixListIds[0]
+	pl := f.lists[id]
+	state := types.PrefixListStateModifyComplete
+	if pl.busy > 0 {
+		pl.busy--
+		state = types.PrefixListStateModifyInProgress
+	}
+	f.calls = append(f.calls, fmt.Sprintf("DescribeManagedPrefixLists %s %s", id, state))
+	return &ec2.DescribeManagedPrefixListsOutput{PrefixLists: []types.ManagedPrefixList{{
+		PrefixListId: aws.String(id), AddressFamily: aws.String(pl.family), MaxEntries: aws.Int32(pl.max),
+		Version: aws.Int64(pl.version), State: state,
+	}}}, nil
+}
+
+func (f *fakeEC2) GetManagedPrefixListEntries(ctx context.Context, in *ec2.GetManagedPrefixListEntriesInput, _ ...func(*ec2.Options)) (*ec2.GetManagedPrefixListEntriesOutput, error) {
+	pl, page := f.lists[aws.ToString(in.PrefixListId)], pageOf(in.NextToken)
+	f.calls = append(f.calls, fmt.Sprintf("GetManagedPrefixListEntries %s %d", aws.ToString(in.PrefixListId), page))
+	if len(pl.entries) == 0 {
+		return &ec2.GetManagedPrefixListEntriesOutput{}, nil
+	}
+	return &ec2.GetManagedPrefixListEntriesOutput{Entries: pl.entries[page], NextToken: nextToken(page, len(pl.entries))}, nil
+}
+
+func (f *fakeEC2) ModifyManagedPrefixList(ctx context.Context, in *ec2.ModifyManagedPrefixListInput, _ ...func(*ec2.Options)) (*ec2.ModifyManagedPrefixListOutput, error) {
+	pl := f.lists[aws.ToString(in.PrefixListId)]
+	if aws.ToInt64(in.CurrentVersion) != pl.version {
+		return nil, fmt.Errorf("version %d is not the current version %d", aws.ToInt64(in.CurrentVersion), pl.version)
+	}
+	f.calls = append(f.calls, fmt.Sprintf("ModifyManagedPrefixList %s version %d: -%d +%d", aws.ToString(in.PrefixListId), pl.version, len(in.RemoveEntries), len(in.AddEntries)))
+	f.modified = append(f.modified, in)
+	pl.version++
+	pl.busy = 1
+	return &ec2.ModifyManagedPrefixListOutput{}, nil
+}
+
+// cidrRule 返回 group 中指向 cidr 的入站规则，cidr 为空时引用其他安全组
+func cidrRule(group, id, cidr, description string) types.SecurityGroupRule {
+	r := types.SecurityGroupRule{
+		GroupId: aws.String(group), SecurityGroupRuleId: aws.String(id), IsEgress: aws.Bool(false),
+		IpProtocol: aws.String("-1"), FromPort: aws.Int32(-1), ToPort: aws.Int32(-1), Description: aws.String(description),
+	}
+	switch {
+	case cidr == "":
+		r.ReferencedGroupInfo = &types.ReferencedSecurityGroup{GroupId: aws.String("sg-other")}
+	case strings.Contains(cidr, ":"):
+		r.CidrIpv6 = aws.String(cidr)
+	default:
+		r.CidrIpv4 = aws.String(cidr)
+	}
+	return r
+}
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, c := range cidrs {
+		ps = append(ps, netip.MustParsePrefix(c))
+	}
+	return ps
+}
+
+// planLines 以 "组: 动作 网段 端口" 的格式返回安全组的修改
+func planLines(p *Plan) []string {
+	var lines []string
+	for _, r := range p.Revoke {
+		lines = append(lines, fmt.Sprintf("%s: revoke %s %s %s", r.GroupID, r.ID, r.Prefix, r.ports()))
+	}
+	for _, r := range p.Authorize {
+		lines = append(lines, fmt.Sprintf("%s: authorize %s %s", r.GroupID, r.Prefix, r.ports()))
+	}
+	return lines
+}
+
+func TestPlanGroups(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    [][]types.SecurityGroupRule
+		ports    []uint16
+		v4, v6   []netip.Prefix
+		want     []string
+		previous []netip.Prefix
+		err      string
+	}{
+		{
+			// sg-1 的 IPv4 配额被一条其他规则和一条引用其他安全组的规则占去两条，IPv6 被引用规则占去一条
+			name: "quota per group and family",
+			rules: [][]types.SecurityGroupRule{
+				{cidrRule("sg-1", "sgr-a", "203.0.113.0/24", "office")},
+				{cidrRule("sg-1", "sgr-b", "", "peers")},
+			},
+			v4: prefixes("192.0.2.0/24", "198.51.100.0/24", "10.1.0.0/16", "10.2.0.0/16"),
+			v6: prefixes("2001:db8::/32", "2001:db9::/32", "2001:dba::/32"),
+			want: []string{
+				"sg-1: authorize 192.0.2.0/24 all",
+				"sg-2: authorize 198.51.100.0/24 all",
+				"sg-2: authorize 10.1.0.0/16 all",
+				"sg-2: authorize 10.2.0.0/16 all",
+				"sg-1: authorize 2001:db8::/32 all",
+				"sg-1: authorize 2001:db9::/32 all",
+				"sg-2: authorize 2001:dba::/32 all",
+			},
+		},
+		{
+			name: "duplicate and retired managed rules revoked",
+			rules: [][]types.SecurityGroupRule{{
+				cidrRule("sg-1", "sgr-a", "192.0.2.0/24", marker),
+				cidrRule("sg-2", "sgr-b", "192.0.2.0/24", marker),
+				cidrRule("sg-2", "sgr-c", "198.51.100.0/24", marker),
+				cidrRule("sg-2", "sgr-d", "203.0.113.0/24", "office"),
+			}},
+			v4:       prefixes("192.0.2.0/24", "10.0.0.0/8"),
+			want:     []string{"sg-2: revoke sgr-b 192.0.2.0/24 all", "sg-2: revoke sgr-c 198.51.100.0/24 all", "sg-1: authorize 10.0.0.0/8 all"},
+			previous: prefixes("192.0.2.0/24", "198.51.100.0/24"),
+		},
+		{
+			name:  "one rule per port",
+			ports: []uint16{443, 22},
+			rules: [][]types.SecurityGroupRule{{cidrRule("sg-1", "sgr-a", "192.0.2.0/24", marker)}},
+			v4:    prefixes("192.0.2.0/24"),
+			want: []string{
+				"sg-1: revoke sgr-a 192.0.2.0/24 all",
+				"sg-1: authorize 192.0.2.0/24 tcp/443",
+				"sg-1: authorize 192.0.2.0/24 tcp/22",
+			},
+			previous: prefixes("192.0.2.0/24"),
+		},
+		{
+			name: "rules do not fit",
+			rules: [][]types.SecurityGroupRule{
+				{cidrRule("sg-1", "sgr-a", "", "peers")},
+				{cidrRule("sg-2", "sgr-b", "203.0.113.0/24", "office"), cidrRule("sg-2", "sgr-c", "203.0.114.0/24", "office")},
+			},
+			v4:  prefixes("192.0.2.0/24", "198.51.100.0/24", "10.0.0.0/8", "172.16.0.0/12"),
+			err: "1 of 4 rules do not fit into 2 security groups with 3 rules per group and address family",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeEC2{rules: tt.rules}
+			b := &Backend{Client: f, SecurityGroups: []string{"sg-1", "sg-2"}, Ports: tt.ports, Description: marker, RulesPerGroup: 3}
+			plan, previous, err := b.Plan(context.Background(), tt.v4, tt.v6)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Plan error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := planLines(plan); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("plan =\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if !reflect.DeepEqual(previous, tt.previous) {
+				t.Errorf("previous = %v, want %v", previous, tt.previous)
+			}
+			var pages []string
+			for i := range max(len(tt.rules), 1) {
+				pages = append(pages, fmt.Sprintf("DescribeSecurityGroupRules %d", i))
+			}
+			if !reflect.DeepEqual(f.calls, pages) {
+				t.Errorf("calls = %v, want %v", f.calls, pages)
+			}
+		})
+	}
+}
+
+func TestPlanPrefixList(t *testing.T) {
+	entry := func(cidr, description string) types.PrefixListEntry {
+		return types.PrefixListEntry{Cidr: aws.String(cidr), Description: aws.String(description)}
+	}
+	f := &fakeEC2{lists: map[string]*fakePrefixList{
+		"pl-4": {family: "IPv4", max: 4, entries: [][]types.PrefixListEntry{
+			{entry("192.0.2.0/24", marker), entry("198.51.100.0/24", marker)},
+			{entry("10.0.0.0/8", "office")},
+		}},
+		"pl-6": {family: "IPv6", max: 1, entries: [][]types.PrefixListEntry{{entry("2001:db8::/32", "office")}}},
+	}}
+	b := &Backend{Client: f, PrefixLists: []string{"pl-4"}, Description: marker}
+	v4, v6 := prefixes("192.0.2.0/24", "10.0.0.0/8", "172.16.0.0/12", "203.0.113.0/24"), prefixes("2001:db8::/32")
+	plan, previous, err := b.Plan(context.Background(), v4, v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 非本工具添加的 10.0.0.0/8 已经存在，不再添加
+	want := []PrefixListChange{{ID: "pl-4", Add: prefixes("172.16.0.0/12", "203.0.113.0/24"), Remove: prefixes("198.51.100.0/24")}}
+	if !reflect.DeepEqual(plan.PrefixLists, want) {
+		t.Errorf("plan = %+v, want %+v", plan.PrefixLists, want)
+	}
+	if want := prefixes("192.0.2.0/24", "198.51.100.0/24"); !reflect.DeepEqual(previous, want) {
+		t.Errorf("previous = %v, want %v", previous, want)
+	}
+	wantCalls := []string{
+		"DescribeManagedPrefixLists pl-4 modify-complete",
+		"GetManagedPrefixListEntries pl-4 0",
+		"GetManagedPrefixListEntries pl-4 1",
+	}
+	if !reflect.DeepEqual(f.calls, wantCalls) {
+		t.Errorf("calls = %v, want %v", f.calls, wantCalls)
+	}
+
+	// 3 个已有条目删除 1 个、添加 2 个后超过 MaxEntries
+	f.lists["pl-4"].max = 3
+	if _, _, err := b.Plan(context.Background(), v4, v6); err == nil || !strings.Contains(err.Error(), "would need 4 entries but allows at most 3") {
+		t.Errorf("Plan error = %v, want the max entries error", err)
+	}
+
+	// IPv6 前缀列表只接收 IPv6 网段
+	b.PrefixLists = []string{"pl-6"}
+	plan, _, err = b.Plan(context.Background(), v4, v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PrefixListChange{{ID: "pl-6"}}; !reflect.DeepEqual(plan.PrefixLists, want) {
+		t.Errorf("plan = %+v, want %+v", plan.PrefixLists, want)
+	}
+}
+
+func TestModifyPrefixListBatches(t *testing.T) {
+	defer func(d time.Duration) { prefixListPoll = d }(prefixListPoll)
+	prefixListPoll = time.Millisecond
+
+	var add, remove []netip.Prefix
+	for i := range 250 {
+		add = append(add, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16))
+	}
+	for i := range 30 {
+		remove = append(remove, netip.PrefixFrom(netip.AddrFrom4([4]byte{172, 16, byte(i), 0}), 24))
+	}
+	f := &fakeEC2{lists: map[string]*fakePrefixList{"pl-4": {family: "IPv4", max: 1000, version: 7, busy: 1}}}
+	b := &Backend{Client: f, Description: marker}
+	if err := b.Execute(context.Background(), &Plan{PrefixLists: []PrefixListChange{{ID: "pl-4", Add: add, Remove: remove}}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DescribeManagedPrefixLists pl-4 modify-in-progress",
+		"DescribeManagedPrefixLists pl-4 modify-complete",
+		"ModifyManagedPrefixList pl-4 version 7: -30 +100",
+		"DescribeManagedPrefixLists pl-4 modify-in-progress",
+		"DescribeManagedPrefixLists pl-4 modify-complete",
+		"ModifyManagedPrefixList pl-4 version 8: -0 +100",
+		"DescribeManagedPrefixLists pl-4 modify-in-progress",
+		"DescribeManagedPrefixLists pl-4 modify-complete",
+		"ModifyManagedPrefixList pl-4 version 9: -0 +50",
+		"DescribeManagedPrefixLists pl-4 modify-in-progress",
+		"DescribeManagedPrefixLists pl-4 modify-complete",
+	}
+	if !reflect.DeepEqual(f.calls, want) {
+		t.Errorf("calls =\n%s\nwant:\n%s", strings.Join(f.calls, "\n"), strings.Join(want, "\n"))
+	}
+	var added []netip.Prefix
+	for _, in := range f.modified {
+		for _, e := range in.AddEntries {
+			if aws.ToString(e.Description) != marker {
+				t.Errorf("entry %s has description %q", aws.ToString(e.Cidr), aws.ToString(e.Description))
+			}
+			added = append(added, netip.MustParsePrefix(aws.ToString(e.Cidr)))
+		}
+	}
+	if !reflect.DeepEqual(added, add) {
+		t.Errorf("added %d entries, want %d in order", len(added), len(add))
+	}
+}
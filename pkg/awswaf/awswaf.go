@@ -0,0 +1,229 @@
+// Package awswaf 把网段同步到 AWS WAFv2 的 IP set，供 CloudFront、ALB 等的 WAF 规则引用。
+package awswaf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+
+	"github-updater/pkg/pipeline"
+)
+
+// MaxAddresses 是一个 IP set 最多容纳的地址数（WAF 的默认配额）
+const MaxAddresses = 10000
+
+// maxAttempts 是 UpdateIPSet 因 LockToken 过期（其他人同时修改）失败后重新读取并重试的总次数
+const maxAttempts = 5
+
+// retryDelay 是第一次重试前的等待时间，之后每次增加同样的时长
+var retryDelay = time.Second
+
+// WAFAPI 是 Backend 用到的 WAFv2 接口，*wafv2.Client 实现了它
+type WAFAPI interface {
+	GetIPSet(context.Context, *wafv2.GetIPSetInput, ...func(*wafv2.Options)) (*wafv2.GetIPSetOutput, error)
+	UpdateIPSet(context.Context, *wafv2.UpdateIPSetInput, ...func(*wafv2.Options)) (*wafv2.UpdateIPSetOutput, error)
+}
+
+// IPSet 标识一个 WAFv2 IP set，由 ParseARN 从 ARN 解析
+type IPSet struct {
+	ARN    string
+	Region string
+	Scope  types.Scope
+	Name   string
+	ID     string
+}
+
+// ParseARN 解析 arn:aws:wafv2:<region>:<account>:<regional|global>/ipset/<name>/<id>
+func ParseARN(s string) (IPSet, error) {
+	a, err := arn.Parse(s)
+	if err != nil || a.Service != "wafv2" {
+		return IPSet{}, fmt.Errorf("%q is not a WAFv2 ARN", s)
+	}
+	parts := strings.Split(a.Resource, "/")
+	if len(parts) != 4 || parts[1] != "ipset" {
+		return IPSet{}, fmt.Errorf("%q is not a WAFv2 IP set ARN (want <regional|global>/ipset/<name>/<id>)", s)
+	}
+	set := IPSet{ARN: s, Region: a.Region, Name: parts[2], ID: parts[3]}
+	switch parts[0] {
+	case "regional":
+		set.Scope = types.ScopeRegional
+	case "global":
+		set.Scope = types.ScopeCloudfront
+	default:
+		return IPSet{}, fmt.Errorf("%q has unknown scope %q", s, parts[0])
+	}
+	return set, nil
+}
+
+// Backend 用期望网段整体替换 IP set 的内容，实现 pipeline.Backend。
+// 每个 IP set 只有一个地址族，按 IPAddressVersion 写入 IPv4 或 IPv6 网段；
+// IP set 中的其他地址会被删除，应当专门用于本工具
+type Backend struct {
+	Sets []IPSet
+	// Client 为空时按默认的凭据链为每个 IP set 所在的 Region 创建
+	Client  WAFAPI
+	clients map[string]WAFAPI
+}
+
+// Change 是对一个 IP set 的修改
+type Change struct {
+	Set    IPSet
+	Add    []netip.Prefix
+	Remove []netip.Prefix
+}
+
+// Name 实现 pipeline.Backend
+func (b *Backend) Name() string { return "awswaf" }
+
+// Changes 读取各个 IP set 的现状，返回需要的修改以及现有的地址
+func (b *Backend) Changes(ctx context.Context, v4, v6 []netip.Prefix) ([]Change, []netip.Prefix, error) {
+	var (
+		changes  []Change
+		previous []netip.Prefix
+	)
+	for _, set := range b.Sets {
+		current, want, _, err := b.read(ctx, set, v4, v6)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = append(previous, current...)
+		d := pipeline.DiffPrefixes(current, want)
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			changes = append(changes, Change{Set: set, Add: d.Added, Remove: d.Removed})
+		}
+	}
+	return changes, previous, nil
+}
+
+// Describe 以每行一项的格式描述修改，用于 -dry-run
+func Describe(changes ...Change) string {
+	var w strings.Builder
+	for _, c := range changes {
+		for _, p := range c.Remove {
+			fmt.Fprintf(&w, "%s: remove %s\n", c.Set.Name, p)
+		}
+		for _, p := range c.Add {
+			fmt.Fprintf(&w, "%s: add %s\n", c.Set.Name, p)
+		}
+	}
+	return w.String()
+}
+
+// Apply 实现 pipeline.Backend：内容不同时用 GetIPSet 返回的 LockToken 调用 UpdateIPSet，
+// 期间有其他修改（WAFOptimisticLockException）时重新读取再试
+func (b *Backend) Apply(ctx context.Context, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	var previous []netip.Prefix
+	for _, set := range b.Sets {
+		current, err := b.update(ctx, set, v4, v6)
+		if err != nil {
+			return previous, err
+		}
+		previous = append(previous, current...)
+	}
+	return previous, nil
+}
+
+// Flush 实现 pipeline.Backend：清空全部 IP set
+func (b *Backend) Flush(ctx context.Context) ([]netip.Prefix, error) {
+	return b.Apply(ctx, nil, nil)
+}
+
+// update 把一个 IP set 替换为期望的内容，返回第一次读取到的地址
+func (b *Backend) update(ctx context.Context, set IPSet, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	client, err := b.client(ctx, set.Region)
+	if err != nil {
+		return nil, err
+	}
+	var previous []netip.Prefix
+	for attempt := 1; ; attempt++ {
+		current, want, got, err := b.read(ctx, set, v4, v6)
+		if err != nil {
+			return previous, err
+		}
+		if attempt == 1 {
+			previous = current
+		}
+		d := pipeline.DiffPrefixes(current, want)
+		if len(d.Added) == 0 && len(d.Removed) == 0 {
+			return previous, nil
+		}
+		addresses := make([]string, len(want))
+		for i, p := range want {
+			addresses[i] = p.String()
+		}
+		// UpdateIPSet 替换全部可修改的属性，Description 需要原样带上
+		_, err = client.UpdateIPSet(ctx, &wafv2.UpdateIPSetInput{
+			Name: aws.String(set.Name), Id: aws.String(set.ID), Scope: set.Scope,
+			Addresses: addresses, LockToken: got.LockToken, Description: got.IPSet.Description,
+		})
+		var stale *types.WAFOptimisticLockException
+		if errors.As(err, &stale) && attempt < maxAttempts {
+			select {
+			case <-ctx.Done():
+				return previous, ctx.Err()
+			case <-time.After(time.Duration(attempt) * retryDelay):
+			}
+			continue
+		}
+		if err != nil {
+			return previous, fmt.Errorf("update IP set %s: %w", set.Name, err)
+		}
+		return previous, nil
+	}
+}
+
+// read 读取 IP set，返回现有的地址、按其地址族选出的期望地址以及 GetIPSet 的结果
+func (b *Backend) read(ctx context.Context, set IPSet, v4, v6 []netip.Prefix) ([]netip.Prefix, []netip.Prefix, *wafv2.GetIPSetOutput, error) {
+	client, err := b.client(ctx, set.Region)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	out, err := client.GetIPSet(ctx, &wafv2.GetIPSetInput{Name: aws.String(set.Name), Id: aws.String(set.ID), Scope: set.Scope})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("get IP set %s: %w", set.Name, err)
+	}
+	want := v4
+	if out.IPSet.IPAddressVersion == types.IPAddressVersionIpv6 {
+		want = v6
+	}
+	if len(want) > MaxAddresses {
+		return nil, nil, nil, fmt.Errorf("IP set %s would need %d addresses but holds at most %d", set.Name, len(want), MaxAddresses)
+	}
+	var current []netip.Prefix
+	for _, s := range out.IPSet.Addresses {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("IP set %s: unsupported address %q", set.Name, s)
+		}
+		current = append(current, p)
+	}
+	return current, want, out, nil
+}
+
+// client 返回 Region 对应的客户端，Client 非空时总是使用它
+func (b *Backend) client(ctx context.Context, region string) (WAFAPI, error) {
+	if b.Client != nil {
+		return b.Client, nil
+	}
+	if c := b.clients[region]; c != nil {
+		return c, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load AWS configuration: %w", err)
+	}
+	if b.clients == nil {
+		b.clients = make(map[string]WAFAPI)
+	}
+	b.clients[region] = wafv2.NewFromConfig(cfg)
+	return b.clients[region], nil
+}
@@ -0,0 +1,176 @@
+package awswaf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+)
+
+// fakeIPSet 是 fakeWAF 中的一个 IP set，每次修改后换一个 LockToken
+type fakeIPSet struct {
+	version     types.IPAddressVersion
+	description string
+	addresses   []string
+	lock        int
+}
+
+// fakeWAF 实现 WAFAPI。conflicts 非零时，UpdateIPSet 之前先模拟一次其他人的修改
+type fakeWAF struct {
+	sets      map[string]*fakeIPSet
+	conflicts int
+	calls     []string
+	updates   []*wafv2.UpdateIPSetInput
+}
+
+func (f *fakeWAF) GetIPSet(ctx context.Context, in *wafv2.GetIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.GetIPSetOutput, error) {
+	s := f.sets[aws.ToString(in.Name)]
+	f.calls = append(f.calls, fmt.Sprintf("GetIPSet %s lock-%d", aws.ToString(in.Name), s.lock))
+	return &wafv2.GetIPSetOutput{
+		IPSet: &types.IPSet{
+			Name: in.Name, Id: in.Id, IPAddressVersion: s.version,
+			Description: aws.String(s.description), Addresses: s.addresses,
+		},
+		LockToken: aws.String(fmt.Sprintf("lock-%d", s.lock)),
+	}, nil
+}
+
+func (f *fakeWAF) UpdateIPSet(ctx context.Context, in *wafv2.UpdateIPSetInput, _ ...func(*wafv2.Options)) (*wafv2.UpdateIPSetOutput, error) {
+	s := f.sets[aws.ToString(in.Name)]
+	if f.conflicts > 0 {
+		f.conflicts--
+		s.lock++
+	}
+	f.calls = append(f.calls, fmt.Sprintf("UpdateIPSet %s %s", aws.ToString(in.Name), aws.ToString(in.LockToken)))
+	if aws.ToString(in.LockToken) != fmt.Sprintf("lock-%d", s.lock) {
+		return nil, &types.WAFOptimisticLockException{Message: aws.String("stale lock token")}
+	}
+	f.updates = append(f.updates, in)
+	s.addresses, s.description = in.Addresses, aws.ToString(in.Description)
+	s.lock++
+	return &wafv2.UpdateIPSetOutput{}, nil
+}
+
+func prefixes(cidrs ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, c := range cidrs {
+		ps = append(ps, netip.MustParsePrefix(c))
+	}
+	return ps
+}
+
+func TestApply(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	v4, v6 := prefixes("192.0.2.0/24", "198.51.100.0/24"), prefixes("2001:db8::/32")
+	sets := []IPSet{
+		{Name: "gh4", ID: "id-4", Scope: types.ScopeRegional},
+		{Name: "gh6", ID: "id-6", Scope: types.ScopeRegional},
+	}
+	tests := []struct {
+		name      string
+		gh4, gh6  []string // IP set 原有的地址
+		conflicts int
+		calls     []string
+		addresses map[string][]string // 修改后的地址，为 nil 时不检查
+		err       string
+	}{
+		{
+			name: "families split",
+			gh4:  []string{"192.0.2.0/24", "203.0.113.0/24"},
+			calls: []string{
+				"GetIPSet gh4 lock-0", "UpdateIPSet gh4 lock-0",
+				"GetIPSet gh6 lock-0", "UpdateIPSet gh6 lock-0",
+			},
+			addresses: map[string][]string{"gh4": {"192.0.2.0/24", "198.51.100.0/24"}, "gh6": {"2001:db8::/32"}},
+		},
+		{
+			name:  "unchanged",
+			gh4:   []string{"198.51.100.0/24", "192.0.2.0/24"},
+			gh6:   []string{"2001:db8::/32"},
+			calls: []string{"GetIPSet gh4 lock-0", "GetIPSet gh6 lock-0"},
+		},
+		{
+			name:      "lock token retried",
+			gh6:       []string{"2001:db8::/32"},
+			conflicts: 1,
+			calls: []string{
+				"GetIPSet gh4 lock-0", "UpdateIPSet gh4 lock-0",
+				"GetIPSet gh4 lock-1", "UpdateIPSet gh4 lock-1",
+				"GetIPSet gh6 lock-0",
+			},
+			addresses: map[string][]string{"gh4": {"192.0.2.0/24", "198.51.100.0/24"}, "gh6": {"2001:db8::/32"}},
+		},
+		{
+			name:      "lock token keeps changing",
+			conflicts: maxAttempts,
+			calls: []string{
+				"GetIPSet gh4 lock-0", "UpdateIPSet gh4 lock-0",
+				"GetIPSet gh4 lock-1", "UpdateIPSet gh4 lock-1",
+				"GetIPSet gh4 lock-2", "UpdateIPSet gh4 lock-2",
+				"GetIPSet gh4 lock-3", "UpdateIPSet gh4 lock-3",
+				"GetIPSet gh4 lock-4", "UpdateIPSet gh4 lock-4",
+			},
+			err: "update IP set gh4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeWAF{sets: map[string]*fakeIPSet{
+				"gh4": {version: types.IPAddressVersionIpv4, description: "GitHub Actions", addresses: tt.gh4},
+				"gh6": {version: types.IPAddressVersionIpv6, description: "GitHub Actions v6", addresses: tt.gh6},
+			}, conflicts: tt.conflicts}
+			b := &Backend{Sets: sets, Client: f}
+			previous, err := b.Apply(context.Background(), v4, v6)
+			if tt.err != "" {
+				var stale *types.WAFOptimisticLockException
+				if err == nil || !strings.Contains(err.Error(), tt.err) || !errors.As(err, &stale) {
+					t.Errorf("Apply error = %v, want %q wrapping the lock exception", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.calls, tt.calls) {
+				t.Errorf("calls = %v, want %v", f.calls, tt.calls)
+			}
+			if want := prefixes(append(append([]string(nil), tt.gh4...), tt.gh6...)...); tt.err == "" && !reflect.DeepEqual(previous, want) {
+				t.Errorf("previous = %v, want %v", previous, want)
+			}
+			for name, want := range tt.addresses {
+				if got := f.sets[name].addresses; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s addresses = %v, want %v", name, got, want)
+				}
+			}
+			for _, in := range f.updates {
+				if want := map[string]string{"gh4": "GitHub Actions", "gh6": "GitHub Actions v6"}[aws.ToString(in.Name)]; aws.ToString(in.Description) != want {
+					t.Errorf("%s updated with description %q, want %q", aws.ToString(in.Name), aws.ToString(in.Description), want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyTooManyAddresses(t *testing.T) {
+	var v4 []netip.Prefix
+	for i := range MaxAddresses + 1 {
+		v4 = append(v4, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24))
+	}
+	f := &fakeWAF{sets: map[string]*fakeIPSet{"gh4": {version: types.IPAddressVersionIpv4}}}
+	b := &Backend{Sets: []IPSet{{Name: "gh4", ID: "id-4", Scope: types.ScopeCloudfront}}, Client: f}
+	_, err := b.Apply(context.Background(), v4, nil)
+	if want := fmt.Sprintf("IP set gh4 would need %d addresses but holds at most %d", MaxAddresses+1, MaxAddresses); err == nil || err.Error() != want {
+		t.Errorf("Apply error = %v, want %q", err, want)
+	}
+	if len(f.updates) > 0 {
+		t.Error("UpdateIPSet called for an IP set over the limit")
+	}
+}
@@ -0,0 +1,250 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver 直接向 DNS 服务器查询 A/AAAA 记录，与系统解析器不同，它返回记录的 TTL，
+// 用于按 TTL 安排主机名来源的下一次解析
+type Resolver struct {
+	Server  string        // host:port，为空时使用 /etc/resolv.conf 中的第一个 nameserver
+	Timeout time.Duration // 每次查询的超时，0 表示 5s
+}
+
+// Resolution 是一个主机名的解析结果
+type Resolution struct {
+	Host  string
+	Addrs []netip.Addr  // 排序后的全部 A 和 AAAA 地址
+	TTL   time.Duration // CNAME 链上所有应答记录（包括 CNAME）中最小的 TTL
+}
+
+// Prefixes 返回每个地址对应的 /32 或 /128 网段
+func (r *Resolution) Prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(r.Addrs))
+	for i, a := range r.Addrs {
+		prefixes[i] = netip.PrefixFrom(a, a.BitLen())
+	}
+	return prefixes
+}
+
+// Resolve 分别查询 host 的 A 和 AAAA 记录
+func (r *Resolver) Resolve(ctx context.Context, host string) (*Resolution, error) {
+	server, err := r.server()
+	if err != nil {
+		return nil, err
+	}
+	res := &Resolution{Host: host, TTL: -1}
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		addrs, ttl, err := r.query(ctx, server, host, qtype)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", host, err)
+		}
+		res.Addrs = append(res.Addrs, addrs...)
+		if ttl >= 0 && (res.TTL < 0 || ttl < res.TTL) {
+			res.TTL = ttl
+		}
+	}
+	if len(res.Addrs) == 0 {
+		return nil, fmt.Errorf("resolve %s: no A or AAAA records", host)
+	}
+	slices.SortFunc(res.Addrs, netip.Addr.Compare)
+	res.Addrs = slices.Compact(res.Addrs)
+	res.TTL = max(res.TTL, 0)
+	return res, nil
+}
+
+// server 返回查询使用的服务器地址
+func (r *Resolver) server() (string, error) {
+	if r.Server != "" {
+		if _, _, err := net.SplitHostPort(r.Server); err != nil {
+			return net.JoinHostPort(r.Server, "53"), nil
+		}
+		return r.Server, nil
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("no DNS resolver configured: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// query 发送一个查询，应答被截断时改用 TCP。返回地址和最小 TTL（没有记录时为 -1）
+func (r *Resolver) query(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	q, msg, err := buildQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := exchange(ctx, "udp", server, msg)
+	if err == nil {
+		var p dnsmessage.Parser
+		if h, herr := p.Start(resp); herr == nil && h.Truncated {
+			resp, err = exchange(ctx, "tcp", server, msg)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseResponse(resp, id, q)
+}
+
+// exchange 发送查询并读取应答，TCP 时带两字节长度前缀
+func exchange(ctx context.Context, network, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, buf)
+	return buf, err
+}
+
+// buildQuery 生成一个要求递归的查询报文，同时返回其中的问题，用于核对应答
+func buildQuery(id uint16, host string, qtype dnsmessage.Type) (dnsmessage.Question, []byte, error) {
+	host = strings.TrimSuffix(host, ".")
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return dnsmessage.Question{}, nil, fmt.Errorf("invalid hostname %q", host)
+		}
+	}
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return dnsmessage.Question{}, nil, fmt.Errorf("invalid hostname %q: %w", host, err)
+	}
+	q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{Header: dnsmessage.Header{ID: id, RecursionDesired: true}, Questions: []dnsmessage.Question{q}}
+	packed, err := msg.Pack()
+	return q, packed, err
+}
+
+var errMalformed = errors.New("malformed DNS response")
+
+// maxCNAMEs 是跟随 CNAME 链的最大长度，超过时视为循环
+const maxCNAMEs = 8
+
+// parseResponse 核对应答的 ID 和问题，从问题中的名称出发沿 CNAME 链取出应答部分中 q.Type 类型的地址，
+// 以及链上记录（包括 CNAME）的最小 TTL。其他名称的记录以及授权和附加部分的记录都被忽略
+func parseResponse(msg []byte, id uint16, q dnsmessage.Question) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, fmt.Errorf("%w: not a response to the query", errMalformed)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errors.New("no such host")
+	default:
+		return nil, 0, fmt.Errorf("DNS server returned rcode %d", h.RCode)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errMalformed, err)
+	}
+	if len(questions) != 1 || questions[0].Type != q.Type || questions[0].Class != q.Class || !sameName(questions[0].Name, q.Name) {
+		return nil, 0, fmt.Errorf("%w: answers a different question", errMalformed)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errMalformed, err)
+	}
+
+	var addrs []netip.Addr
+	ttl := time.Duration(-1)
+	use := func(h dnsmessage.ResourceHeader) {
+		if t := time.Duration(h.TTL) * time.Second; ttl < 0 || t < ttl {
+			ttl = t
+		}
+	}
+	name := q.Name
+	for range maxCNAMEs + 1 {
+		var next *dnsmessage.Name
+		for _, rr := range answers {
+			if rr.Header.Class != dnsmessage.ClassINET || !sameName(rr.Header.Name, name) {
+				continue
+			}
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				if q.Type == dnsmessage.TypeA {
+					addrs = append(addrs, netip.AddrFrom4(body.A))
+					use(rr.Header)
+				}
+			case *dnsmessage.AAAAResource:
+				if q.Type == dnsmessage.TypeAAAA {
+					addrs = append(addrs, netip.AddrFrom16(body.AAAA).Unmap())
+					use(rr.Header)
+				}
+			case *dnsmessage.CNAMEResource:
+				if next == nil {
+					next = &body.CNAME
+					use(rr.Header)
+				}
+			}
+		}
+		// 有地址时链已经结束；名称同时有 CNAME 和地址的应答不合规，以地址为准
+		if len(addrs) > 0 || next == nil {
+			return addrs, ttl, nil
+		}
+		name = *next
+	}
+	return nil, 0, fmt.Errorf("%w: CNAME chain longer than %d", errMalformed, maxCNAMEs)
+}
+
+// sameName 按 DNS 的规则不区分大小写比较两个名称
+func sameName(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
@@ -0,0 +1,208 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsRR 是测试应答中的一条记录，value 为地址或 CNAME 的目标
+type dnsRR struct {
+	name, value string
+	ttl         uint32
+}
+
+func (rr dnsRR) resource(t *testing.T) dnsmessage.Resource {
+	t.Helper()
+	h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(rr.name), Class: dnsmessage.ClassINET, TTL: rr.ttl}
+	if a, err := netip.ParseAddr(rr.value); err == nil {
+		if a.Is4() {
+			return dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: a.As4()}}
+		}
+		return dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: a.As16()}}
+	}
+	return dnsmessage.Resource{Header: h, Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(rr.value)}}
+}
+
+// dnsResponse 生成对 q 的应答，answers 放在应答部分，authority 放在授权部分
+func dnsResponse(t *testing.T, id uint16, rcode dnsmessage.RCode, q dnsmessage.Question, answers, authority []dnsRR) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, RecursionAvailable: true, RCode: rcode},
+		Questions: []dnsmessage.Question{q},
+	}
+	for _, rr := range answers {
+		msg.Answers = append(msg.Answers, rr.resource(t))
+	}
+	for _, rr := range authority {
+		msg.Authorities = append(msg.Authorities, rr.resource(t))
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func question(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+func TestParseResponse(t *testing.T) {
+	const id = 0x1234
+	q := question("api.example.com.", dnsmessage.TypeA)
+	tests := []struct {
+		name      string
+		q         dnsmessage.Question // 应答中的问题，为空时与查询相同
+		id        uint16
+		rcode     dnsmessage.RCode
+		answers   []dnsRR
+		authority []dnsRR
+		qtype     dnsmessage.Type // 查询类型，为 0 时为 A
+		want      []string
+		wantTTL   time.Duration
+		wantErr   string
+	}{
+		{
+			name:    "address records",
+			answers: []dnsRR{{"api.example.com.", "192.0.2.1", 300}, {"api.example.com.", "192.0.2.2", 60}},
+			want:    []string{"192.0.2.1", "192.0.2.2"}, wantTTL: time.Minute,
+		},
+		{
+			name:    "names compared without case",
+			answers: []dnsRR{{"API.Example.COM.", "192.0.2.1", 300}},
+			want:    []string{"192.0.2.1"}, wantTTL: 300 * time.Second,
+		},
+		{
+			name: "CNAME chain in any order",
+			answers: []dnsRR{
+				{"edge.cdn.example.net.", "198.51.100.7", 600},
+				{"api.example.com.", "api.cdn.example.net.", 3600},
+				{"api.cdn.example.net.", "edge.cdn.example.net.", 30},
+			},
+			want: []string{"198.51.100.7"}, wantTTL: 30 * time.Second,
+		},
+		{
+			name: "records for other names ignored",
+			answers: []dnsRR{
+				{"api.example.com.", "api.cdn.example.net.", 3600},
+				{"evil.example.org.", "203.0.113.66", 1},
+				{"api.cdn.example.net.", "198.51.100.7", 600},
+			},
+			want: []string{"198.51.100.7"}, wantTTL: 600 * time.Second,
+		},
+		{
+			name:      "authority section ignored",
+			answers:   []dnsRR{{"api.example.com.", "192.0.2.1", 300}},
+			authority: []dnsRR{{"api.example.com.", "203.0.113.66", 5}},
+			want:      []string{"192.0.2.1"}, wantTTL: 300 * time.Second,
+		},
+		{
+			name:    "other address family ignored",
+			qtype:   dnsmessage.TypeAAAA,
+			answers: []dnsRR{{"api.example.com.", "192.0.2.1", 300}, {"api.example.com.", "2001:db8::1", 120}},
+			want:    []string{"2001:db8::1"}, wantTTL: 2 * time.Minute,
+		},
+		{name: "no records", wantTTL: -1},
+		{name: "wrong id", id: 0x4321, answers: []dnsRR{{"api.example.com.", "192.0.2.1", 300}}, wantErr: "not a response"},
+		{name: "other name", q: question("evil.example.org.", dnsmessage.TypeA), answers: []dnsRR{{"evil.example.org.", "203.0.113.66", 300}}, wantErr: "different question"},
+		{name: "other type", q: question("api.example.com.", dnsmessage.TypeAAAA), wantErr: "different question"},
+		{name: "no such host", rcode: dnsmessage.RCodeNameError, wantErr: "no such host"},
+		{name: "server failure", rcode: dnsmessage.RCodeServerFailure, wantErr: "rcode 2"},
+		{
+			name:    "CNAME loop",
+			answers: []dnsRR{{"api.example.com.", "a.example.net.", 60}, {"a.example.net.", "api.example.com.", 60}},
+			wantErr: "CNAME chain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := q
+			if tt.qtype != 0 {
+				query.Type = tt.qtype
+			}
+			respQ := query
+			if tt.q.Type != 0 {
+				respQ = tt.q
+			}
+			respID := uint16(id)
+			if tt.id != 0 {
+				respID = tt.id
+			}
+			addrs, ttl, err := parseResponse(dnsResponse(t, respID, tt.rcode, respQ, tt.answers, tt.authority), id, query)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, a := range addrs {
+				got = append(got, a.String())
+			}
+			if !slices.Equal(got, tt.want) || ttl != tt.wantTTL {
+				t.Errorf("got %v ttl %v, want %v ttl %v", got, ttl, tt.want, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestParseResponseMalformed(t *testing.T) {
+	q := question("api.example.com.", dnsmessage.TypeA)
+	full := dnsResponse(t, 1, dnsmessage.RCodeSuccess, q, []dnsRR{{"api.example.com.", "192.0.2.1", 300}}, nil)
+	for _, n := range []int{0, 11, 20, len(full) - 1} {
+		if _, _, err := parseResponse(full[:n], 1, q); !errors.Is(err, errMalformed) {
+			t.Errorf("%d bytes: error = %v, want errMalformed", n, err)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			answers := []dnsRR{{"github.com.", "140.82.112.3", 60}}
+			if q.Type == dnsmessage.TypeAAAA {
+				answers = nil
+			}
+			conn.WriteTo(dnsResponse(t, h.ID, dnsmessage.RCodeSuccess, q, answers, nil), addr)
+		}
+	}()
+
+	r := &Resolver{Server: conn.LocalAddr().String(), Timeout: 2 * time.Second}
+	res, err := r.Resolve(context.Background(), "GitHub.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Addrs, []netip.Addr{netip.MustParseAddr("140.82.112.3")}) || res.TTL != time.Minute {
+		t.Errorf("resolution = %v ttl %v", res.Addrs, res.TTL)
+	}
+}
@@ -0,0 +1,350 @@
+// Package fetch 从 GitHub meta API 获取 IP 网段。
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultURL 是 GitHub meta API 的地址
+	DefaultURL = "https://api.github.com/meta"
+	// DefaultUserAgent 是请求时默认使用的 User-Agent
+	DefaultUserAgent = "go-nft-updater/1.0"
+)
+
+// ErrDecode 表示响应已收到但无法解码
+var ErrDecode = errors.New("decode meta")
+
+// ErrStale 表示响应来自过期的缓存（见 Client.MaxAge 和 Client.NotBefore）
+var ErrStale = errors.New("stale meta response")
+
+// Meta 是 meta API 响应中本工具关心的部分（各分类的 CIDR 列表）
+type Meta struct {
+	Hooks      []string `json:"hooks"`
+	Web        []string `json:"web"`
+	API        []string `json:"api"`
+	Git        []string `json:"git"`
+	Packages   []string `json:"packages"`
+	Pages      []string `json:"pages"`
+	Importer   []string `json:"importer"`
+	Actions    []string `json:"actions"`
+	Dependabot []string `json:"dependabot"`
+	Copilot    []string `json:"copilot"`
+}
+
+// DefaultCategories 是未指定分类时使用的分类
+var DefaultCategories = []string{"actions"}
+
+// Categories 按分类名返回全部分类的原始 CIDR 列表
+func (m *Meta) Categories() map[string][]string {
+	return map[string][]string{
+		"hooks":      m.Hooks,
+		"web":        m.Web,
+		"api":        m.API,
+		"git":        m.Git,
+		"packages":   m.Packages,
+		"pages":      m.Pages,
+		"importer":   m.Importer,
+		"actions":    m.Actions,
+		"dependabot": m.Dependabot,
+		"copilot":    m.Copilot,
+	}
+}
+
+// Select 返回指定分类的原始 CIDR 列表，names 为空时使用 DefaultCategories
+func (m *Meta) Select(names []string) (map[string][]string, error) {
+	if len(names) == 0 {
+		names = DefaultCategories
+	}
+	all := m.Categories()
+	selected := make(map[string][]string, len(names))
+	for _, name := range names {
+		cidrs, ok := all[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+		selected[name] = cidrs
+	}
+	return selected, nil
+}
+
+// ValidCategory 判断是否为已知的分类
+func ValidCategory(name string) bool {
+	_, ok := (&Meta{}).Categories()[name]
+	return ok
+}
+
+// Result 是一次获取解析后的结果
+type Result struct {
+	Categories map[string][]netip.Prefix // 按分类名组织的网段
+	Invalid    []string                  // 无法解析而被跳过的条目
+	Bytes      int64                     // 从网络读取的响应体字节数，读取本地文件时为 0
+	Date       time.Time                 // 响应的 Date 头部，读取本地文件或没有该头部时为零值
+	RateLimit  *RateLimit                // 响应中的配额，没有 X-RateLimit-* 头部时为 nil
+	Missing    []string                  // 请求了但文档中没有的分类（不在 Categories 中）
+	FinalURL   string                    // 经过重定向时为最终的地址（已去除凭据），否则为空
+}
+
+// RateLimit 是响应的 X-RateLimit-* 头部给出的请求配额，同一令牌或地址的所有请求共用
+type RateLimit struct {
+	Limit     int       // 每个窗口的请求数
+	Remaining int       // 当前窗口剩余的请求数
+	Reset     time.Time // 当前窗口结束的时间
+}
+
+// parseRateLimit 解析配额头部，缺少或无法解析时返回 nil
+func parseRateLimit(h http.Header) *RateLimit {
+	limit, err1 := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || limit <= 0 {
+		return nil
+	}
+	return &RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}
+}
+
+// Total 返回获取到的条目总数（含无效条目）
+func (r *Result) Total() int {
+	n := len(r.Invalid)
+	for _, prefixes := range r.Categories {
+		n += len(prefixes)
+	}
+	return n
+}
+
+// Select 返回只含 names 中分类的副本，names 为空时使用 DefaultCategories，r 中没有的分类记在 Missing 中。
+// 网段与 r 共用，不应修改
+func (r *Result) Select(names []string) *Result {
+	if len(names) == 0 {
+		names = DefaultCategories
+	}
+	sel := *r
+	sel.Categories = make(map[string][]netip.Prefix, len(names))
+	sel.Missing = nil
+	for _, name := range names {
+		if prefixes, ok := r.Categories[name]; ok {
+			sel.Categories[name] = prefixes
+		} else {
+			sel.Missing = append(sel.Missing, name)
+		}
+	}
+	return &sel
+}
+
+// Client 请求 meta API，零值使用默认地址和 http.DefaultClient
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+	File       string   // 非空时从本地文件读取 meta 文档，不访问网络
+	Categories []string // 要获取的分类，为空时使用 DefaultCategories
+	UserAgent  string
+	Trace      TraceFunc // 非 nil 时输出请求/响应及各阶段耗时，敏感头部会被隐去
+
+	// MaxAge 大于 0 时，Age 头部超过该值的响应视为来自过期的 CDN 缓存
+	MaxAge time.Duration
+	// NotBefore 非零时，Date 头部早于该时间（之前见过的最新响应）的响应视为过期
+	NotBefore time.Time
+	// NoCache 为 true 时要求缓存向源站重新验证（Cache-Control: no-cache）
+	NoCache bool
+	// MaxRedirects 大于 0 时限制跟随的重定向次数，小于 0 时不跟随任何重定向，0 使用 http.Client 的默认行为
+	MaxRedirects int
+	// HTTPSRedirectsOnly 为 true 时拒绝重定向到非 HTTPS 地址
+	HTTPSRedirectsOnly bool
+}
+
+// Fetch 获取 meta 文档并以流式方式按分类解析网段，见 Decode
+func (c *Client) Fetch(ctx context.Context) (*Result, error) {
+	for _, name := range c.Categories {
+		if !ValidCategory(name) {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+	}
+	body, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	res, err := Decode(body, c.Categories)
+	if err != nil {
+		return nil, c.decodeError(err)
+	}
+	if b, ok := body.(*responseBody); ok {
+		res.Bytes, res.Date, res.RateLimit, res.FinalURL = b.n, b.date, b.rateLimit, b.finalURL
+	}
+	return res, nil
+}
+
+// Source 返回用于展示的数据来源（已去除 URL 中的凭据）
+func (c *Client) Source() string {
+	if c.File != "" {
+		return c.File
+	}
+	if u, err := url.Parse(c.url()); err == nil {
+		return u.Redacted()
+	}
+	return c.url()
+}
+
+func (c *Client) url() string {
+	if c.URL == "" {
+		return DefaultURL
+	}
+	return c.URL
+}
+
+// FetchMeta 请求并解码完整的原始 meta 文档
+func (c *Client) FetchMeta(ctx context.Context) (*Meta, error) {
+	body, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var meta Meta
+	if err := json.NewDecoder(body).Decode(&meta); err != nil {
+		return nil, c.decodeError(err)
+	}
+	return &meta, nil
+}
+
+func (c *Client) decodeError(err error) error {
+	if c.File != "" {
+		return fmt.Errorf("%w: %s: %w", ErrDecode, c.File, err)
+	}
+	return fmt.Errorf("%w: %w", ErrDecode, err)
+}
+
+// open 打开本地文件或发出请求，返回 meta 文档的内容
+func (c *Client) open(ctx context.Context) (io.ReadCloser, error) {
+	if c.File != "" {
+		return os.Open(c.File)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.MaxRedirects != 0 || c.HTTPSRedirectsOnly {
+		limited := *client
+		limited.CheckRedirect = c.checkRedirect
+		client = &limited
+	}
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if c.NoCache {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+	if c.Trace != nil {
+		req = withTrace(req, c.Trace)
+		traceRequest(req, c.Trace)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.Trace != nil {
+		traceResponse(resp, c.Trace)
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	date, err := c.checkFresh(resp.Header)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	body := &responseBody{countingReader: countingReader{r: resp.Body}, body: resp.Body, trace: c.Trace, date: date, rateLimit: parseRateLimit(resp.Header)}
+	if final := resp.Request.URL; final.String() != req.URL.String() {
+		body.finalURL = final.Redacted()
+	}
+	return body, nil
+}
+
+// checkRedirect 按 MaxRedirects 和 HTTPSRedirectsOnly 决定是否跟随重定向
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.MaxRedirects < 0 {
+		return fmt.Errorf("redirected to %s, but redirects are not allowed", req.URL.Redacted())
+	}
+	max := c.MaxRedirects
+	if max == 0 {
+		max = 10
+	}
+	if len(via) > max {
+		return fmt.Errorf("stopped after %d redirects (last to %s)", max, req.URL.Redacted())
+	}
+	if c.HTTPSRedirectsOnly && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing redirect from %s to non-HTTPS %s", via[len(via)-1].URL.Redacted(), req.URL.Redacted())
+	}
+	if c.Trace != nil {
+		c.Trace("trace: redirected to %s", req.URL.Redacted())
+	}
+	return nil
+}
+
+// checkFresh 按 MaxAge 和 NotBefore 检查响应是否来自过期的缓存，返回响应的 Date。
+// 错误中带有相关的头部，便于确认是哪个缓存节点
+func (c *Client) checkFresh(h http.Header) (time.Time, error) {
+	date, _ := http.ParseTime(h.Get("Date"))
+	if c.MaxAge > 0 {
+		if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && time.Duration(age)*time.Second > c.MaxAge {
+			return date, fmt.Errorf("%w: Age %ds exceeds %s (Date: %q, Age: %q)", ErrStale, age, c.MaxAge, h.Get("Date"), h.Get("Age"))
+		}
+	}
+	if !c.NotBefore.IsZero() && !date.IsZero() && date.Before(c.NotBefore) {
+		return date, fmt.Errorf("%w: Date is older than the last seen response from %s (Date: %q, Age: %q)",
+			ErrStale, c.NotBefore.UTC().Format(http.TimeFormat), h.Get("Date"), h.Get("Age"))
+	}
+	return date, nil
+}
+
+// responseBody 在关闭时输出读取的字节数（启用 Trace 时）
+type responseBody struct {
+	countingReader
+	body      io.Closer
+	trace     TraceFunc
+	date      time.Time
+	rateLimit *RateLimit
+	finalURL  string
+}
+
+func (b *responseBody) Close() error {
+	if b.trace != nil {
+		b.trace("trace: < body %d bytes", b.n)
+	}
+	return b.body.Close()
+}
+
+// Parse 把各分类的 CIDR 字符串解析为 netip.Prefix，跳过无效的
+func Parse(byCategory map[string][]string) *Result {
+	res := &Result{Categories: make(map[string][]netip.Prefix, len(byCategory))}
+	for category, cidrs := range byCategory {
+		prefixes := make([]netip.Prefix, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				res.Invalid = append(res.Invalid, cidr)
+				continue
+			}
+			prefixes = append(prefixes, p)
+		}
+		res.Categories[category] = prefixes
+	}
+	return res
+}
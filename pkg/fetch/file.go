@@ -0,0 +1,45 @@
+package fetch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ReadCIDRFile 读取每行一个 CIDR 的文件，忽略空行和 # 开头的注释。
+// 解析错误会带上文件名和行号，一次报告全部错误行。
+func ReadCIDRFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		prefixes []netip.Prefix
+		errs     []error
+	)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, line, err))
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := errors.Join(append(errs, scanner.Err())...); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
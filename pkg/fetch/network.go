@@ -0,0 +1,60 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	waitInitialBackoff = 500 * time.Millisecond
+	waitMaxBackoff     = 10 * time.Second
+	probeTimeout       = 5 * time.Second
+)
+
+// WaitForNetwork 在 timeout 内反复探测 meta 主机（DNS 解析 + TCP 连接），
+// 失败时按指数退避重试，直到可达或超时。
+func (c *Client) WaitForNetwork(ctx context.Context, timeout time.Duration) error {
+	u, err := url.Parse(c.url())
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	backoff := waitInitialBackoff
+	for {
+		err := probe(ctx, u.Hostname(), port)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("network not reachable after %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, waitMaxBackoff)
+	}
+}
+
+func probe(ctx context.Context, host, port string) error {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: probeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0], port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,123 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Decode 以流式方式解析 meta 文档：逐个读取 token，只保留 names 中分类的网段并在读到时立即解析，
+// 其他字段直接跳过，内存占用与结果大小而不是整个文档成正比。names 为空时使用 DefaultCategories。
+// 文档中没有的分类记在 Result.Missing 中，值为 null 的分类视为存在但为空
+func Decode(r io.Reader, names []string) (*Result, error) {
+	if len(names) == 0 {
+		names = DefaultCategories
+	}
+	res := &Result{Categories: make(map[string][]netip.Prefix, len(names))}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !ValidCategory(name) {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+		res.Categories[name] = []netip.Prefix{}
+	}
+
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		if _, ok := res.Categories[key]; !ok {
+			if err := skipValue(dec); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seen[key] = true
+		if err := decodeCIDRs(dec, key, res); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !seen[name] {
+			delete(res.Categories, name)
+			res.Missing = append(res.Missing, name)
+		}
+	}
+	return res, nil
+}
+
+// decodeCIDRs 读取一个分类的 CIDR 数组，null 视为空数组
+func decodeCIDRs(dec *json.Decoder, category string, res *Result) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("%s: expected an array, got %v", category, tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			res.Invalid = append(res.Invalid, "null")
+			continue
+		}
+		cidr, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %v", category, tok)
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			res.Invalid = append(res.Invalid, cidr)
+			continue
+		}
+		res.Categories[category] = append(res.Categories[category], p)
+	}
+	return expectDelim(dec, ']')
+}
+
+// skipValue 跳过下一个值（包括嵌套的对象和数组），不保留其内容
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
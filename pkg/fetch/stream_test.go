@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	doc := `{
+		"verifiable_password_authentication": false,
+		"ssh_key_fingerprints": {"SHA256_ED25519": "+DiY3wvvV6TuJJhbpZisF/zLDA0zPMSvHdkr4UvCOqU"},
+		"hooks": ["192.30.252.0/22", "2606:50c0::/32", "not-a-cidr", null],
+		"web": null,
+		"domains": {"website": ["*.github.com"], "actions_inbound": {"full_domains": ["github.com"]}},
+		"api": ["140.82.112.0/20"]
+	}`
+	res, err := Decode(strings.NewReader(doc), []string{"hooks", "web", "git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]netip.Prefix{
+		"hooks": {netip.MustParsePrefix("192.30.252.0/22"), netip.MustParsePrefix("2606:50c0::/32")},
+		"web":   {},
+	}
+	if !reflect.DeepEqual(res.Categories, want) {
+		t.Errorf("categories = %v, want %v", res.Categories, want)
+	}
+	if !reflect.DeepEqual(res.Invalid, []string{"not-a-cidr", "null"}) {
+		t.Errorf("invalid = %q", res.Invalid)
+	}
+	if !reflect.DeepEqual(res.Missing, []string{"git"}) {
+		t.Errorf("missing = %q, want [git]", res.Missing)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name, doc string
+		names     []string
+	}{
+		{"unknown category", `{}`, []string{"gists"}},
+		{"not an object", `["192.0.2.0/24"]`, nil},
+		{"category not an array", `{"actions": "192.0.2.0/24"}`, nil},
+		{"number in array", `{"actions": [1]}`, nil},
+		{"truncated", `{"actions": ["192.0.2.0/24"`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(strings.NewReader(tt.doc), tt.names); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+// benchmarkMeta 生成与真实 meta 文档结构相近的文档：actions 有 n 个网段，其他分类较小，另有嵌套的 domains
+func benchmarkMeta(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"verifiable_password_authentication": false, "ssh_keys": ["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"],`)
+	for _, name := range []string{"hooks", "web", "api", "git", "packages", "pages", "importer", "dependabot", "copilot"} {
+		fmt.Fprintf(&b, `"%s": ["192.30.252.0/22", "185.199.108.0/22", "140.82.112.0/20", "2a0a:a440::/29", "2606:50c0::/32"],`, name)
+	}
+	b.WriteString(`"actions": [`)
+	for i := range n {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		if i%4 == 3 {
+			fmt.Fprintf(&b, `"2603:1030:%x::/48"`, i)
+		} else {
+			fmt.Fprintf(&b, `"%d.%d.%d.0/24"`, 4+i>>16, i>>8&0xff, i&0xff)
+		}
+	}
+	b.WriteString(`], "domains": {"website": ["*.github.com", "*.github.dev"], "actions_inbound": {"full_domains": ["github.com"], "wildcard_domains": ["*.actions.githubusercontent.com"]}}}`)
+	return b.Bytes()
+}
+
+func BenchmarkDecode(b *testing.B) {
+	doc := benchmarkMeta(5000)
+	for _, names := range [][]string{{"hooks"}, {"actions"}} {
+		b.Run(strings.Join(names, ","), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for b.Loop() {
+				if _, err := Decode(bytes.NewReader(doc), names); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecodeUnmarshal 是流式解析之前的做法：整个文档解码为 Meta，再选出分类逐个解析，用于对比
+func BenchmarkDecodeUnmarshal(b *testing.B) {
+	doc := benchmarkMeta(5000)
+	for _, names := range [][]string{{"hooks"}, {"actions"}} {
+		b.Run(strings.Join(names, ","), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(doc)))
+			for b.Loop() {
+				var m Meta
+				if err := json.NewDecoder(bytes.NewReader(doc)).Decode(&m); err != nil {
+					b.Fatal(err)
+				}
+				selected, err := m.Select(names)
+				if err != nil {
+					b.Fatal(err)
+				}
+				categories := make(map[string][]netip.Prefix, len(selected))
+				for name, cidrs := range selected {
+					for _, s := range cidrs {
+						if p, err := netip.ParsePrefix(s); err == nil {
+							categories[name] = append(categories[name], p)
+						}
+					}
+				}
+			}
+		})
+	}
+}
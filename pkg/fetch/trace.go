@@ -0,0 +1,94 @@
+package fetch
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TraceFunc 接收 -trace 模式下的诊断输出
+type TraceFunc func(format string, v ...interface{})
+
+// sensitiveHeaders 中的头部在跟踪输出中只显示为 [REDACTED]
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+func redactHeaders(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(k)] {
+			v = "[REDACTED]"
+		}
+		parts = append(parts, k+": "+v)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// withTrace 为请求挂上 httptrace，记录 DNS/连接/TLS 各阶段耗时
+func withTrace(req *http.Request, trace TraceFunc) *http.Request {
+	var dnsStart, connectStart, tlsStart time.Time
+	start := time.Now()
+	ct := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			trace("trace: DNS resolved %v in %s (err: %v)", info.Addrs, time.Since(dnsStart), info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			trace("trace: connect %s %s in %s (err: %v)", network, addr, time.Since(connectStart), err)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			trace("trace: TLS handshake (%s) in %s (err: %v)", tls.VersionName(state.Version), time.Since(tlsStart), err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace("trace: got connection to %s (reused: %v)", info.Conn.RemoteAddr(), info.Reused)
+		},
+		GotFirstResponseByte: func() {
+			trace("trace: first response byte after %s", time.Since(start))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+}
+
+func traceRequest(req *http.Request, trace TraceFunc) {
+	trace("trace: > %s %s", req.Method, req.URL.Redacted())
+	trace("trace: > headers: %s", redactHeaders(req.Header))
+}
+
+func traceResponse(resp *http.Response, trace TraceFunc) {
+	trace("trace: < %s", resp.Status)
+	trace("trace: < headers: %s", redactHeaders(resp.Header))
+}
+
+// countingReader 统计读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,255 @@
+// Package firewalld 通过 firewall-cmd 维护 firewalld 的 hash:net ipset 对象，
+// 用于不允许绕过 firewalld 直接修改 nftables 或 iptables 的主机。
+package firewalld
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github-updater/pkg/pipeline"
+)
+
+// defaultMaxElem 是新建 ipset 的 maxelem，网段更多时按数量调大
+const defaultMaxElem = 65536
+
+// Backend 用 firewalld 的 ipset 保存期望网段，实现 pipeline.Backend。
+// 条目按差异同时在永久配置和运行时配置中增删，不重新加载 firewalld，其他运行时修改不受影响。
+// firewall-cmd 不能在运行时创建集合或修改集合的选项，集合不存在或需要调大 maxelem 时
+// 只修改永久配置，最后执行一次 --reload
+type Backend struct {
+	IPv4Set string
+	IPv6Set string
+	Path    string // 为空时使用 PATH 中的 "firewall-cmd"
+}
+
+// Change 是对一个 firewalld ipset 的修改
+type Change struct {
+	Name    string
+	Family  string // inet 或 inet6
+	Create  bool   // 集合不存在，需要先创建
+	MaxElem int    // 非零时把现有集合的 maxelem 调大到该值
+	Add     []netip.Prefix
+	Remove  []netip.Prefix
+}
+
+// command 是一次 firewall-cmd 调用，Entries 非空时通过标准输入传给 --*-entries-from-file
+type command struct {
+	Args    []string
+	Entries []netip.Prefix
+}
+
+// Name 实现 pipeline.Backend
+func (b *Backend) Name() string { return "firewalld" }
+
+// Changes 读取永久配置中集合的现状，返回需要的修改以及集合现有的条目
+func (b *Backend) Changes(ctx context.Context, v4, v6 []netip.Prefix) ([]Change, []netip.Prefix, error) {
+	names, err := b.ipsets(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		changes  []Change
+		previous []netip.Prefix
+	)
+	for _, want := range []struct {
+		name, family string
+		prefixes     []netip.Prefix
+	}{{b.IPv4Set, "inet", v4}, {b.IPv6Set, "inet6", v6}} {
+		if want.name == "" {
+			continue
+		}
+		c := Change{Name: want.name, Family: want.family, Create: !slices.Contains(names, want.name)}
+		var current []netip.Prefix
+		if !c.Create {
+			if current, err = b.List(ctx, want.name); err != nil {
+				return nil, nil, err
+			}
+			maxElem, err := b.maxElem(ctx, want.name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(want.prefixes) > maxElem {
+				c.MaxElem = len(want.prefixes)
+			}
+		}
+		previous = append(previous, current...)
+		d := pipeline.DiffPrefixes(current, want.prefixes)
+		c.Add, c.Remove = d.Added, d.Removed
+		if c.Create || c.MaxElem > 0 || len(c.Add) > 0 || len(c.Remove) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	return changes, previous, nil
+}
+
+// commands 把修改转换为 firewall-cmd 调用：条目的增删先写入永久配置，再对运行时配置执行一次。
+// 有集合需要创建或调大 maxelem 时改为最后执行 --reload，由 firewalld 按永久配置重建运行时的集合
+func commands(changes []Change) []command {
+	reload := slices.ContainsFunc(changes, func(c Change) bool { return c.Create || c.MaxElem > 0 })
+	var cmds []command
+	for _, scope := range [][]string{{"--permanent"}, nil} {
+		if scope == nil && reload {
+			break
+		}
+		for _, c := range changes {
+			if scope != nil && c.Create {
+				cmds = append(cmds, command{Args: []string{"--permanent", "--new-ipset=" + c.Name, "--type=hash:net",
+					"--option=family=" + c.Family, fmt.Sprintf("--option=maxelem=%d", max(defaultMaxElem, len(c.Add)))}})
+			}
+			if scope != nil && c.MaxElem > 0 {
+				cmds = append(cmds, command{Args: []string{"--permanent", "--ipset=" + c.Name, fmt.Sprintf("--add-option=maxelem=%d", c.MaxElem)}})
+			}
+			if len(c.Remove) > 0 {
+				cmds = append(cmds, command{Args: append(slices.Clone(scope), "--ipset="+c.Name, "--remove-entries-from-file=/dev/stdin"), Entries: c.Remove})
+			}
+			if len(c.Add) > 0 {
+				cmds = append(cmds, command{Args: append(slices.Clone(scope), "--ipset="+c.Name, "--add-entries-from-file=/dev/stdin"), Entries: c.Add})
+			}
+		}
+	}
+	if reload {
+		cmds = append(cmds, command{Args: []string{"--reload"}})
+	}
+	return cmds
+}
+
+// Script 以 shell 脚本的形式输出修改对应的 firewall-cmd 调用，用于 -dry-run
+func Script(changes ...Change) string {
+	var w strings.Builder
+	for _, c := range commands(changes) {
+		fmt.Fprintf(&w, "firewall-cmd %s", strings.Join(c.Args, " "))
+		if len(c.Entries) == 0 {
+			w.WriteString("\n")
+			continue
+		}
+		w.WriteString(" <<'EOF'\n")
+		for _, p := range c.Entries {
+			fmt.Fprintf(&w, "%s\n", p)
+		}
+		w.WriteString("EOF\n")
+	}
+	return w.String()
+}
+
+// Apply 实现 pipeline.Backend：按差异修改永久配置和运行时配置中的集合
+func (b *Backend) Apply(ctx context.Context, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	changes, previous, err := b.Changes(ctx, v4, v6)
+	if err != nil {
+		return nil, err
+	}
+	return previous, b.exec(ctx, commands(changes))
+}
+
+// Flush 实现 pipeline.Backend：删除两个集合的全部条目，不存在的集合跳过
+func (b *Backend) Flush(ctx context.Context) ([]netip.Prefix, error) {
+	names, err := b.ipsets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		changes  []Change
+		previous []netip.Prefix
+	)
+	for _, name := range []string{b.IPv4Set, b.IPv6Set} {
+		if name == "" || !slices.Contains(names, name) {
+			continue
+		}
+		current, err := b.List(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(current) > 0 {
+			changes = append(changes, Change{Name: name, Remove: current})
+			previous = append(previous, current...)
+		}
+	}
+	return previous, b.exec(ctx, commands(changes))
+}
+
+// List 返回永久配置中集合的条目，单个地址视为 /32 或 /128
+func (b *Backend) List(ctx context.Context, name string) ([]netip.Prefix, error) {
+	out, err := b.run(ctx, nil, "--permanent", "--ipset="+name, "--get-entries")
+	if err != nil {
+		return nil, fmt.Errorf("firewall-cmd --ipset=%s --get-entries: %v - %s", name, err, strings.TrimSpace(string(out)))
+	}
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Fields(string(out)) {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("firewalld ipset %s: unsupported entry %q", name, entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("firewalld ipset %s: unsupported entry %q", name, entry)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// maxElem 返回永久配置中集合的 maxelem，没有设置时为 ipset 的默认值
+func (b *Backend) maxElem(ctx context.Context, name string) (int, error) {
+	out, err := b.run(ctx, nil, "--permanent", "--info-ipset="+name)
+	if err != nil {
+		return 0, fmt.Errorf("firewall-cmd --info-ipset=%s: %v - %s", name, err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		options, ok := strings.CutPrefix(strings.TrimSpace(line), "options:")
+		if !ok {
+			continue
+		}
+		for _, opt := range strings.Fields(options) {
+			if v, ok := strings.CutPrefix(opt, "maxelem="); ok {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return 0, fmt.Errorf("firewalld ipset %s: invalid option %q", name, opt)
+				}
+				return n, nil
+			}
+		}
+	}
+	return defaultMaxElem, nil
+}
+
+// ipsets 返回永久配置中已有的 ipset 名称
+func (b *Backend) ipsets(ctx context.Context) ([]string, error) {
+	out, err := b.run(ctx, nil, "--permanent", "--get-ipsets")
+	if err != nil {
+		return nil, fmt.Errorf("firewall-cmd --get-ipsets: %v - %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (b *Backend) exec(ctx context.Context, cmds []command) error {
+	for _, c := range cmds {
+		if out, err := b.run(ctx, c.Entries, c.Args...); err != nil {
+			return fmt.Errorf("firewall-cmd %s: %v - %s", strings.Join(c.Args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func (b *Backend) run(ctx context.Context, entries []netip.Prefix, args ...string) ([]byte, error) {
+	path := b.Path
+	if path == "" {
+		path = "firewall-cmd"
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	if len(entries) > 0 {
+		var in strings.Builder
+		for _, p := range entries {
+			fmt.Fprintf(&in, "%s\n", p)
+		}
+		cmd.Stdin = strings.NewReader(in.String())
+	}
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,70 @@
+package firewalld
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestScript(t *testing.T) {
+	p := netip.MustParsePrefix
+	tests := []struct {
+		name    string
+		changes []Change
+		want    string
+	}{
+		{name: "no changes"},
+		{
+			name: "entries",
+			changes: []Change{
+				{Name: "gh4", Family: "inet", Add: []netip.Prefix{p("192.0.2.0/24")}, Remove: []netip.Prefix{p("198.51.100.0/24")}},
+				{Name: "gh6", Family: "inet6", Add: []netip.Prefix{p("2001:db8::/32")}},
+			},
+			want: `firewall-cmd --permanent --ipset=gh4 --remove-entries-from-file=/dev/stdin <<'EOF'
+198.51.100.0/24
+EOF
+firewall-cmd --permanent --ipset=gh4 --add-entries-from-file=/dev/stdin <<'EOF'
+192.0.2.0/24
+EOF
+firewall-cmd --permanent --ipset=gh6 --add-entries-from-file=/dev/stdin <<'EOF'
+2001:db8::/32
+EOF
+firewall-cmd --ipset=gh4 --remove-entries-from-file=/dev/stdin <<'EOF'
+198.51.100.0/24
+EOF
+firewall-cmd --ipset=gh4 --add-entries-from-file=/dev/stdin <<'EOF'
+192.0.2.0/24
+EOF
+firewall-cmd --ipset=gh6 --add-entries-from-file=/dev/stdin <<'EOF'
+2001:db8::/32
+EOF
+`,
+		},
+		{
+			name:    "create",
+			changes: []Change{{Name: "gh4", Family: "inet", Create: true, Add: []netip.Prefix{p("192.0.2.0/24")}}},
+			want: `firewall-cmd --permanent --new-ipset=gh4 --type=hash:net --option=family=inet --option=maxelem=65536
+firewall-cmd --permanent --ipset=gh4 --add-entries-from-file=/dev/stdin <<'EOF'
+192.0.2.0/24
+EOF
+firewall-cmd --reload
+`,
+		},
+		{
+			name:    "raise maxelem",
+			changes: []Change{{Name: "gh4", Family: "inet", MaxElem: 70000, Remove: []netip.Prefix{p("192.0.2.0/24")}}},
+			want: `firewall-cmd --permanent --ipset=gh4 --add-option=maxelem=70000
+firewall-cmd --permanent --ipset=gh4 --remove-entries-from-file=/dev/stdin <<'EOF'
+192.0.2.0/24
+EOF
+firewall-cmd --reload
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Script(tt.changes...); got != tt.want {
+				t.Errorf("Script =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Package iprange 提供基于地址区间的网段运算，用于比较经过 auto-merge 的集合内容。
+package iprange
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Range 是闭区间 [From, To]，两端地址族相同
+type Range struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+// FromPrefix 返回网段覆盖的地址区间
+func FromPrefix(p netip.Prefix) Range {
+	p = p.Masked()
+	return Range{From: p.Addr(), To: lastAddr(p)}
+}
+
+// FromPrefixes 批量转换网段
+func FromPrefixes(prefixes []netip.Prefix) []Range {
+	rs := make([]Range, len(prefixes))
+	for i, p := range prefixes {
+		rs[i] = FromPrefix(p)
+	}
+	return rs
+}
+
+// Prefixes 返回恰好覆盖该区间的最少网段
+func (r Range) Prefixes() []netip.Prefix {
+	var out []netip.Prefix
+	from := r.From
+	for from.IsValid() && from.Compare(r.To) <= 0 {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1)
+			if p.Masked().Addr() != from || lastAddr(p).Compare(r.To) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		out = append(out, p)
+		from = lastAddr(p).Next() // 到达地址空间末尾时返回无效地址，循环结束
+	}
+	return out
+}
+
+// ToPrefixes 把一组区间转换为网段
+func ToPrefixes(rs []Range) []netip.Prefix {
+	var out []netip.Prefix
+	for _, r := range rs {
+		out = append(out, r.Prefixes()...)
+	}
+	return out
+}
+
+// Merge 排序并合并重叠或相邻的区间
+func Merge(rs []Range) []Range {
+	if len(rs) == 0 {
+		return nil
+	}
+	sorted := append([]Range(nil), rs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].From.Less(sorted[j].From) })
+	out := []Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &out[len(out)-1]
+		next := last.To.Next()
+		if last.From.Is4() == r.From.Is4() && (!next.IsValid() || r.From.Compare(next) <= 0) {
+			if r.To.Compare(last.To) > 0 {
+				last.To = r.To
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Subtract 返回 a 中不被 b 覆盖的部分（已合并排序）
+func Subtract(a, b []Range) []Range {
+	a, b = Merge(a), Merge(b)
+	var out []Range
+	j := 0
+	for _, r := range a {
+		from := r.From
+		for j < len(b) && b[j].To.Less(from) {
+			j++
+		}
+		for k := j; k < len(b) && b[k].From.Compare(r.To) <= 0; k++ {
+			if b[k].From.Compare(from) > 0 {
+				out = append(out, Range{From: from, To: b[k].From.Prev()})
+			}
+			if b[k].To.Compare(from) >= 0 {
+				from = b[k].To.Next()
+			}
+			if !from.IsValid() || from.Compare(r.To) > 0 {
+				break
+			}
+		}
+		if from.IsValid() && from.Compare(r.To) <= 0 {
+			out = append(out, Range{From: from, To: r.To})
+		}
+	}
+	return out
+}
+
+// Intersect 返回同时被 a 和 b 覆盖的部分（已合并排序）
+func Intersect(a, b []Range) []Range {
+	return Subtract(a, Subtract(a, b))
+}
+
+// lastAddr 返回网段内的最后一个地址
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 12
+	}
+	for i := p.Bits() + offset*8; i < 128; i++ {
+		a[i/8] |= 1 << (7 - uint(i%8))
+	}
+	last := netip.AddrFrom16(a)
+	if p.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
@@ -0,0 +1,98 @@
+package iprange
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, s := range ss {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}
+
+func TestSubtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     []string
+		want     []string
+		wantSize int // 期望的区间数，0 表示不检查
+	}{
+		{name: "whole prefix", a: []string{"192.0.2.0/24"}, b: []string{"192.0.2.0/24"}},
+		{name: "covered by a larger prefix", a: []string{"192.0.2.0/24"}, b: []string{"192.0.0.0/16"}},
+		{name: "disjoint", a: []string{"192.0.2.0/24"}, b: []string{"198.51.100.0/24"}, want: []string{"192.0.2.0/24"}},
+		{
+			name: "middle slice",
+			a:    []string{"192.0.2.0/24"}, b: []string{"192.0.2.64/27"},
+			want:     []string{"192.0.2.0/26", "192.0.2.96/27", "192.0.2.128/25"},
+			wantSize: 2,
+		},
+		{name: "lower edge", a: []string{"192.0.2.0/24"}, b: []string{"192.0.2.0/25"}, want: []string{"192.0.2.128/25"}},
+		{name: "upper edge", a: []string{"192.0.2.0/24"}, b: []string{"192.0.2.255/32"},
+			want: []string{"192.0.2.0/25", "192.0.2.128/26", "192.0.2.192/27", "192.0.2.224/28", "192.0.2.240/29", "192.0.2.248/30", "192.0.2.252/31", "192.0.2.254/32"}},
+		{name: "overlapping edge", a: []string{"192.0.2.0/24"}, b: []string{"192.0.2.128/25", "192.0.3.0/24"}, want: []string{"192.0.2.0/25"}},
+		{name: "several holes", a: []string{"10.0.0.0/8"}, b: []string{"10.1.0.0/16", "10.3.0.0/16", "10.2.0.0/16"},
+			want: []string{"10.0.0.0/16", "10.4.0.0/14", "10.8.0.0/13", "10.16.0.0/12", "10.32.0.0/11", "10.64.0.0/10", "10.128.0.0/9"}},
+		{name: "end of address space", a: []string{"255.255.255.0/24"}, b: []string{"255.255.255.0/25"}, want: []string{"255.255.255.128/25"}},
+		{name: "start of address space", a: []string{"0.0.0.0/0"}, b: []string{"0.0.0.0/1"}, want: []string{"128.0.0.0/1"}},
+		{name: "v6 middle slice", a: []string{"2001:db8::/32"}, b: []string{"2001:db8:8000::/34"},
+			want: []string{"2001:db8::/33", "2001:db8:c000::/34"}},
+		{name: "v6 end of address space", a: []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120"}, b: []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff80/121"},
+			want: []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/121"}},
+		{name: "families do not mix", a: []string{"192.0.2.0/24", "2001:db8::/32"}, b: []string{"::/0"}, want: []string{"192.0.2.0/24"}},
+		{name: "unmerged input", a: []string{"192.0.2.0/25", "192.0.2.0/24", "192.0.2.128/25"}, b: []string{"192.0.2.128/26"},
+			want: []string{"192.0.2.0/25", "192.0.2.192/26"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := Subtract(FromPrefixes(prefixes(tt.a...)), FromPrefixes(prefixes(tt.b...)))
+			if got, want := ToPrefixes(rs), prefixes(tt.want...); !reflect.DeepEqual(got, want) {
+				t.Errorf("Subtract = %v, want %v", got, want)
+			}
+			if tt.wantSize > 0 && len(rs) != tt.wantSize {
+				t.Errorf("%d ranges, want %d", len(rs), tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	got := ToPrefixes(Merge(FromPrefixes(prefixes("192.0.2.128/25", "2001:db8::/33", "192.0.2.0/25", "198.51.100.0/24", "2001:db8:8000::/33", "192.0.2.64/26"))))
+	want := prefixes("192.0.2.0/24", "198.51.100.0/24", "2001:db8::/32")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge = %v, want %v", got, want)
+	}
+	if Merge(nil) != nil {
+		t.Error("Merge(nil) is not nil")
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     []string
+	}{
+		{"192.0.2.0", "192.0.2.255", []string{"192.0.2.0/24"}},
+		{"192.0.2.1", "192.0.2.6", []string{"192.0.2.1/32", "192.0.2.2/31", "192.0.2.4/31", "192.0.2.6/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"2001:db8::", "2001:db8::2", []string{"2001:db8::/127", "2001:db8::2/128"}},
+	}
+	for _, tt := range tests {
+		r := Range{From: netip.MustParseAddr(tt.from), To: netip.MustParseAddr(tt.to)}
+		if got, want := r.Prefixes(), prefixes(tt.want...); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s-%s = %v, want %v", tt.from, tt.to, got, want)
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	a := FromPrefixes(prefixes("192.0.2.0/24", "2001:db8::/32"))
+	b := FromPrefixes(prefixes("192.0.2.128/25", "198.51.100.0/24", "2001:db8:1::/48"))
+	if got, want := ToPrefixes(Intersect(a, b)), prefixes("192.0.2.128/25", "2001:db8:1::/48"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Intersect = %v, want %v", got, want)
+	}
+}
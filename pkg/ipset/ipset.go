@@ -0,0 +1,222 @@
+// Package ipset 通过 ipset restore 维护 hash:net 类型的 ipset，可选地在 iptables/ip6tables 中安装引用它们的规则。
+package ipset
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// ErrNotFound 表示 ipset 不存在
+var ErrNotFound = errors.New("no such ipset")
+
+// TempSuffix 是更新时临时集合名称的后缀，临时集合写好后与正式集合交换
+const TempSuffix = "_tmp"
+
+// MaxNameLen 是 ipset 名称的最大长度
+const MaxNameLen = 31
+
+// defaultMaxElem 是 ipset 默认的 maxelem，网段更多时按数量调大
+const defaultMaxElem = 65536
+
+// Backend 用 ipset 保存期望网段，实现 pipeline.Backend。每个集合的内容先写入临时集合，
+// 再用 swap 原子地与正式集合交换，正式集合不存在时先创建
+type Backend struct {
+	IPv4Set string
+	IPv6Set string
+	// Chain 非空时在 iptables 和 ip6tables 的该链（必须已存在，例如 INPUT）开头插入
+	// 引用集合的 ACCEPT 规则，已有相同规则时不重复添加
+	Chain string
+	// Comment 是规则的注释，用于识别本工具添加的规则
+	Comment string
+	Path    string // 为空时使用 PATH 中的 "ipset"
+}
+
+// Update 是对一个 ipset 的整体替换
+type Update struct {
+	Name     string
+	Family   string // inet 或 inet6
+	Prefixes []netip.Prefix
+	Create   bool // 正式集合不存在，需要先创建
+	Stale    bool // 上次中断时留下了临时集合，需要先删除
+}
+
+// Name 实现 pipeline.Backend
+func (b *Backend) Name() string { return "ipset" }
+
+// Updates 读取正式集合和临时集合的现状，返回替换需要的 Update 以及正式集合现有的内容
+func (b *Backend) Updates(ctx context.Context, v4, v6 []netip.Prefix) ([]Update, []netip.Prefix, error) {
+	var (
+		updates  []Update
+		previous []netip.Prefix
+	)
+	for _, u := range []Update{{Name: b.IPv4Set, Family: "inet", Prefixes: v4}, {Name: b.IPv6Set, Family: "inet6", Prefixes: v6}} {
+		if u.Name == "" {
+			continue
+		}
+		ps, err := b.List(ctx, u.Name)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			u.Create = true
+		case err != nil:
+			return nil, nil, err
+		}
+		previous = append(previous, ps...)
+		if u.Stale, err = b.exists(ctx, u.Name+TempSuffix); err != nil {
+			return nil, nil, err
+		}
+		updates = append(updates, u)
+	}
+	return updates, previous, nil
+}
+
+// Script 生成 ipset restore 的输入
+func Script(updates ...Update) string {
+	var w strings.Builder
+	for _, u := range updates {
+		tmp := u.Name + TempSuffix
+		params := fmt.Sprintf("hash:net family %s maxelem %d", u.Family, max(defaultMaxElem, len(u.Prefixes)))
+		if u.Create {
+			fmt.Fprintf(&w, "create %s %s\n", u.Name, params)
+		}
+		if u.Stale {
+			fmt.Fprintf(&w, "destroy %s\n", tmp)
+		}
+		fmt.Fprintf(&w, "create %s %s\n", tmp, params)
+		for _, p := range u.Prefixes {
+			fmt.Fprintf(&w, "add %s %s\n", tmp, p)
+		}
+		fmt.Fprintf(&w, "swap %s %s\n", tmp, u.Name)
+		fmt.Fprintf(&w, "destroy %s\n", tmp)
+	}
+	return w.String()
+}
+
+// Apply 实现 pipeline.Backend：通过 ipset restore 替换两个集合的内容，再按 Chain 安装规则
+func (b *Backend) Apply(ctx context.Context, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	updates, previous, err := b.Updates(ctx, v4, v6)
+	if err != nil {
+		return nil, err
+	}
+	if out, err := b.run(ctx, Script(updates...), "restore"); err != nil {
+		return nil, fmt.Errorf("ipset restore: %v - %s", err, strings.TrimSpace(string(out)))
+	}
+	if b.Chain == "" {
+		return previous, nil
+	}
+	for _, u := range updates {
+		tool := "iptables"
+		if u.Family == "inet6" {
+			tool = "ip6tables"
+		}
+		if err := b.ensureRule(ctx, tool, u.Name); err != nil {
+			return previous, err
+		}
+	}
+	return previous, nil
+}
+
+// Flush 实现 pipeline.Backend，不存在的集合跳过
+func (b *Backend) Flush(ctx context.Context) ([]netip.Prefix, error) {
+	var previous []netip.Prefix
+	for _, name := range []string{b.IPv4Set, b.IPv6Set} {
+		if name == "" {
+			continue
+		}
+		ps, err := b.List(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return previous, err
+		}
+		if out, err := b.run(ctx, "", "flush", name); err != nil {
+			return previous, fmt.Errorf("ipset flush %s: %v - %s", name, err, strings.TrimSpace(string(out)))
+		}
+		previous = append(previous, ps...)
+	}
+	return previous, nil
+}
+
+// List 通过 ipset save 读取 hash:net / hash:ip 类型 ipset 的条目，单个地址视为 /32 或 /128。
+// 集合不存在时返回 ErrNotFound
+func (b *Backend) List(ctx context.Context, name string) ([]netip.Prefix, error) {
+	out, err := b.run(ctx, "", "save", name)
+	if err != nil {
+		if strings.Contains(string(out), "does not exist") {
+			return nil, fmt.Errorf("ipset %s: %w", name, ErrNotFound)
+		}
+		return nil, fmt.Errorf("ipset save %s: %v - %s", name, err, strings.TrimSpace(string(out)))
+	}
+	var prefixes []netip.Prefix
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		// 条目行形如 "add <name> 192.0.2.0/24 [timeout N] [comment "..."]"
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != name {
+			continue
+		}
+		entry := fields[2]
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("ipset %s: unsupported entry %q", name, entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ipset %s: unsupported entry %q", name, entry)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, sc.Err()
+}
+
+// exists 通过 ipset list -n 判断集合是否存在
+func (b *Backend) exists(ctx context.Context, name string) (bool, error) {
+	out, err := b.run(ctx, "", "list", "-n", name)
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(string(out), "does not exist") {
+		return false, nil
+	}
+	return false, fmt.Errorf("ipset list %s: %v - %s", name, err, strings.TrimSpace(string(out)))
+}
+
+// ensureRule 在 Chain 中查找引用 set 的规则（iptables -C），没有时插入到链的开头
+func (b *Backend) ensureRule(ctx context.Context, tool, set string) error {
+	rule := []string{b.Chain, "-m", "set", "--match-set", set, "src", "-m", "comment", "--comment", b.Comment, "-j", "ACCEPT"}
+	out, err := exec.CommandContext(ctx, tool, append([]string{"-w", "-C"}, rule...)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	// 规则不存在时 -C 以 1 退出，其他退出码（或找不到命令）是真正的错误
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return fmt.Errorf("%s -C %s: %v - %s", tool, b.Chain, err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.CommandContext(ctx, tool, append([]string{"-w", "-I"}, rule...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s -I %s: %v - %s", tool, b.Chain, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (b *Backend) run(ctx context.Context, stdin string, args ...string) ([]byte, error) {
+	path := b.Path
+	if path == "" {
+		path = "ipset"
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,173 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScript(t *testing.T) {
+	p := netip.MustParsePrefix
+	tests := []struct {
+		name   string
+		update Update
+		want   string
+	}{
+		{
+			name:   "existing set",
+			update: Update{Name: "gh4", Family: "inet", Prefixes: []netip.Prefix{p("192.0.2.0/24"), p("198.51.100.7/32")}},
+			want: `create gh4_tmp hash:net family inet maxelem 65536
+add gh4_tmp 192.0.2.0/24
+add gh4_tmp 198.51.100.7/32
+swap gh4_tmp gh4
+destroy gh4_tmp
+`,
+		},
+		{
+			name:   "created if missing",
+			update: Update{Name: "gh6", Family: "inet6", Prefixes: []netip.Prefix{p("2001:db8::/32")}, Create: true},
+			want: `create gh6 hash:net family inet6 maxelem 65536
+create gh6_tmp hash:net family inet6 maxelem 65536
+add gh6_tmp 2001:db8::/32
+swap gh6_tmp gh6
+destroy gh6_tmp
+`,
+		},
+		{
+			name:   "stale temporary set",
+			update: Update{Name: "gh4", Family: "inet", Stale: true},
+			want: `destroy gh4_tmp
+create gh4_tmp hash:net family inet maxelem 65536
+swap gh4_tmp gh4
+destroy gh4_tmp
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Script(tt.update); got != tt.want {
+				t.Errorf("Script =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	many := make([]netip.Prefix, defaultMaxElem+1)
+	for i := range many {
+		many[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 32)
+	}
+	if got := Script(Update{Name: "gh4", Family: "inet", Prefixes: many}); !strings.HasPrefix(got, "create gh4_tmp hash:net family inet maxelem 65537\n") {
+		t.Errorf("maxelem not raised: %.60s", got)
+	}
+}
+
+// writeStub 在 dir 中写入可执行的 shell 脚本 name，调用参数记在 $STUB_LOG 中
+func writeStub(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho \""+name+" $*\" >> \"$STUB_LOG\"\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// ipsetStub 模拟 gh4 存在、gh6 不存在，并留有上次中断的 gh4_tmp；restore 的输入写到 $STUB_LOG.restore
+const ipsetStub = `case "$1" in
+save)
+	if [ "$2" = gh4 ]; then
+		echo "create gh4 hash:net family inet hashsize 1024 maxelem 65536"
+		echo "add gh4 192.0.2.0/24"
+		echo "add gh4 198.51.100.7"
+		exit 0
+	fi
+	;;
+list)
+	[ "$3" = gh4_tmp ] && exit 0
+	;;
+restore)
+	cat > "$STUB_LOG.restore"
+	exit 0
+	;;
+esac
+echo "ipset v7.1: The set with the given name does not exist" >&2
+exit 1
+`
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	t.Setenv("STUB_LOG", log)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ipset := writeStub(t, dir, "ipset", ipsetStub)
+	// iptables 中还没有规则（-C 以 1 退出），ip6tables 中已经有了
+	writeStub(t, dir, "iptables", `[ "$2" = -C ] && exit 1
+exit 0
+`)
+	writeStub(t, dir, "ip6tables", "exit 0\n")
+
+	b := &Backend{IPv4Set: "gh4", IPv6Set: "gh6", Chain: "INPUT", Comment: "github-updater", Path: ipset}
+	v4, v6 := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}
+	previous, err := b.Apply(context.Background(), v4, v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.7/32")}; !reflect.DeepEqual(previous, want) {
+		t.Errorf("previous = %v, want %v", previous, want)
+	}
+
+	rule := "INPUT -m set --match-set %s src -m comment --comment github-updater -j ACCEPT"
+	wantCalls := []string{
+		"ipset save gh4", "ipset list -n gh4_tmp",
+		"ipset save gh6", "ipset list -n gh6_tmp",
+		"ipset restore",
+		"iptables -w -C " + strings.Replace(rule, "%s", "gh4", 1),
+		"iptables -w -I " + strings.Replace(rule, "%s", "gh4", 1),
+		"ip6tables -w -C " + strings.Replace(rule, "%s", "gh6", 1),
+	}
+	calls, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(strings.TrimSpace(string(calls)), "\n"); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("calls =\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantCalls, "\n"))
+	}
+	restore, err := os.ReadFile(log + ".restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Script(
+		Update{Name: "gh4", Family: "inet", Prefixes: v4, Stale: true},
+		Update{Name: "gh6", Family: "inet6", Prefixes: v6, Create: true},
+	); string(restore) != want {
+		t.Errorf("restore input =\n%s\nwant:\n%s", restore, want)
+	}
+}
+
+func TestApplyRuleCheckFails(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STUB_LOG", filepath.Join(dir, "log"))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	ipset := writeStub(t, dir, "ipset", ipsetStub)
+	// 退出码 1 以外的失败（例如链不存在）不能当作规则不存在
+	writeStub(t, dir, "iptables", `echo "iptables: No chain/target/match by that name." >&2
+exit 2
+`)
+	b := &Backend{IPv4Set: "gh4", Chain: "GITHUB", Comment: "github-updater", Path: ipset}
+	_, err := b.Apply(context.Background(), []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "iptables -C GITHUB: exit status 2 - iptables: No chain/target/match by that name.") {
+		t.Errorf("Apply error = %v, want the iptables -C error", err)
+	}
+}
+
+func TestListNotFound(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STUB_LOG", filepath.Join(dir, "log"))
+	b := &Backend{Path: writeStub(t, dir, "ipset", ipsetStub)}
+	if _, err := b.List(context.Background(), "gh6"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("List error = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,248 @@
+package nft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Client 通过 Executor 与 nftables 交互，零值使用 ExecExecutor
+type Client struct {
+	Executor Executor
+}
+
+// Backend 返回用于展示的执行方式，例如 "nft" 或 "nft via ssh host"
+func (c *Client) Backend() string {
+	switch e := c.Executor.(type) {
+	case nil:
+		return "nft"
+	case ExecExecutor:
+		if e.Path != "" {
+			return "nft at " + e.Path
+		}
+		return "nft"
+	case SSHExecutor:
+		return "nft via ssh " + e.Host
+	case *Recorder:
+		return "recorder"
+	case FileExecutor:
+		return "file " + e.Path
+	case OfflineExecutor:
+		return "offline"
+	case NetlinkExecutor:
+		return "netlink"
+	case *UnprivilegedExecutor:
+		return (&Client{Executor: e.Executor}).Backend()
+	}
+	return fmt.Sprintf("%T", c.Executor)
+}
+
+func (c *Client) run(ctx context.Context, args []string, stdin string) ([]byte, error) {
+	exec := c.Executor
+	if exec == nil {
+		exec = ExecExecutor{}
+	}
+	if stdin == "" {
+		return exec.Run(ctx, args, nil)
+	}
+	return exec.Run(ctx, args, strings.NewReader(stdin))
+}
+
+// Apply 通过 nft -f - 在一个事务中执行脚本，失败时返回 *ApplyFailure
+func (c *Client) Apply(ctx context.Context, commands string) error {
+	output, err := c.run(ctx, []string{"-f", "-"}, commands)
+	if err != nil {
+		return &ApplyFailure{Err: err, Output: string(output), Statements: attributeErrors(commands, string(output))}
+	}
+	return nil
+}
+
+// Check 通过 nft -c -f - 只检查脚本能否被接受，不做任何修改，失败时返回 *ApplyFailure
+func (c *Client) Check(ctx context.Context, commands string) error {
+	output, err := c.run(ctx, []string{"-c", "-f", "-"}, commands)
+	if err != nil {
+		return &ApplyFailure{Err: err, Output: string(output), Statements: attributeErrors(commands, string(output))}
+	}
+	return nil
+}
+
+// ApplyConfigs 在一个事务中应用 configs，payload 是由它们渲染出的脚本。Executor 是 ConfigExecutor 时
+// 直接应用 configs，否则通过 nft -f - 执行 payload，失败时返回 *ApplyFailure
+func (c *Client) ApplyConfigs(ctx context.Context, payload string, configs ...Config) error {
+	if ce, ok := c.Executor.(ConfigExecutor); ok {
+		if err := ce.ApplyConfigs(ctx, false, configs...); err != nil {
+			return &ApplyFailure{Err: err}
+		}
+		return nil
+	}
+	return c.Apply(ctx, payload)
+}
+
+// CheckConfigs 与 ApplyConfigs 相同，但只检查能否被接受，不做任何修改
+func (c *Client) CheckConfigs(ctx context.Context, payload string, configs ...Config) error {
+	if ce, ok := c.Executor.(ConfigExecutor); ok {
+		if err := ce.ApplyConfigs(ctx, true, configs...); err != nil {
+			return &ApplyFailure{Err: err}
+		}
+		return nil
+	}
+	return c.Check(ctx, payload)
+}
+
+// FlushSets 在一个事务中清空（不删除）多个由 ListSet 读取的集合或映射
+func (c *Client) FlushSets(ctx context.Context, sets ...*Set) error {
+	if ce, ok := c.Executor.(ConfigExecutor); ok {
+		if err := ce.FlushSets(ctx, sets...); err != nil {
+			return &ApplyFailure{Err: err}
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, s := range sets {
+		fmt.Fprintf(&b, "flush %s %s %s %s\n", s.Keyword(), s.Family, s.Table, s.Name)
+	}
+	return c.Apply(ctx, b.String())
+}
+
+// SetElements 是一个集合及其全部元素，Map 为 true 时是 verdict 映射，元素带 Verdict
+type SetElements struct {
+	Name     string
+	Elements []Element
+	Map      bool
+}
+
+// ReplaceSets 在一个事务中清空集合并写入给定元素，用于恢复应用前的内容
+func (c *Client) ReplaceSets(ctx context.Context, family, table string, sets ...SetElements) error {
+	if ce, ok := c.Executor.(ConfigExecutor); ok {
+		if err := ce.ReplaceSets(ctx, family, table, sets...); err != nil {
+			return &ApplyFailure{Err: err}
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, s := range sets {
+		keyword := "set"
+		if s.Map {
+			keyword = "map"
+		}
+		fmt.Fprintf(&b, "flush %s %s %s %s\n", keyword, family, table, s.Name)
+		writeElements(&b, family, table, s.Name, s.Elements, nil)
+	}
+	return c.Apply(ctx, b.String())
+}
+
+// DeleteSet 单独删除一个集合。
+// 不放在批量事务里，因为如果集合不存在，delete 会报错导致整个事务回滚。
+func (c *Client) DeleteSet(ctx context.Context, family, table, setName string) error {
+	if ce, ok := c.Executor.(ConfigExecutor); ok {
+		return ce.DeleteSet(ctx, family, table, setName)
+	}
+	output, err := c.run(ctx, []string{"delete", "set", family, table, setName}, "")
+	if err != nil {
+		return fmt.Errorf("%v - %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// TableExists 查询表是否存在（-t 不输出集合元素）
+func (c *Client) TableExists(ctx context.Context, family, table string) (bool, error) {
+	output, err := c.run(ctx, []string{"-t", "list", "table", family, table}, "")
+	if err != nil {
+		if notFound(output, err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("nft list table failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	return true, nil
+}
+
+// ListTable 返回 nft list table 的输出，可以作为 nft -f 的输入重建该表。表不存在时返回空字符串
+func (c *Client) ListTable(ctx context.Context, family, table string) (string, error) {
+	output, err := c.run(ctx, []string{"list", "table", family, table}, "")
+	if err != nil {
+		if notFound(output, err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("nft list table failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// InspectChain 查询现有的链 ch 并设置其 Create/AddIPv4Rule/AddIPv6Rule/DeleteHandles：
+// 已存在的链和规则不会重复创建；本工具添加的规则与配置不一致（接口、端口、动作或地址族改变）
+// 或重复时按 handle 删除，再添加新的规则。返回链是否已存在；
+// 链不存在且没有 Hook（不允许创建）时返回错误
+func (c *Client) InspectChain(ctx context.Context, config *Config, ch *ChainConfig) (bool, error) {
+	output, err := c.run(ctx, []string{"-j", "list", "chain", config.Family, config.TableName, ch.Name}, "")
+	if err != nil {
+		// 只有链（或表）不存在才按缺少链处理，权限不足等其他失败直接返回
+		if !notFound(output, err) {
+			return false, fmt.Errorf("nft list chain failed: %v - %s", err, strings.TrimSpace(string(output)))
+		}
+		ch.AddIPv4Rule, ch.AddIPv6Rule = ch.WantsFamily("ipv4"), ch.WantsFamily("ipv6")
+		if ch.Hook != "" {
+			ch.Create = true
+			return false, nil
+		}
+		if errors.Is(err, errOffline) {
+			return true, nil // 离线生成时无法确认，假定目标主机上已有该链
+		}
+		return false, fmt.Errorf("chain %s not found in %s/%s and no hook is configured to create it", ch.Name, config.Family, config.TableName)
+	}
+	rules, err := parseRuleListing(output, config.RuleComment())
+	if err != nil {
+		return true, fmt.Errorf("chain %s: %w", ch.Name, err)
+	}
+	ch.references, ch.DeleteHandles = nil, nil
+	for _, fam := range []struct {
+		name, set string
+		add       *bool
+	}{{"ipv4", config.IPv4SetName, &ch.AddIPv4Rule}, {"ipv6", config.IPv6SetName, &ch.AddIPv6Rule}} {
+		*fam.add = false
+		if fam.set == "" {
+			continue
+		}
+		want := ch.WantsFamily(fam.name)
+		found := false
+		for _, r := range rules {
+			if r.set != fam.set {
+				continue
+			}
+			if r.handle > 0 {
+				ch.references = append(ch.references, r.handle)
+			}
+			if want && !found && r.matches(*ch, config.ruleVerdict(*ch)) {
+				found = true
+				continue
+			}
+			if r.managed && r.handle > 0 {
+				ch.DeleteHandles = append(ch.DeleteHandles, r.handle)
+			}
+		}
+		*fam.add = want && !found
+	}
+	return true, nil
+}
+
+// ManagedRules 返回链中注释为 marker 的规则的 handle，链不存在时返回空
+func (c *Client) ManagedRules(ctx context.Context, family, table, chain, marker string) ([]uint64, error) {
+	output, err := c.run(ctx, []string{"-j", "list", "chain", family, table, chain}, "")
+	if err != nil {
+		if notFound(output, err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("nft list chain failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	rules, err := parseRuleListing(output, marker)
+	if err != nil {
+		return nil, fmt.Errorf("chain %s: %w", chain, err)
+	}
+	var handles []uint64
+	for _, r := range rules {
+		if r.managed && r.handle > 0 {
+			handles = append(handles, r.handle)
+		}
+	}
+	return handles, nil
+}
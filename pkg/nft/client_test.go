@@ -0,0 +1,124 @@
+package nft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClientRecordedCalls(t *testing.T) {
+	v4 := &Set{Family: "inet", Table: "filter", Name: "github_v4"}
+	m6 := &Set{Family: "inet", Table: "filter", Name: "github_v6", Map: true}
+	tests := []struct {
+		name  string
+		call  func(c *Client) error
+		calls []Call
+	}{
+		{
+			name:  "apply",
+			call:  func(c *Client) error { return c.Apply(context.Background(), "flush set inet filter github_v4\n") },
+			calls: []Call{{Args: []string{"-f", "-"}, Stdin: "flush set inet filter github_v4\n"}},
+		},
+		{
+			name:  "check",
+			call:  func(c *Client) error { return c.Check(context.Background(), "add table inet filter\n") },
+			calls: []Call{{Args: []string{"-c", "-f", "-"}, Stdin: "add table inet filter\n"}},
+		},
+		{
+			name: "flush sets in one transaction",
+			call: func(c *Client) error { return c.FlushSets(context.Background(), v4, m6) },
+			calls: []Call{{Args: []string{"-f", "-"},
+				Stdin: "flush set inet filter github_v4\nflush map inet filter github_v6\n"}},
+		},
+		{
+			name: "replace sets",
+			call: func(c *Client) error {
+				return c.ReplaceSets(context.Background(), "inet", "filter",
+					SetElements{Name: "github_v4", Elements: []Element{{Prefix: netip.MustParsePrefix("192.30.252.0/22")}}},
+					SetElements{Name: "github_v6"})
+			},
+			calls: []Call{{Args: []string{"-f", "-"},
+				Stdin: "flush set inet filter github_v4\nadd element inet filter github_v4 { 192.30.252.0/22 }\nflush set inet filter github_v6\n"}},
+		},
+		{
+			name:  "delete set outside a transaction",
+			call:  func(c *Client) error { return c.DeleteSet(context.Background(), "ip", "filter", "github_v4") },
+			calls: []Call{{Args: []string{"delete", "set", "ip", "filter", "github_v4"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &Recorder{}
+			if err := tt.call(&Client{Executor: rec}); err != nil {
+				t.Fatal(err)
+			}
+			got := rec.Calls()
+			if !slices.EqualFunc(got, tt.calls, func(a, b Call) bool { return slices.Equal(a.Args, b.Args) && a.Stdin == b.Stdin }) {
+				t.Errorf("calls = %q, want %q", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestApplyFailure(t *testing.T) {
+	rec := &Recorder{Respond: func(args []string, stdin string) ([]byte, error) {
+		return []byte("/dev/stdin:1:1-31: Error: Could not process rule: Device or resource busy\ndelete set inet filter github_v4\n^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^\n"), errors.New("exit status 1")
+	}}
+	err := (&Client{Executor: rec}).Apply(context.Background(), "delete set inet filter github_v4\n")
+	var failure *ApplyFailure
+	if !errors.As(err, &failure) {
+		t.Fatalf("error = %v, want *ApplyFailure", err)
+	}
+	if len(failure.Statements) != 1 || failure.Statements[0].Line != 1 {
+		t.Errorf("statements = %+v, want line 1", failure.Statements)
+	}
+	// 输出中的内核错误与 netlink 后端返回的 errno 一样可以用 errors.Is 识别
+	if !errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ENOENT) {
+		t.Errorf("error %v: EBUSY %t, ENOENT %t", err, errors.Is(err, syscall.EBUSY), errors.Is(err, syscall.ENOENT))
+	}
+	if err := (&ApplyFailure{Err: fmt.Errorf("conn.Receive: %w", syscall.EBUSY)}); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("wrapped errno not found in %v", err)
+	}
+}
+
+func TestInspectChainErrors(t *testing.T) {
+	errExit := errors.New("exit status 1")
+	tests := []struct {
+		name       string
+		output     string
+		err        error
+		hook       string
+		wantExists bool
+		wantCreate bool
+		wantErr    string
+	}{
+		{name: "missing with hook", output: "Error: No such file or directory", err: errExit, hook: "input", wantCreate: true},
+		{name: "missing without hook", output: "Error: No such file or directory", err: errExit, wantErr: "no hook is configured"},
+		{name: "offline", output: "Error: No such file or directory", err: errOffline, wantExists: true},
+		{name: "permission denied", output: "Error: Operation not permitted", err: errExit, hook: "input", wantErr: "Operation not permitted"},
+		{name: "exec failure", err: errors.New(`exec: "nft": executable file not found in $PATH`), hook: "input", wantErr: "executable file not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{Executor: &Recorder{Respond: func(args []string, stdin string) ([]byte, error) { return []byte(tt.output), tt.err }}}
+			config := &Config{Target: Target{Family: "inet", TableName: "filter", IPv4SetName: "gh4"}}
+			ch := &ChainConfig{Name: "input", Hook: tt.hook}
+			exists, err := c.InspectChain(context.Background(), config, ch)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if exists != tt.wantExists || ch.Create != tt.wantCreate {
+				t.Errorf("exists %v, create %v; want %v, %v", exists, ch.Create, tt.wantExists, tt.wantCreate)
+			}
+		})
+	}
+}
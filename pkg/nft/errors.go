@@ -0,0 +1,130 @@
+package nft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ApplyFailure 是 nft -f 执行失败的错误。nft 能指出出错行时，
+// Statements 给出对应的脚本语句，便于在大量元素中定位问题
+type ApplyFailure struct {
+	Err        error
+	Output     string // nft 的原始输出
+	Statements []StatementError
+}
+
+// StatementError 是脚本中一条出错的语句
+type StatementError struct {
+	Index   int    // 第几条语句（跳过空行和注释，从 1 开始）
+	Line    int    // 在脚本中的行号
+	Text    string // 语句内容，过长时截断
+	Message string // nft 的错误信息
+}
+
+func (e StatementError) String() string {
+	return fmt.Sprintf("statement %d failed: %s: %s", e.Index, e.Text, e.Message)
+}
+
+func (e *ApplyFailure) Error() string {
+	if len(e.Statements) == 0 && e.Output == "" {
+		return fmt.Sprintf("nft failed: %v", e.Err)
+	}
+	if len(e.Statements) == 0 {
+		return fmt.Sprintf("nft failed: %v\nOutput: %s", e.Err, e.Output)
+	}
+	msgs := make([]string, len(e.Statements))
+	for i, s := range e.Statements {
+		msgs[i] = s.String()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap 除 Err 外还返回 nft 输出中报告的内核错误，
+// 使 errors.Is(err, syscall.EBUSY) 对 nft 命令和 netlink 后端都成立
+func (e *ApplyFailure) Unwrap() []error {
+	if errno := outputErrno(e.Output); errno != 0 {
+		return []error{e.Err, errno}
+	}
+	return []error{e.Err}
+}
+
+// nftErrnos 是 nft 输出中内核错误的写法
+var nftErrnos = []struct {
+	msg   string
+	errno syscall.Errno
+}{
+	{"No such file or directory", syscall.ENOENT},
+	{"Device or resource busy", syscall.EBUSY},
+	{"Operation not permitted", syscall.EPERM},
+	{"Permission denied", syscall.EACCES},
+}
+
+// outputErrno 返回 nft 输出中报告的内核错误，没有时返回 0
+func outputErrno(output string) syscall.Errno {
+	for _, e := range nftErrnos {
+		if strings.Contains(output, e.msg) {
+			return e.errno
+		}
+	}
+	return 0
+}
+
+// permissionDenied 判断调用是否因为权限不足而失败
+func permissionDenied(output []byte, err error) bool {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return true
+	}
+	errno := outputErrno(string(output))
+	return errno == syscall.EPERM || errno == syscall.EACCES
+}
+
+// notFound 判断查询失败是否因为对象不存在
+func notFound(output []byte, err error) bool {
+	return errors.Is(err, syscall.ENOENT) || outputErrno(string(output)) == syscall.ENOENT
+}
+
+// maxStatementText 限制错误信息中语句的长度，元素列表可能有上万字符
+const maxStatementText = 200
+
+// nft 对 -f 输入的报错形如 "/dev/stdin:12:1-40: Error: Could not process rule: ..."
+var nftErrorRe = regexp.MustCompile(`^[^:\s]*:(\d+):\d+(?:-\d+)?: Error: (.*)$`)
+
+// attributeErrors 把 nft 输出中的行号映射回脚本中的语句
+func attributeErrors(script, output string) []StatementError {
+	lines := strings.Split(script, "\n")
+	var errs []StatementError
+	sc := bufio.NewScanner(strings.NewReader(output))
+	for sc.Scan() {
+		m := nftErrorRe.FindStringSubmatch(strings.TrimSpace(sc.Text()))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		text := strings.TrimSpace(lines[n-1])
+		if len(text) > maxStatementText {
+			text = text[:maxStatementText] + "..."
+		}
+		errs = append(errs, StatementError{Index: statementIndex(lines[:n]), Line: n, Text: text, Message: m[2]})
+	}
+	return errs
+}
+
+// statementIndex 返回最后一行是第几条语句
+func statementIndex(lines []string) int {
+	n := 0
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "#") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package nft
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Executor 执行一次 nft 调用，返回合并后的 stdout/stderr 输出。
+// stdin 为 nil 表示不需要标准输入。
+type Executor interface {
+	Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error)
+}
+
+// ConfigExecutor 是不经过 nft 脚本、直接修改集合的 Executor，例如 NetlinkExecutor。
+// Client 的更新方法对它调用以下方法，而不是生成脚本后执行 nft -f -
+type ConfigExecutor interface {
+	Executor
+	// ApplyConfigs 在一个事务中应用 configs，check 为 true 时只检查而不修改
+	ApplyConfigs(ctx context.Context, check bool, configs ...Config) error
+	// ReplaceSets 在一个事务中清空集合并写入给定元素
+	ReplaceSets(ctx context.Context, family, table string, sets ...SetElements) error
+	// FlushSets 在一个事务中清空集合
+	FlushSets(ctx context.Context, sets ...*Set) error
+	// DeleteSet 删除一个集合
+	DeleteSet(ctx context.Context, family, table, name string) error
+}
+
+// ExecExecutor 调用系统中的 nft 命令
+type ExecExecutor struct {
+	Path string // 为空时使用 PATH 中的 "nft"
+}
+
+// Run 实现 Executor
+func (e ExecExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	path := e.Path
+	if path == "" {
+		path = "nft"
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	return cmd.CombinedOutput()
+}
+
+// Call 是 Recorder 记录的一次调用
+type Call struct {
+	Args  []string
+	Stdin string
+}
+
+// String 返回 "nft arg1 arg2 ..." 形式的命令行
+func (c Call) String() string {
+	return strings.Join(append([]string{"nft"}, c.Args...), " ")
+}
+
+// Recorder 记录所有调用而不真正执行 nft，可用于测试或演练。
+// Respond 为 nil 时所有调用都返回成功且无输出。
+type Recorder struct {
+	Respond func(args []string, stdin string) ([]byte, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Run 实现 Executor
+func (r *Recorder) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	call := Call{Args: append([]string(nil), args...)}
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		call.Stdin = string(data)
+	}
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+	if r.Respond == nil {
+		return nil, nil
+	}
+	return r.Respond(call.Args, call.Stdin)
+}
+
+// Calls 返回按顺序记录的调用
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// SSHExecutor 通过 ssh 在远程主机上执行 nft，沿用本机的 SSH 配置和密钥
+type SSHExecutor struct {
+	Host    string
+	SSHPath string // 为空时使用 PATH 中的 "ssh"
+}
+
+// Run 实现 Executor，参数在远程 shell 中按单引号转义
+func (e SSHExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	path := e.SSHPath
+	if path == "" {
+		path = "ssh"
+	}
+	remote := []string{"nft"}
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+	// BatchMode 避免在没有终端时卡在密码提示上
+	cmd := exec.CommandContext(ctx, path, "-o", "BatchMode=yes", e.Host, "--", strings.Join(remote, " "))
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	return cmd.CombinedOutput()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,142 @@
+package nft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errOffline 是离线时无法完成的调用返回的错误
+var errOffline = errors.New("not available when generating the script offline")
+
+// OfflineExecutor 不调用 nft，按空规则集应答：查询返回 "No such file or directory"，
+// nft -c 直接通过，版本查询失败（依赖版本的功能按未知版本处理），nft -f 被拒绝。
+// 用于为其他主机生成脚本
+type OfflineExecutor struct{}
+
+// Run 实现 Executor
+func (OfflineExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case len(args) == 3 && args[0] == "-c":
+		return nil, nil
+	case len(args) == 1 && args[0] == "--version":
+		return nil, errOffline
+	}
+	return []byte("Error: No such file or directory"), errOffline
+}
+
+// UnprivilegedExecutor 用于只生成脚本的场合（-dry-run）：调用因权限不足（EPERM 或 EACCES）失败时
+// 调用一次 Warn，并按 OfflineExecutor 应答，即按空规则集生成脚本。其他结果原样返回
+type UnprivilegedExecutor struct {
+	Executor Executor
+	Warn     func(err error)
+
+	once sync.Once
+}
+
+// Run 实现 Executor
+func (e *UnprivilegedExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	output, err := e.Executor.Run(ctx, args, stdin)
+	if err == nil || !permissionDenied(output, err) {
+		return output, err
+	}
+	e.once.Do(func() {
+		if e.Warn != nil {
+			line, _, _ := bytes.Cut(bytes.TrimSpace(output), []byte("\n"))
+			e.Warn(fmt.Errorf("%v - %s", err, line))
+		}
+	})
+	return OfflineExecutor{}.Run(ctx, args, stdin)
+}
+
+// FileExecutor 把 nft -f - 的脚本写入文件或命名管道而不执行，供其他进程或主机使用，
+// 其他调用与 OfflineExecutor 相同
+type FileExecutor struct {
+	Path string
+	// FIFOTimeout 是命名管道等待读端出现的最长时间，0 表示一直等待
+	FIFOTimeout time.Duration
+}
+
+// fifoPoll 是等待命名管道读端时的重试间隔
+const fifoPoll = 100 * time.Millisecond
+
+// Run 实现 Executor
+func (e FileExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	if len(args) == 2 && args[0] == "-f" && args[1] == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		return nil, e.write(ctx, data)
+	}
+	return OfflineExecutor{}.Run(ctx, args, stdin)
+}
+
+func (e FileExecutor) write(ctx context.Context, data []byte) error {
+	if fi, err := os.Stat(e.Path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		return e.writeFIFO(ctx, data)
+	}
+	// 普通文件先写临时文件再改名，读者不会看到写了一半的脚本
+	tmp, err := os.CreateTemp(filepath.Dir(e.Path), "."+filepath.Base(e.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), e.Path)
+}
+
+// writeFIFO 以非阻塞方式打开管道以便发现没有读端（ENXIO），
+// 读端出现后切回阻塞模式写入整个脚本
+func (e FileExecutor) writeFIFO(ctx context.Context, data []byte) error {
+	var deadline time.Time
+	if e.FIFOTimeout > 0 {
+		deadline = time.Now().Add(e.FIFOTimeout)
+	}
+	for {
+		fd, err := syscall.Open(e.Path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err == nil {
+			if err := syscall.SetNonblock(fd, false); err != nil {
+				syscall.Close(fd)
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+			f := os.NewFile(uintptr(fd), e.Path)
+			_, err := f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if errors.Is(err, syscall.EPIPE) {
+				return fmt.Errorf("reader of %s went away before the script was fully written", e.Path)
+			}
+			return err
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return fmt.Errorf("open %s: %w", e.Path, err)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("no reader on named pipe %s after %s", e.Path, e.FIFOTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(fifoPoll):
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package nft
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github-updater/pkg/iprange"
+)
+
+// fingerprintVersion 是指纹输入格式的版本，只有格式本身改变时才递增
+const fingerprintVersion = "github-updater fingerprint v1"
+
+// Fingerprint 返回集合实际状态的稳定哈希（十六进制 SHA-256），用于发现带外修改。
+// 按 names 的顺序，每个集合的输入为一行
+//
+//	set <family> <table> <name> <type> flags=<排序后的标志，逗号分隔>
+//
+// 之后是按文本排序的元素行 "<网段>[ . <端口>][ : <动作>]"；sets 中没有的集合记为
+// "absent <family> <table> <name>"。元素先按端口和动作分组合并为最少的网段，因此元素的写法、
+// auto-merge 和顺序不影响结果；元素和集合的注释、policy、超时不参与计算
+func Fingerprint(family, table string, names []string, sets map[string]*Set) string {
+	var b strings.Builder
+	b.WriteString(fingerprintVersion + "\n")
+	for _, name := range names {
+		s := sets[name]
+		if s == nil {
+			fmt.Fprintf(&b, "absent %s %s %s\n", family, table, name)
+			continue
+		}
+		flags := slices.Clone(s.Flags)
+		slices.Sort(flags)
+		fmt.Fprintf(&b, "set %s %s %s %s flags=%s\n", family, table, name, s.Type, strings.Join(flags, ","))
+
+		type group struct {
+			port    uint16
+			verdict string
+		}
+		ranges := make(map[group][]iprange.Range)
+		for _, e := range s.Elements {
+			g := group{e.Port, e.Verdict}
+			ranges[g] = append(ranges[g], e.Range)
+		}
+		var lines []string
+		for g, rs := range ranges {
+			for _, p := range iprange.ToPrefixes(iprange.Merge(rs)) {
+				line := p.String()
+				if g.port != 0 {
+					line += fmt.Sprintf(" . %d", g.port)
+				}
+				if g.verdict != "" {
+					line += " : " + g.verdict
+				}
+				lines = append(lines, line)
+			}
+		}
+		slices.Sort(lines)
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
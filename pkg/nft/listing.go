@@ -0,0 +1,268 @@
+package nft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github-updater/pkg/iprange"
+)
+
+// ErrNotFound 表示要查询的对象不存在
+var ErrNotFound = errors.New("no such object")
+
+// Set 是 nft -j list set 返回的集合定义和内容
+type Set struct {
+	Family     string
+	Table      string
+	Name       string
+	Type       string
+	Flags      []string
+	Policy     string        // 未显式设置时为空
+	Timeout    time.Duration // 元素默认超时，0 表示没有
+	GCInterval time.Duration
+	Comment    string
+	Map        bool // verdict 映射（nft list map），Type 以 " : verdict" 结尾
+	Elements   []ListedElement
+}
+
+// Keyword 返回集合在 nft 语句中的关键字，set 或 map
+func (s *Set) Keyword() string {
+	if s.Map {
+		return "map"
+	}
+	return "set"
+}
+
+// ListedElement 是集合中的一个元素，单个地址和网段也以区间表示
+type ListedElement struct {
+	Range   iprange.Range
+	Port    uint16 // 拼接集合（地址 . 端口）中的端口，普通集合为 0
+	Comment string
+	Verdict string // 映射中元素对应的动作，例如 accept 或 jump github_in
+}
+
+// Ranges 返回所有元素的区间
+func (s *Set) Ranges() []iprange.Range {
+	rs := make([]iprange.Range, len(s.Elements))
+	for i, e := range s.Elements {
+		rs[i] = e.Range
+	}
+	return rs
+}
+
+// PortRanges 返回拼接集合中端口为 port 的元素的区间
+func (s *Set) PortRanges(port uint16) []iprange.Range {
+	var rs []iprange.Range
+	for _, e := range s.Elements {
+		if e.Port == port {
+			rs = append(rs, e.Range)
+		}
+	}
+	return rs
+}
+
+// ListSet 通过 nft -j list set 读取集合，没有该集合时再按 verdict 映射读取，
+// 两者都不存在时返回 ErrNotFound
+func (c *Client) ListSet(ctx context.Context, family, table, name string) (*Set, error) {
+	var output []byte
+	for _, keyword := range []string{"set", "map"} {
+		var err error
+		output, err = c.run(ctx, []string{"-j", "list", keyword, family, table, name}, "")
+		if err == nil {
+			return parseSetListing(output)
+		}
+		if !notFound(output, err) {
+			return nil, fmt.Errorf("nft list %s failed: %v - %s", keyword, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil, fmt.Errorf("set %s %s %s: %w", family, table, name, ErrNotFound)
+}
+
+// SetRef 标识一个集合
+type SetRef struct {
+	Family string
+	Table  string
+	Name   string
+}
+
+func (s SetRef) String() string { return s.Family + " " + s.Table + " " + s.Name }
+
+// ListSets 列出所有地址族中的集合（不含元素）
+func (c *Client) ListSets(ctx context.Context) ([]SetRef, error) {
+	output, err := c.run(ctx, []string{"-j", "list", "sets"}, "")
+	if err != nil {
+		return nil, fmt.Errorf("nft list sets failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	var listing jsonListing
+	if err := json.Unmarshal(output, &listing); err != nil {
+		return nil, fmt.Errorf("decode nft json: %w", err)
+	}
+	var refs []SetRef
+	for _, obj := range listing.Nftables {
+		if obj.Set != nil {
+			refs = append(refs, SetRef{Family: obj.Set.Family, Table: obj.Set.Table, Name: obj.Set.Name})
+		}
+	}
+	return refs, nil
+}
+
+// jsonSet 是 nft -j 输出中的 set 或 map 对象，映射的 Map 为值的类型
+type jsonSet struct {
+	Family     string            `json:"family"`
+	Table      string            `json:"table"`
+	Name       string            `json:"name"`
+	Type       json.RawMessage   `json:"type"`
+	Map        string            `json:"map"`
+	Flags      []string          `json:"flags"`
+	Policy     string            `json:"policy"`
+	Timeout    int64             `json:"timeout"`
+	GCInterval int64             `json:"gc-interval"`
+	Comment    string            `json:"comment"`
+	Elem       []json.RawMessage `json:"elem"`
+}
+
+type jsonListing struct {
+	Nftables []struct {
+		Set *jsonSet `json:"set"`
+		Map *jsonSet `json:"map"`
+	} `json:"nftables"`
+}
+
+func parseSetListing(data []byte) (*Set, error) {
+	var listing jsonListing
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return nil, fmt.Errorf("decode nft json: %w", err)
+	}
+	for _, obj := range listing.Nftables {
+		js := obj.Set
+		if js == nil {
+			js = obj.Map
+		}
+		if js == nil {
+			continue
+		}
+		s := &Set{
+			Family:     js.Family,
+			Table:      js.Table,
+			Name:       js.Name,
+			Flags:      js.Flags,
+			Policy:     js.Policy,
+			Timeout:    time.Duration(js.Timeout) * time.Second,
+			GCInterval: time.Duration(js.GCInterval) * time.Second,
+			Comment:    js.Comment,
+			Map:        obj.Set == nil,
+		}
+		// type 通常是字符串，拼接类型时是数组
+		if err := json.Unmarshal(js.Type, &s.Type); err != nil {
+			var parts []string
+			if json.Unmarshal(js.Type, &parts) == nil {
+				s.Type = strings.Join(parts, " . ")
+			}
+		}
+		if s.Map {
+			s.Type += " : " + js.Map
+		}
+		for _, raw := range js.Elem {
+			parse := parseElement
+			if s.Map {
+				parse = parseMapElement
+			}
+			e, err := parse(raw)
+			if err != nil {
+				return nil, err
+			}
+			s.Elements = append(s.Elements, e)
+		}
+		return s, nil
+	}
+	return nil, errors.New("no set in nft json output")
+}
+
+// parseMapElement 解析映射元素 [键, 动作]，动作形如 {"accept":null} 或 {"jump":{"target":"x"}}
+func parseMapElement(raw json.RawMessage) (ListedElement, error) {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+		return ListedElement{}, fmt.Errorf("unexpected map element %s", raw)
+	}
+	e, err := parseElement(pair[0])
+	if err != nil {
+		return e, err
+	}
+	var verdict map[string]*struct {
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(pair[1], &verdict); err != nil || len(verdict) != 1 {
+		return e, fmt.Errorf("unexpected verdict in map element %s", raw)
+	}
+	for name, v := range verdict {
+		e.Verdict = name
+		if v != nil && v.Target != "" {
+			e.Verdict += " " + v.Target
+		}
+	}
+	return e, nil
+}
+
+// parseElement 解析元素，可能的形式："1.2.3.4"、{"prefix":...}、{"range":[...]}、{"elem":{"val":...,"comment":...}}
+func parseElement(raw json.RawMessage) (ListedElement, error) {
+	var addr string
+	if json.Unmarshal(raw, &addr) == nil {
+		a, err := netip.ParseAddr(addr)
+		if err != nil {
+			return ListedElement{}, err
+		}
+		return ListedElement{Range: iprange.Range{From: a, To: a}}, nil
+	}
+	var obj struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Range  []string          `json:"range"`
+		Concat []json.RawMessage `json:"concat"`
+		Elem   *struct {
+			Val     json.RawMessage `json:"val"`
+			Comment string          `json:"comment"`
+		} `json:"elem"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return ListedElement{}, fmt.Errorf("unexpected set element %s", raw)
+	}
+	switch {
+	case obj.Prefix != nil:
+		a, err := netip.ParseAddr(obj.Prefix.Addr)
+		if err != nil {
+			return ListedElement{}, err
+		}
+		return ListedElement{Range: iprange.FromPrefix(netip.PrefixFrom(a, obj.Prefix.Len))}, nil
+	case len(obj.Range) == 2:
+		from, err := netip.ParseAddr(obj.Range[0])
+		if err != nil {
+			return ListedElement{}, err
+		}
+		to, err := netip.ParseAddr(obj.Range[1])
+		if err != nil {
+			return ListedElement{}, err
+		}
+		return ListedElement{Range: iprange.Range{From: from, To: to}}, nil
+	case len(obj.Concat) == 2:
+		e, err := parseElement(obj.Concat[0])
+		if err != nil {
+			return e, err
+		}
+		if err := json.Unmarshal(obj.Concat[1], &e.Port); err != nil {
+			return e, fmt.Errorf("unexpected port in set element %s", raw)
+		}
+		return e, nil
+	case obj.Elem != nil:
+		e, err := parseElement(obj.Elem.Val)
+		e.Comment = obj.Elem.Comment
+		return e, err
+	}
+	return ListedElement{}, fmt.Errorf("unexpected set element %s", raw)
+}
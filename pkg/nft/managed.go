@@ -0,0 +1,76 @@
+package nft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ManagedSet 是规则集中 comment 带有管理标记的集合或映射
+type ManagedSet struct {
+	SetRef
+	Map bool
+}
+
+// Keyword 返回集合在 nft 语句中的关键字，set 或 map
+func (s ManagedSet) Keyword() string {
+	if s.Map {
+		return "map"
+	}
+	return "set"
+}
+
+// ManagedRule 是规则集中注释为管理标记的规则
+type ManagedRule struct {
+	Family string
+	Table  string
+	Chain  string
+	Handle uint64
+	Set    string // 引用的集合
+}
+
+// Managed 是 ListManaged 找到的对象
+type Managed struct {
+	Sets  []ManagedSet
+	Rules []ManagedRule
+	// Unmanaged 记录引用了各集合、但不带管理标记的规则所在的链，这些集合无法单独删除
+	Unmanaged map[SetRef][]string
+}
+
+// ListManaged 通过 nft -j -t list ruleset 找出所有地址族和表中带有 marker 的集合、映射
+// （comment 为 ManagedComment 的形式）和规则（注释为 marker）
+func (c *Client) ListManaged(ctx context.Context, marker string) (*Managed, error) {
+	output, err := c.run(ctx, []string{"-j", "-t", "list", "ruleset"}, "")
+	if err != nil {
+		return nil, fmt.Errorf("nft list ruleset failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	var listing jsonListing
+	if err := json.Unmarshal(output, &listing); err != nil {
+		return nil, fmt.Errorf("decode nft json: %w", err)
+	}
+	m := &Managed{Unmanaged: make(map[SetRef][]string)}
+	for _, obj := range listing.Nftables {
+		for _, s := range []struct {
+			set   *jsonSet
+			isMap bool
+		}{{obj.Set, false}, {obj.Map, true}} {
+			if s.set != nil && CommentManager(s.set.Comment) == marker {
+				m.Sets = append(m.Sets, ManagedSet{SetRef{s.set.Family, s.set.Table, s.set.Name}, s.isMap})
+			}
+		}
+	}
+	rules, err := parseRuleListing(output, marker)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if !r.managed || r.handle == 0 {
+			ref := SetRef{r.family, r.table, r.set}
+			m.Unmanaged[ref] = append(m.Unmanaged[ref], r.chain)
+			continue
+		}
+		m.Rules = append(m.Rules, ManagedRule{r.family, r.table, r.chain, r.handle, r.set})
+	}
+	return m, nil
+}
@@ -0,0 +1,426 @@
+//go:build linux
+
+package nft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+
+	"github-updater/pkg/iprange"
+)
+
+// netlinkVersion 是 --version 的应答。用到的集合功能 netlink 后端都直接支持，
+// 按 nft 1.0.0 报告，使依赖版本的检查通过
+const netlinkVersion = "nftables v1.0.0 (netlink backend)"
+
+// errNetlinkUnsupported 是 netlink 后端无法完成的调用返回的错误
+var errNetlinkUnsupported = errors.New("not supported by the netlink backend")
+
+// NetlinkExecutor 不调用 nft 命令，通过 netlink（github.com/google/nftables）直接读写集合，
+// 主机上不需要安装 nft。它实现 ConfigExecutor：更新由 Config 直接生成一个 netlink 批次，
+// 与 nft -f 一样全部生效或全部不生效，不接受 nft 脚本；失败时返回内核的错误，
+// 可以用 errors.Is 与 syscall.EBUSY 等比较。查询只支持 list set、list sets 和表的存在性检查。
+// 链和规则、映射、拼接集合、gc-interval 和 policy 不支持；表的 comment 被忽略，读取的集合不带 comment
+type NetlinkExecutor struct{}
+
+// Run 实现 Executor，查询的应答格式与 nft 相同
+func (e NetlinkExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case slices.Equal(args, []string{"--version"}):
+		return []byte(netlinkVersion), nil
+	case len(args) == 5 && slices.Equal(args[:3], []string{"-t", "list", "table"}):
+		return e.listTable(args[3], args[4])
+	case len(args) == 6 && args[0] == "-j" && args[1] == "list" && (args[2] == "set" || args[2] == "map"):
+		return e.listSet(args[2] == "map", args[3], args[4], args[5])
+	case slices.Equal(args, []string{"-j", "list", "sets"}):
+		return e.listSets()
+	}
+	return []byte("Error: nft " + strings.Join(args, " ") + " is " + errNetlinkUnsupported.Error()), errNetlinkUnsupported
+}
+
+var netlinkFamilies = map[string]nftables.TableFamily{
+	"ip":     nftables.TableFamilyIPv4,
+	"ip6":    nftables.TableFamilyIPv6,
+	"inet":   nftables.TableFamilyINet,
+	"arp":    nftables.TableFamilyARP,
+	"bridge": nftables.TableFamilyBridge,
+	"netdev": nftables.TableFamilyNetdev,
+}
+
+func netlinkFamilyName(f nftables.TableFamily) string {
+	for name, v := range netlinkFamilies {
+		if v == f {
+			return name
+		}
+	}
+	return strconv.Itoa(int(f))
+}
+
+func netlinkTable(family, table string) (*nftables.Table, error) {
+	fam, ok := netlinkFamilies[family]
+	if !ok {
+		return nil, fmt.Errorf("unknown family %s", family)
+	}
+	return &nftables.Table{Name: table, Family: fam}, nil
+}
+
+// ApplyConfigs 实现 ConfigExecutor，check 为 true 时只生成批次而不提交
+func (e NetlinkExecutor) ApplyConfigs(ctx context.Context, check bool, configs ...Config) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, c := range configs {
+		if err := addNetlinkConfig(conn, c); err != nil {
+			return err
+		}
+	}
+	if check {
+		return nil
+	}
+	return conn.Flush()
+}
+
+// addNetlinkConfig 把 c 对应的操作加入批次，顺序与 Render 生成的脚本相同：
+// 删除 DeleteSets、建表、建集合、清空（常量集合除外）、写入元素
+func addNetlinkConfig(conn *nftables.Conn, c Config) error {
+	switch {
+	case len(c.Ports) > 0:
+		return fmt.Errorf("sets of address . port are %w", errNetlinkUnsupported)
+	case c.VerdictMap:
+		return fmt.Errorf("verdict maps are %w", errNetlinkUnsupported)
+	case c.SetAttrs.Policy != "":
+		return fmt.Errorf("set policy is %w", errNetlinkUnsupported)
+	case c.SetAttrs.GCInterval != 0:
+		return fmt.Errorf("set gc-interval is %w", errNetlinkUnsupported)
+	}
+	for _, ch := range c.Chains {
+		if ch.Create || ch.AddIPv4Rule || ch.AddIPv6Rule || len(ch.DeleteHandles) > 0 {
+			return fmt.Errorf("changing chain %s is %w", ch.Name, errNetlinkUnsupported)
+		}
+	}
+	t, err := netlinkTable(c.Family, c.TableName)
+	if err != nil {
+		return err
+	}
+	for _, name := range c.DeleteSets {
+		conn.DelSet(&nftables.Set{Table: t, Name: name})
+	}
+	// 表的 comment 无法通过 netlink 设置，忽略
+	conn.AddTable(t)
+	for _, s := range []struct {
+		name, comment string
+		key           nftables.SetDatatype
+		elems         []Element
+	}{
+		{c.IPv4SetName, c.IPv4SetComment, nftables.TypeIPAddr, c.IPv4Elements},
+		{c.IPv6SetName, c.IPv6SetComment, nftables.TypeIP6Addr, c.IPv6Elements},
+	} {
+		if s.name == "" {
+			continue
+		}
+		set := &nftables.Set{
+			Table: t, Name: s.name, KeyType: s.key, Comment: s.comment,
+			Interval: true, AutoMerge: true, Constant: c.SetAttrs.Constant,
+			HasTimeout: c.SetAttrs.Timeout > 0, Timeout: c.SetAttrs.Timeout,
+		}
+		if err := conn.AddSet(set, nil); err != nil {
+			return err
+		}
+		if !c.SetAttrs.Constant {
+			conn.FlushSet(set)
+		}
+		if err := addNetlinkElements(conn, set, s.elems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNetlinkElements 把元素写入集合，没有元素时不做任何操作
+func addNetlinkElements(conn *nftables.Conn, s *nftables.Set, elems []Element) error {
+	if len(elems) == 0 {
+		return nil
+	}
+	ranges := make([]netlinkElement, len(elems))
+	for i, e := range elems {
+		if e.Verdict != "" {
+			return fmt.Errorf("element %s: verdicts are %w", e, errNetlinkUnsupported)
+		}
+		ranges[i] = netlinkElement{Range: e.Range, comment: e.Comment}
+		if !e.Range.From.IsValid() {
+			ranges[i].Range = iprange.FromPrefix(e.Prefix)
+		}
+	}
+	vals, err := netlinkSetElements(s, ranges)
+	if err != nil {
+		return err
+	}
+	return conn.SetAddElements(s, vals)
+}
+
+// ReplaceSets 实现 ConfigExecutor，按现有集合的类型和标志写入元素
+func (e NetlinkExecutor) ReplaceSets(ctx context.Context, family, table string, sets ...SetElements) error {
+	t, err := netlinkTable(family, table)
+	if err != nil {
+		return err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, se := range sets {
+		if se.Map {
+			return fmt.Errorf("map %s: verdict maps are %w", se.Name, errNetlinkUnsupported)
+		}
+		s, err := conn.GetSetByName(t, se.Name)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", se.Name, err)
+		}
+		s.Table = t
+		conn.FlushSet(s)
+		if err := addNetlinkElements(conn, s, se.Elements); err != nil {
+			return err
+		}
+	}
+	return conn.Flush()
+}
+
+// FlushSets 实现 ConfigExecutor
+func (e NetlinkExecutor) FlushSets(ctx context.Context, sets ...*Set) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, s := range sets {
+		t, err := netlinkTable(s.Family, s.Table)
+		if err != nil {
+			return err
+		}
+		conn.FlushSet(&nftables.Set{Table: t, Name: s.Name})
+	}
+	return conn.Flush()
+}
+
+// DeleteSet 实现 ConfigExecutor
+func (e NetlinkExecutor) DeleteSet(ctx context.Context, family, table, name string) error {
+	t, err := netlinkTable(family, table)
+	if err != nil {
+		return err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	conn.DelSet(&nftables.Set{Table: t, Name: name})
+	return conn.Flush()
+}
+
+// netlinkElement 是写入或读取的一个元素
+type netlinkElement struct {
+	iprange.Range
+	comment string
+}
+
+// netlinkSetElements 把元素转换为 netlink 的集合元素。区间集合中每个区间是一个起点元素
+// 加一个标记为区间结束的 to+1 元素（与下一个区间的起点键相同也要写出）；
+// 与 auto-merge 一样先合并重叠的区间，到达地址空间末尾的区间没有结束元素
+func netlinkSetElements(s *nftables.Set, elems []netlinkElement) ([]nftables.SetElement, error) {
+	is4 := s.KeyType.Bytes == 4
+	sorted := slices.Clone(elems)
+	for _, e := range sorted {
+		if e.From.Is4() != is4 {
+			return nil, fmt.Errorf("element %s does not match type %s of set %s", e.Range, s.KeyType.Name, s.Name)
+		}
+		if !s.Interval && e.From != e.To {
+			return nil, fmt.Errorf("element %s needs the interval flag on set %s", e.Range, s.Name)
+		}
+	}
+	slices.SortFunc(sorted, func(a, b netlinkElement) int { return a.From.Compare(b.From) })
+	var merged []netlinkElement
+	for _, e := range sorted {
+		if n := len(merged); n > 0 && !merged[n-1].To.Less(e.From) {
+			if merged[n-1].To.Less(e.To) {
+				merged[n-1].To = e.To
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	var vals []nftables.SetElement
+	for _, e := range merged {
+		vals = append(vals, nftables.SetElement{Key: e.From.AsSlice(), Comment: e.comment})
+		if !s.Interval {
+			continue
+		}
+		end := e.To.Next()
+		if !end.IsValid() {
+			continue
+		}
+		vals = append(vals, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+	}
+	return vals, nil
+}
+
+// netlinkRanges 把读取的集合元素还原为区间：起点元素到下一个元素之前为止，
+// 没有结束元素时到地址空间末尾
+func netlinkRanges(s *nftables.Set, elems []nftables.SetElement) []netlinkElement {
+	slices.SortFunc(elems, func(a, b nftables.SetElement) int {
+		if c := bytes.Compare(a.Key, b.Key); c != 0 {
+			return c
+		}
+		switch {
+		case a.IntervalEnd == b.IntervalEnd:
+			return 0
+		case a.IntervalEnd:
+			return -1
+		}
+		return 1
+	})
+	var (
+		out  []netlinkElement
+		open *netlinkElement
+	)
+	for _, e := range elems {
+		a, ok := netip.AddrFromSlice(e.Key)
+		if !ok {
+			continue
+		}
+		if open != nil {
+			open.To = a.Prev()
+			out = append(out, *open)
+			open = nil
+		}
+		if e.IntervalEnd {
+			continue
+		}
+		r := netlinkElement{Range: iprange.Range{From: a, To: a}, comment: e.Comment}
+		if to, ok := netip.AddrFromSlice(e.KeyEnd); ok {
+			r.To = to
+		} else if s.Interval {
+			open = &r
+			continue
+		}
+		out = append(out, r)
+	}
+	if open != nil {
+		last := make([]byte, open.From.BitLen()/8)
+		for i := range last {
+			last[i] = 0xff
+		}
+		open.To, _ = netip.AddrFromSlice(last)
+		out = append(out, *open)
+	}
+	return out
+}
+
+// listTable 只检查表是否存在，内核的错误原样返回，Client 据此识别不存在的表
+func (e NetlinkExecutor) listTable(family, table string) ([]byte, error) {
+	t, err := netlinkTable(family, table)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ListTableOfFamily(t.Name, t.Family); err != nil {
+		return nil, err
+	}
+	return []byte("table " + family + " " + table + "\n"), nil
+}
+
+func (e NetlinkExecutor) listSet(isMap bool, family, table, name string) ([]byte, error) {
+	t, err := netlinkTable(family, table)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	s, err := conn.GetSetByName(t, name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case s.IsMap != isMap:
+		// 与 nft 一样，按另一种对象读取时视为不存在
+		return nil, fmt.Errorf("%s: %w", name, syscall.ENOENT)
+	case isMap || s.Concatenation:
+		return nil, fmt.Errorf("listing %s is %w", name, errNetlinkUnsupported)
+	}
+	elems, err := conn.GetSetElements(s)
+	if err != nil {
+		return nil, err
+	}
+	js := netlinkJSONSet(family, table, s)
+	for _, r := range netlinkRanges(s, elems) {
+		var val interface{} = r.From.String()
+		if ps := r.Prefixes(); len(ps) > 1 {
+			val = map[string][]string{"range": {r.From.String(), r.To.String()}}
+		} else if ps[0].Bits() != r.From.BitLen() {
+			val = map[string]interface{}{"prefix": map[string]interface{}{"addr": r.From.String(), "len": ps[0].Bits()}}
+		}
+		if r.comment != "" {
+			val = map[string]interface{}{"elem": map[string]interface{}{"val": val, "comment": r.comment}}
+		}
+		raw, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		js.Elem = append(js.Elem, raw)
+	}
+	return json.Marshal(map[string][]map[string]*jsonSet{"nftables": {{"set": js}}})
+}
+
+func (e NetlinkExecutor) listSets() ([]byte, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	objs := []map[string]*jsonSet{}
+	for _, t := range tables {
+		sets, err := conn.GetSets(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sets {
+			if !s.IsMap && !s.Anonymous {
+				objs = append(objs, map[string]*jsonSet{"set": netlinkJSONSet(netlinkFamilyName(t.Family), t.Name, s)})
+			}
+		}
+	}
+	return json.Marshal(map[string][]map[string]*jsonSet{"nftables": objs})
+}
+
+// netlinkJSONSet 按 nft -j 的格式描述集合，不含元素
+func netlinkJSONSet(family, table string, s *nftables.Set) *jsonSet {
+	typ, _ := json.Marshal(s.KeyType.Name)
+	js := &jsonSet{Family: family, Table: table, Name: s.Name, Type: typ, Timeout: int64(s.Timeout / time.Second)}
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{{"constant", s.Constant}, {"interval", s.Interval}, {"timeout", s.HasTimeout}} {
+		if f.on {
+			js.Flags = append(js.Flags, f.name)
+		}
+	}
+	return js
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package nft
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// errNetlinkUnsupported 是 netlink 后端无法完成的调用返回的错误
+var errNetlinkUnsupported = errors.New("the netlink backend is only available on Linux")
+
+// NetlinkExecutor 在 Linux 以外的系统上不可用，所有调用都返回错误
+type NetlinkExecutor struct{}
+
+// Run 实现 Executor
+func (e NetlinkExecutor) Run(ctx context.Context, args []string, stdin io.Reader) ([]byte, error) {
+	return []byte("Error: " + errNetlinkUnsupported.Error()), errNetlinkUnsupported
+}
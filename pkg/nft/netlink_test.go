@@ -0,0 +1,158 @@
+//go:build linux
+
+package nft
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+
+	"github-updater/pkg/iprange"
+)
+
+// parseNetlinkElement 解析测试中的元素：地址、网段或 from-to 区间，# 之后是 comment
+func parseNetlinkElement(t *testing.T, s string) netlinkElement {
+	t.Helper()
+	value, comment, _ := strings.Cut(s, "#")
+	var e netlinkElement
+	e.comment = comment
+	switch from, to, ok := strings.Cut(value, "-"); {
+	case ok:
+		e.Range = iprange.Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to)}
+	case strings.Contains(value, "/"):
+		e.Range = iprange.FromPrefix(netip.MustParsePrefix(value))
+	default:
+		a := netip.MustParseAddr(value)
+		e.Range = iprange.Range{From: a, To: a}
+	}
+	return e
+}
+
+func TestNetlinkSetElementsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		v6        bool
+		plain     bool     // 不带 interval 标志的集合
+		elems     []string // 写入的元素
+		want      []string // 读回的区间，为空时与 elems 相同
+		wantCount int      // 期望的 netlink 元素数
+	}{
+		{name: "disjoint", elems: []string{"192.0.2.0-192.0.2.255", "198.51.100.0-198.51.100.255"}, wantCount: 4},
+		{
+			name:  "unsorted",
+			elems: []string{"198.51.100.0/24", "192.0.2.7", "10.0.0.0/8"},
+			want:  []string{"10.0.0.0-10.255.255.255", "192.0.2.7-192.0.2.7", "198.51.100.0-198.51.100.255"}, wantCount: 6,
+		},
+		{
+			// 前一个区间的结束元素与后一个的起点键相同，两个区间不合并
+			name:  "adjacent",
+			elems: []string{"192.0.2.0/25", "192.0.2.128/25"},
+			want:  []string{"192.0.2.0-192.0.2.127", "192.0.2.128-192.0.2.255"}, wantCount: 4,
+		},
+		{
+			name:  "overlapping",
+			elems: []string{"10.1.0.0/16#inner", "10.0.0.0/8#outer", "10.255.255.0-11.0.0.255"},
+			want:  []string{"10.0.0.0-11.0.0.255#outer"}, wantCount: 2,
+		},
+		{name: "start of address space", elems: []string{"0.0.0.0-127.255.255.255"}, wantCount: 2},
+		{name: "end of address space", elems: []string{"192.0.2.0-192.0.2.255", "255.255.255.0-255.255.255.255"}, wantCount: 3},
+		{name: "whole address space", elems: []string{"0.0.0.0/0"}, want: []string{"0.0.0.0-255.255.255.255"}, wantCount: 1},
+		{name: "comments", elems: []string{"192.0.2.0-192.0.2.255#hooks", "198.51.100.0-198.51.100.255#web api"}, wantCount: 4},
+		{
+			name:  "v6",
+			v6:    true,
+			elems: []string{"2001:db8::/32#actions", "2001:db9::-2001:db9::ff", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120"},
+			want: []string{
+				"2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff#actions", "2001:db9::-2001:db9::ff",
+				"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			},
+			wantCount: 5,
+		},
+		{name: "no interval flag", plain: true, elems: []string{"192.0.2.9-192.0.2.9#a", "192.0.2.1-192.0.2.1"}, want: []string{"192.0.2.1-192.0.2.1", "192.0.2.9-192.0.2.9#a"}, wantCount: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &nftables.Set{Name: "gh", KeyType: nftables.TypeIPAddr, Interval: !tt.plain}
+			if tt.v6 {
+				s.KeyType = nftables.TypeIP6Addr
+			}
+			var elems []netlinkElement
+			for _, e := range tt.elems {
+				elems = append(elems, parseNetlinkElement(t, e))
+			}
+			vals, err := netlinkSetElements(s, elems)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vals) != tt.wantCount {
+				t.Errorf("%d netlink elements, want %d: %+v", len(vals), tt.wantCount, vals)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.elems
+			}
+			var wantElems []netlinkElement
+			for _, e := range want {
+				wantElems = append(wantElems, parseNetlinkElement(t, e))
+			}
+			if got := netlinkRanges(s, vals); !reflect.DeepEqual(got, wantElems) {
+				t.Errorf("round trip = %v, want %v", got, wantElems)
+			}
+		})
+	}
+}
+
+func TestNetlinkSetElementsErrors(t *testing.T) {
+	v4 := &nftables.Set{Name: "gh4", KeyType: nftables.TypeIPAddr, Interval: true}
+	if _, err := netlinkSetElements(v4, []netlinkElement{parseNetlinkElement(t, "2001:db8::/32")}); err == nil {
+		t.Error("IPv6 element accepted by an IPv4 set")
+	}
+	plain := &nftables.Set{Name: "gh4", KeyType: nftables.TypeIPAddr}
+	if _, err := netlinkSetElements(plain, []netlinkElement{parseNetlinkElement(t, "192.0.2.0/24")}); err == nil {
+		t.Error("range accepted by a set without the interval flag")
+	}
+}
+
+func TestNetlinkApplyConfigsCheck(t *testing.T) {
+	base := Config{
+		Target:       Target{Family: "inet", TableName: "filter", IPv4SetName: "gh4", IPv6SetName: "gh6"},
+		IPv4Elements: []Element{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Comment: "hooks"}},
+		IPv6Elements: []Element{{Range: iprange.Range{From: netip.MustParseAddr("2001:db8::"), To: netip.MustParseAddr("2001:db8::ff")}}},
+		SetAttrs:     SetAttrs{Constant: true},
+		DeleteSets:   []string{"gh4"},
+		// 已存在且不需要改动的链不影响 netlink 后端
+		Chains: []ChainConfig{{Name: "input"}},
+	}
+	// 只检查时不提交批次，不需要访问内核
+	if err := (NetlinkExecutor{}).ApplyConfigs(context.Background(), true, base); err != nil {
+		t.Fatalf("ApplyConfigs = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(c *Config)
+	}{
+		{"ports", func(c *Config) { c.Ports = []uint16{443} }},
+		{"verdict map", func(c *Config) { c.VerdictMap = true }},
+		{"policy", func(c *Config) { c.SetAttrs.Policy = "memory" }},
+		{"gc-interval", func(c *Config) { c.SetAttrs.Timeout, c.SetAttrs.GCInterval = time.Hour, time.Minute }},
+		{"rule changes", func(c *Config) { c.Chains = []ChainConfig{{Name: "input", AddIPv4Rule: true}} }},
+		{"element verdicts", func(c *Config) {
+			c.IPv4Elements = []Element{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Verdict: "drop"}}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			tt.change(&c)
+			if err := (NetlinkExecutor{}).ApplyConfigs(context.Background(), true, c); !errors.Is(err, errNetlinkUnsupported) {
+				t.Errorf("ApplyConfigs = %v, want %v", err, errNetlinkUnsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,689 @@
+// Package nft 渲染 nftables 集合更新脚本并通过 nft 命令应用。
+package nft
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github-updater/pkg/iprange"
+)
+
+// Target 标识要管理的表和集合
+type Target struct {
+	Family      string
+	TableName   string
+	IPv4SetName string
+	IPv6SetName string
+	// Marker 标识本工具管理的对象，写入规则的注释和表、集合的 comment，为空时为 RuleComment
+	Marker string
+}
+
+// ManagedMarker 返回实际使用的标记
+func (t Target) ManagedMarker() string {
+	if t.Marker == "" {
+		return RuleComment
+	}
+	return t.Marker
+}
+
+// markerRe 限制标记的写法，标记会出现在注释中，CommentManager 以空格分隔管理者名称
+var markerRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidMarker 检查管理标记
+func ValidMarker(m string) error {
+	if !markerRe.MatchString(m) {
+		return fmt.Errorf("invalid managed marker %q (want 1-64 letters, digits, '_', '.' or '-')", m)
+	}
+	return nil
+}
+
+var (
+	validFamilies = map[string]bool{"ip": true, "ip6": true, "inet": true, "bridge": true, "netdev": true}
+	// nft 词法中标识符的写法
+	identifierRe = regexp.MustCompile(`^[A-Za-z_.][A-Za-z0-9/\\_.-]*$`)
+	// 接口名最长 15 个字符，末尾的 * 表示前缀匹配
+	interfaceRe = regexp.MustCompile(`^[A-Za-z0-9_.:@-]{1,15}\*?$`)
+)
+
+// Validate 检查地址族以及表和集合的名称
+func (t Target) Validate() error {
+	var errs []error
+	if !validFamilies[t.Family] {
+		errs = append(errs, fmt.Errorf("invalid family %q (want ip, ip6, inet, bridge or netdev)", t.Family))
+	}
+	for _, n := range []struct{ what, name string }{
+		{"table", t.TableName}, {"IPv4 set", t.IPv4SetName}, {"IPv6 set", t.IPv6SetName},
+	} {
+		if !identifierRe.MatchString(n.name) {
+			errs = append(errs, fmt.Errorf("invalid %s name %q", n.what, n.name))
+		}
+	}
+	if t.IPv4SetName == t.IPv6SetName {
+		errs = append(errs, fmt.Errorf("IPv4 and IPv6 sets must have different names (both %q)", t.IPv4SetName))
+	}
+	return errors.Join(errs...)
+}
+
+// Element 是集合中的一个元素，Comment 非空时作为元素注释写入。
+// Range 有效时以 from-to 区间形式写入，代替 Prefix；Verdict 是 verdict 映射中元素对应的动作
+type Element struct {
+	Prefix  netip.Prefix
+	Range   iprange.Range
+	Comment string
+	Verdict string
+}
+
+func (e Element) String() string { return string(e.appendTo(nil, 0, false)) }
+
+// appendTo 把元素追加到 b，withPort 为 true 时与 port 拼接，用于 地址 . 端口 的拼接集合
+func (e Element) appendTo(b []byte, port uint16, withPort bool) []byte {
+	if e.Range.From.IsValid() {
+		b = e.Range.From.AppendTo(b)
+		b = append(b, '-')
+		b = e.Range.To.AppendTo(b)
+	} else {
+		b = e.Prefix.AppendTo(b)
+	}
+	if withPort {
+		b = append(b, " . "...)
+		b = strconv.AppendUint(b, uint64(port), 10)
+	}
+	if e.Comment != "" {
+		b = append(b, " comment "...)
+		b = strconv.AppendQuote(b, e.Comment)
+	}
+	if e.Verdict != "" {
+		b = append(b, " : "...)
+		b = append(b, e.Verdict...)
+	}
+	return b
+}
+
+func (e Element) key() string {
+	if e.Range.From.IsValid() {
+		return e.Range.From.String() + "-" + e.Range.To.String()
+	}
+	return e.Prefix.String()
+}
+
+// Config 描述一次完整的集合更新，IPv4SetName 或 IPv6SetName 为空时不生成该地址族的部分
+type Config struct {
+	Target
+	IPv4Elements []Element
+	IPv6Elements []Element
+	Chains       []ChainConfig // 挂载引用规则的链
+	Ports        []uint16      // 非空时集合类型为 地址 . 端口，元素为网段与端口的笛卡尔积
+	SetAttrs     SetAttrs
+	// VerdictMap 为 true 时创建 地址 : verdict 映射代替集合，元素带各自的 Verdict，
+	// 引用规则为 vmap 且不带动作
+	VerdictMap bool
+
+	// 非空时写入表和集合的 comment，见 ManagedComment。已存在的对象无法修改注释，调用方应留空
+	TableComment   string
+	IPv4SetComment string
+	IPv6SetComment string
+
+	// DeleteSets 中的集合在同一事务中先删除再创建，用于替换常量集合
+	DeleteSets []string
+}
+
+// SetAttrs 是可选的集合属性，零值表示不写入集合定义、由 nft 使用默认值。
+// 这些属性在集合创建后无法修改
+type SetAttrs struct {
+	Policy     string        // performance 或 memory
+	Timeout    time.Duration // 元素默认超时，非 0 时集合带 timeout 标志
+	GCInterval time.Duration // 过期元素的回收间隔，只能与 Timeout 一起使用
+	Constant   bool          // 带 constant 标志，集合被规则引用后内容不可修改，更新时需在事务中删除重建
+}
+
+// Validate 检查属性取值
+func (a SetAttrs) Validate() error {
+	if a.Policy != "" && a.Policy != "performance" && a.Policy != "memory" {
+		return fmt.Errorf("invalid set policy %q (want performance or memory)", a.Policy)
+	}
+	if a.GCInterval != 0 && a.Timeout == 0 {
+		return errors.New("set gc-interval requires element timeouts")
+	}
+	if a.Timeout < 0 || a.GCInterval < 0 || a.Timeout%time.Second != 0 || a.GCInterval%time.Second != 0 {
+		return errors.New("set timeout and gc-interval must be positive whole seconds")
+	}
+	return nil
+}
+
+// Mismatch 比较现有集合与期望的类型和属性，policy 和 gc-interval 只在显式设置时比较。
+// 一致时返回空字符串
+func (a SetAttrs) Mismatch(set *Set, wantType string) string {
+	var diffs []string
+	if set.Type != wantType {
+		diffs = append(diffs, fmt.Sprintf("type %s (want %s)", set.Type, wantType))
+	}
+	if !slices.Contains(set.Flags, "interval") {
+		diffs = append(diffs, fmt.Sprintf("flags %v (want interval)", set.Flags))
+	}
+	if a.Policy != "" && set.Policy != a.Policy {
+		diffs = append(diffs, fmt.Sprintf("policy %q (want %q)", set.Policy, a.Policy))
+	}
+	if a.Timeout != set.Timeout {
+		diffs = append(diffs, fmt.Sprintf("timeout %s (want %s)", set.Timeout, a.Timeout))
+	}
+	if a.GCInterval != 0 && set.GCInterval != a.GCInterval {
+		diffs = append(diffs, fmt.Sprintf("gc-interval %s (want %s)", set.GCInterval, a.GCInterval))
+	}
+	if constant := slices.Contains(set.Flags, "constant"); constant != a.Constant {
+		diffs = append(diffs, fmt.Sprintf("constant flag %t (want %t)", constant, a.Constant))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// ChainConfig 描述一个挂载引用规则的链。Hook 非空时链不存在则按 Type/Hook/Priority/Policy 创建，
+// 为空时链必须已经存在
+type ChainConfig struct {
+	Name     string
+	Type     string
+	Hook     string
+	Priority string
+	Policy   string
+	Match    string // 引用规则的地址匹配写法，见 MatchAuto 等，空值同 MatchAuto
+
+	Verdict       string   // 规则的动作，例如 accept、drop、jump other，空值同 accept
+	Ports         []uint16 // 非空时规则只匹配这些目标端口（th dport），不能与 Config.Ports 同时使用
+	AddressFamily string   // "ipv4" 或 "ipv6" 时只添加该地址族的规则，空值两者都添加
+
+	InInterfaces  []string // 非空时规则只匹配从这些接口进入的流量（iifname），可用 eth* 通配
+	OutInterfaces []string // 非空时规则只匹配从这些接口发出的流量（oifname）
+
+	// 以下由 InspectChain 根据现有规则集设置
+	Create        bool     // 链不存在时才创建
+	AddIPv4Rule   bool     // 引用规则不存在时才添加
+	AddIPv6Rule   bool     //
+	DeleteHandles []uint64 // 在同一事务中先删除的规则：本工具添加的旧规则，或重建集合时引用集合的规则
+
+	references []uint64 // 链中引用两个集合的全部规则
+}
+
+// RuleVerdict 返回规则的动作
+func (c ChainConfig) RuleVerdict() string {
+	if c.Verdict == "" {
+		return "accept"
+	}
+	return c.Verdict
+}
+
+// WantsFamily 判断链中是否应有 family（"ipv4" 或 "ipv6"）集合的引用规则
+func (c ChainConfig) WantsFamily(family string) bool {
+	return c.AddressFamily == "" || c.AddressFamily == family
+}
+
+// RebuildRules 删除链中引用集合的全部规则并重新添加本工具的规则，
+// 用于在同一事务中删除重建被引用的集合
+func (c *ChainConfig) RebuildRules() {
+	if c.Create {
+		return
+	}
+	c.DeleteHandles = c.references
+	c.AddIPv4Rule, c.AddIPv6Rule = c.WantsFamily("ipv4"), c.WantsFamily("ipv6")
+}
+
+// portsExpr 返回与 nft list 输出写法一致的端口匹配值，例如 443 或 { 80, 443 }
+func portsExpr(ports []uint16) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	sorted := slices.Clone(ports)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	if len(sorted) == 1 {
+		return strconv.Itoa(int(sorted[0]))
+	}
+	parts := make([]string, len(sorted))
+	for i, p := range sorted {
+		parts[i] = strconv.Itoa(int(p))
+	}
+	return "{ " + strings.Join(parts, ", ") + " }"
+}
+
+// Scope 返回规则中限定接口的表达式（与 nft list 的输出写法一致），不限定时为空字符串
+func (c ChainConfig) Scope() string {
+	var parts []string
+	for _, m := range []struct {
+		key   string
+		names []string
+	}{{"iifname", c.InInterfaces}, {"oifname", c.OutInterfaces}} {
+		if len(m.names) == 0 {
+			continue
+		}
+		quoted := make([]string, len(m.names))
+		for i, n := range m.names {
+			quoted[i] = strconv.Quote(n)
+		}
+		if len(quoted) == 1 {
+			parts = append(parts, m.key+" "+quoted[0])
+		} else {
+			parts = append(parts, m.key+" { "+strings.Join(quoted, ", ")+" }")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// 引用规则中地址匹配的写法
+const (
+	MatchAuto    = "auto"    // inet 表中用 meta nfproto 限定地址族，其他表直接匹配
+	MatchPlain   = "plain"   // 只写 ip saddr / ip6 saddr
+	MatchNfproto = "nfproto" // 总是用 meta nfproto 限定地址族
+)
+
+// ValidMatch 检查引用规则的匹配写法
+func ValidMatch(m string) error {
+	switch m {
+	case "", MatchAuto, MatchPlain, MatchNfproto:
+		return nil
+	}
+	return fmt.Errorf("invalid rule match %q (want %s, %s or %s)", m, MatchAuto, MatchPlain, MatchNfproto)
+}
+
+// RuleComment 是默认的管理标记，写入本工具添加的规则的注释
+const RuleComment = "github-updater"
+
+// managedPrefix 是 ManagedComment 的开头，用于识别管理者
+const managedPrefix = "managed by "
+
+// ManagedComment 返回写入表和集合的注释，包含管理标记、版本和更新时间
+func ManagedComment(marker, version string, at time.Time) string {
+	name := marker
+	if version != "" {
+		name += " " + version
+	}
+	return fmt.Sprintf("%s%s, updated %s", managedPrefix, name, at.UTC().Format(time.RFC3339))
+}
+
+// CommentManager 从注释中解析管理者名称，不是 "managed by ..." 形式时返回空字符串
+func CommentManager(comment string) string {
+	rest, ok := strings.CutPrefix(comment, managedPrefix)
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return strings.TrimSuffix(name, ",")
+}
+
+// 防止“被占用无法删除”时也能正常更新数据
+const nftTemplate = `
+{{- range .Chains}}
+{{- $chain := .Name}}
+{{- range .DeleteHandles}}
+delete rule {{$.Family}} {{$.TableName}} {{$chain}} handle {{.}}
+{{- end}}
+{{- end}}
+{{- range .DeleteSets}}
+delete {{$.SetKeyword}} {{$.Family}} {{$.TableName}} {{.}}
+{{- end}}
+add table {{.Family}} {{.TableName}}{{with .TableComment}} { comment {{printf "%q" .}}; }{{end}}
+
+# 1. 定义集合 (如果已存在且属性一致则忽略，如果不一致且被占用则会报错)
+{{- if .IPv4SetName}}
+add {{.SetKeyword}} {{.Family}} {{.TableName}} {{.IPv4SetName}} { type {{.IPv4SetType}}; {{.SetFlags}}{{with .IPv4SetComment}} comment {{printf "%q" .}};{{end}} }
+{{- end}}
+{{- if .IPv6SetName}}
+add {{.SetKeyword}} {{.Family}} {{.TableName}} {{.IPv6SetName}} { type {{.IPv6SetType}}; {{.SetFlags}}{{with .IPv6SetComment}} comment {{printf "%q" .}};{{end}} }
+{{- end}}
+
+{{- if not .SetAttrs.Constant}}
+
+# 2. 清空集合内容 (确保只有最新的 IP)
+{{- if .IPv4SetName}}
+flush {{.SetKeyword}} {{.Family}} {{.TableName}} {{.IPv4SetName}}
+{{- end}}
+{{- if .IPv6SetName}}
+flush {{.SetKeyword}} {{.Family}} {{.TableName}} {{.IPv6SetName}}
+{{- end}}
+{{- end}}
+
+# 3. 插入新数据
+`
+
+// 元素由 writeElements 直接写入，不经过模板
+const chainTemplate = `
+{{- range .Chains}}
+{{- if .Create}}
+
+# 4. 创建引用链 {{.Name}}
+add chain {{$.Family}} {{$.TableName}} {{.Name}} { type {{.Type}} hook {{.Hook}} priority {{.Priority}}; policy {{.Policy}}; }
+{{- end}}
+{{- if or .AddIPv4Rule .AddIPv6Rule}}
+
+# 5. 在 {{.Name}} 中挂载引用规则
+{{- end}}
+{{- if .AddIPv4Rule}}
+add rule {{$.Family}} {{$.TableName}} {{.Name}} {{$.Rule . "ipv4"}} comment "{{$.RuleComment}}"
+{{- end}}
+{{- if .AddIPv6Rule}}
+add rule {{$.Family}} {{$.TableName}} {{.Name}} {{$.Rule . "ipv6"}} comment "{{$.RuleComment}}"
+{{- end}}
+{{- end}}
+`
+
+var (
+	tmpl      = template.Must(template.New("nft").Parse(strings.TrimLeft(nftTemplate, "\n")))
+	chainTmpl = template.Must(template.New("chain").Parse(chainTemplate))
+)
+
+// IPv4SetType 返回 IPv4 集合的类型
+func (c Config) IPv4SetType() string { return c.setType("ipv4_addr") }
+
+// IPv6SetType 返回 IPv6 集合的类型
+func (c Config) IPv6SetType() string { return c.setType("ipv6_addr") }
+
+func (c Config) setType(addr string) string {
+	if len(c.Ports) > 0 {
+		addr += " . inet_service"
+	}
+	if c.VerdictMap {
+		addr += " : verdict"
+	}
+	return addr
+}
+
+// SetKeyword 返回集合对象在 nft 语句中的关键字，set 或 map
+func (c Config) SetKeyword() string {
+	if c.VerdictMap {
+		return "map"
+	}
+	return "set"
+}
+
+// SetFlags 返回集合定义中的 flags 及其他属性。拼接集合和映射不支持 auto-merge，元素需由调用方预先合并
+func (c Config) SetFlags() string {
+	a := c.SetAttrs
+	flags := "interval"
+	if a.Constant {
+		flags = "constant, " + flags
+	}
+	parts := []string{"flags " + flags + ";"}
+	if a.Timeout > 0 {
+		parts = []string{"flags " + flags + ", timeout;", "timeout " + nftDuration(a.Timeout) + ";"}
+	}
+	if a.GCInterval > 0 {
+		parts = append(parts, "gc-interval "+nftDuration(a.GCInterval)+";")
+	}
+	if a.Policy != "" {
+		parts = append(parts, "policy "+a.Policy+";")
+	}
+	if len(c.Ports) == 0 && !c.VerdictMap {
+		parts = append(parts, "auto-merge;")
+	}
+	return strings.Join(parts, " ")
+}
+
+// nftDuration 把时长格式化为 nft 的写法，例如 1d2h30s
+func nftDuration(d time.Duration) string {
+	var b strings.Builder
+	for _, u := range []struct {
+		unit string
+		d    time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.unit)
+			d -= n * u.d
+		}
+	}
+	if b.Len() == 0 {
+		return "0s"
+	}
+	return b.String()
+}
+
+// SplitFamilies 把配置拆成只含 IPv4 集合和只含 IPv6 集合的两份，分别在独立的事务中执行。
+// 两份都会创建表和（需要时）链，链中只添加各自的引用规则
+func (c Config) SplitFamilies() (v4, v6 Config) {
+	v4, v6 = c, c
+	v4.IPv6SetName, v4.IPv6Elements = "", nil
+	v6.IPv4SetName, v6.IPv4Elements = "", nil
+	v4.Chains, v6.Chains = slices.Clone(c.Chains), slices.Clone(c.Chains)
+	for i := range c.Chains {
+		v4.Chains[i].AddIPv6Rule, v6.Chains[i].AddIPv4Rule = false, false
+		v6.Chains[i].Create = false // 链只由 IPv4 的事务创建
+	}
+	v4.DeleteSets, v6.DeleteSets = nil, nil
+	for _, name := range c.DeleteSets {
+		if name == c.IPv4SetName {
+			v4.DeleteSets = append(v4.DeleteSets, name)
+		} else {
+			v6.DeleteSets = append(v6.DeleteSets, name)
+		}
+	}
+	return v4, v6
+}
+
+// Rule 返回链 ch 中引用 family（"ipv4" 或 "ipv6"）集合的规则表达式，不含注释
+func (c Config) Rule(ch ChainConfig, family string) string {
+	set := c.IPv4SetName
+	expr := c.match(ch, "ipv4", "ip saddr")
+	if family == "ipv6" {
+		set = c.IPv6SetName
+		expr = c.match(ch, "ipv6", "ip6 saddr")
+	}
+	if c.VerdictMap {
+		return expr + " vmap @" + set
+	}
+	expr += " @" + set
+	if ports := portsExpr(ch.Ports); ports != "" {
+		expr += " th dport " + ports
+	}
+	return expr + " " + ch.RuleVerdict()
+}
+
+// ruleVerdict 返回链 ch 中引用规则的动作，映射的引用规则没有动作
+func (c Config) ruleVerdict(ch ChainConfig) string {
+	if c.VerdictMap {
+		return ""
+	}
+	return ch.RuleVerdict()
+}
+
+func (c Config) match(ch ChainConfig, nfproto, saddr string) string {
+	expr := saddr
+	if len(c.Ports) > 0 {
+		expr += " . th dport"
+	}
+	// inet 表同时处理两个地址族，先限定地址族再匹配，避免部分内核拒绝或误匹配
+	switch ch.Match {
+	case MatchPlain:
+	case MatchNfproto:
+		expr = "meta nfproto " + nfproto + " " + expr
+	default:
+		if c.Family == "inet" {
+			expr = "meta nfproto " + nfproto + " " + expr
+		}
+	}
+	if scope := ch.Scope(); scope != "" {
+		expr = scope + " " + expr
+	}
+	return expr
+}
+
+// RuleComment 供模板引用，即管理标记
+func (c Config) RuleComment() string { return c.ManagedMarker() }
+
+// elementChunk 是每条 add element 语句最多包含的元素数。所有语句仍在同一个 nft -f 事务中，
+// 分段只是避免生成超长的单行，也便于 nft 报错时定位到具体语句
+const elementChunk = 1000
+
+// writeElements 把元素按 elementChunk 分段写成 add element 语句，逐个追加而不先拼接成整个列表。
+// 没有元素时不写任何语句
+func writeElements(w *strings.Builder, family, table, set string, elems []Element, ports []uint16) {
+	var scratch [128]byte
+	n := 0
+	write := func(e Element, port uint16, withPort bool) {
+		if n%elementChunk == 0 {
+			if n > 0 {
+				w.WriteString(" }\n")
+			}
+			fmt.Fprintf(w, "add element %s %s %s { ", family, table, set)
+		} else {
+			w.WriteString(", ")
+		}
+		w.Write(e.appendTo(scratch[:0], port, withPort))
+		n++
+	}
+	for _, e := range elems {
+		if len(ports) == 0 {
+			write(e, 0, false)
+			continue
+		}
+		for _, port := range ports {
+			write(e, port, true)
+		}
+	}
+	if n > 0 {
+		w.WriteString(" }\n")
+	}
+}
+
+// Coalesce 合并没有注释的元素中重叠或相邻的网段，合并后的区间在 from-to 写法更短时
+// 以区间输出，否则仍输出为网段，用于缩小大量网段时的脚本体积。带注释的元素原样保留，
+// 映射中只合并 Verdict 相同的元素
+func Coalesce(elems []Element) []Element {
+	var out []Element
+	prefixes := make(map[string][]netip.Prefix)
+	var verdicts []string
+	for _, e := range elems {
+		if e.Comment != "" || e.Range.From.IsValid() {
+			out = append(out, e)
+			continue
+		}
+		if _, ok := prefixes[e.Verdict]; !ok {
+			verdicts = append(verdicts, e.Verdict)
+		}
+		prefixes[e.Verdict] = append(prefixes[e.Verdict], e.Prefix)
+	}
+	for _, v := range verdicts {
+		for _, r := range iprange.Merge(iprange.FromPrefixes(prefixes[v])) {
+			ps := r.Prefixes()
+			if len(ps) > 1 && len(Element{Range: r}.key()) < prefixesLen(ps) {
+				out = append(out, Element{Range: r, Verdict: v})
+				continue
+			}
+			for _, p := range ps {
+				out = append(out, Element{Prefix: p, Verdict: v})
+			}
+		}
+	}
+	return out
+}
+
+// prefixesLen 返回网段列表写入脚本后的长度
+func prefixesLen(ps []netip.Prefix) int {
+	n := 2 * (len(ps) - 1) // ", " 分隔符
+	for _, p := range ps {
+		n += len(p.String())
+	}
+	return n
+}
+
+// Render 生成 nft -f 使用的事务脚本。脚本直接写入 strings.Builder，
+// 元素较多时也只在内存中保留一份
+func Render(config Config) (string, error) {
+	var b strings.Builder
+	b.Grow(24*(len(config.IPv4Elements)+len(config.IPv6Elements))*max(1, len(config.Ports)) + 1024)
+	// 首尾的标记行便于比较规则集的工具识别本工具生成的内容
+	b.WriteString("# BEGIN managed by " + config.RuleComment())
+	if err := tmpl.Execute(&b, config); err != nil {
+		return "", err
+	}
+	if config.IPv4SetName != "" {
+		writeElements(&b, config.Family, config.TableName, config.IPv4SetName, config.IPv4Elements, config.Ports)
+	}
+	if config.IPv6SetName != "" {
+		writeElements(&b, config.Family, config.TableName, config.IPv6SetName, config.IPv6Elements, config.Ports)
+	}
+	var chain strings.Builder
+	if err := chainTmpl.Execute(&chain, config); err != nil {
+		return "", err
+	}
+	if c := strings.TrimLeft(chain.String(), "\n"); c != "" {
+		b.WriteString("\n" + c)
+	}
+	out := strings.TrimRight(b.String(), "\n")
+	return out + "\n# END managed by " + config.RuleComment(), nil
+}
+
+var (
+	validChainTypes    = map[string]bool{"filter": true, "nat": true, "route": true}
+	validChainHooks    = map[string]bool{"prerouting": true, "input": true, "forward": true, "output": true, "postrouting": true, "ingress": true}
+	validChainPolicies = map[string]bool{"accept": true, "drop": true}
+	namedPriorities    = map[string]bool{"raw": true, "mangle": true, "dstnat": true, "filter": true, "security": true, "srcnat": true}
+)
+
+// verdictRe 匹配规则的动作，jump/goto 需要目标链名
+var verdictRe = regexp.MustCompile(`^(accept|drop|reject|return|continue|(jump|goto) [A-Za-z_.][A-Za-z0-9/\\_.-]*)$`)
+
+// ValidVerdict 检查规则或映射元素的动作
+func ValidVerdict(v string) error {
+	if !verdictRe.MatchString(v) {
+		return fmt.Errorf("invalid verdict %q (want accept, drop, reject, return, continue, jump <chain> or goto <chain>)", v)
+	}
+	return nil
+}
+
+// ValidateChain 检查链的名称、动作和接口限定，Hook 非空（需要时创建）时还检查 type/hook/priority/policy
+func ValidateChain(c ChainConfig) error {
+	if !identifierRe.MatchString(c.Name) {
+		return fmt.Errorf("invalid chain name %q", c.Name)
+	}
+	if c.Verdict != "" {
+		if err := ValidVerdict(c.Verdict); err != nil {
+			return fmt.Errorf("chain %s: %w", c.Name, err)
+		}
+	}
+	if c.AddressFamily != "" && c.AddressFamily != "ipv4" && c.AddressFamily != "ipv6" {
+		return fmt.Errorf("chain %s: invalid address family %q (want ipv4 or ipv6)", c.Name, c.AddressFamily)
+	}
+	if slices.Contains(c.Ports, 0) {
+		return fmt.Errorf("chain %s: port 0 is not valid", c.Name)
+	}
+	if c.Hook == "" {
+		return validateInterfaces(c)
+	}
+	if !validChainTypes[c.Type] {
+		return fmt.Errorf("invalid chain type %q", c.Type)
+	}
+	if !validChainHooks[c.Hook] {
+		return fmt.Errorf("invalid chain hook %q", c.Hook)
+	}
+	if !validChainPolicies[c.Policy] {
+		return fmt.Errorf("invalid chain policy %q", c.Policy)
+	}
+	if _, err := strconv.Atoi(c.Priority); err != nil && !namedPriorities[c.Priority] {
+		return fmt.Errorf("invalid chain priority %q", c.Priority)
+	}
+	return validateInterfaces(c)
+}
+
+// validateInterfaces 检查接口名称，以及在已知钩子时接口方向是否可用
+func validateInterfaces(c ChainConfig) error {
+	for _, n := range c.InInterfaces {
+		if !interfaceRe.MatchString(n) {
+			return fmt.Errorf("invalid input interface %q", n)
+		}
+	}
+	for _, n := range c.OutInterfaces {
+		if !interfaceRe.MatchString(n) {
+			return fmt.Errorf("invalid output interface %q", n)
+		}
+	}
+	// 出方向的钩子没有入接口，入方向的钩子没有出接口
+	if len(c.InInterfaces) > 0 && (c.Hook == "output" || c.Hook == "postrouting") {
+		return fmt.Errorf("input interfaces cannot be matched in a chain with hook %s", c.Hook)
+	}
+	if len(c.OutInterfaces) > 0 && (c.Hook == "prerouting" || c.Hook == "input" || c.Hook == "ingress") {
+		return fmt.Errorf("output interfaces cannot be matched in a chain with hook %s", c.Hook)
+	}
+	return nil
+}
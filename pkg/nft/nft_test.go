@@ -0,0 +1,240 @@
+package nft
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/iprange"
+)
+
+func testConfig(family string) Config {
+	return Config{Target: Target{Family: family, TableName: "filter", IPv4SetName: "gh4", IPv6SetName: "gh6"}}
+}
+
+func TestRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		chain  ChainConfig
+		v4, v6 string
+	}{
+		{
+			name: "inet guards the family",
+			v4:   "meta nfproto ipv4 ip saddr @gh4 accept",
+			v6:   "meta nfproto ipv6 ip6 saddr @gh6 accept",
+		},
+		{
+			name:   "ip table matches directly",
+			config: func(c *Config) { c.Family = "ip" },
+			v4:     "ip saddr @gh4 accept",
+			v6:     "ip6 saddr @gh6 accept",
+		},
+		{
+			name:  "plain match in inet",
+			chain: ChainConfig{Match: MatchPlain},
+			v4:    "ip saddr @gh4 accept",
+			v6:    "ip6 saddr @gh6 accept",
+		},
+		{
+			name:   "nfproto forced outside inet",
+			config: func(c *Config) { c.Family = "ip6" },
+			chain:  ChainConfig{Match: MatchNfproto},
+			v4:     "meta nfproto ipv4 ip saddr @gh4 accept",
+			v6:     "meta nfproto ipv6 ip6 saddr @gh6 accept",
+		},
+		{
+			name:  "rule ports and verdict",
+			chain: ChainConfig{Ports: []uint16{443, 22, 443}, Verdict: "jump github"},
+			v4:    "meta nfproto ipv4 ip saddr @gh4 th dport { 22, 443 } jump github",
+			v6:    "meta nfproto ipv6 ip6 saddr @gh6 th dport { 22, 443 } jump github",
+		},
+		{
+			name:   "port-scoped sets",
+			config: func(c *Config) { c.Ports = []uint16{443} },
+			chain:  ChainConfig{Verdict: "drop"},
+			v4:     "meta nfproto ipv4 ip saddr . th dport @gh4 drop",
+			v6:     "meta nfproto ipv6 ip6 saddr . th dport @gh6 drop",
+		},
+		{
+			name:   "verdict map",
+			config: func(c *Config) { c.VerdictMap = true },
+			chain:  ChainConfig{Verdict: "drop", Ports: []uint16{22}},
+			v4:     "meta nfproto ipv4 ip saddr vmap @gh4",
+			v6:     "meta nfproto ipv6 ip6 saddr vmap @gh6",
+		},
+		{
+			name:  "interfaces",
+			chain: ChainConfig{InInterfaces: []string{"eth0", "wg*"}, OutInterfaces: []string{"lan"}, Ports: []uint16{22}},
+			v4:    `iifname { "eth0", "wg*" } oifname "lan" meta nfproto ipv4 ip saddr @gh4 th dport 22 accept`,
+			v6:    `iifname { "eth0", "wg*" } oifname "lan" meta nfproto ipv6 ip6 saddr @gh6 th dport 22 accept`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig("inet")
+			if tt.config != nil {
+				tt.config(&c)
+			}
+			if got := c.Rule(tt.chain, "ipv4"); got != tt.v4 {
+				t.Errorf("ipv4 rule = %q, want %q", got, tt.v4)
+			}
+			if got := c.Rule(tt.chain, "ipv6"); got != tt.v6 {
+				t.Errorf("ipv6 rule = %q, want %q", got, tt.v6)
+			}
+		})
+	}
+}
+
+func TestRenderChainRules(t *testing.T) {
+	c := testConfig("inet")
+	c.Chains = []ChainConfig{
+		{Name: "input", Type: "filter", Hook: "input", Priority: "0", Policy: "accept", Create: true, AddIPv4Rule: true, AddIPv6Rule: true},
+		{Name: "forward", AddIPv6Rule: true, DeleteHandles: []uint64{7, 9}, Verdict: "drop"},
+	}
+	out, err := Render(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 删除旧规则在最前面，使被引用的集合可以在同一事务中删除重建
+	want := `# BEGIN managed by github-updater
+delete rule inet filter forward handle 7
+delete rule inet filter forward handle 9
+add table inet filter
+
+# 1. 定义集合 (如果已存在且属性一致则忽略，如果不一致且被占用则会报错)
+add set inet filter gh4 { type ipv4_addr; flags interval; auto-merge; }
+add set inet filter gh6 { type ipv6_addr; flags interval; auto-merge; }
+
+# 2. 清空集合内容 (确保只有最新的 IP)
+flush set inet filter gh4
+flush set inet filter gh6
+
+# 3. 插入新数据
+
+# 4. 创建引用链 input
+add chain inet filter input { type filter hook input priority 0; policy accept; }
+
+# 5. 在 input 中挂载引用规则
+add rule inet filter input meta nfproto ipv4 ip saddr @gh4 accept comment "github-updater"
+add rule inet filter input meta nfproto ipv6 ip6 saddr @gh6 accept comment "github-updater"
+
+# 5. 在 forward 中挂载引用规则
+add rule inet filter forward meta nfproto ipv6 ip6 saddr @gh6 drop comment "github-updater"
+# END managed by github-updater`
+	if out != want {
+		t.Errorf("rendered script:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRuleValidation(t *testing.T) {
+	for _, m := range []string{"", MatchAuto, MatchPlain, MatchNfproto} {
+		if err := ValidMatch(m); err != nil {
+			t.Errorf("ValidMatch(%q) = %v", m, err)
+		}
+	}
+	if ValidMatch("meta") == nil {
+		t.Error("ValidMatch accepted an unknown match")
+	}
+	for _, v := range []string{"accept", "drop", "jump github_allow", "goto x.y"} {
+		if err := ValidVerdict(v); err != nil {
+			t.Errorf("ValidVerdict(%q) = %v", v, err)
+		}
+	}
+	for _, v := range []string{"", "jump", "accept; drop", "queue"} {
+		if ValidVerdict(v) == nil {
+			t.Errorf("ValidVerdict(%q) accepted", v)
+		}
+	}
+}
+
+func TestWriteElementsChunks(t *testing.T) {
+	elems := benchmarkElements(2*elementChunk + 1)
+	var b strings.Builder
+	writeElements(&b, "inet", "filter", "gh4", elems, nil)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d statements, want 3", len(lines))
+	}
+	var got []string
+	for _, l := range lines {
+		body, ok := strings.CutPrefix(l, "add element inet filter gh4 { ")
+		if !ok || !strings.HasSuffix(body, " }") {
+			t.Fatalf("malformed statement %.60q", l)
+		}
+		got = append(got, strings.Split(strings.TrimSuffix(body, " }"), ", ")...)
+	}
+	if len(got) != len(elems) || got[0] != elems[0].String() || got[len(got)-1] != elems[len(elems)-1].String() {
+		t.Errorf("elements not written in order: %d of %d", len(got), len(elems))
+	}
+
+	b.Reset()
+	writeElements(&b, "inet", "filter", "gh4", []Element{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Comment: `hooks "web"`},
+		{Range: iprange.Range{From: netip.MustParseAddr("198.51.100.7"), To: netip.MustParseAddr("198.51.100.9")}},
+	}, []uint16{22, 443})
+	want := `add element inet filter gh4 { 192.0.2.0/24 . 22 comment "hooks \"web\"", 192.0.2.0/24 . 443 comment "hooks \"web\"", 198.51.100.7-198.51.100.9 . 22, 198.51.100.7-198.51.100.9 . 443 }` + "\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	writeElements(&b, "inet", "filter", "gh4", nil, nil)
+	if b.Len() != 0 {
+		t.Errorf("empty set wrote %q", b.String())
+	}
+}
+
+// benchmarkElements 返回 n 个互不重叠的 /24 网段
+func benchmarkElements(n int) []Element {
+	elems := make([]Element, n)
+	for i := range elems {
+		elems[i] = Element{Prefix: netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(10 + i>>16), byte(i >> 8), byte(i), 0}), 24)}
+	}
+	return elems
+}
+
+func BenchmarkRender50k(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		ports []uint16
+	}{{"plain", nil}, {"ports", []uint16{22, 443}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := testConfig("inet")
+			c.IPv4Elements, c.Ports = benchmarkElements(50000), bc.ports
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := Render(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkJoinElements50k 是分段写入之前的做法：每个元素先格式化为字符串，再拼接成整个列表交给模板，用于对比
+func BenchmarkJoinElements50k(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		ports []uint16
+	}{{"plain", nil}, {"ports", []uint16{22, 443}}} {
+		b.Run(bc.name, func(b *testing.B) {
+			elems := benchmarkElements(50000)
+			b.ReportAllocs()
+			for b.Loop() {
+				var parts []string
+				for _, e := range elems {
+					if len(bc.ports) == 0 {
+						parts = append(parts, e.key())
+						continue
+					}
+					for _, port := range bc.ports {
+						parts = append(parts, fmt.Sprintf("%s . %d", e.key(), port))
+					}
+				}
+				_ = fmt.Sprintf("add element inet filter gh4 { %s }\n", strings.Join(parts, ", "))
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package nft
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// listedRule 是 nft -j list chain 输出中引用了集合的一条规则，按表达式的结构解析，
+// 与 nft 文本输出的写法（各版本之间有差异）无关
+type listedRule struct {
+	set     string   // 引用的集合
+	iif     []string // iifname 匹配的接口（已排序）
+	oif     []string // oifname 匹配的接口（已排序）
+	ports   []uint16 // th dport 匹配的端口（已排序）
+	verdict string   // vmap 引用映射时为空
+	other   bool     // 含有本工具不会生成的其他匹配或语句（计数器除外）
+	managed bool     // 注释为本工具的管理标记
+	handle  uint64   // 没有 handle 时为 0
+
+	family, table, chain string // 规则所在的位置
+}
+
+// matches 判断规则是否与链的配置一致，verdict 是期望的动作
+func (r listedRule) matches(ch ChainConfig, verdict string) bool {
+	return !r.other && r.verdict == verdict &&
+		slices.Equal(r.iif, sortedSet(ch.InInterfaces)) &&
+		slices.Equal(r.oif, sortedSet(ch.OutInterfaces)) &&
+		slices.Equal(r.ports, sortedSet(ch.Ports))
+}
+
+// sortedSet 返回排序去重后的副本，空输入返回 nil 以便与解析结果比较
+func sortedSet[T string | uint16](items []T) []T {
+	if len(items) == 0 {
+		return nil
+	}
+	out := slices.Clone(items)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// jsonRule 是 nft -j 输出中的 rule 对象
+type jsonRule struct {
+	Family  string            `json:"family"`
+	Table   string            `json:"table"`
+	Chain   string            `json:"chain"`
+	Handle  uint64            `json:"handle"`
+	Comment string            `json:"comment"`
+	Expr    []json.RawMessage `json:"expr"`
+}
+
+// parseRuleListing 取出 nft -j list chain（或 list ruleset）输出中所有引用集合（@name）的规则，
+// 注释为 marker 的规则记为 managed
+func parseRuleListing(data []byte, marker string) ([]listedRule, error) {
+	var listing struct {
+		Nftables []struct {
+			Rule *jsonRule `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return nil, fmt.Errorf("decode nft json: %w", err)
+	}
+	var rules []listedRule
+	for _, obj := range listing.Nftables {
+		if obj.Rule == nil {
+			continue
+		}
+		r := listedRule{handle: obj.Rule.Handle, managed: obj.Rule.Comment == marker,
+			family: obj.Rule.Family, table: obj.Rule.Table, chain: obj.Rule.Chain}
+		for _, raw := range obj.Rule.Expr {
+			r.addStatement(raw)
+		}
+		if r.set != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// addStatement 按语句的结构更新规则
+func (r *listedRule) addStatement(raw json.RawMessage) {
+	var stmt map[string]json.RawMessage
+	if json.Unmarshal(raw, &stmt) != nil || len(stmt) != 1 {
+		r.other = true
+		return
+	}
+	for key, body := range stmt {
+		switch key {
+		case "match":
+			r.addMatch(body)
+		case "vmap":
+			var vmap struct {
+				Data string `json:"data"`
+			}
+			if json.Unmarshal(body, &vmap) != nil || !strings.HasPrefix(vmap.Data, "@") {
+				r.other = true
+				return
+			}
+			r.set = vmap.Data[1:]
+		case "counter":
+		case "accept", "drop", "reject", "return", "continue":
+			r.verdict = key
+		case "jump", "goto":
+			var v struct {
+				Target string `json:"target"`
+			}
+			if json.Unmarshal(body, &v) != nil || v.Target == "" {
+				r.other = true
+				return
+			}
+			r.verdict = key + " " + v.Target
+		default:
+			r.other = true
+		}
+	}
+}
+
+// addMatch 解析 match 语句：meta nfproto、ip/ip6 saddr（可与 th dport 拼接）@集合、
+// iifname/oifname 和 th dport。其他匹配记为 other
+func (r *listedRule) addMatch(body json.RawMessage) {
+	var m struct {
+		Op    string          `json:"op"`
+		Left  json.RawMessage `json:"left"`
+		Right json.RawMessage `json:"right"`
+	}
+	if json.Unmarshal(body, &m) != nil || (m.Op != "==" && m.Op != "in") {
+		r.other = true
+		return
+	}
+	var left struct {
+		Meta *struct {
+			Key string `json:"key"`
+		} `json:"meta"`
+		Payload *payloadExpr  `json:"payload"`
+		Concat  []payloadNode `json:"concat"`
+	}
+	if json.Unmarshal(m.Left, &left) != nil {
+		r.other = true
+		return
+	}
+	var ref string
+	isRef := json.Unmarshal(m.Right, &ref) == nil && strings.HasPrefix(ref, "@")
+	switch {
+	case left.Meta != nil && left.Meta.Key == "nfproto":
+		// 地址族限定只是避免误匹配，不影响规则是否一致
+	case left.Meta != nil && (left.Meta.Key == "iifname" || left.Meta.Key == "oifname"):
+		names, ok := rightValues[string](m.Right)
+		if !ok {
+			r.other = true
+			return
+		}
+		if left.Meta.Key == "iifname" {
+			r.iif = sortedSet(names)
+		} else {
+			r.oif = sortedSet(names)
+		}
+	case left.Payload != nil && left.Payload.field() == "saddr" && isRef:
+		r.set = ref[1:]
+	case len(left.Concat) == 2 && left.Concat[0].Payload != nil && left.Concat[0].Payload.field() == "saddr" && isRef:
+		r.set = ref[1:]
+	case left.Payload != nil && left.Payload.protocol() == "th" && left.Payload.Field == "dport":
+		ports, ok := rightValues[uint16](m.Right)
+		if !ok {
+			r.other = true
+			return
+		}
+		r.ports = sortedSet(ports)
+	default:
+		r.other = true
+	}
+}
+
+// payloadExpr 是 {"payload":{"protocol":"ip","field":"saddr"}}，早期的 nft 用 name 代替 protocol
+type payloadExpr struct {
+	Protocol string `json:"protocol"`
+	Name     string `json:"name"`
+	Field    string `json:"field"`
+}
+
+func (p *payloadExpr) protocol() string {
+	if p.Protocol != "" {
+		return p.Protocol
+	}
+	return p.Name
+}
+
+// field 返回 ip 或 ip6 头部的字段名，其他协议返回空字符串
+func (p *payloadExpr) field() string {
+	if proto := p.protocol(); proto == "ip" || proto == "ip6" {
+		return p.Field
+	}
+	return ""
+}
+
+type payloadNode struct {
+	Payload *payloadExpr `json:"payload"`
+}
+
+// rightValues 解析匹配的右值：单个值或 {"set":[...]}
+func rightValues[T string | uint16](raw json.RawMessage) ([]T, bool) {
+	var one T
+	if json.Unmarshal(raw, &one) == nil {
+		return []T{one}, true
+	}
+	var set struct {
+		Set []T `json:"set"`
+	}
+	if json.Unmarshal(raw, &set) == nil && len(set.Set) > 0 {
+		return set.Set, true
+	}
+	return nil, false
+}
@@ -0,0 +1,56 @@
+package nft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// simulateScript 在命名空间内依次加载现有的表、列出、执行脚本、再次列出。
+// 表不存在时 list 失败，对应的输出文件保持为空
+const simulateScript = `set -e
+nft=$1 family=$2 table=$3 dir=$4
+if [ -s "$dir/current.nft" ]; then "$nft" -f "$dir/current.nft"; fi
+"$nft" -j list table "$family" "$table" >"$dir/before.json" 2>/dev/null || :
+"$nft" -f "$dir/payload.nft"
+"$nft" -j list table "$family" "$table" >"$dir/after.json" 2>/dev/null || :
+`
+
+// Simulate 在一个临时的网络命名空间中重建 current（nft list table 的输出，表不存在时为空），
+// 执行 payload，返回执行前后 nft -j list table 的输出。主机上的规则集不受影响；
+// 非 root 时同时创建用户命名空间。path 为空时使用 PATH 中的 "nft"
+func Simulate(ctx context.Context, path, family, table, current, payload string) (before, after []byte, err error) {
+	if path == "" {
+		path = "nft"
+	}
+	dir, err := os.MkdirTemp("", "github-updater-plan-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "current.nft"), []byte(current), 0o600); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "payload.nft"), []byte(payload), 0o600); err != nil {
+		return nil, nil, err
+	}
+
+	args := []string{"--net"}
+	if os.Geteuid() != 0 {
+		args = []string{"--user", "--map-root-user", "--net"}
+	}
+	args = append(args, "--", "sh", "-c", simulateScript, "sh", path, family, table, dir)
+	if output, err := exec.CommandContext(ctx, "unshare", args...).CombinedOutput(); err != nil {
+		return nil, nil, fmt.Errorf("simulate in a scratch network namespace: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	if before, err = os.ReadFile(filepath.Join(dir, "before.json")); err != nil {
+		return nil, nil, err
+	}
+	if after, err = os.ReadFile(filepath.Join(dir, "after.json")); err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
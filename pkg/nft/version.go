@@ -0,0 +1,64 @@
+package nft
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Version 是 nft 命令行工具的版本
+type Version struct {
+	Major, Minor, Patch int
+}
+
+func (v Version) String() string { return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch) }
+
+// AtLeast 判断版本是否不低于 major.minor.patch
+func (v Version) AtLeast(major, minor, patch int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Patch >= patch
+}
+
+// ConcatIntervals 判断是否支持带区间的拼接集合（如 ipv4_addr . inet_service），需要 nft 0.9.4+
+func (v Version) ConcatIntervals() bool { return v.AtLeast(0, 9, 4) }
+
+// ElementComments 判断是否支持集合元素的 comment，需要 nft 0.9.4+
+func (v Version) ElementComments() bool { return v.AtLeast(0, 9, 4) }
+
+// Comments 判断是否支持表和集合的 comment 属性，需要 nft 0.9.7+
+func (v Version) Comments() bool { return v.AtLeast(0, 9, 7) }
+
+// IntervalTimeouts 判断是否支持带元素超时和 gc-interval 的区间集合，需要 nft 0.9.4+
+func (v Version) IntervalTimeouts() bool { return v.AtLeast(0, 9, 4) }
+
+// ConstantSets 判断是否支持集合的 constant 标志，需要 nft 0.9.0+
+func (v Version) ConstantSets() bool { return v.AtLeast(0, 9, 0) }
+
+var versionRe = regexp.MustCompile(`v(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Version 通过 nft --version 查询版本，输出形如 "nftables v1.0.6 (Lester Gooch #5)"
+func (c *Client) Version(ctx context.Context) (Version, error) {
+	out, err := c.run(ctx, []string{"--version"}, "")
+	if err != nil {
+		return Version{}, fmt.Errorf("nft --version: %v", err)
+	}
+	return parseVersion(string(out))
+}
+
+func parseVersion(s string) (Version, error) {
+	m := versionRe.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, fmt.Errorf("cannot parse nft version from %q", s)
+	}
+	var v Version
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email 通过 SMTP 中继发送纯文本邮件
+type Email struct {
+	Server   string // host:port
+	From     string
+	To       []string
+	Username string // 为空时不认证
+	Password string
+	StartTLS bool // 要求使用 STARTTLS
+
+	// MaxDiffLines 限制正文中差异明细的行数，0 表示不列出明细
+	MaxDiffLines int
+}
+
+// Notify 实现 Notifier
+func (m *Email) Notify(ctx context.Context, e Event) error {
+	host, _, err := net.SplitHostPort(m.Server)
+	if err != nil {
+		return fmt.Errorf("smtp server %q: %v", m.Server, err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Server)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("starttls: %v", err)
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(m.message(e))); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *Email) message(e Event) string {
+	var b strings.Builder
+	subject := fmt.Sprintf("github-updater: %s on %s", e.Kind(), e.Host)
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", m.From, strings.Join(m.To, ", "), subject, time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(e.Text() + "\r\n")
+
+	lines := 0
+	for _, c := range e.Changes {
+		if len(c.Added)+len(c.Removed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\r\n%s: +%d/-%d\r\n", c.Set, len(c.Added), len(c.Removed))
+		for _, group := range []struct {
+			sign  string
+			items []string
+		}{{"+", c.Added}, {"-", c.Removed}} {
+			for i, p := range group.items {
+				if lines >= m.MaxDiffLines {
+					fmt.Fprintf(&b, "  ... %d more\r\n", len(group.items)-i)
+					break
+				}
+				fmt.Fprintf(&b, "  %s %s\r\n", group.sign, p)
+				lines++
+			}
+		}
+	}
+	return b.String()
+}
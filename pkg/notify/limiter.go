@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Limiter 限制同一类事件的发送频率，避免数据源反复变化时刷屏。
+// Path 非空时把发送时间持久化到文件，使 cron 等一次性运行之间也能限流。
+type Limiter struct {
+	Interval time.Duration
+	Path     string
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Allow 判断 kind 类事件当前是否允许发送，允许时记录发送时间
+func (l *Limiter) Allow(kind string, now time.Time) bool {
+	if l.Interval <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+		l.load()
+	}
+	if t, ok := l.last[kind]; ok && now.Sub(t) < l.Interval {
+		return false
+	}
+	l.last[kind] = now
+	l.save()
+	return true
+}
+
+func (l *Limiter) load() {
+	if l.Path == "" {
+		return
+	}
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(data, &l.last)
+}
+
+func (l *Limiter) save() {
+	if l.Path == "" {
+		return
+	}
+	data, err := json.Marshal(l.last)
+	if err != nil {
+		return
+	}
+	os.WriteFile(l.Path, data, 0o640)
+}
@@ -0,0 +1,31 @@
+package notify
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &Limiter{Interval: time.Hour, Path: path}
+	if !l.Allow("change", now) {
+		t.Fatal("first change not allowed")
+	}
+	if l.Allow("change", now.Add(30*time.Minute)) {
+		t.Error("second change within the interval allowed")
+	}
+	if !l.Allow("failure", now.Add(30*time.Minute)) {
+		t.Error("failure limited by an earlier change")
+	}
+
+	// 新的 Limiter 从文件读取上次的发送时间，模拟 cron 的下一次运行
+	next := &Limiter{Interval: time.Hour, Path: path}
+	if next.Allow("change", now.Add(45*time.Minute)) {
+		t.Error("change allowed after reloading the state file")
+	}
+	if !next.Allow("change", now.Add(time.Hour)) {
+		t.Error("change not allowed after the interval")
+	}
+}
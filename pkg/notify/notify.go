@@ -0,0 +1,148 @@
+// Package notify 在集合发生变化或更新失败时发送通知。
+// 所有通知都是尽力而为的，发送失败不应影响防火墙更新本身。
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Event 描述一次需要通知的运行结果
+type Event struct {
+	Host    string   // 执行更新的主机
+	Target  string   // 例如 inet/filter
+	Sets    []string // 涉及的集合
+	Added   int
+	Removed int
+	Err     error // 非 nil 表示更新失败
+	Pending bool  // 只发现了上游变化，尚未应用（-monitor）
+
+	Changes []SetChange // 每个集合的变化明细，可能为空
+}
+
+// Kind 返回事件类型，用于限流分组
+func (e Event) Kind() string {
+	if e.Err != nil {
+		return "failure"
+	}
+	if e.Pending {
+		return "pending"
+	}
+	return "change"
+}
+
+// Text 返回不含链接的纯文本消息
+func (e Event) Text() string {
+	if e.Err != nil {
+		return fmt.Sprintf("github-updater on %s: update of %s (%s) FAILED: %v", e.Host, e.Target, strings.Join(e.Sets, ", "), e.Err)
+	}
+	if e.Pending {
+		return fmt.Sprintf("github-updater on %s: %s (%s) has upstream changes awaiting approval, +%d/−%d prefixes (not applied)", e.Host, e.Target, strings.Join(e.Sets, ", "), e.Added, e.Removed)
+	}
+	return fmt.Sprintf("github-updater on %s: %s (%s) updated, +%d/−%d prefixes", e.Host, e.Target, strings.Join(e.Sets, ", "), e.Added, e.Removed)
+}
+
+// Notifier 发送一条通知
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// Slack 通过 Incoming Webhook 发送消息
+type Slack struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+// Notify 实现 Notifier
+func (s *Slack) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, s.Client, s.WebhookURL, map[string]interface{}{"text": e.Text()})
+}
+
+// DefaultTelegramAPI 是 Telegram Bot API 的地址
+const DefaultTelegramAPI = "https://api.telegram.org"
+
+// Telegram 通过 Bot API 的 sendMessage 发送消息
+type Telegram struct {
+	Token  string
+	ChatID string
+	APIURL string // 为空时使用 DefaultTelegramAPI
+	Client *http.Client
+}
+
+// Notify 实现 Notifier
+func (t *Telegram) Notify(ctx context.Context, e Event) error {
+	api := t.APIURL
+	if api == "" {
+		api = DefaultTelegramAPI
+	}
+	return postJSON(ctx, t.Client, api+"/bot"+t.Token+"/sendMessage", map[string]interface{}{
+		"chat_id":                  t.ChatID,
+		"text":                     e.Text(),
+		"disable_web_page_preview": true,
+	})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// 错误信息里的 URL 可能包含 token，只保留底层原因
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SetChange 是单个集合的变化明细
+type SetChange struct {
+	Set     string
+	Added   []string
+	Removed []string
+}
+
+// kindFilter 只转发指定类型的事件
+type kindFilter struct {
+	Notifier
+	kinds map[string]bool
+}
+
+// OnlyKinds 包装 n，只发送 kinds 中列出的事件类型（"change"、"failure"）
+func OnlyKinds(n Notifier, kinds ...string) Notifier {
+	f := kindFilter{Notifier: n, kinds: make(map[string]bool)}
+	for _, k := range kinds {
+		f.kinds[k] = true
+	}
+	return f
+}
+
+// Notify 实现 Notifier
+func (f kindFilter) Notify(ctx context.Context, e Event) error {
+	if !f.kinds[e.Kind()] {
+		return nil
+	}
+	return f.Notifier.Notify(ctx, e)
+}
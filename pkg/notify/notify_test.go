@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// request 是 httptest 服务器收到的一次请求
+type request struct {
+	Method      string
+	Path        string
+	ContentType string
+	Body        map[string]interface{}
+}
+
+func recordServer(t *testing.T, status int) (*httptest.Server, *[]request) {
+	t.Helper()
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req := request{Method: r.Method, Path: r.URL.Path, ContentType: r.Header.Get("Content-Type")}
+		if err := json.Unmarshal(data, &req.Body); err != nil {
+			t.Errorf("body %q is not a JSON object: %v", data, err)
+		}
+		got = append(got, req)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &got
+}
+
+var changeEvent = Event{Host: "fw1", Target: "inet/filter", Sets: []string{"gh_v4", "gh_v6"}, Added: 3, Removed: 1}
+
+func TestPayloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifier func(url string) Notifier
+		event    Event
+		path     string
+		body     map[string]interface{}
+	}{
+		{
+			name:     "slack change",
+			notifier: func(url string) Notifier { return &Slack{WebhookURL: url + "/services/T000/B000/XXX"} },
+			event:    changeEvent,
+			path:     "/services/T000/B000/XXX",
+			body:     map[string]interface{}{"text": "github-updater on fw1: inet/filter (gh_v4, gh_v6) updated, +3/−1 prefixes"},
+		},
+		{
+			name:     "slack failure",
+			notifier: func(url string) Notifier { return &Slack{WebhookURL: url} },
+			event:    Event{Host: "fw1", Target: "inet/filter", Sets: []string{"gh_v4"}, Err: errors.New("fetch failed")},
+			path:     "/",
+			body:     map[string]interface{}{"text": "github-updater on fw1: update of inet/filter (gh_v4) FAILED: fetch failed"},
+		},
+		{
+			name:     "telegram change",
+			notifier: func(url string) Notifier { return &Telegram{Token: "123:abc", ChatID: "-1001", APIURL: url} },
+			event:    changeEvent,
+			path:     "/bot123:abc/sendMessage",
+			body: map[string]interface{}{
+				"chat_id":                  "-1001",
+				"text":                     "github-updater on fw1: inet/filter (gh_v4, gh_v6) updated, +3/−1 prefixes",
+				"disable_web_page_preview": true,
+			},
+		},
+		{
+			name:     "telegram pending",
+			notifier: func(url string) Notifier { return &Telegram{Token: "t", ChatID: "@ops", APIURL: url} },
+			event:    Event{Host: "fw1", Target: "inet/filter", Sets: []string{"gh_v4"}, Added: 2, Pending: true},
+			path:     "/bott/sendMessage",
+			body: map[string]interface{}{
+				"chat_id":                  "@ops",
+				"text":                     "github-updater on fw1: inet/filter (gh_v4) has upstream changes awaiting approval, +2/−0 prefixes (not applied)",
+				"disable_web_page_preview": true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, got := recordServer(t, http.StatusOK)
+			if err := tt.notifier(srv.URL).Notify(context.Background(), tt.event); err != nil {
+				t.Fatal(err)
+			}
+			if len(*got) != 1 {
+				t.Fatalf("%d requests, want 1", len(*got))
+			}
+			req := (*got)[0]
+			if req.Method != http.MethodPost || req.Path != tt.path || req.ContentType != "application/json" {
+				t.Errorf("request = %s %s (%s), want POST %s (application/json)", req.Method, req.Path, req.ContentType, tt.path)
+			}
+			if !reflect.DeepEqual(req.Body, tt.body) {
+				t.Errorf("body = %v, want %v", req.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestErrorHidesToken(t *testing.T) {
+	srv, _ := recordServer(t, http.StatusForbidden)
+	tg := &Telegram{Token: "secret-token", ChatID: "1", APIURL: srv.URL}
+	err := tg.Notify(context.Background(), changeEvent)
+	if err == nil || err.Error() != "status 403" {
+		t.Errorf("error = %v, want status 403", err)
+	}
+
+	// 连接失败时错误信息不能包含 URL 中的 token
+	srv.Close()
+	err = tg.Notify(context.Background(), changeEvent)
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error = %v, want a connection error without the token", err)
+	}
+}
+
+func TestOnlyKinds(t *testing.T) {
+	srv, got := recordServer(t, http.StatusOK)
+	n := OnlyKinds(&Slack{WebhookURL: srv.URL}, "failure")
+	if err := n.Notify(context.Background(), changeEvent); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Event{Host: "fw1", Err: errors.New("boom")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*got) != 1 || !strings.Contains((*got)[0].Body["text"].(string), "FAILED: boom") {
+		t.Errorf("requests = %v, want only the failure", *got)
+	}
+}
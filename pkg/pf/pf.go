@@ -0,0 +1,139 @@
+// Package pf 通过 pfctl 维护 OpenBSD/FreeBSD pf 的地址表（table）。
+package pf
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+
+	"github-updater/pkg/state"
+)
+
+// MaxTableLen 是 pf 表名的最大长度（PF_TABLE_NAME_SIZE 减去结尾的 0）
+const MaxTableLen = 31
+
+// ErrNotFound 表示表不存在
+var ErrNotFound = errors.New("no such pf table")
+
+// Backend 把期望网段写入 File，再用 pfctl -T replace 原子地替换表的内容，实现 pipeline.Backend。
+// pf 的表同时容纳 IPv4 和 IPv6 地址，两个地址族写入同一张表
+type Backend struct {
+	Table  string
+	Anchor string // 为空时使用主规则集
+	// File 是交给 pfctl -f 的文件，每行一个网段，原子地替换。pf.conf 可以用
+	// table <name> persist file "..." 引用它，开机时不必等本工具运行就能加载上次的内容
+	File string
+	Path string // 为空时使用 PATH 中的 "pfctl"
+}
+
+// Name 实现 pipeline.Backend
+func (b *Backend) Name() string { return "pf" }
+
+// Contents 返回写入 File 的内容
+func Contents(v4, v6 []netip.Prefix) string {
+	var w strings.Builder
+	for _, ps := range [][]netip.Prefix{v4, v6} {
+		for _, p := range ps {
+			fmt.Fprintf(&w, "%s\n", p)
+		}
+	}
+	return w.String()
+}
+
+// Command 返回对表执行 op 的 pfctl 参数，例如 "replace", "-f", file
+func (b *Backend) Command(op string, extra ...string) []string {
+	var args []string
+	if b.Anchor != "" {
+		args = append(args, "-a", b.Anchor)
+	}
+	return append(append(args, "-t", b.Table, "-T", op), extra...)
+}
+
+// Apply 实现 pipeline.Backend：写入 File 后用 pfctl -T replace 替换表的内容，表不存在时由 pfctl 创建
+func (b *Backend) Apply(ctx context.Context, v4, v6 []netip.Prefix) ([]netip.Prefix, error) {
+	previous, err := b.List(ctx)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := state.WriteFile(b.File, []byte(Contents(v4, v6)), 0o644); err != nil {
+		return previous, fmt.Errorf("write pf table file: %w", err)
+	}
+	if _, err := b.run(ctx, b.Command("replace", "-f", b.File)...); err != nil {
+		return previous, err
+	}
+	return previous, nil
+}
+
+// Flush 实现 pipeline.Backend：清空表和 File，表不存在时跳过
+func (b *Backend) Flush(ctx context.Context) ([]netip.Prefix, error) {
+	previous, err := b.List(ctx)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 同时清空文件，否则重新加载 pf.conf 时又会装回旧的内容
+	if err := state.WriteFile(b.File, nil, 0o644); err != nil {
+		return previous, fmt.Errorf("write pf table file: %w", err)
+	}
+	if _, err := b.run(ctx, b.Command("flush")...); err != nil {
+		return previous, err
+	}
+	return previous, nil
+}
+
+// List 通过 pfctl -T show 读取表中的地址，单个地址视为 /32 或 /128。表不存在时返回 ErrNotFound
+func (b *Backend) List(ctx context.Context) ([]netip.Prefix, error) {
+	out, err := b.run(ctx, b.Command("show")...)
+	if err != nil {
+		if strings.Contains(err.Error(), "Table does not exist") {
+			return nil, fmt.Errorf("pf table %s: %w", b.Table, ErrNotFound)
+		}
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		entry := strings.TrimSpace(sc.Text())
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("pf table %s: unsupported entry %q", b.Table, entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("pf table %s: unsupported entry %q", b.Table, entry)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, sc.Err()
+}
+
+func (b *Backend) run(ctx context.Context, args ...string) ([]byte, error) {
+	path := b.Path
+	if path == "" {
+		path = "pfctl"
+	}
+	// pfctl 会在标准错误输出与表无关的提示（例如内核不支持 ALTQ），只解析标准输出
+	out, err := exec.CommandContext(ctx, path, args...).Output()
+	if err != nil {
+		var stderr []byte
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr = exitErr.Stderr
+		}
+		return out, fmt.Errorf("pfctl %s: %v - %s", strings.Join(args, " "), err, strings.TrimSpace(string(stderr)))
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package pf
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		anchor string
+		want   []string
+	}{
+		{"main ruleset", "", []string{"-t", "github", "-T", "replace", "-f", "/var/lib/github-updater/pf-table.txt"}},
+		{"anchor", "github/actions", []string{"-a", "github/actions", "-t", "github", "-T", "replace", "-f", "/var/lib/github-updater/pf-table.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Backend{Table: "github", Anchor: tt.anchor}
+			if got := b.Command("replace", "-f", "/var/lib/github-updater/pf-table.txt"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Command = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContents(t *testing.T) {
+	v4 := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.7/32")}
+	v6 := []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}
+	if got, want := Contents(v4, v6), "192.0.2.0/24\n198.51.100.7/32\n2001:db8::/32\n"; got != want {
+		t.Errorf("Contents = %q, want %q", got, want)
+	}
+	if got := Contents(nil, nil); got != "" {
+		t.Errorf("Contents of no prefixes = %q, want empty", got)
+	}
+}
+
+// pfctlStub 写入模拟 pfctl 的 shell 脚本：-T show 时在标准输出输出 show，在标准错误输出 stderr 并以 code 退出
+func pfctlStub(t *testing.T, show, stderr string, code int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pfctl")
+	script := "#!/bin/sh\nprintf '%s' '" + show + "'\nprintf '%s' '" + stderr + "' >&2\nexit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestList(t *testing.T) {
+	show := "   192.0.2.0/24\n   198.51.100.7\n\n   2001:db8::/32\n   2001:db8:1::1\n"
+	// 与表无关的提示不影响解析
+	b := &Backend{Table: "github", Path: pfctlStub(t, show, "No ALTQ support in kernel\nALTQ related functions disabled\n", 0)}
+	got, err := b.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.7/32"),
+		netip.MustParsePrefix("2001:db8::/32"), netip.MustParsePrefix("2001:db8:1::1/128"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+
+	b.Path = pfctlStub(t, "   example.com\n", "", 0)
+	if _, err := b.List(context.Background()); err == nil || !strings.Contains(err.Error(), `unsupported entry "example.com"`) {
+		t.Errorf("List error = %v, want an unsupported entry error", err)
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	b := &Backend{Table: "github", Anchor: "gh", Path: pfctlStub(t, "", "pfctl: Table does not exist.\n", 1)}
+	_, err := b.List(context.Background())
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("List error = %v, want %v", err, ErrNotFound)
+	}
+	// 表不存在时 Flush 跳过，不调用 pfctl -T flush
+	if previous, err := b.Flush(context.Background()); err != nil || previous != nil {
+		t.Errorf("Flush = %v, %v, want nothing", previous, err)
+	}
+
+	b.Path = pfctlStub(t, "", "pfctl: /dev/pf: Permission denied\n", 1)
+	_, err = b.List(context.Background())
+	if err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "pfctl -a gh -t github -T show: exit status 1 - pfctl: /dev/pf: Permission denied") {
+		t.Errorf("List error = %v, want the pfctl error", err)
+	}
+}
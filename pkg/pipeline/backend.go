@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// Backend 代替 nftables 保存期望网段，例如 ipset。设置 Options.Backend 后 Run 不再使用 Nft，
+// 获取、跳过、导出、摘要等流程不变，与 nft 表、集合属性和链相关的选项不起作用
+type Backend interface {
+	// Name 是摘要和日志中显示的执行方式
+	Name() string
+	// Apply 用给定的网段替换目标中的内容，返回替换前的内容（目标不存在时为空）
+	Apply(ctx context.Context, v4, v6 []netip.Prefix) (previous []netip.Prefix, err error)
+	// Flush 清空目标，返回清空前的内容，用于 FlushOnFetchFailure
+	Flush(ctx context.Context) (previous []netip.Prefix, err error)
+}
+
+// applyBackend 确认后把网段交给 Options.Backend 应用
+func (r *runner) applyBackend(ctx context.Context, classified *Classified) error {
+	b := r.opts.Backend
+	v4, v6 := Prefixes(classified.IPv4), Prefixes(classified.IPv6)
+	ok, err := r.confirm(fmt.Sprintf("Apply %d IPv4 and %d IPv6 prefixes with %s?", len(v4), len(v6), b.Name()), "")
+	if err != nil || !ok {
+		return err
+	}
+	var previous []netip.Prefix
+	err = r.res.Phases.Run("apply", func() error {
+		r.log.Verbosef("Applying with %s...", b.Name())
+		var err error
+		if previous, err = b.Apply(ctx, v4, v6); err != nil {
+			return &ApplyError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.res.Applied = true
+	if r.opts.TrackChanges {
+		if len(previous) == 0 {
+			previous = r.opts.AssumeLive
+		}
+		d := DiffPrefixes(previous, slices.Concat(v4, v6))
+		r.res.Added, r.res.Removed = d.Added, d.Removed
+	}
+	return nil
+}
+
+// flushBackend 是 flushOnFailure 在设置了 Options.Backend 时的实现
+func (r *runner) flushBackend(ctx context.Context, err error) error {
+	var previous []netip.Prefix
+	ferr := r.res.Phases.Run("flush", func() error {
+		var err error
+		previous, err = r.opts.Backend.Flush(ctx)
+		return err
+	})
+	if ferr != nil {
+		return fmt.Errorf("%w; flushing the sets also failed: %v", err, ferr)
+	}
+	r.res.Removed, r.res.Flushed = previous, true
+	r.log.Printf("Fetch failed, flushed the %s sets (%d ranges removed) because of the fail-closed policy.", r.opts.Backend.Name(), len(previous))
+	return err
+}
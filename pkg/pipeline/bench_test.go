@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/nft"
+)
+
+// benchmarkCategories 生成与 meta 文档规模相近的分类：actions 有 n 个网段（其中一部分相邻或重叠，
+// 四分之一是 IPv6），hooks、web、api 共享一小组网段
+func benchmarkCategories(n int) map[string][]netip.Prefix {
+	actions := make([]netip.Prefix, 0, n)
+	for i := range n {
+		switch {
+		case i%4 == 3:
+			actions = append(actions, netip.MustParsePrefix(fmt.Sprintf("2603:1030:%x::/48", i)))
+		case i%8 == 5:
+			// 与前一个 /24 重叠
+			actions = append(actions, netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(4 + i>>16), byte(i >> 8), byte(i - 1), 128}), 25))
+		default:
+			actions = append(actions, netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(4 + i>>16), byte(i >> 8), byte(i), 0}), 24))
+		}
+	}
+	shared := prefixes("192.30.252.0/22", "185.199.108.0/22", "140.82.112.0/20", "143.55.64.0/20", "2a0a:a440::/29", "2606:50c0::/32")
+	return map[string][]netip.Prefix{"actions": actions, "hooks": shared, "web": shared, "api": shared}
+}
+
+func BenchmarkClassify(b *testing.B) {
+	categories := benchmarkCategories(5000)
+	b.ReportAllocs()
+	for b.Loop() {
+		Classify(categories)
+	}
+}
+
+func BenchmarkMerge(b *testing.B) {
+	c := Classify(benchmarkCategories(5000))
+	b.ReportAllocs()
+	for b.Loop() {
+		Merge(c.IPv4)
+	}
+}
+
+func BenchmarkCoalesce(b *testing.B) {
+	c := Classify(benchmarkCategories(5000))
+	for _, bc := range []struct {
+		name    string
+		comment func(Entry) string
+	}{{"plain", nil}, {"comments", CategoryComment}} {
+		b.Run(bc.name, func(b *testing.B) {
+			elems := Elements(c.IPv4, bc.comment)
+			b.ReportAllocs()
+			for b.Loop() {
+				nft.Coalesce(elems)
+			}
+		})
+	}
+}
+
+// BenchmarkGenerate 测量 -dry-run 生成脚本的完整过程：读取来源文件、分类、合并与渲染
+func BenchmarkGenerate(b *testing.B) {
+	var lines []string
+	for _, ps := range benchmarkCategories(5000) {
+		for _, p := range ps {
+			lines = append(lines, p.String())
+		}
+	}
+	path := filepath.Join(b.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	opts := Options{
+		Sources: []Source{{Name: "actions", File: path}},
+		Nft:     &nft.Client{Executor: nft.OfflineExecutor{}},
+		Target:  testTarget(),
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := Render(context.Background(), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+)
+
+// Entry 是一个网段及其来源信息，最终渲染时只使用 Prefix
+type Entry struct {
+	Prefix     netip.Prefix
+	Categories []string // 来源分类（已排序）
+	Extra      bool     // 是否来自 -extra-file
+}
+
+// Family 返回网段的地址族，"ipv4" 或 "ipv6"
+func (e Entry) Family() string {
+	if e.Prefix.Addr().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// withCategories 合并另一条目的来源信息，分类保持有序且不重复
+func (e *Entry) withCategories(o Entry) {
+	for _, name := range o.Categories {
+		i := sort.SearchStrings(e.Categories, name)
+		if i < len(e.Categories) && e.Categories[i] == name {
+			continue
+		}
+		e.Categories = append(e.Categories[:i:i], append([]string{name}, e.Categories[i:]...)...)
+	}
+	e.Extra = e.Extra || o.Extra
+}
+
+// Prefixes 返回条目中的网段
+func Prefixes(entries []Entry) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(entries))
+	for i, e := range entries {
+		prefixes[i] = e.Prefix
+	}
+	return prefixes
+}
+
+// Classified 是按地址族分类并去重后的网段
+type Classified struct {
+	IPv4 []Entry
+	IPv6 []Entry
+	// Verdicts 是来源为分类指定的 verdict 映射动作，未列出的分类使用 Options.VerdictMap
+	Verdicts map[string]string
+}
+
+// Classify 按地址族分类，同一网段出现在多个分类中时只保留一份并合并来源
+func Classify(categories map[string][]netip.Prefix) *Classified {
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c := &Classified{}
+	index := make(map[netip.Prefix]*Entry)
+	var order []netip.Prefix
+	for _, name := range names {
+		for _, p := range categories[name] {
+			e := index[p]
+			if e == nil {
+				e = &Entry{Prefix: p}
+				index[p] = e
+				order = append(order, p)
+			}
+			e.withCategories(Entry{Categories: []string{name}, Extra: name == ExtraCategory})
+		}
+	}
+	for _, p := range order {
+		if p.Addr().Is4() {
+			c.IPv4 = append(c.IPv4, *index[p])
+		} else {
+			c.IPv6 = append(c.IPv6, *index[p])
+		}
+	}
+	return c
+}
+
+// Unmap 把 IPv4 映射的 IPv6 网段（::ffff:a.b.c.d/n）转换为对应的 IPv4 网段，其他网段原样返回。
+// 前缀短于 /96 的映射网段超出了映射地址的范围，无法转换，返回 false
+func Unmap(p netip.Prefix) (netip.Prefix, bool) {
+	if !p.Addr().Is4In6() {
+		return p, true
+	}
+	if p.Bits() < 96 {
+		return p, false
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96), true
+}
+
+// HashPrefixes 返回一组网段的哈希，与 Classified.Hash 的算法相同
+func HashPrefixes(prefixes []netip.Prefix) string {
+	return Classify(map[string][]netip.Prefix{"imported": prefixes}).Hash(true)
+}
+
+// Elements 把条目转换为集合元素，comment 非 nil 时为每个元素生成注释
+func Elements(entries []Entry, comment func(Entry) string) []nft.Element {
+	elems := make([]nft.Element, len(entries))
+	for i, e := range entries {
+		elems[i] = nft.Element{Prefix: e.Prefix}
+		if comment != nil {
+			elems[i].Comment = comment(e)
+		}
+	}
+	return elems
+}
+
+// CategoryComment 以来源分类作为元素注释，例如 "actions,hooks"
+func CategoryComment(e Entry) string { return strings.Join(e.Categories, ",") }
+
+// MarkerPrefix 是 MarkerComment 生成的注释的开头，用于识别本工具管理的元素
+const MarkerPrefix = "gh-"
+
+// maxMarkerCategories 限制标记中分类部分的长度，避免元素较多时脚本过大
+const maxMarkerCategories = 24
+
+// MarkerComment 返回形如 "gh-actions 2024-05-01" 的元素标记，日期为数据获取日期
+func MarkerComment(fetchedAt time.Time) func(Entry) string {
+	date := fetchedAt.UTC().Format("2006-01-02")
+	return func(e Entry) string {
+		cats := strings.Join(e.Categories, "+")
+		if len(cats) > maxMarkerCategories {
+			cats = cats[:maxMarkerCategories]
+		}
+		return MarkerPrefix + cats + " " + date
+	}
+}
+
+// MarkerDate 解析 MarkerComment 标记中的日期，不是本工具的标记时返回 false
+func MarkerDate(comment string) (time.Time, bool) {
+	if !strings.HasPrefix(comment, MarkerPrefix) {
+		return time.Time{}, false
+	}
+	i := strings.LastIndexByte(comment, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02", comment[i+1:])
+	return t, err == nil
+}
+
+// Merge 合并重叠和相邻的网段，合并后的网段带有全部被合并条目的来源
+func Merge(entries []Entry) []Entry {
+	var out []Entry
+	for _, p := range iprange.ToPrefixes(iprange.Merge(iprange.FromPrefixes(Prefixes(entries)))) {
+		merged := Entry{Prefix: p}
+		for _, e := range entries {
+			if p.Overlaps(e.Prefix) {
+				merged.withCategories(e)
+			}
+		}
+		out = append(out, merged)
+	}
+	return out
+}
+
+// Hash 返回期望网段的稳定哈希（排序后的规范 CIDR 的 SHA-256），与获取顺序无关。
+// includeExtra 为 false 时不包含只来自 -extra-file 的网段
+func (c *Classified) Hash(includeExtra bool) string {
+	var prefixes []netip.Prefix
+	for _, entries := range [][]Entry{c.IPv4, c.IPv6} {
+		for _, e := range entries {
+			if !includeExtra && e.Extra && len(e.Categories) == 1 {
+				continue
+			}
+			prefixes = append(prefixes, e.Prefix.Masked())
+		}
+	}
+	SortPrefixes(prefixes)
+	h := sha256.New()
+	for i, p := range prefixes {
+		if i > 0 && p == prefixes[i-1] {
+			continue
+		}
+		h.Write([]byte(p.String() + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ExtraCategory 是 -extra-file 中网段所属的分类
+const ExtraCategory = "extra"
+
+// Exclude 从分类结果中去掉与 exclude 重叠的部分，部分重叠的网段被拆分为覆盖剩余地址的最少网段。
+// 返回受影响的网段数和拆分产生的网段数
+func (c *Classified) Exclude(exclude []netip.Prefix) (affected, produced int) {
+	if len(exclude) == 0 {
+		return 0, 0
+	}
+	ex := iprange.FromPrefixes(exclude)
+	c.IPv4 = excludeEntries(c.IPv4, ex, &affected, &produced)
+	c.IPv6 = excludeEntries(c.IPv6, ex, &affected, &produced)
+	return affected, produced
+}
+
+func excludeEntries(entries []Entry, ex []iprange.Range, affected, produced *int) []Entry {
+	var out []Entry
+	for _, e := range entries {
+		rest := iprange.ToPrefixes(iprange.Subtract([]iprange.Range{iprange.FromPrefix(e.Prefix)}, ex))
+		if len(rest) == 1 && rest[0] == e.Prefix {
+			out = append(out, e)
+			continue
+		}
+		*affected++
+		*produced += len(rest)
+		for _, q := range rest {
+			split := e // 拆分后的网段沿用原来的来源
+			split.Prefix = q
+			out = append(out, split)
+		}
+	}
+	return out
+}
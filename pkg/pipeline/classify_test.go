@@ -0,0 +1,165 @@
+package pipeline
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	ps := make([]netip.Prefix, len(ss))
+	for i, s := range ss {
+		ps[i] = netip.MustParsePrefix(s)
+	}
+	return ps
+}
+
+func TestClassifyKeepsSources(t *testing.T) {
+	c := Classify(map[string][]netip.Prefix{
+		"web":         prefixes("192.30.252.0/22", "2606:50c0::/32"),
+		"hooks":       prefixes("192.30.252.0/22", "140.82.112.0/20"),
+		"api":         prefixes("140.82.112.0/20", "192.30.252.0/22"),
+		ExtraCategory: prefixes("10.0.0.0/8", "140.82.112.0/20"),
+	})
+	want4 := []Entry{
+		// 按分类名排序后第一次出现的顺序
+		{Prefix: netip.MustParsePrefix("140.82.112.0/20"), Categories: []string{"api", "extra", "hooks"}, Extra: true},
+		{Prefix: netip.MustParsePrefix("192.30.252.0/22"), Categories: []string{"api", "hooks", "web"}},
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Categories: []string{"extra"}, Extra: true},
+	}
+	want6 := []Entry{{Prefix: netip.MustParsePrefix("2606:50c0::/32"), Categories: []string{"web"}}}
+	if !reflect.DeepEqual(c.IPv4, want4) {
+		t.Errorf("IPv4 = %+v, want %+v", c.IPv4, want4)
+	}
+	if !reflect.DeepEqual(c.IPv6, want6) {
+		t.Errorf("IPv6 = %+v, want %+v", c.IPv6, want6)
+	}
+}
+
+func TestMergeKeepsSources(t *testing.T) {
+	entries := []Entry{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/25"), Categories: []string{"hooks"}},
+		{Prefix: netip.MustParsePrefix("192.0.2.128/25"), Categories: []string{"web"}},
+		{Prefix: netip.MustParsePrefix("192.0.2.64/26"), Categories: []string{"api", "hooks"}},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Categories: []string{"extra"}, Extra: true},
+		{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Categories: []string{"git"}},
+	}
+	want := []Entry{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Categories: []string{"api", "hooks", "web"}},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Categories: []string{"extra"}, Extra: true},
+		{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Categories: []string{"git"}},
+	}
+	if got := Merge(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge = %+v, want %+v", got, want)
+	}
+}
+
+func TestExcludeKeepsSources(t *testing.T) {
+	c := Classify(map[string][]netip.Prefix{"hooks": prefixes("192.0.2.0/24"), "web": prefixes("192.0.2.0/24")})
+	affected, produced := c.Exclude(prefixes("192.0.2.0/26"))
+	if affected != 1 || produced != 2 {
+		t.Errorf("Exclude = %d, %d, want 1, 2", affected, produced)
+	}
+	want := []Entry{
+		{Prefix: netip.MustParsePrefix("192.0.2.64/26"), Categories: []string{"hooks", "web"}},
+		{Prefix: netip.MustParsePrefix("192.0.2.128/25"), Categories: []string{"hooks", "web"}},
+	}
+	if !reflect.DeepEqual(c.IPv4, want) {
+		t.Errorf("IPv4 = %+v, want %+v", c.IPv4, want)
+	}
+}
+
+func TestHash(t *testing.T) {
+	a := Classify(map[string][]netip.Prefix{"hooks": prefixes("192.0.2.0/24", "2001:db8::/32"), "web": prefixes("192.0.2.0/24")})
+	b := Classify(map[string][]netip.Prefix{"git": prefixes("2001:db8::/32", "192.0.2.0/24")})
+	if a.Hash(true) != b.Hash(true) {
+		t.Error("hash depends on categories or order")
+	}
+	withExtra := Classify(map[string][]netip.Prefix{
+		"hooks":       prefixes("192.0.2.0/24", "2001:db8::/32"),
+		ExtraCategory: prefixes("10.0.0.0/8", "192.0.2.0/24"),
+	})
+	if withExtra.Hash(true) == a.Hash(true) {
+		t.Error("extra prefixes not included in the hash")
+	}
+	// 同时来自 GitHub 的网段仍然计入，只来自 -extra-file 的网段被忽略
+	if withExtra.Hash(false) != a.Hash(true) {
+		t.Error("extra-only prefixes included in the hash with includeExtra=false")
+	}
+}
+
+func TestElementComments(t *testing.T) {
+	e := Entry{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Categories: []string{"actions", "hooks"}}
+	if got := CategoryComment(e); got != "actions,hooks" {
+		t.Errorf("CategoryComment = %q", got)
+	}
+	fetched := time.Date(2024, 5, 1, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))
+	marker := MarkerComment(fetched)(e)
+	if marker != "gh-actions+hooks 2024-05-02" {
+		t.Errorf("MarkerComment = %q", marker)
+	}
+	if date, ok := MarkerDate(marker); !ok || !date.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("MarkerDate = %v, %v", date, ok)
+	}
+	if _, ok := MarkerDate("added by hand"); ok {
+		t.Error("MarkerDate accepted a foreign comment")
+	}
+	elems := Elements([]Entry{e}, CategoryComment)
+	if len(elems) != 1 || elems[0].Prefix != e.Prefix || elems[0].Comment != "actions,hooks" {
+		t.Errorf("Elements = %+v", elems)
+	}
+}
+
+func TestUnmap(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"::ffff:192.0.2.1/128", "192.0.2.1/32", true},            // 映射的单个主机
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24", true},            // 映射的子网
+		{"::ffff:0.0.0.0/96", "0.0.0.0/0", true},                  // 整个映射地址空间
+		{"::ffff:0.0.0.0/95", "::ffff:0.0.0.0/95", false},         // 短于 /96，超出映射范围
+		{"::ffff:10.0.0.0/80", "::ffff:10.0.0.0/80", false},       // 同上
+		{"2001:db8::/32", "2001:db8::/32", true},                  // 普通 IPv6 原样返回
+		{"192.0.2.0/24", "192.0.2.0/24", true},                    // IPv4 原样返回
+		{"::192.0.2.1/128", "::192.0.2.1/128", true},              // IPv4 兼容地址不是映射地址
+		{"64:ff9b::192.0.2.1/128", "64:ff9b::c000:201/128", true}, // NAT64 前缀也不转换
+	}
+	for _, tt := range tests {
+		got, ok := Unmap(netip.MustParsePrefix(tt.in))
+		if got != netip.MustParsePrefix(tt.want) || ok != tt.ok {
+			t.Errorf("Unmap(%s) = %s, %v, want %s, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestClassifyMovesMappedRanges(t *testing.T) {
+	categories := map[string][]netip.Prefix{
+		"hooks": prefixes("::ffff:192.0.2.1/128", "::ffff:198.51.100.0/120", "::ffff:0.0.0.0/90", "2001:db8::/32"),
+		"web":   prefixes("192.0.2.1/32"),
+	}
+	r := newRunner(Options{})
+	c, err := r.classify(categories, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Prefixes(c.IPv4), prefixes("192.0.2.1/32", "198.51.100.0/24"); !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv4 = %v, want %v", got, want)
+	}
+	if got, want := Prefixes(c.IPv6), prefixes("2001:db8::/32"); !reflect.DeepEqual(got, want) {
+		t.Errorf("IPv6 = %v, want %v", got, want)
+	}
+	// 转换后与 web 中的同一主机合并为一个条目
+	if !reflect.DeepEqual(c.IPv4[0].Categories, []string{"hooks", "web"}) {
+		t.Errorf("categories of %s = %v", c.IPv4[0].Prefix, c.IPv4[0].Categories)
+	}
+	if len(r.res.Warnings) != 1 || !strings.Contains(r.res.Warnings[0], "skipped 1 IPv4-mapped ranges shorter than /96") {
+		t.Errorf("warnings = %q", r.res.Warnings)
+	}
+	// 调用方的映射不被修改
+	if len(categories["hooks"]) != 4 || categories["hooks"][0] != netip.MustParsePrefix("::ffff:192.0.2.1/128") {
+		t.Errorf("input categories modified: %v", categories["hooks"])
+	}
+}
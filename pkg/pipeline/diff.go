@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Diff 是两组网段之间的差异，均已排序（IPv4 在前，按地址和前缀长度）
+type Diff struct {
+	Added   []netip.Prefix // 新出现的网段
+	Removed []netip.Prefix // 不再存在的网段
+}
+
+// Empty 表示两组网段完全一致
+func (d Diff) Empty() bool { return len(d.Added) == 0 && len(d.Removed) == 0 }
+
+// DiffPrefixes 按规范化（去除主机位）后的网段精确比较 old 和 new
+func DiffPrefixes(old, new []netip.Prefix) Diff {
+	oldSet := prefixSet(old)
+	newSet := prefixSet(new)
+	var d Diff
+	for p := range newSet {
+		if !oldSet[p] {
+			d.Added = append(d.Added, p)
+		}
+	}
+	for p := range oldSet {
+		if !newSet[p] {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	SortPrefixes(d.Added)
+	SortPrefixes(d.Removed)
+	return d
+}
+
+// WriteTo 以稳定的格式输出差异：先 "+ " 新增，后 "- " 移除，每行一个网段
+func (d Diff) WriteTo(w io.Writer) (int64, error) {
+	return d.WriteAnnotated(w, nil)
+}
+
+// WriteAnnotated 与 WriteTo 相同，有说明的网段在行尾附加 "  # 说明"
+func (d Diff) WriteAnnotated(w io.Writer, notes Notes) (int64, error) {
+	var n int64
+	for _, group := range []struct {
+		sign     string
+		prefixes []netip.Prefix
+	}{{"+", d.Added}, {"-", d.Removed}} {
+		for _, p := range group.prefixes {
+			line := group.sign + " " + p.String()
+			if note := notes.Lookup(p); note != "" {
+				line += "  # " + note
+			}
+			m, err := fmt.Fprintln(w, line)
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Notes 是差异中网段的说明（所属分类、元素注释等），尽力而为，没有说明的网段只输出 CIDR
+type Notes map[netip.Prefix]string
+
+// AddEntries 以所属分类作为期望网段的说明
+func (n Notes) AddEntries(entries []Entry) {
+	for _, e := range entries {
+		for _, c := range e.Categories {
+			n.add(e.Prefix, c)
+		}
+	}
+}
+
+// AddCategories 以分类作为网段的说明，例如上次应用的快照中的网段
+func (n Notes) AddCategories(categories map[string][]netip.Prefix) {
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, p := range categories[name] {
+			n.add(p, name)
+		}
+	}
+}
+
+// Fill 为还没有说明的网段加上 other 中的说明
+func (n Notes) Fill(other Notes) {
+	for p, note := range other {
+		if _, ok := n[p]; !ok {
+			n[p] = note
+		}
+	}
+}
+
+// add 追加一条说明，已有的说明不重复
+func (n Notes) add(p netip.Prefix, note string) {
+	p = p.Masked()
+	old, ok := n[p]
+	switch {
+	case !ok || old == "":
+		n[p] = note
+	case !slices.Contains(strings.Split(old, ","), note):
+		n[p] = old + "," + note
+	}
+}
+
+// Lookup 返回网段的说明：优先精确匹配，否则取包含它的最长网段的说明
+// （差异中的网段可能是原网段被部分覆盖后剩下的一段）
+func (n Notes) Lookup(p netip.Prefix) string {
+	p = p.Masked()
+	if note, ok := n[p]; ok {
+		return note
+	}
+	best, note := -1, ""
+	for q, s := range n {
+		if q.Bits() > best && q.Bits() <= p.Bits() && q.Contains(p.Addr()) {
+			best, note = q.Bits(), s
+		}
+	}
+	return note
+}
+
+// All 返回分类后的全部网段
+func (c *Classified) All() []netip.Prefix {
+	return append(Prefixes(c.IPv4), Prefixes(c.IPv6)...)
+}
+
+// SortPrefixes 按地址（IPv4 在前）和前缀长度排序
+func SortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
+
+func prefixSet(prefixes []netip.Prefix) map[netip.Prefix]bool {
+	set := make(map[netip.Prefix]bool, len(prefixes))
+	for _, p := range prefixes {
+		set[p.Masked()] = true
+	}
+	return set
+}
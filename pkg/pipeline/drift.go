@@ -0,0 +1,85 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+)
+
+// SetDrift 是内核中一个集合相对期望内容的偏差
+type SetDrift struct {
+	Set        string
+	Exists     bool
+	Comment    string         // 集合的 comment，可用 nft.CommentManager 判断管理者
+	Missing    []netip.Prefix // 期望存在但集合中没有的网段
+	Unexpected []netip.Prefix // 集合中有但不在期望内容中的网段
+	Notes      Notes          // 集合中带注释的元素的注释，映射中还包括元素的动作
+}
+
+// Drifted 判断集合是否偏离期望内容
+func (d SetDrift) Drifted() bool {
+	return !d.Exists || len(d.Missing) > 0 || len(d.Unexpected) > 0
+}
+
+// CheckDrift 只读地比较 opts.Target 中的集合和期望网段
+func CheckDrift(ctx context.Context, opts Options, classified *Classified) ([]SetDrift, error) {
+	nftc := opts.Nft
+	if nftc == nil {
+		nftc = &nft.Client{}
+	}
+	t := opts.Target
+	var drifts []SetDrift
+	for _, s := range []struct {
+		name    string
+		entries []Entry
+	}{{t.IPv4SetName, classified.IPv4}, {t.IPv6SetName, classified.IPv6}} {
+		if s.name == "" {
+			continue // 不管理该地址族
+		}
+		d := SetDrift{Set: s.name, Exists: true}
+		set, err := nftc.ListSet(ctx, t.Family, t.TableName, s.name)
+		var live []iprange.Range
+		switch {
+		case errors.Is(err, nft.ErrNotFound):
+			d.Exists = false
+		case err != nil:
+			return nil, err
+		default:
+			live = set.Ranges()
+			d.Comment = set.Comment
+			d.Notes = make(Notes)
+			for _, e := range set.Elements {
+				note := e.Comment
+				if e.Verdict != "" {
+					note = strings.TrimSpace(e.Verdict + " " + e.Comment)
+				}
+				if ps := e.Range.Prefixes(); note != "" && len(ps) == 1 {
+					d.Notes[ps[0]] = note
+				}
+			}
+		}
+		if opts.VerdictMap != "" {
+			// 映射按动作分别比较，动作改变的网段同时算作缺少和多余
+			desired, err := MapElements(s.entries, classified.Verdicts, opts.VerdictMap, nil)
+			if err != nil {
+				return nil, err
+			}
+			listed := make(map[string][]iprange.Range)
+			if set != nil {
+				listed = listedVerdictRanges(set)
+			}
+			d.Missing, d.Unexpected = diffVerdicts(verdictRanges(desired), listed)
+			drifts = append(drifts, d)
+			continue
+		}
+		desired := iprange.FromPrefixes(Prefixes(s.entries))
+		d.Missing = iprange.ToPrefixes(iprange.Subtract(desired, live))
+		d.Unexpected = iprange.ToPrefixes(iprange.Subtract(live, desired))
+		drifts = append(drifts, d)
+	}
+	return drifts, nil
+}
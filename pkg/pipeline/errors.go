@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 各类错误都可以用 errors.As 识别，调用方据此区分“GitHub 不可用”和“nft 拒绝脚本”等情况。
+
+// FetchError 表示请求 meta API 失败（网络错误、非 200 状态码等）
+type FetchError struct{ Err error }
+
+func (e *FetchError) Error() string { return "fetch failed: " + e.Err.Error() }
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// DecodeError 表示响应已收到但无法解码
+type DecodeError struct{ Err error }
+
+func (e *DecodeError) Error() string { return "decode failed: " + e.Err.Error() }
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// ErrEmpty 表示获取结果中没有任何有效网段，包装在 *GuardError 中返回
+var ErrEmpty = errors.New("no valid IPs parsed")
+
+// GuardError 表示数据未通过安全检查（例如没有任何有效网段）
+type GuardError struct{ Err error }
+
+func (e *GuardError) Error() string { return "guard rejected update: " + e.Err.Error() }
+func (e *GuardError) Unwrap() error { return e.Err }
+
+// RenderError 表示生成 nft 脚本失败
+type RenderError struct{ Err error }
+
+func (e *RenderError) Error() string { return "render failed: " + e.Err.Error() }
+func (e *RenderError) Unwrap() error { return e.Err }
+
+// ApplyError 表示 nft 执行失败
+type ApplyError struct{ Err error }
+
+func (e *ApplyError) Error() string { return "apply failed: " + e.Err.Error() }
+func (e *ApplyError) Unwrap() error { return e.Err }
+
+// VerifyError 表示应用后集合内容与预期不符
+type VerifyError struct{ Err error }
+
+func (e *VerifyError) Error() string { return "verify failed: " + e.Err.Error() }
+func (e *VerifyError) Unwrap() error { return e.Err }
+
+// PostCheckError 表示应用后的自检失败，Rollback 为恢复集合时的错误（成功时为 nil）
+type PostCheckError struct {
+	Err      error
+	Rollback error
+}
+
+func (e *PostCheckError) Error() string {
+	if e.Rollback != nil {
+		return fmt.Sprintf("post-apply check failed: %v; restoring the previous sets also failed: %v", e.Err, e.Rollback)
+	}
+	return fmt.Sprintf("post-apply check failed: %v; previous set contents restored", e.Err)
+}
+func (e *PostCheckError) Unwrap() error { return e.Err }
+
+// ExportError 表示必需的导出失败（nft 应用本身成功或未执行）
+type ExportError struct{ Err error }
+
+func (e *ExportError) Error() string { return "export failed: " + e.Err.Error() }
+func (e *ExportError) Unwrap() error { return e.Err }
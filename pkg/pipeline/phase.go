@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PhaseTiming 记录单个阶段的耗时（time.Since 使用单调时钟）
+type PhaseTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Phases 按执行顺序记录各阶段耗时
+type Phases struct {
+	Timings []PhaseTiming
+	logger  Logger
+}
+
+// Run 执行一个命名阶段并记录耗时，失败时在错误中标明阶段名。
+func (p *Phases) Run(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+	p.Timings = append(p.Timings, PhaseTiming{Name: name, Duration: d})
+	if p.logger != nil {
+		if err != nil {
+			p.logger.Printf("Phase %s failed after %s.", name, d)
+		} else {
+			p.logger.Printf("Phase %s completed in %s.", name, d)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed during %s phase: %w", name, err)
+	}
+	return nil
+}
+
+func (p Phases) String() string {
+	parts := make([]string, 0, len(p.Timings))
+	for _, t := range p.Timings {
+		parts = append(parts, fmt.Sprintf("%s=%s", t.Name, t.Duration))
+	}
+	return strings.Join(parts, " ")
+}
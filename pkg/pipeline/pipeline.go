@@ -0,0 +1,1572 @@
+// Package pipeline 串联获取、分类、渲染与应用的完整更新流程。
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github-updater/pkg/fetch"
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+)
+
+// Logger 是流程使用的日志接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Verbosef(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+}
+
+// ConfirmFunc 在执行破坏性操作前询问调用方，plan 为待执行的内容（可能为空）
+type ConfirmFunc func(question, plan string) (bool, error)
+
+// Source 是一个具名的数据来源：meta 文档（Client）或每行一个 CIDR 的文件（File，网段的分类为 Name）
+type Source struct {
+	Name   string
+	Client *fetch.Client
+	File   string
+	// Hosts 非空时解析这些主机名，每个地址作为一个 /32 或 /128 网段，Resolver 为 nil 时使用默认值
+	Hosts    []string
+	Resolver *fetch.Resolver
+	// Export 非 nil 时在获取成功后以该来源的网段调用，例如写到其他程序读取的文件
+	Export func(prefixes []netip.Prefix)
+	// Resolved 非 nil 时在每个主机名解析成功后调用，可据其 TTL 安排下一次解析
+	Resolved func(res *fetch.Resolution)
+	// Verdict 非空时该来源的网段在 verdict 映射中使用此动作，代替 Options.VerdictMap
+	Verdict string
+}
+
+// Options 控制一次更新
+type Options struct {
+	Client   *fetch.Client
+	Sources  []Source     // 非空时代替 Client，合并全部来源的网段
+	Shared   *SharedFetch // 非 nil 且没有 Sources 时与其他更新共用 Client 的获取结果
+	Nft      *nft.Client  // 为 nil 时直接调用系统 nft 命令
+	Target   nft.Target
+	Chains   []nft.ChainConfig // 挂载引用规则的链，为空时不管理规则
+	Comments bool              // 为元素附加来源分类注释
+	// ElementComments 为元素附加 "gh-<分类> <获取日期>" 标记（优先于 Comments），
+	// PreserveUnmanaged 时带标记的元素视为本工具管理、不再需要时会被移除
+	ElementComments bool
+	Confirm         ConfirmFunc // 为 nil 时不询问
+	Logger          Logger
+
+	// PreserveUnmanaged 为 true 时，刷新前记录集合中不属于 GitHub 网段的元素并在更新后重新加入
+	PreserveUnmanaged bool
+
+	// Append 为 true 时从不移除集合中已有的元素（追加模式）。已有元素保留原注释，
+	// 因此 ElementComments 标记中的日期就是该网段最后一次出现在获取结果中的日期
+	Append bool
+
+	// PruneStale 大于 0 时，追加模式下带本工具标记、日期早于该时长且本次获取中没有的元素
+	// 在同一事务中删除。没有标记的元素（手工添加）从不删除
+	PruneStale time.Duration
+
+	// SeparateFamilies 为 true 时 IPv4 和 IPv6 集合在两个独立的事务中更新，
+	// 一个地址族失败不会回滚另一个，Result.Families 给出各自的结果
+	SeparateFamilies bool
+
+	// OnlyFamily 为 "ipv4" 或 "ipv6" 时只更新该地址族的集合，另一个集合和引用它的规则保持不变，
+	// 用于只有一个地址族的数据变化时的局部更新
+	OnlyFamily string
+
+	// Shadow 非 nil 时，成功应用后用该客户端把同样的内容写入名称加 ShadowSuffix 的集合（不挂载规则），
+	// 再比较两组集合在内核中的内容并记录差异，用于迁移执行方式前确认结果一致。
+	// 影子应用的失败和差异只记录日志，不影响本次结果
+	Shadow *nft.Client
+
+	// Exporters 在分类完成后与 nft 应用并发执行，把期望网段写到其他程序使用的文件等。
+	// ExportAfterApply 为 true 时改为等 nft 应用成功后再执行，使导出与实际应用的内容一致
+	Exporters        []Exporter
+	ExportAfterApply bool
+
+	// RecreateSets 为 true 时，已有的集合在应用的同一事务中删除重建，使属性的修改生效，
+	// 事务失败时原集合保持不变；被 Chains 之外的规则引用的集合无法删除，只替换内容。
+	// 为 false 时只创建缺失的集合并清空内容
+	RecreateSets bool
+
+	// RepairSets 为 true 时，类型或属性与配置不一致的已有集合在同一事务中删除重建，
+	// Chains 中引用集合的规则随之重建；为 false 时给出错误
+	RepairSets bool
+
+	// CleanFamilyMismatch 为 true 时，删除（经确认后）其他地址族中与配置同名的集合；
+	// 为 false 时只发出警告
+	CleanFamilyMismatch bool
+
+	// TrackChanges 为 true 时，应用前读取集合现有内容，在 Result 中给出新增和移除的网段
+	TrackChanges bool
+
+	// Verify 为 true 时，应用后重新读取集合确认内容完整
+	Verify bool
+
+	// WaitForNetwork 大于 0 时，获取前等待网络可达（最多等待该时长）
+	WaitForNetwork time.Duration
+
+	// ExtraFiles 中每个文件的网段（每行一个 CIDR）按顺序合并去重后作为 extra 分类加入；
+	// ExcludeFile 非空时从结果中去掉文件中的网段。每次运行都重新读取
+	ExtraFiles  []string
+	ExcludeFile string
+
+	// SetAttrs 是集合的可选属性（policy、元素超时、gc-interval）
+	SetAttrs nft.SetAttrs
+
+	// Ports 非空时集合类型为 地址 . 端口（inet_service），只放行访问这些目标端口的流量。
+	// 需要 nft 0.9.4 及以上
+	Ports []uint16
+
+	// VerdictMap 非空时两个集合改为 地址 : verdict 映射，没有指定 Source.Verdict 的网段使用此动作，
+	// 引用规则为 vmap。重叠的网段动作不同时拒绝更新
+	VerdictMap string
+
+	// Version 是写入表和集合 comment 的工具版本，见 nft.ManagedComment
+	Version string
+
+	// HashIgnoreExtras 为 true 时 Result.Hash 不包含只来自 ExtraFiles 的网段
+	HashIgnoreExtras bool
+	// PreviousHash 非空时，Changed 以 Result.Hash 是否与它不同来判断，
+	// 而不是与集合原有内容的差异
+	PreviousHash string
+
+	// AssumeLive 非空且集合为空或不存在时，代替集合原有内容计算 Result 中的变化，
+	// 例如迁移时从原来的 ipset 导入的内容
+	AssumeLive []netip.Prefix
+
+	// SkipIfHash 非空且与本次期望网段的哈希相同时，获取后不再清理和应用，
+	// Result.Skipped 为 true。用于只在数据变化时更新
+	SkipIfHash string
+
+	// PostCheck 非 nil 时在应用（和校验）之后调用，例如确认仍能访问 GitHub。
+	// 失败时把集合恢复为应用前的内容并返回 *PostCheckError
+	PostCheck func(ctx context.Context) error
+
+	// KeepOnEmpty 为 true 时，获取结果没有任何有效网段只产生警告，集合保持原有内容
+	// （Result.Kept 为 true），而不是返回 ErrEmpty
+	KeepOnEmpty bool
+
+	// MissingCategory 决定 meta 响应中缺少请求的分类时的处理方式：skip（默认）只应用存在的分类，
+	// fail 返回 *GuardError，stale 使用 Previous 中该分类的网段
+	MissingCategory string
+	// Previous 是最近一次应用的数据，MissingCategory 为 stale 时使用；
+	// PreserveUnmanaged 时其中的网段视为本工具管理，上游不再包含时会被移除
+	Previous *Snapshot
+
+	// FlushOnFetchFailure 为 true 时获取失败（*FetchError）后清空现有的集合（fail-closed），
+	// Result.Flushed 为 true，返回的仍是获取错误
+	FlushOnFetchFailure bool
+
+	// Backend 非 nil 时代替 nftables 应用网段，见 Backend
+	Backend Backend
+}
+
+// Exporter 是一个导出目标，Write 可能与 nft 应用及其他导出并发调用
+type Exporter struct {
+	Name     string
+	Required bool // 失败时整次运行失败（*ExportError），否则只记录
+	Write    func(ctx context.Context, classified *Classified) error
+}
+
+// ExportResult 是单个导出的结果
+type ExportResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// Result 汇总一次更新的结果
+type Result struct {
+	IPv4Count int
+	IPv6Count int
+	Preserved int  // 保留的非托管元素数（追加模式下为保留的已有元素数）
+	Pruned    int  // 追加模式下因过期删除的元素数
+	Excluded  int  // 与 ExcludeFile 重叠而被去掉或拆分的网段数
+	Split     int  // 部分排除的网段拆分后剩下的网段数
+	Applied   bool // 为 false 表示用户取消或已跳过
+	Skipped   bool // 期望网段与 SkipIfHash 相同，未应用
+	Kept      bool // 没有有效网段，按 KeepOnEmpty 保留了原有内容
+	Flushed   bool // 获取失败，按 FlushOnFetchFailure 清空了集合
+	Phases    Phases
+	Families  []FamilyResult // SeparateFamilies 时各地址族的结果
+	Exports   []ExportResult // 各导出的结果，按 Options.Exporters 的顺序
+
+	// TrackChanges 时与集合原有内容相比新增和移除的网段
+	Added   []netip.Prefix
+	Removed []netip.Prefix
+
+	Source     string        // 数据来源
+	Categories []string      // 获取到的分类（已排序）
+	Backend    string        // 应用更新的方式
+	Duration   time.Duration // 整次运行耗时
+	Warnings   []string      // 运行中产生的警告
+	Snapshot   *Snapshot     // 获取成功时的原始数据，可保存供 ApplySnapshot 使用
+	Hash       string        // 期望网段的哈希，见 Classified.Hash
+	// FetchedBytes 是本次从网络读取的响应体字节数
+	FetchedBytes int64
+	// MetaDate 是 meta 响应的 Date 头部（只取 Options.Client），没有时为零值
+	MetaDate time.Time
+	// RateLimit 是响应中的请求配额，多个来源时取剩余最少的，没有时为 nil
+	RateLimit *fetch.RateLimit
+
+	prevHash string
+}
+
+// FamilyResult 是 SeparateFamilies 时单个地址族的事务结果
+type FamilyResult struct {
+	Family  string // ipv4 或 ipv6
+	Applied bool
+	Err     error
+}
+
+// Changed 表示集合内容是否有变化（仅 TrackChanges 时有意义）。
+// 设置了 Options.PreviousHash 时比较哈希
+func (r *Result) Changed() bool {
+	if r.prevHash != "" && r.Hash != "" {
+		return r.Hash != r.prevHash
+	}
+	return len(r.Added) > 0 || len(r.Removed) > 0
+}
+
+// runner 保存一次运行中各步骤共享的状态
+type runner struct {
+	opts    Options
+	log     Logger
+	confirm ConfirmFunc
+	nft     *nft.Client
+	res     *Result
+
+	live4, live6 []iprange.Range // PreserveUnmanaged 或 TrackChanges 时记录的集合原有内容
+	marked4      []iprange.Range // 原有内容中带 MarkerPrefix 标记的元素
+	marked6      []iprange.Range
+	backup4      []nft.Element // 应用前的完整元素，PostCheck 失败时用于恢复
+	backup6      []nft.Element
+	start        time.Time
+	version      *nft.Version // 缓存的 nft 版本
+	config       nft.Config   // render 生成的最终配置
+	markerWarned bool
+	recreate     bool              // RecreateSets 且已确认，render 在事务中删除重建已有集合
+	verdicts     map[string]string // 来源为分类指定的映射动作
+	exclude      []netip.Prefix    // ExcludeFile 中的网段
+}
+
+func newRunner(opts Options) *runner {
+	r := &runner{opts: opts, log: opts.Logger, confirm: opts.Confirm, nft: opts.Nft, res: &Result{}, start: time.Now()}
+	if r.log == nil {
+		r.log = nopLogger{}
+	}
+	if r.confirm == nil {
+		r.confirm = func(string, string) (bool, error) { return true, nil }
+	}
+	if r.nft == nil {
+		r.nft = &nft.Client{}
+	}
+	r.res.Phases.logger = r.log
+	r.res.Backend = r.nft.Backend()
+	if opts.Backend != nil {
+		r.res.Backend = opts.Backend.Name()
+	}
+	r.res.prevHash = opts.PreviousHash
+	return r
+}
+
+// warnf 输出警告并记录到结果中
+func (r *runner) warnf(format string, v ...interface{}) {
+	r.log.Warnf(format, v...)
+	r.res.Warnings = append(r.res.Warnings, fmt.Sprintf(format, v...))
+}
+
+// done 记录整次运行的耗时
+func (r *runner) done() { r.res.Duration = time.Since(r.start) }
+
+// Run 执行一次完整的更新：清理旧集合、获取、分类、渲染、应用
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	r := newRunner(opts)
+	defer r.done()
+	// 先获取再清理，获取失败或数据未变化时不会修改集合
+	classified, err := r.fetch(ctx)
+	if r.keep(err) {
+		return r.res, nil
+	}
+	if err != nil {
+		return r.res, r.flushOnFailure(ctx, err)
+	}
+	if r.skip(classified) {
+		return r.res, nil
+	}
+	return r.res, r.outputs(ctx, classified, func() error {
+		if r.opts.Backend != nil {
+			return r.applyBackend(ctx, classified)
+		}
+		if err := r.prepare(ctx); err != nil {
+			return err
+		}
+		return r.apply(ctx, classified)
+	})
+}
+
+// outputs 执行 nft 应用和全部导出：默认并发，ExportAfterApply 时导出等待应用成功。
+// 应用失败时返回应用的错误；应用成功而必需的导出失败时返回 *ExportError
+func (r *runner) outputs(ctx context.Context, classified *Classified, apply func() error) error {
+	if len(r.opts.Exporters) == 0 {
+		return apply()
+	}
+	var applyErr error
+	if r.opts.ExportAfterApply {
+		if applyErr = apply(); applyErr != nil || !r.res.Applied {
+			r.log.Verbosef("Skipping exports because the sets were not applied.")
+			return applyErr
+		}
+		return r.exported(r.export(ctx, classified))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		applyErr = apply()
+	}()
+	results := r.export(ctx, classified)
+	<-done
+	// 应用结束后才修改 r.res，避免与应用并发写入
+	exportErr := r.exported(results)
+	if applyErr != nil {
+		return applyErr
+	}
+	return exportErr
+}
+
+// export 并发执行全部导出并等待完成，返回每个导出的结果
+func (r *runner) export(ctx context.Context, classified *Classified) []ExportResult {
+	results := make([]ExportResult, len(r.opts.Exporters))
+	var wg sync.WaitGroup
+	for i, e := range r.opts.Exporters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := e.Write(ctx, classified)
+			results[i] = ExportResult{Name: e.Name, Err: err, Duration: time.Since(start)}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// exported 记录导出结果，必需的导出失败时返回 *ExportError
+func (r *runner) exported(results []ExportResult) error {
+	var errs []error
+	for i, res := range results {
+		switch {
+		case res.Err == nil:
+			r.log.Verbosef("Export %s completed in %s.", res.Name, res.Duration)
+		case r.opts.Exporters[i].Required:
+			r.log.Printf("Export %s failed: %v", res.Name, res.Err)
+			errs = append(errs, fmt.Errorf("%s: %w", res.Name, res.Err))
+		default:
+			r.warnf("optional export %s failed: %v", res.Name, res.Err)
+		}
+	}
+	r.res.Exports = results
+	if len(errs) > 0 {
+		return &ExportError{Err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// keep 判断获取错误是否为没有有效网段且按 KeepOnEmpty 保留原有内容，是时记录警告
+func (r *runner) keep(err error) bool {
+	var guard *GuardError
+	if !r.opts.KeepOnEmpty || !errors.Is(err, ErrEmpty) || !errors.As(err, &guard) {
+		return false
+	}
+	r.warnf("%v; keeping the current set contents", guard.Err)
+	r.res.Kept = true
+	return true
+}
+
+// flushOnFailure 在获取失败且设置了 FlushOnFetchFailure 时清空现有的集合，
+// 返回值仍是获取错误，清空失败时附带原因
+func (r *runner) flushOnFailure(ctx context.Context, err error) error {
+	var fetchErr *FetchError
+	if !r.opts.FlushOnFetchFailure || !errors.As(err, &fetchErr) {
+		return err
+	}
+	if r.opts.Backend != nil {
+		return r.flushBackend(ctx, err)
+	}
+	t := r.opts.Target
+	var (
+		sets  []*nft.Set
+		names []string
+	)
+	for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+		set, lerr := r.nft.ListSet(ctx, t.Family, t.TableName, name)
+		if errors.Is(lerr, nft.ErrNotFound) {
+			continue
+		}
+		if lerr != nil {
+			return fmt.Errorf("%w; flushing the sets also failed: %v", err, lerr)
+		}
+		sets = append(sets, set)
+		names = append(names, name)
+		for _, e := range set.Elements {
+			r.res.Removed = append(r.res.Removed, iprange.ToPrefixes([]iprange.Range{e.Range})...)
+		}
+	}
+	if len(sets) == 0 {
+		r.warnf("fetch failed and no sets exist in %s/%s, nothing to flush", t.Family, t.TableName)
+		return err
+	}
+	if ferr := r.res.Phases.Run("flush", func() error { return r.nft.FlushSets(ctx, sets...) }); ferr != nil {
+		r.res.Removed = nil
+		return fmt.Errorf("%w; flushing the sets also failed: %v", err, ferr)
+	}
+	r.res.Flushed = true
+	r.log.Printf("Fetch failed, flushed %s (%d ranges removed) because of the fail-closed policy.", strings.Join(names, ", "), len(r.res.Removed))
+	return err
+}
+
+// skip 判断期望网段是否与 SkipIfHash 相同，相同时记录跳过
+func (r *runner) skip(classified *Classified) bool {
+	if r.opts.SkipIfHash == "" {
+		return false
+	}
+	r.res.Hash = classified.Hash(!r.opts.HashIgnoreExtras)
+	if r.res.Hash != r.opts.SkipIfHash {
+		return false
+	}
+	r.res.Skipped = true
+	r.log.Verbosef("Desired sets unchanged since the last apply (hash %.12s), skipping.", r.res.Hash)
+	return true
+}
+
+// Fetch 只获取并分类网段，不接触 nftables，用于只读的比较等场景
+func Fetch(ctx context.Context, opts Options) (*Classified, *Result, error) {
+	r := newRunner(opts)
+	defer r.done()
+	classified, err := r.fetch(ctx)
+	return classified, r.res, err
+}
+
+// ApplyClassified 把已经获取并分类的网段应用到 opts.Nft（例如远程主机），
+// 同一份数据可以依次应用到多个目标而只获取一次。
+func ApplyClassified(ctx context.Context, opts Options, classified *Classified) (*Result, error) {
+	r := newRunner(opts)
+	defer r.done()
+	r.res.IPv4Count, r.res.IPv6Count = len(classified.IPv4), len(classified.IPv6)
+	if err := r.prepare(ctx); err != nil {
+		return r.res, err
+	}
+	return r.res, r.apply(ctx, classified)
+}
+
+// prepare 记录需要保留的元素并尝试清理旧集合
+func (r *runner) prepare(ctx context.Context) error {
+	t := r.opts.Target
+	if err := r.snapshot(ctx); err != nil {
+		return err
+	}
+
+	if err := r.checkFamilies(ctx); err != nil {
+		return err
+	}
+
+	// 默认只依赖 add（不存在时创建）加 flush；RecreateSets 时在应用的事务中删除重建集合以便修改属性，删除同样需要确认
+	if !r.opts.RecreateSets {
+		return nil
+	}
+	ok, err := r.confirm(fmt.Sprintf("Recreate sets %s, %s in %s/%s while updating?", t.IPv4SetName, t.IPv6SetName, t.Family, t.TableName), "")
+	if err != nil {
+		return err
+	}
+	r.recreate = ok
+	if !ok {
+		r.log.Verbosef("Keeping the existing sets, only replacing their contents.")
+	}
+	return nil
+}
+
+// snapshot 在需要时读取集合的原有内容
+func (r *runner) snapshot(ctx context.Context) error {
+	t := r.opts.Target
+	// 清理和 flush 都会丢失原有内容，先记录下来
+	if r.opts.PreserveUnmanaged || r.opts.Append || r.opts.TrackChanges || r.opts.PostCheck != nil || r.opts.SetAttrs.Constant {
+		err := r.res.Phases.Run("snapshot", func() (err error) {
+			if r.live4, r.marked4, r.backup4, err = listLive(ctx, r.nft, t.Family, t.TableName, t.IPv4SetName, r.opts.Ports); err != nil {
+				return err
+			}
+			if r.live6, r.marked6, r.backup6, err = listLive(ctx, r.nft, t.Family, t.TableName, t.IPv6SetName, r.opts.Ports); err != nil {
+				return err
+			}
+			if len(r.live4) == 0 && len(r.live6) == 0 && len(r.opts.AssumeLive) > 0 {
+				imported := Classify(map[string][]netip.Prefix{"imported": r.opts.AssumeLive})
+				r.live4, r.live6 = iprange.FromPrefixes(Prefixes(imported.IPv4)), iprange.FromPrefixes(Prefixes(imported.IPv6))
+				r.log.Verbosef("Sets are empty, comparing against %d imported prefixes.", len(r.opts.AssumeLive))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFamilies 查找其他地址族中与配置同名的集合。
+// 修改过 -family 后旧集合会残留，与新集合并存容易造成混乱和重复规则。
+func (r *runner) checkFamilies(ctx context.Context) error {
+	t := r.opts.Target
+	sets, err := r.nft.ListSets(ctx)
+	if err != nil {
+		r.log.Verbosef("Family check skipped: %v", err)
+		return nil
+	}
+	for _, s := range sets {
+		if s.Family == t.Family || (s.Name != t.IPv4SetName && s.Name != t.IPv6SetName) {
+			continue
+		}
+		r.warnf("set %s also exists in family %s (configured family is %s); it is not managed by this run", s.Name, s.Family, t.Family)
+		if !r.opts.CleanFamilyMismatch {
+			continue
+		}
+		ok, err := r.confirm(fmt.Sprintf("Delete leftover set %s?", s), "")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := r.nft.DeleteSet(ctx, s.Family, s.Table, s.Name); err != nil {
+			r.warnf("could not delete leftover set %s (still referenced by rules?): %v", s, err)
+		} else {
+			r.log.Printf("Deleted leftover set %s.", s)
+		}
+	}
+	return nil
+}
+
+func (r *runner) fetch(ctx context.Context) (*Classified, error) {
+	client := r.opts.Client
+	if client == nil {
+		client = &fetch.Client{}
+	}
+	r.res.Source = client.Source()
+	if len(r.opts.Sources) > 0 {
+		var names []string
+		for _, src := range r.opts.Sources {
+			names = append(names, src.Name)
+		}
+		r.res.Source = "sources " + strings.Join(names, ", ")
+	}
+	if r.opts.WaitForNetwork > 0 && client.File == "" {
+		err := r.res.Phases.Run("wait-network", func() error {
+			r.log.Verbosef("Waiting up to %s for the network...", r.opts.WaitForNetwork)
+			return client.WaitForNetwork(ctx, r.opts.WaitForNetwork)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 1. 获取数据
+	var fetched *fetch.Result
+	err := r.res.Phases.Run("fetch", func() (err error) {
+		if len(r.opts.Sources) > 0 {
+			fetched, err = r.fetchSources(ctx)
+		} else if r.opts.Shared != nil {
+			fetched, err = r.opts.Shared.fetch(ctx, r, client)
+		} else {
+			fetched, err = r.fetchFresh(ctx, client)
+		}
+		if errors.Is(err, fetch.ErrDecode) {
+			return &DecodeError{Err: err}
+		}
+		if err != nil {
+			return &FetchError{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.missingCategories(fetched); err != nil {
+		return nil, err
+	}
+	r.res.FetchedBytes, r.res.MetaDate, r.res.RateLimit = fetched.Bytes, fetched.Date, fetched.RateLimit
+	if fetched.Bytes > 0 {
+		r.log.Verbosef("Received %d bytes.", fetched.Bytes)
+	}
+	if fetched.FinalURL != "" {
+		r.log.Verbosef("Request was redirected, final URL: %s.", fetched.FinalURL)
+	}
+	if rl := fetched.RateLimit; rl != nil {
+		r.log.Verbosef("Rate limit: %d of %d requests left until %s.", rl.Remaining, rl.Limit, rl.Reset.Local().Format(time.TimeOnly))
+	}
+	r.res.Snapshot = &Snapshot{Source: r.res.Source, FetchedAt: time.Now().UTC(), Categories: fetched.Categories, Verdicts: r.verdicts}
+	if len(r.opts.ExtraFiles) > 0 {
+		extra, err := r.readExtras()
+		if err != nil {
+			return nil, fmt.Errorf("extra file: %w", err)
+		}
+		categories := make(map[string][]netip.Prefix, len(fetched.Categories)+1)
+		for name, prefixes := range fetched.Categories {
+			categories[name] = prefixes
+		}
+		r.redundantExtras(extra, fetched.Categories)
+		categories[ExtraCategory] = append(categories[ExtraCategory], extra...)
+		r.res.Snapshot.Categories = categories
+	}
+
+	// 2. 分类 IP (先分类，统计出数量)
+	classified, err := r.classify(r.res.Snapshot.Categories, fetched.Invalid)
+	if err != nil || r.opts.ExcludeFile == "" {
+		return classified, err
+	}
+	exclude, err := fetch.ReadCIDRFile(r.opts.ExcludeFile)
+	if err != nil {
+		return nil, fmt.Errorf("exclude file: %w", err)
+	}
+	r.exclude = exclude
+	if n, split := classified.Exclude(exclude); n > 0 {
+		r.warnf("excluded %d ranges listed in %s", n, r.opts.ExcludeFile)
+		if split > 0 {
+			r.log.Verbosef("Splitting the partially excluded ranges produced %d prefixes.", split)
+		}
+		r.res.Excluded, r.res.Split = n, split
+		r.res.IPv4Count, r.res.IPv6Count = len(classified.IPv4), len(classified.IPv6)
+	}
+	return classified, nil
+}
+
+// fetchFresh 获取 meta 文档，响应来自过期的缓存时要求缓存重新验证后再试一次。
+// 仍然过期时返回错误，本次不应用，集合保持原有内容
+func (r *runner) fetchFresh(ctx context.Context, client *fetch.Client) (*fetch.Result, error) {
+	res, err := client.Fetch(ctx)
+	if !errors.Is(err, fetch.ErrStale) {
+		return res, err
+	}
+	r.warnf("%v; retrying with Cache-Control: no-cache", err)
+	retry := *client
+	retry.NoCache = true
+	return retry.Fetch(ctx)
+}
+
+// fetchSources 依次获取 Sources 中的每个来源并合并，同一分类的网段合在一起
+func (r *runner) fetchSources(ctx context.Context) (*fetch.Result, error) {
+	merged := &fetch.Result{Categories: make(map[string][]netip.Prefix)}
+	for _, src := range r.opts.Sources {
+		var prefixes []netip.Prefix
+		switch {
+		case len(src.Hosts) > 0:
+			resolver := src.Resolver
+			if resolver == nil {
+				resolver = &fetch.Resolver{}
+			}
+			for _, host := range src.Hosts {
+				res, err := resolver.Resolve(ctx, host)
+				if err != nil {
+					return nil, fmt.Errorf("source %s: %w", src.Name, err)
+				}
+				r.log.Verbosef("Source %s: %s resolved to %d addresses (TTL %s).", src.Name, host, len(res.Addrs), res.TTL)
+				if src.Resolved != nil {
+					src.Resolved(res)
+				}
+				prefixes = append(prefixes, res.Prefixes()...)
+			}
+			merged.Categories[src.Name] = append(merged.Categories[src.Name], prefixes...)
+			r.setVerdict(src, src.Name)
+		case src.Client != nil:
+			res, err := r.fetchFresh(ctx, src.Client)
+			if err != nil {
+				return nil, fmt.Errorf("source %s: %w", src.Name, err)
+			}
+			for name, ps := range res.Categories {
+				merged.Categories[name] = append(merged.Categories[name], ps...)
+				prefixes = append(prefixes, ps...)
+				r.setVerdict(src, name)
+			}
+			merged.Invalid = append(merged.Invalid, res.Invalid...)
+			merged.Missing = append(merged.Missing, res.Missing...)
+			if res.FinalURL != "" {
+				r.log.Verbosef("Source %s was redirected, final URL: %s.", src.Name, res.FinalURL)
+			}
+			merged.Bytes += res.Bytes
+			if res.RateLimit != nil && (merged.RateLimit == nil || res.RateLimit.Remaining < merged.RateLimit.Remaining) {
+				merged.RateLimit = res.RateLimit
+			}
+		default:
+			ps, err := fetch.ReadCIDRFile(src.File)
+			if err != nil {
+				return nil, fmt.Errorf("source %s: %w", src.Name, err)
+			}
+			merged.Categories[src.Name] = append(merged.Categories[src.Name], ps...)
+			prefixes = ps
+			r.setVerdict(src, src.Name)
+		}
+		r.log.Verbosef("Source %s: %d ranges.", src.Name, len(prefixes))
+		if src.Export != nil {
+			src.Export(prefixes)
+		}
+	}
+	return merged, nil
+}
+
+// missingCategories 按 MissingCategory 处理响应中缺少的分类，并记录存在和缺少的分类及处理方式
+func (r *runner) missingCategories(fetched *fetch.Result) error {
+	if len(fetched.Missing) == 0 {
+		return nil
+	}
+	present := slices.Sorted(maps.Keys(fetched.Categories))
+	r.log.Printf("Categories present in the response: %s; missing: %s.", strings.Join(present, ", "), strings.Join(fetched.Missing, ", "))
+	switch r.opts.MissingCategory {
+	case "fail":
+		return &GuardError{Err: fmt.Errorf("categories missing from the response: %s", strings.Join(fetched.Missing, ", "))}
+	case "stale":
+		for _, name := range fetched.Missing {
+			var (
+				prev []netip.Prefix
+				ok   bool
+			)
+			if r.opts.Previous != nil {
+				prev, ok = r.opts.Previous.Categories[name]
+			}
+			if !ok {
+				r.warnf("category %s is missing from the response and not in the last applied data, skipping it", name)
+				continue
+			}
+			fetched.Categories[name] = prev
+			r.warnf("category %s is missing from the response, reusing its %d ranges from the last applied data (fetched %s)",
+				name, len(prev), r.opts.Previous.FetchedAt.Local().Format(time.RFC3339))
+		}
+	default:
+		for _, name := range fetched.Missing {
+			r.warnf("category %s is missing from the response, skipping it", name)
+		}
+	}
+	return nil
+}
+
+// setVerdict 记录来源 src 为分类 name 指定的映射动作。多个来源给同一分类指定不同动作时
+// 以先出现的为准并警告，MapElements 无法再区分这些网段的来源
+func (r *runner) setVerdict(src Source, name string) {
+	if src.Verdict == "" {
+		return
+	}
+	if r.verdicts == nil {
+		r.verdicts = make(map[string]string)
+	}
+	if v, ok := r.verdicts[name]; ok && v != src.Verdict {
+		r.warnf("source %s sets verdict %q for category %s, which another source already maps to %q; keeping %q", src.Name, src.Verdict, name, v, v)
+		return
+	}
+	r.verdicts[name] = src.Verdict
+}
+
+// readExtras 按顺序读取全部 ExtraFiles 并去重，同一网段以最先列出它的文件为准。
+// 所有文件的错误（带文件名和行号）一起返回
+func (r *runner) readExtras() ([]netip.Prefix, error) {
+	var (
+		extra []netip.Prefix
+		errs  []error
+		owner = make(map[netip.Prefix]string)
+	)
+	for _, path := range r.opts.ExtraFiles {
+		prefixes, err := fetch.ReadCIDRFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, p := range prefixes {
+			if first, ok := owner[p.Masked()]; ok {
+				if first != path {
+					r.log.Verbosef("Extra range %s in %s is already listed in %s.", p, path, first)
+				}
+				continue
+			}
+			owner[p.Masked()] = path
+			extra = append(extra, p)
+		}
+	}
+	return extra, errors.Join(errs...)
+}
+
+// redundantExtras 指出已经被获取的网段完整覆盖的额外网段
+func (r *runner) redundantExtras(extra []netip.Prefix, fetched map[string][]netip.Prefix) {
+	var all []netip.Prefix
+	for _, prefixes := range fetched {
+		all = append(all, prefixes...)
+	}
+	covered := iprange.FromPrefixes(all)
+	for _, p := range extra {
+		if len(iprange.Subtract([]iprange.Range{iprange.FromPrefix(p)}, covered)) == 0 {
+			r.log.Verbosef("Extra range %s is already covered by the fetched ranges.", p)
+		}
+	}
+}
+
+// classify 分类网段并执行安全检查，invalid 为获取时跳过的无效条目
+func (r *runner) classify(categories map[string][]netip.Prefix, invalid []string) (*Classified, error) {
+	var classified *Classified
+	err := r.res.Phases.Run("classify", func() error {
+		categories = r.unmap(categories)
+		classified = Classify(categories)
+		classified.Verdicts = r.verdicts
+		total := len(invalid)
+		for name, prefixes := range categories {
+			r.res.Categories = append(r.res.Categories, name)
+			total += len(prefixes)
+		}
+		sort.Strings(r.res.Categories)
+		if len(invalid) > 0 {
+			r.warnf("skipped %d invalid CIDRs (first: %q)", len(invalid), invalid[0])
+		}
+		r.res.IPv4Count, r.res.IPv6Count = len(classified.IPv4), len(classified.IPv6)
+		r.log.Verbosef("Fetched %d ranges (IPv4: %d, IPv6: %d).", total, r.res.IPv4Count, r.res.IPv6Count)
+		if r.res.IPv4Count == 0 && r.res.IPv6Count == 0 {
+			return &GuardError{Err: emptyReason(categories, invalid)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return classified, nil
+}
+
+// unmap 把 IPv4 映射的 IPv6 网段转换为 IPv4 网段，使其进入 IPv4 集合；否则它们在 IPv6 集合中
+// 永远匹配不到真实的 IPv4 流量。无法转换的跳过并警告。没有映射网段时原样返回 categories
+func (r *runner) unmap(categories map[string][]netip.Prefix) map[string][]netip.Prefix {
+	var (
+		result  map[string][]netip.Prefix
+		skipped []netip.Prefix
+	)
+	for name, prefixes := range categories {
+		if !slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Addr().Is4In6() }) {
+			continue
+		}
+		if result == nil {
+			result = maps.Clone(categories)
+		}
+		kept := make([]netip.Prefix, 0, len(prefixes))
+		for _, p := range prefixes {
+			v4, ok := Unmap(p)
+			if !ok {
+				skipped = append(skipped, p)
+				continue
+			}
+			if v4 != p {
+				r.log.Verbosef("Converted IPv4-mapped range %s in %s to %s.", p, name, v4)
+			}
+			kept = append(kept, v4)
+		}
+		result[name] = kept
+	}
+	if len(skipped) > 0 {
+		r.warnf("skipped %d IPv4-mapped ranges shorter than /96 with no IPv4 equivalent (first: %s)", len(skipped), skipped[0])
+	}
+	if result == nil {
+		return categories
+	}
+	return result
+}
+
+// emptyReason 说明为什么没有有效网段：响应中的分类本身为空，还是条目全部无法解析
+func emptyReason(categories map[string][]netip.Prefix, invalid []string) error {
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: all %d entries were invalid CIDRs (first: %q)", ErrEmpty, len(invalid), invalid[0])
+	}
+	names := make([]string, 0, len(categories))
+	for name := range categories {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%w: the response contained no categories", ErrEmpty)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("%w: categories %s are present but empty in the response", ErrEmpty, strings.Join(names, ", "))
+}
+
+// apply 渲染并应用更新，必要时校验结果
+func (r *runner) apply(ctx context.Context, classified *Classified) error {
+	t := r.opts.Target
+	payload, err := r.render(ctx, classified)
+	if err != nil {
+		return err
+	}
+	if payload == "" {
+		return nil
+	}
+	if r.opts.SeparateFamilies {
+		return r.applyFamilies(ctx, classified)
+	}
+
+	// 5. 确认后执行命令
+	ok, err := r.confirm(fmt.Sprintf("Apply these changes to %s/%s?", t.Family, t.TableName), payload)
+	if err != nil || !ok {
+		return err
+	}
+	err = r.execute(ctx, "apply", payload, r.config)
+	if err != nil && r.recreate && len(r.config.DeleteSets) > 0 && errors.Is(err, syscall.EBUSY) {
+		// 集合被 Chains 之外的规则引用而无法删除，事务没有生效；保留原集合，只替换内容
+		r.log.Printf("Sets are referenced by rules outside the managed chains and cannot be recreated; keeping them and replacing their contents.")
+		r.recreate = false
+		if payload, err = r.render(ctx, classified); err == nil && payload != "" {
+			err = r.execute(ctx, "apply", payload, r.config)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	r.res.Applied = true
+	if err := r.verify(ctx, classified); err != nil {
+		return err
+	}
+	if err := r.postCheck(ctx); err != nil {
+		return err
+	}
+	r.shadow(ctx)
+	return nil
+}
+
+// ShadowSuffix 是 Options.Shadow 写入的集合名称的后缀
+const ShadowSuffix = "_shadow"
+
+// shadow 用 Options.Shadow 把本次渲染的内容写入影子集合并与正式集合比较
+func (r *runner) shadow(ctx context.Context) {
+	if r.opts.Shadow == nil {
+		return
+	}
+	backend := r.opts.Shadow.Backend()
+	config := r.config
+	config.IPv4SetName += ShadowSuffix
+	config.IPv6SetName += ShadowSuffix
+	config.Chains, config.DeleteSets = nil, nil
+	config.TableComment, config.IPv4SetComment, config.IPv6SetComment = "", "", ""
+	config.SetAttrs.Constant = false // 影子集合只用于比较，每次照常清空重写
+	r.res.Phases.Run("shadow", func() error {
+		payload, err := nft.Render(config)
+		if err == nil {
+			err = r.opts.Shadow.ApplyConfigs(ctx, payload, config)
+		}
+		if err != nil {
+			r.log.Printf("Shadow apply with %s failed: %v", backend, err)
+			return nil
+		}
+		t := r.opts.Target
+		identical := true
+		for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+			primary, err := listRanges(ctx, r.nft, t.Family, t.TableName, name)
+			if err != nil {
+				r.log.Printf("Shadow comparison skipped: %v", err)
+				return nil
+			}
+			shadow, err := listRanges(ctx, r.nft, t.Family, t.TableName, name+ShadowSuffix)
+			if err != nil {
+				r.log.Printf("Shadow comparison skipped: %v", err)
+				return nil
+			}
+			missing, extra := iprange.ToPrefixes(iprange.Subtract(primary, shadow)), iprange.ToPrefixes(iprange.Subtract(shadow, primary))
+			if len(missing) == 0 && len(extra) == 0 {
+				continue
+			}
+			identical = false
+			msg := fmt.Sprintf("Shadow set %s%s written by %s differs from %s: %d prefixes missing, %d extra", name, ShadowSuffix, backend, name, len(missing), len(extra))
+			if len(missing) > 0 {
+				msg += fmt.Sprintf(" (first missing: %s)", missing[0])
+			}
+			if len(extra) > 0 {
+				msg += fmt.Sprintf(" (first extra: %s)", extra[0])
+			}
+			r.log.Printf("%s.", msg)
+		}
+		if identical {
+			r.log.Printf("Shadow sets written by %s match the applied sets.", backend)
+		}
+		return nil
+	})
+}
+
+// applyFamilies 把 IPv4 和 IPv6 集合分别在独立的事务中应用，一个地址族失败时另一个照常应用
+func (r *runner) applyFamilies(ctx context.Context, classified *Classified) error {
+	t := r.opts.Target
+	for _, ch := range r.config.Chains {
+		if len(ch.DeleteHandles) > 0 {
+			return &RenderError{Err: fmt.Errorf("rules in chain %s must be replaced, which cannot be done in separate per-family transactions", ch.Name)}
+		}
+	}
+	v4, v6 := r.config.SplitFamilies()
+	parts := []struct {
+		family  string
+		config  nft.Config
+		payload string
+	}{{family: "ipv4", config: v4}, {family: "ipv6", config: v6}}
+	for i := range parts {
+		payload, err := nft.Render(parts[i].config)
+		if err != nil {
+			return &RenderError{Err: err}
+		}
+		parts[i].payload = payload
+	}
+
+	ok, err := r.confirm(fmt.Sprintf("Apply these changes to %s/%s (one transaction per family)?", t.Family, t.TableName), parts[0].payload+"\n\n"+parts[1].payload)
+	if err != nil || !ok {
+		return err
+	}
+	var errs []error
+	for _, p := range parts {
+		err := r.execute(ctx, "apply-"+p.family, p.payload, p.config)
+		r.res.Families = append(r.res.Families, FamilyResult{Family: p.family, Applied: err == nil, Err: err})
+		if err != nil {
+			r.log.Printf("Updating the %s set failed: %v", p.family, err)
+			errs = append(errs, err)
+			continue
+		}
+		r.res.Applied = true
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := r.verify(ctx, classified); err != nil {
+		return err
+	}
+	if err := r.postCheck(ctx); err != nil {
+		return err
+	}
+	r.shadow(ctx)
+	return nil
+}
+
+// postCheck 执行 PostCheck，失败时恢复应用前的集合内容
+func (r *runner) postCheck(ctx context.Context) error {
+	if r.opts.PostCheck == nil {
+		return nil
+	}
+	err := r.res.Phases.Run("post-check", func() error { return r.opts.PostCheck(ctx) })
+	if err == nil {
+		return nil
+	}
+	t := r.opts.Target
+	r.log.Printf("Post-apply check failed, restoring the previous contents of %s and %s...", t.IPv4SetName, t.IPv6SetName)
+	rollback := r.res.Phases.Run("rollback", func() error {
+		return r.nft.ReplaceSets(ctx, t.Family, t.TableName,
+			nft.SetElements{Name: t.IPv4SetName, Elements: r.backup4, Map: r.opts.VerdictMap != ""},
+			nft.SetElements{Name: t.IPv6SetName, Elements: r.backup6, Map: r.opts.VerdictMap != ""})
+	})
+	if rollback == nil {
+		r.res.Applied = false
+	}
+	return &PostCheckError{Err: err, Rollback: rollback}
+}
+
+// render 生成完整的集合配置并渲染为 nft 脚本
+func (r *runner) render(ctx context.Context, classified *Classified) (string, error) {
+	t := r.opts.Target
+	r.res.Hash = classified.Hash(!r.opts.HashIgnoreExtras)
+
+	// 3. 填充配置
+	config := nft.Config{
+		Target:       t,
+		IPv4Elements: Elements(classified.IPv4, r.elementComment(ctx)),
+		IPv6Elements: Elements(classified.IPv6, r.elementComment(ctx)),
+	}
+	if len(r.opts.Ports) > 0 {
+		if err := r.checkConcatSupport(ctx); err != nil {
+			return "", err
+		}
+		// 拼接集合没有 auto-merge，重叠的网段需要预先合并
+		config.Ports = r.opts.Ports
+		config.IPv4Elements = Elements(Merge(classified.IPv4), r.elementComment(ctx))
+		config.IPv6Elements = Elements(Merge(classified.IPv6), r.elementComment(ctx))
+	}
+	if r.opts.VerdictMap != "" {
+		// 映射没有 auto-merge，按动作分组预先合并，重叠网段的动作必须一致
+		config.VerdictMap = true
+		v4, err := MapElements(classified.IPv4, classified.Verdicts, r.opts.VerdictMap, r.elementComment(ctx))
+		if err != nil {
+			return "", err
+		}
+		v6, err := MapElements(classified.IPv6, classified.Verdicts, r.opts.VerdictMap, r.elementComment(ctx))
+		if err != nil {
+			return "", err
+		}
+		config.IPv4Elements, config.IPv6Elements = v4, v6
+	}
+	managed4, managed6 := r.managedLive()
+	if r.opts.PreserveUnmanaged {
+		unmanaged4 := unmanaged(iprange.Subtract(r.live4, managed4), Prefixes(classified.IPv4))
+		unmanaged6 := unmanaged(iprange.Subtract(r.live6, managed6), Prefixes(classified.IPv6))
+		r.res.Preserved = len(unmanaged4) + len(unmanaged6)
+		if r.res.Preserved > 0 {
+			r.log.Printf("Preserving %d unmanaged elements (IPv4: %d, IPv6: %d).", r.res.Preserved, len(unmanaged4), len(unmanaged6))
+		}
+		config.IPv4Elements = append(config.IPv4Elements, unmanaged4...)
+		config.IPv6Elements = append(config.IPv6Elements, unmanaged6...)
+	}
+	var pruned []netip.Prefix
+	if r.opts.Append {
+		kept4, pruned4 := r.retain(r.backup4, Prefixes(classified.IPv4))
+		kept6, pruned6 := r.retain(r.backup6, Prefixes(classified.IPv6))
+		pruned = append(pruned4, pruned6...)
+		r.res.Preserved, r.res.Pruned = len(kept4)+len(kept6), len(pruned)
+		if r.res.Preserved > 0 {
+			r.log.Verbosef("Keeping %d existing elements (IPv4: %d, IPv6: %d).", r.res.Preserved, len(kept4), len(kept6))
+		}
+		if r.res.Pruned > 0 {
+			r.log.Printf("Pruning %d elements not seen for more than %s (IPv4: %d, IPv6: %d).", r.res.Pruned, r.opts.PruneStale, len(pruned4), len(pruned6))
+		}
+		config.IPv4Elements = append(config.IPv4Elements, kept4...)
+		config.IPv6Elements = append(config.IPv6Elements, kept6...)
+	}
+	n4, n6 := len(config.IPv4Elements), len(config.IPv6Elements)
+	config.IPv4Elements, config.IPv6Elements = nft.Coalesce(config.IPv4Elements), nft.Coalesce(config.IPv6Elements)
+	r.log.Verbosef("Coalesced %d elements into %d.", n4+n6, len(config.IPv4Elements)+len(config.IPv6Elements))
+	if r.opts.TrackChanges {
+		desired4, desired6 := iprange.FromPrefixes(Prefixes(classified.IPv4)), iprange.FromPrefixes(Prefixes(classified.IPv6))
+		r.res.Added = append(iprange.ToPrefixes(iprange.Subtract(desired4, r.live4)), iprange.ToPrefixes(iprange.Subtract(desired6, r.live6))...)
+		switch {
+		case r.opts.Append:
+			// 追加模式下只有过期删除的元素会被移除
+			r.res.Removed = pruned
+		case !r.opts.PreserveUnmanaged:
+			r.res.Removed = append(iprange.ToPrefixes(iprange.Subtract(r.live4, desired4)), iprange.ToPrefixes(iprange.Subtract(r.live6, desired6))...)
+		default:
+			// 保留模式下只有带标记或上次由本工具写入的元素会被移除
+			r.res.Removed = append(iprange.ToPrefixes(iprange.Subtract(managed4, desired4)), iprange.ToPrefixes(iprange.Subtract(managed6, desired6))...)
+		}
+		r.log.Verbosef("Changes against current sets: +%d/-%d prefixes.", len(r.res.Added), len(r.res.Removed))
+	}
+	config.Chains = slices.Clone(r.opts.Chains)
+	for i := range config.Chains {
+		ch := &config.Chains[i]
+		exists, err := r.nft.InspectChain(ctx, &config, ch)
+		if err != nil {
+			return "", &RenderError{Err: err}
+		}
+		if !exists {
+			r.log.Verbosef("Chain %s not found, it will be created.", ch.Name)
+			continue
+		}
+		r.log.Verbosef("Chain %s already exists, skipping creation.", ch.Name)
+		if len(ch.DeleteHandles) > 0 {
+			r.log.Verbosef("Managed rules in chain %s changed, replacing %d of them.", ch.Name, len(ch.DeleteHandles))
+		} else if !ch.AddIPv4Rule && !ch.AddIPv6Rule {
+			r.log.Verbosef("Rules referencing the sets already present in chain %s.", ch.Name)
+		}
+	}
+
+	config.SetAttrs = r.opts.SetAttrs
+	if config.SetAttrs.Timeout > 0 {
+		if err := r.checkTimeoutSupport(ctx); err != nil {
+			return "", err
+		}
+	}
+	existing, err := r.checkSetAttrs(ctx, &config)
+	if err != nil {
+		return "", err
+	}
+	r.managedComments(ctx, &config, existing)
+	if config.SetAttrs.Constant {
+		current, err := r.constantSets(ctx, &config, existing, classified)
+		if err != nil || current {
+			return "", err
+		}
+	}
+	if len(config.DeleteSets) > 0 {
+		// 被引用的集合无法删除，先删除链中引用集合的规则，重建集合后再添加引用规则
+		for i := range config.Chains {
+			if ch := &config.Chains[i]; !ch.Create {
+				ch.RebuildRules()
+				r.log.Verbosef("Rebuilding the rules in chain %s so the sets can be replaced.", ch.Name)
+			}
+		}
+	}
+
+	switch r.opts.OnlyFamily {
+	case "ipv4":
+		config, _ = config.SplitFamilies()
+	case "ipv6":
+		_, config = config.SplitFamilies()
+	}
+	r.config = config
+
+	// 4. 生成命令
+	var payload string
+	err = r.res.Phases.Run("render", func() (err error) {
+		if payload, err = nft.Render(config); err != nil {
+			return &RenderError{Err: err}
+		}
+		// 新增的引用规则先用 nft -c 检查，避免因匹配写法不被接受而整个事务失败
+		if slices.ContainsFunc(config.Chains, func(ch nft.ChainConfig) bool { return ch.AddIPv4Rule || ch.AddIPv6Rule }) {
+			if err := r.nft.CheckConfigs(ctx, payload, config); err != nil {
+				return &RenderError{Err: fmt.Errorf("nft -c rejected the generated rules (try -rule-match): %w", err)}
+			}
+		}
+		return nil
+	})
+	return payload, err
+}
+
+// execute 在一个事务中应用 configs，payload 是由它们渲染出的脚本，phase 为记录耗时的阶段名
+func (r *runner) execute(ctx context.Context, phase, payload string, configs ...nft.Config) error {
+	return r.res.Phases.Run(phase, func() error {
+		r.log.Verbosef("Executing main update commands...")
+		if err := r.nft.ApplyConfigs(ctx, payload, configs...); err != nil {
+			var failure *nft.ApplyFailure
+			if errors.As(err, &failure) && len(failure.Statements) > 0 {
+				r.log.Verbosef("Raw nft output:\n%s", failure.Output)
+			}
+			if (r.opts.SetAttrs.Constant || r.opts.RepairSets || r.recreate) && errors.Is(err, syscall.EBUSY) {
+				err = fmt.Errorf("%w (sets can only be replaced when the rules referencing them are in the -chain managed by this tool)", err)
+			}
+			return &ApplyError{Err: err}
+		}
+		return nil
+	})
+}
+
+// constantSets 准备常量集合的替换：常量集合被规则引用后无法 flush 或修改，
+// 已存在的集合在同一事务中删除重建（引用规则的处理见 render）。
+// 集合已是常量且内容与期望一致时返回 true，无需应用
+func (r *runner) constantSets(ctx context.Context, config *nft.Config, existing map[string]*nft.Set, classified *Classified) (bool, error) {
+	v, err := r.nftVersion(ctx)
+	if err != nil {
+		r.warnf("cannot determine nft version, assuming constant sets are supported: %v", err)
+	} else if !v.ConstantSets() {
+		return false, fmt.Errorf("nft %s does not support constant sets (requires 0.9.0 or later)", v)
+	}
+	t := r.opts.Target
+	set4, set6 := existing[t.IPv4SetName], existing[t.IPv6SetName]
+	if set4 != nil && set6 != nil && len(config.Ports) == 0 && !r.opts.PreserveUnmanaged &&
+		config.SetAttrs.Mismatch(set4, config.IPv4SetType()) == "" && config.SetAttrs.Mismatch(set6, config.IPv6SetType()) == "" &&
+		sameRanges(r.live4, iprange.FromPrefixes(Prefixes(classified.IPv4))) && sameRanges(r.live6, iprange.FromPrefixes(Prefixes(classified.IPv6))) {
+		r.res.Skipped = true
+		r.log.Verbosef("Constant sets already hold the desired contents, nothing to apply.")
+		return true, nil
+	}
+	for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+		if existing[name] != nil {
+			config.DeleteSets = append(config.DeleteSets, name)
+		}
+	}
+	return false, nil
+}
+
+// sameRanges 判断两组区间覆盖的地址是否完全相同
+func sameRanges(a, b []iprange.Range) bool {
+	return len(iprange.Subtract(a, b)) == 0 && len(iprange.Subtract(b, a)) == 0
+}
+
+// verify 校验内核中的集合覆盖了全部期望网段
+func (r *runner) verify(ctx context.Context, classified *Classified) error {
+	if !r.opts.Verify {
+		return nil
+	}
+	t := r.opts.Target
+	return r.res.Phases.Run("verify", func() error {
+		for _, s := range []struct {
+			skip    string
+			name    string
+			entries []Entry
+		}{{"ipv6", t.IPv4SetName, classified.IPv4}, {"ipv4", t.IPv6SetName, classified.IPv6}} {
+			if r.opts.OnlyFamily == s.skip {
+				continue
+			}
+			var err error
+			if r.opts.VerdictMap != "" {
+				err = r.verifyMap(ctx, s.name, s.entries, classified.Verdicts)
+			} else {
+				err = verifySet(ctx, r.nft, t.Family, t.TableName, s.name, Prefixes(s.entries), r.opts.Ports)
+			}
+			if err != nil {
+				return &VerifyError{Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+// checkSetAttrs 检查已存在（清理时未能删除）的集合类型和属性是否与配置一致，
+// nft 无法修改已有集合的这些属性，不一致时给出明确的错误而不是让事务失败；
+// RepairSets 时改为把集合加入 config.DeleteSets 在事务中重建。
+// 返回属性一致的已有集合，无法查询时为 nil
+func (r *runner) checkSetAttrs(ctx context.Context, config *nft.Config) (map[string]*nft.Set, error) {
+	t := r.opts.Target
+	existing := make(map[string]*nft.Set)
+	for _, s := range []struct{ name, typ string }{
+		{t.IPv4SetName, config.IPv4SetType()},
+		{t.IPv6SetName, config.IPv6SetType()},
+	} {
+		set, err := r.nft.ListSet(ctx, t.Family, t.TableName, s.name)
+		if errors.Is(err, nft.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			r.log.Verbosef("Set attribute check skipped: %v", err)
+			return nil, nil
+		}
+		// 常量集合每次都在事务中重建，属性不一致也无妨
+		if r.recreate && !config.SetAttrs.Constant {
+			r.log.Verbosef("Recreating set %s in the update transaction.", s.name)
+			config.DeleteSets = append(config.DeleteSets, s.name)
+			continue
+		}
+		if diff := config.SetAttrs.Mismatch(set, s.typ); diff != "" && !config.SetAttrs.Constant {
+			if r.opts.RepairSets {
+				r.log.Printf("Existing set %s has %s, recreating it.", s.name, diff)
+				config.DeleteSets = append(config.DeleteSets, s.name)
+				continue
+			}
+			if r.opts.RecreateSets {
+				return nil, fmt.Errorf("existing set %s has %s; nft cannot change these in place and the set could not be recreated (is it referenced by rules? try -repair-sets)", s.name, diff)
+			}
+			return nil, fmt.Errorf("existing set %s has %s; nft cannot change these in place, rerun with -repair-sets to recreate it", s.name, diff)
+		}
+		existing[s.name] = set
+	}
+	return existing, nil
+}
+
+// managedComments 为将要创建的表和集合加上标识本工具的 comment。
+// 已存在的对象无法修改注释；nft 不支持注释或无法确认时不加
+func (r *runner) managedComments(ctx context.Context, config *nft.Config, existing map[string]*nft.Set) {
+	if existing == nil {
+		return
+	}
+	if v, err := r.nftVersion(ctx); err != nil || !v.Comments() {
+		return
+	}
+	t := r.opts.Target
+	comment := nft.ManagedComment(t.ManagedMarker(), r.opts.Version, time.Now())
+	if existing[t.IPv4SetName] == nil {
+		config.IPv4SetComment = comment
+	}
+	if existing[t.IPv6SetName] == nil {
+		config.IPv6SetComment = comment
+	}
+	if ok, err := r.nft.TableExists(ctx, t.Family, t.TableName); err == nil && !ok {
+		config.TableComment = comment
+	}
+}
+
+// nftVersion 查询并缓存 nft 版本
+func (r *runner) nftVersion(ctx context.Context) (nft.Version, error) {
+	if r.version == nil {
+		v, err := r.nft.Version(ctx)
+		if err != nil {
+			return v, err
+		}
+		r.version = &v
+	}
+	return *r.version, nil
+}
+
+// checkConcatSupport 确认 nft 支持带区间的拼接集合，无法获取版本时只给出警告
+func (r *runner) checkConcatSupport(ctx context.Context) error {
+	v, err := r.nftVersion(ctx)
+	if err != nil {
+		r.warnf("cannot determine nft version, assuming concatenated interval sets are supported: %v", err)
+		return nil
+	}
+	if !v.ConcatIntervals() {
+		return fmt.Errorf("nft %s does not support concatenated interval sets needed for port-scoped sets (requires 0.9.4 or later)", v)
+	}
+	return nil
+}
+
+// checkTimeoutSupport 确认 nft 支持区间集合的元素超时和 gc-interval，无法获取版本时只给出警告
+func (r *runner) checkTimeoutSupport(ctx context.Context) error {
+	v, err := r.nftVersion(ctx)
+	if err != nil {
+		r.warnf("cannot determine nft version, assuming element timeouts are supported: %v", err)
+		return nil
+	}
+	if !v.IntervalTimeouts() {
+		return fmt.Errorf("nft %s does not support element timeouts and gc-interval on interval sets (requires 0.9.4 or later)", v)
+	}
+	return nil
+}
+
+// listRanges 读取集合当前内容，集合不存在时视为空
+func listRanges(ctx context.Context, nftc *nft.Client, family, table, setName string) ([]iprange.Range, error) {
+	set, err := nftc.ListSet(ctx, family, table, setName)
+	if errors.Is(err, nft.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return set.Ranges(), nil
+}
+
+// retain 返回追加模式下要保留的已有元素（去掉已被期望网段覆盖的部分，注释不变），
+// 以及按 PruneStale 删除的网段
+func (r *runner) retain(existing []nft.Element, desired []netip.Prefix) (kept []nft.Element, pruned []netip.Prefix) {
+	want := iprange.FromPrefixes(desired)
+	cutoff := time.Now().Add(-r.opts.PruneStale)
+	for _, e := range existing {
+		rng := e.Range
+		if e.Prefix.IsValid() {
+			rng = iprange.FromPrefix(e.Prefix)
+		}
+		rest := iprange.ToPrefixes(iprange.Subtract([]iprange.Range{rng}, want))
+		if len(rest) == 0 {
+			continue
+		}
+		if seen, ok := MarkerDate(e.Comment); ok && r.opts.PruneStale > 0 && seen.Before(cutoff) {
+			pruned = append(pruned, rest...)
+			continue
+		}
+		for _, p := range rest {
+			kept = append(kept, nft.Element{Prefix: p, Comment: e.Comment})
+		}
+	}
+	return kept, pruned
+}
+
+// listLive 读取集合现有内容，同时返回其中带 MarkerPrefix 标记的元素，
+// 以及用于恢复的完整元素（保留注释）
+func listLive(ctx context.Context, nftc *nft.Client, family, table, setName string, ports []uint16) (live, marked []iprange.Range, backup []nft.Element, err error) {
+	set, err := nftc.ListSet(ctx, family, table, setName)
+	if errors.Is(err, nft.ErrNotFound) {
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	seen := make(map[iprange.Range]bool)
+	for _, e := range set.Elements {
+		// 拼接集合中同一网段按端口出现多次，备份中只保留一次，恢复时重新与端口组合
+		if seen[e.Range] {
+			continue
+		}
+		seen[e.Range] = true
+		if strings.HasPrefix(e.Comment, MarkerPrefix) {
+			marked = append(marked, e.Range)
+		}
+		elem := nft.Element{Range: e.Range, Comment: e.Comment, Verdict: e.Verdict}
+		if ps := e.Range.Prefixes(); len(ps) == 1 {
+			elem = nft.Element{Prefix: ps[0], Comment: e.Comment, Verdict: e.Verdict}
+		}
+		backup = append(backup, elem)
+	}
+	if len(ports) == 0 {
+		return set.Ranges(), marked, backup, nil
+	}
+	// 拼接集合中只有对每个端口都存在的网段才算已放行，端口列表变化时因此能看到网段的变化
+	live = set.PortRanges(ports[0])
+	for _, port := range ports[1:] {
+		live = iprange.Intersect(live, set.PortRanges(port))
+	}
+	return live, marked, backup, nil
+}
+
+// elementComment 返回生成元素注释的函数，不需要注释时为 nil。
+// nft 不支持元素注释时省略并警告一次
+func (r *runner) elementComment(ctx context.Context) func(Entry) string {
+	switch {
+	case r.opts.ElementComments:
+		if v, err := r.nftVersion(ctx); err == nil && !v.ElementComments() {
+			if !r.markerWarned {
+				r.warnf("nft %s does not support element comments, omitting -element-comments markers", v)
+				r.markerWarned = true
+			}
+			return nil
+		}
+		fetchedAt := time.Now()
+		if r.res.Snapshot != nil {
+			fetchedAt = r.res.Snapshot.FetchedAt
+		}
+		return MarkerComment(fetchedAt)
+	case r.opts.Comments:
+		return CategoryComment
+	}
+	return nil
+}
+
+// verifySet 检查集合当前内容覆盖了全部期望网段。ports 非空时（拼接集合）每个端口都要覆盖全部网段
+func verifySet(ctx context.Context, nftc *nft.Client, family, table, setName string, desired []netip.Prefix, ports []uint16) error {
+	if len(ports) == 0 {
+		live, err := listRanges(ctx, nftc, family, table, setName)
+		if err != nil {
+			return err
+		}
+		if missing := iprange.Subtract(iprange.FromPrefixes(desired), live); len(missing) > 0 {
+			return fmt.Errorf("set %s is missing %d ranges, first: %s", setName, len(missing), missing[0].Prefixes()[0])
+		}
+		return nil
+	}
+	set, err := nftc.ListSet(ctx, family, table, setName)
+	if errors.Is(err, nft.ErrNotFound) {
+		set, err = &nft.Set{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	want := iprange.FromPrefixes(desired)
+	for _, port := range ports {
+		if missing := iprange.Subtract(want, set.PortRanges(port)); len(missing) > 0 {
+			return fmt.Errorf("set %s is missing %d ranges for port %d, first: %s", setName, len(missing), port, missing[0].Prefixes()[0])
+		}
+	}
+	return nil
+}
+
+// verifyMap 检查映射中每个期望网段都存在且动作正确
+func (r *runner) verifyMap(ctx context.Context, name string, entries []Entry, verdicts map[string]string) error {
+	t := r.opts.Target
+	desired, err := MapElements(entries, verdicts, r.opts.VerdictMap, nil)
+	if err != nil {
+		return err
+	}
+	set, err := r.nft.ListSet(ctx, t.Family, t.TableName, name)
+	if errors.Is(err, nft.ErrNotFound) {
+		set, err = &nft.Set{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	live := listedVerdictRanges(set)
+	for v, want := range verdictRanges(desired) {
+		if missing := iprange.Subtract(want, live[v]); len(missing) > 0 {
+			return fmt.Errorf("map %s is missing %d ranges with verdict %s, first: %s", name, len(missing), v, missing[0].Prefixes()[0])
+		}
+	}
+	return nil
+}
+
+// managedLive 返回集合原有内容中由本工具写入的部分：带 MarkerPrefix 标记的元素，
+// 以及最近一次应用的网段（不含当时被 ExcludeFile 排除的部分）。
+// 没有标记时只能靠后者区分，否则 GitHub 不再列出的网段会被当作手工添加的元素一直保留
+func (r *runner) managedLive() (v4, v6 []iprange.Range) {
+	v4, v6 = r.marked4, r.marked6
+	if r.opts.Previous == nil || len(r.opts.Previous.Categories) == 0 {
+		return v4, v6
+	}
+	previous := Classify(r.opts.Previous.Categories)
+	previous.Exclude(r.exclude)
+	v4 = iprange.Merge(append(slices.Clone(v4), iprange.Intersect(r.live4, iprange.FromPrefixes(Prefixes(previous.IPv4)))...))
+	v6 = iprange.Merge(append(slices.Clone(v6), iprange.Intersect(r.live6, iprange.FromPrefixes(Prefixes(previous.IPv6)))...))
+	return v4, v6
+}
+
+// unmanaged 返回现有内容中不被期望网段覆盖的部分。
+// 集合开启了 auto-merge，内核中的元素可能是多个网段合并后的区间，因此按区间相减而不是逐个比较。
+func unmanaged(live []iprange.Range, desired []netip.Prefix) []nft.Element {
+	var elems []nft.Element
+	for _, p := range iprange.ToPrefixes(iprange.Subtract(live, iprange.FromPrefixes(desired))) {
+		elems = append(elems, nft.Element{Prefix: p})
+	}
+	return elems
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{})   {}
+func (nopLogger) Verbosef(string, ...interface{}) {}
+func (nopLogger) Warnf(string, ...interface{})    {}
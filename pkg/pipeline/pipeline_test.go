@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/nft"
+)
+
+// fakeNft 模拟 nft 命令行：sets 是 "family table name" 到 nft -j list set 输出的映射，
+// applyErrs 依次作为 nft -f - 的结果（用完后返回成功）
+type fakeNft struct {
+	version   string
+	sets      map[string]string
+	listSets  string
+	applyErrs []string
+}
+
+func (f *fakeNft) respond(args []string, stdin string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	switch {
+	case cmd == "--version":
+		return []byte(f.version), nil
+	case cmd == "-j list sets":
+		if f.listSets == "" {
+			return []byte(`{"nftables": []}`), nil
+		}
+		return []byte(f.listSets), nil
+	case strings.HasPrefix(cmd, "-j list set "), strings.HasPrefix(cmd, "-j list map "):
+		if out, ok := f.sets[strings.Join(args[3:], " ")]; ok && args[2] == "set" {
+			return []byte(out), nil
+		}
+		return []byte("Error: No such file or directory\n"), errors.New("exit status 1")
+	case strings.HasPrefix(cmd, "-t list table "), strings.HasPrefix(cmd, "-j list chain "):
+		return []byte("Error: No such file or directory\n"), errors.New("exit status 1")
+	case cmd == "-f -":
+		if len(f.applyErrs) > 0 {
+			msg := f.applyErrs[0]
+			f.applyErrs = f.applyErrs[1:]
+			if msg != "" {
+				return []byte(msg), errors.New("exit status 1")
+			}
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+func setJSON(family, table, name, typ string, elems ...string) string {
+	return fmt.Sprintf(`{"nftables": [{"metainfo": {"json_schema_version": 1}}, {"set": {"family": %q, "name": %q, "table": %q, "type": %q, "handle": 2, "flags": ["interval"], "elem": [%s]}}]}`,
+		family, name, table, typ, strings.Join(elems, ", "))
+}
+
+func testTarget() nft.Target {
+	return nft.Target{Family: "inet", TableName: "filter", IPv4SetName: "github_v4", IPv6SetName: "github_v6"}
+}
+
+func testClassified() *Classified {
+	return Classify(map[string][]netip.Prefix{
+		"hooks": {netip.MustParsePrefix("192.30.252.0/22"), netip.MustParsePrefix("2606:50c0::/32")},
+	})
+}
+
+func TestApplyRecordedCalls(t *testing.T) {
+	existing := map[string]string{
+		"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv4_addr", `{"prefix": {"addr": "10.0.0.0", "len": 8}}`),
+		"inet filter github_v6": setJSON("inet", "filter", "github_v6", "ipv6_addr"),
+	}
+	busy := "/dev/stdin:2:1-31: Error: Could not process rule: Device or resource busy\ndelete set inet filter github_v4\n^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^\n"
+	fresh := `# BEGIN managed by github-updater
+add table inet filter
+
+# 1. 定义集合 (如果已存在且属性一致则忽略，如果不一致且被占用则会报错)
+add set inet filter github_v4 { type ipv4_addr; flags interval; auto-merge; }
+add set inet filter github_v6 { type ipv6_addr; flags interval; auto-merge; }
+
+# 2. 清空集合内容 (确保只有最新的 IP)
+flush set inet filter github_v4
+flush set inet filter github_v6
+
+# 3. 插入新数据
+add element inet filter github_v4 { 192.30.252.0/22 }
+add element inet filter github_v6 { 2606:50c0::/32 }
+# END managed by github-updater`
+	tests := []struct {
+		name    string
+		fake    fakeNft
+		opts    Options
+		calls   []string
+		stdin   []string // 依次与每次 nft -f - 的输入比较，以 "~" 开头时只要求包含其余部分，以 "!" 开头时要求不包含
+		applied bool
+		err     string
+	}{
+		{
+			name: "new sets",
+			calls: []string{
+				"nft -j list sets",
+				"nft -j list set inet filter github_v4", "nft -j list map inet filter github_v4",
+				"nft -j list set inet filter github_v6", "nft -j list map inet filter github_v6",
+				"nft --version",
+				"nft -f -",
+			},
+			stdin:   []string{fresh},
+			applied: true,
+		},
+		{
+			name: "leftover set deleted before apply",
+			fake: fakeNft{listSets: `{"nftables": [{"set": {"family": "ip", "table": "filter", "name": "github_v4"}}]}`},
+			opts: Options{CleanFamilyMismatch: true},
+			calls: []string{
+				"nft -j list sets",
+				"nft delete set ip filter github_v4",
+				"nft -j list set inet filter github_v4", "nft -j list map inet filter github_v4",
+				"nft -j list set inet filter github_v6", "nft -j list map inet filter github_v6",
+				"nft --version",
+				"nft -f -",
+			},
+			stdin:   []string{fresh},
+			applied: true,
+		},
+		{
+			name: "busy sets recreated without delete",
+			fake: fakeNft{sets: existing, applyErrs: []string{busy}},
+			opts: Options{RecreateSets: true},
+			calls: []string{
+				"nft -j list sets",
+				"nft -j list set inet filter github_v4",
+				"nft -j list set inet filter github_v6",
+				"nft --version",
+				"nft -f -",
+				"nft -j list set inet filter github_v4",
+				"nft -j list set inet filter github_v6",
+				"nft -f -",
+			},
+			stdin:   []string{"~delete set inet filter github_v4\ndelete set inet filter github_v6\n", "!delete set"},
+			applied: true,
+		},
+		{
+			name: "busy sets still busy",
+			fake: fakeNft{sets: existing, applyErrs: []string{busy, busy}},
+			opts: Options{RecreateSets: true},
+			calls: []string{
+				"nft -j list sets",
+				"nft -j list set inet filter github_v4",
+				"nft -j list set inet filter github_v6",
+				"nft --version",
+				"nft -f -",
+				"nft -j list set inet filter github_v4",
+				"nft -j list set inet filter github_v6",
+				"nft -f -",
+			},
+			stdin: []string{"~delete set", "!delete set"},
+			err:   "Device or resource busy",
+		},
+		{
+			name: "busy repair not retried",
+			fake: fakeNft{sets: map[string]string{
+				"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv6_addr"),
+				"inet filter github_v6": existing["inet filter github_v6"],
+			}, applyErrs: []string{busy}},
+			opts: Options{RepairSets: true},
+			calls: []string{
+				"nft -j list sets",
+				"nft -j list set inet filter github_v4",
+				"nft -j list set inet filter github_v6",
+				"nft --version",
+				"nft -f -",
+			},
+			stdin: []string{"~delete set inet filter github_v4\n"},
+			err:   "(sets can only be replaced when the rules referencing them are in the -chain managed by this tool)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.fake
+			f.version = "nftables v0.9.6 (Capital Idea #2)"
+			rec := &nft.Recorder{Respond: f.respond}
+			opts := tt.opts
+			opts.Nft = &nft.Client{Executor: rec}
+			opts.Target = testTarget()
+			res, err := ApplyClassified(context.Background(), opts, testClassified())
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" {
+				var applyErr *ApplyError
+				if err == nil || !strings.Contains(err.Error(), tt.err) || !errors.As(err, &applyErr) {
+					t.Fatalf("error = %v, want *ApplyError containing %q", err, tt.err)
+				}
+			}
+			if res.Applied != tt.applied {
+				t.Errorf("Applied = %v, want %v", res.Applied, tt.applied)
+			}
+			var (
+				calls  []string
+				stdins []string
+			)
+			for _, c := range rec.Calls() {
+				calls = append(calls, c.String())
+				if c.Stdin != "" {
+					stdins = append(stdins, c.Stdin)
+				}
+			}
+			if !slices.Equal(calls, tt.calls) {
+				t.Errorf("calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(tt.calls, "\n"))
+			}
+			if len(stdins) != len(tt.stdin) {
+				t.Fatalf("%d calls with stdin, want %d", len(stdins), len(tt.stdin))
+			}
+			for i, want := range tt.stdin {
+				got := stdins[i]
+				switch {
+				case strings.HasPrefix(want, "~"):
+					if !strings.Contains(got, want[1:]) {
+						t.Errorf("stdin %d does not contain %q:\n%s", i, want[1:], got)
+					}
+				case strings.HasPrefix(want, "!"):
+					if strings.Contains(got, want[1:]) {
+						t.Errorf("stdin %d contains %q:\n%s", i, want[1:], got)
+					}
+				case got != want:
+					t.Errorf("stdin %d:\n%q\nwant:\n%q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreserveUnmanagedDropsRetired(t *testing.T) {
+	live := map[string]string{
+		"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv4_addr",
+			`{"prefix": {"addr": "10.0.0.0", "len": 8}}`, `{"prefix": {"addr": "192.30.252.0", "len": 22}}`, `{"prefix": {"addr": "198.51.100.0", "len": 24}}`),
+		"inet filter github_v6": setJSON("inet", "filter", "github_v6", "ipv6_addr"),
+	}
+	tests := []struct {
+		name     string
+		previous *Snapshot
+		want     string
+		removed  []netip.Prefix
+	}{
+		// 没有上次应用的记录时无法区分，198.51.100.0/24 与手工添加的 10.0.0.0/8 一样保留
+		{"no previous", nil, "{ 10.0.0.0/8, 192.30.252.0/22, 198.51.100.0/24 }", nil},
+		{
+			"retired by GitHub",
+			&Snapshot{Categories: map[string][]netip.Prefix{"hooks": prefixes("192.30.252.0/22", "198.51.100.0/24", "2606:50c0::/32")}},
+			"{ 10.0.0.0/8, 192.30.252.0/22 }",
+			prefixes("198.51.100.0/24"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeNft{version: "nftables v0.9.6", sets: live}
+			rec := &nft.Recorder{Respond: f.respond}
+			opts := Options{Nft: &nft.Client{Executor: rec}, Target: testTarget(), PreserveUnmanaged: true, TrackChanges: true, Previous: tt.previous}
+			res, err := ApplyClassified(context.Background(), opts, testClassified())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stdin string
+			for _, c := range rec.Calls() {
+				if c.String() == "nft -f -" {
+					stdin = c.Stdin
+				}
+			}
+			if want := "add element inet filter github_v4 " + tt.want; !strings.Contains(stdin, want) {
+				t.Errorf("script does not contain %q:\n%s", want, stdin)
+			}
+			if !slices.Equal(res.Removed, tt.removed) {
+				t.Errorf("removed = %v, want %v", res.Removed, tt.removed)
+			}
+		})
+	}
+}
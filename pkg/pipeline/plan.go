@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github-updater/pkg/nft"
+)
+
+// Plan 是已经获取、尚未应用的更新。多个 Plan 可以合并到一个事务中应用
+type Plan struct {
+	Result *Result
+
+	r          *runner
+	classified *Classified
+}
+
+// Prepare 只获取并分类网段，不接触 nftables。获取失败不会留下任何修改（FlushOnFetchFailure 时除外），
+// 因此可以先为所有目标准备好数据，再决定是否应用
+func Prepare(ctx context.Context, opts Options) (*Plan, error) {
+	r := newRunner(opts)
+	defer r.done()
+	classified, err := r.fetch(ctx)
+	if r.keep(err) {
+		err = nil
+	}
+	if err != nil {
+		err = r.flushOnFailure(ctx, err)
+	}
+	plan := &Plan{Result: r.res, r: r, classified: classified}
+	return plan, err
+}
+
+// ApplyPlans 依次为每个 Plan 清理旧集合并渲染脚本，再通过第一个 Plan 的 nft 客户端
+// 把全部脚本合并为一个 nft -f 事务（全部成功或全部不生效），最后逐个校验。
+// 渲染失败的 Plan 不参与事务。返回与 plans 一一对应的错误；confirm 拒绝时不应用且没有错误
+func ApplyPlans(ctx context.Context, confirm ConfirmFunc, plans []*Plan) []error {
+	errs := make([]error, len(plans))
+	defer func() {
+		for _, p := range plans {
+			p.r.done()
+		}
+	}()
+
+	var (
+		payloads []string
+		configs  []nft.Config
+		included []int
+	)
+	for i, p := range plans {
+		if p.r.res.Kept || p.r.skip(p.classified) {
+			continue
+		}
+		if errs[i] = p.r.prepare(ctx); errs[i] != nil {
+			continue
+		}
+		payload, err := p.r.render(ctx, p.classified)
+		if errs[i] = err; err != nil || payload == "" {
+			continue
+		}
+		payloads = append(payloads, payload)
+		configs = append(configs, p.r.config)
+		included = append(included, i)
+	}
+	if len(included) == 0 {
+		return errs
+	}
+
+	payload := strings.Join(payloads, "\n\n")
+	if confirm != nil {
+		ok, err := confirm(fmt.Sprintf("Apply changes for %d profiles in one transaction?", len(included)), payload)
+		if err != nil || !ok {
+			for _, i := range included {
+				errs[i] = err
+			}
+			return errs
+		}
+	}
+
+	// 整个事务只执行一次，耗时记到第一个参与的 Plan 上
+	err := plans[included[0]].r.execute(ctx, "apply", payload, configs...)
+	for _, i := range included {
+		p := plans[i]
+		errs[i] = err
+		if err == nil {
+			p.Result.Applied = true
+			if errs[i] = p.r.verify(ctx, p.classified); errs[i] == nil {
+				errs[i] = p.r.postCheck(ctx)
+			}
+			if errs[i] == nil {
+				p.r.shadow(ctx)
+			}
+		}
+	}
+	return errs
+}
+
+// Render 获取网段并生成脚本而不应用，也不清理旧集合。opts.Nft 只用于查询，
+// 为其他主机生成脚本时应使用 nft.OfflineExecutor
+func Render(ctx context.Context, opts Options) (string, *Result, error) {
+	r := newRunner(opts)
+	defer r.done()
+	classified, err := r.fetch(ctx)
+	if err != nil {
+		return "", r.res, err
+	}
+	// 保留或追加已有元素时脚本要包含它们，与实际应用时相同
+	if err := r.snapshot(ctx); err != nil {
+		return "", r.res, err
+	}
+	r.recreate = r.opts.RecreateSets
+	payload, err := r.render(ctx, classified)
+	return payload, r.res, err
+}
+
+// RulesetPlan 是 PlanRuleset 的结果
+type RulesetPlan struct {
+	Payload string // 将要执行的脚本
+	Check   error  // 在主机上 nft -c 检查脚本的错误
+	Before  []byte // 临时命名空间中执行前 nft -j list table 的输出，表不存在时为空
+	After   []byte // 执行后的输出
+	Result  *Result
+}
+
+// PlanRuleset 获取网段并生成脚本，先在主机上用 nft -c 检查，再把表的现有内容复制到临时的
+// 网络命名空间中执行脚本，得到执行前后整个表的内容。不修改主机上的规则集，
+// 只需要 nft list 的权限（以及创建命名空间的权限）
+func PlanRuleset(ctx context.Context, opts Options) (*RulesetPlan, error) {
+	r := newRunner(opts)
+	defer r.done()
+	plan := &RulesetPlan{Result: r.res}
+	path, ok := localNftPath(r.nft)
+	if !ok {
+		return plan, fmt.Errorf("planning needs a local nft, not %s", r.nft.Backend())
+	}
+	classified, err := r.fetch(ctx)
+	if r.keep(err) {
+		return plan, nil
+	}
+	if err != nil {
+		return plan, err
+	}
+	if err := r.snapshot(ctx); err != nil {
+		return plan, err
+	}
+	r.recreate = r.opts.RecreateSets // 计划只做模拟，不询问
+	payload, err := r.render(ctx, classified)
+	if err != nil || payload == "" {
+		return plan, err
+	}
+
+	t := r.opts.Target
+	current, err := r.nft.ListTable(ctx, t.Family, t.TableName)
+	if err != nil {
+		return plan, err
+	}
+	plan.Payload = payload
+
+	plan.Check = r.res.Phases.Run("check", func() error { return r.nft.Check(ctx, payload) })
+	if plan.Check != nil {
+		return plan, &RenderError{Err: fmt.Errorf("nft -c rejected the script: %w", plan.Check)}
+	}
+	err = r.res.Phases.Run("simulate", func() (err error) {
+		plan.Before, plan.After, err = nft.Simulate(ctx, path, t.Family, t.TableName, current, payload)
+		return err
+	})
+	return plan, err
+}
+
+// localNftPath 返回本机执行 nft 时的路径，客户端不在本机执行时返回 false
+func localNftPath(c *nft.Client) (string, bool) {
+	switch e := c.Executor.(type) {
+	case nil:
+		return "", true
+	case nft.ExecExecutor:
+		return e.Path, true
+	}
+	return "", false
+}
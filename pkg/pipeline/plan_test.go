@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/nft"
+)
+
+func TestRenderIncludesLiveElements(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	if err := os.WriteFile(path, []byte("192.30.252.0/22\n2606:50c0::/32\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts Options
+		want bool
+	}{
+		{"default", Options{}, false},
+		{"preserve unmanaged", Options{PreserveUnmanaged: true}, true},
+		{"append", Options{Append: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeNft{version: "nftables v0.9.6", sets: map[string]string{
+				"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv4_addr", `{"prefix": {"addr": "10.0.0.0", "len": 8}}`),
+				"inet filter github_v6": setJSON("inet", "filter", "github_v6", "ipv6_addr"),
+			}}
+			rec := &nft.Recorder{Respond: f.respond}
+			opts := tt.opts
+			opts.Sources = []Source{{Name: "hooks", File: path}}
+			opts.Nft = &nft.Client{Executor: rec}
+			opts.Target = testTarget()
+			payload, _, err := Render(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// -dry-run 的输出与实际应用的脚本一致，保留的元素也要出现
+			if got := strings.Contains(payload, "add element inet filter github_v4 { 10.0.0.0/8, 192.30.252.0/22 }"); got != tt.want {
+				t.Errorf("existing element in script = %v, want %v:\n%s", got, tt.want, payload)
+			}
+			for _, c := range rec.Calls() {
+				if c.String() == "nft -f -" {
+					t.Errorf("Render applied the script")
+				}
+			}
+		})
+	}
+}
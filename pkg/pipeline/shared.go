@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github-updater/pkg/fetch"
+)
+
+// SharedFetch 让多次更新共用一次 meta 获取，例如 -profile all 时数据来源相同的各 profile。
+// 第一次更新按 Categories（各次更新需要的全部分类）获取，结果和错误都保存下来，
+// 之后的更新不再请求，各自从中取出自己 Client.Categories 中的分类
+type SharedFetch struct {
+	Categories []string
+
+	once sync.Once
+	res  *fetch.Result
+	err  error
+}
+
+// Add 把 names 加入需要获取的分类，names 为空时加入 fetch.DefaultCategories
+func (s *SharedFetch) Add(names ...string) {
+	if len(names) == 0 {
+		names = fetch.DefaultCategories
+	}
+	for _, name := range names {
+		if !slices.Contains(s.Categories, name) {
+			s.Categories = append(s.Categories, name)
+		}
+	}
+}
+
+func (s *SharedFetch) fetch(ctx context.Context, r *runner, client *fetch.Client) (*fetch.Result, error) {
+	s.once.Do(func() {
+		all := *client
+		all.Categories = s.Categories
+		s.res, s.err = r.fetchFresh(ctx, &all)
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.res.Select(client.Categories), nil
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github-updater/pkg/fetch"
+)
+
+func TestSharedFetch(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"hooks": ["192.30.252.0/22"], "web": ["140.82.112.0/20"], "api": ["2606:50c0::/32"]}`))
+	}))
+	defer srv.Close()
+
+	shared := &SharedFetch{}
+	profiles := [][]string{{"hooks"}, {"web", "api", "pages"}}
+	for _, categories := range profiles {
+		shared.Add(categories...)
+	}
+	want := []struct {
+		categories []string
+		v4, v6     int
+	}{
+		{[]string{"hooks"}, 1, 0},
+		{[]string{"api", "web"}, 1, 1},
+	}
+	for i, categories := range profiles {
+		opts := Options{Client: &fetch.Client{URL: srv.URL, Categories: categories}, Shared: shared}
+		classified, res, err := Fetch(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Categories, want[i].categories) || len(classified.IPv4) != want[i].v4 || len(classified.IPv6) != want[i].v6 {
+			t.Errorf("profile %v: categories %v, %d IPv4 and %d IPv6 prefixes, want %+v", categories, res.Categories, len(classified.IPv4), len(classified.IPv6), want[i])
+		}
+	}
+	if requests != 1 {
+		t.Errorf("%d requests, want 1", requests)
+	}
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+)
+
+// Snapshot 是一次成功获取的数据，保存下来后可以在没有网络时重新应用
+type Snapshot struct {
+	Source     string                    `json:"source"`
+	FetchedAt  time.Time                 `json:"fetched_at"`
+	Categories map[string][]netip.Prefix `json:"categories"`
+	Verdicts   map[string]string         `json:"verdicts,omitempty"` // 来源为分类指定的映射动作，见 Source.Verdict
+
+	// 由 TakeSnapshot 从内核读取时，Target 为 family/table，Sets 为各集合的实际内容
+	Target string                    `json:"target,omitempty"`
+	Sets   map[string][]netip.Prefix `json:"sets,omitempty"`
+}
+
+// Age 返回快照距 now 的时间
+func (s *Snapshot) Age(now time.Time) time.Duration { return now.Sub(s.FetchedAt) }
+
+// ApplySnapshot 用快照代替网络获取，其余步骤（清理、安全检查、确认、应用、校验）与 Run 相同
+func ApplySnapshot(ctx context.Context, opts Options, snap *Snapshot) (*Result, error) {
+	r := newRunner(opts)
+	defer r.done()
+	r.res.Source = fmt.Sprintf("cache of %s, fetched %s", snap.Source, snap.FetchedAt.Format(time.RFC3339))
+	if err := r.prepare(ctx); err != nil {
+		return r.res, err
+	}
+	r.verdicts = snap.Verdicts
+	classified, err := r.classify(snap.Categories, nil)
+	if err != nil {
+		return r.res, err
+	}
+	return r.res, r.apply(ctx, classified)
+}
+
+// TakeSnapshot 读取 t 中两个集合的实际内容，集合不存在时报错
+func TakeSnapshot(ctx context.Context, nftc *nft.Client, t nft.Target) (*Snapshot, error) {
+	snap := &Snapshot{
+		Source:    "live sets",
+		FetchedAt: time.Now().UTC(),
+		Target:    t.Family + "/" + t.TableName,
+		Sets:      make(map[string][]netip.Prefix),
+	}
+	for _, name := range []string{t.IPv4SetName, t.IPv6SetName} {
+		if name == "" {
+			continue
+		}
+		set, err := nftc.ListSet(ctx, t.Family, t.TableName, name)
+		if err != nil {
+			return nil, err
+		}
+		snap.Sets[name] = append([]netip.Prefix{}, iprange.ToPrefixes(set.Ranges())...)
+	}
+	return snap, nil
+}
+
+// RestoreSnapshot 在一个事务中把 t 中的集合恢复为快照的内容，与上游数据无关
+func RestoreSnapshot(ctx context.Context, nftc *nft.Client, t nft.Target, snap *Snapshot) error {
+	sets, err := snap.SetElements(t)
+	if err != nil {
+		return err
+	}
+	return nftc.ReplaceSets(ctx, t.Family, t.TableName, sets...)
+}
+
+// SetElements 检查快照能否恢复到 t 并返回各集合的元素：表和集合名必须与 t 一致，
+// 网段的地址族必须与集合一致。全部问题一起返回
+func (snap *Snapshot) SetElements(t nft.Target) ([]nft.SetElements, error) {
+	if snap.Sets == nil {
+		return nil, errors.New("snapshot has no set contents (state-dir snapshots hold fetched data; use reapply for those)")
+	}
+	if want := t.Family + "/" + t.TableName; snap.Target != want {
+		return nil, fmt.Errorf("snapshot is for %s, the configured table is %s", snap.Target, want)
+	}
+	var (
+		errs []error
+		sets []nft.SetElements
+	)
+	for name := range snap.Sets {
+		if name == "" || (name != t.IPv4SetName && name != t.IPv6SetName) {
+			errs = append(errs, fmt.Errorf("snapshot contains set %q which is not configured", name))
+		}
+	}
+	for _, s := range []struct {
+		name string
+		v4   bool
+	}{{t.IPv4SetName, true}, {t.IPv6SetName, false}} {
+		if s.name == "" {
+			continue
+		}
+		prefixes, ok := snap.Sets[s.name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("snapshot has no contents for set %s", s.name))
+			continue
+		}
+		elems := make([]nft.Element, 0, len(prefixes))
+		for _, p := range prefixes {
+			if p.Addr().Is4() != s.v4 {
+				errs = append(errs, fmt.Errorf("set %s: %s has the wrong address family", s.name, p))
+				continue
+			}
+			elems = append(elems, nft.Element{Prefix: p.Masked()})
+		}
+		sets = append(sets, nft.SetElements{Name: s.name, Elements: elems})
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return sets, nil
+}
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github-updater/pkg/nft"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	f := &fakeNft{sets: map[string]string{
+		"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv4_addr",
+			`{"prefix": {"addr": "192.30.252.0", "len": 22}}`, `{"range": ["198.51.100.0", "198.51.100.255"]}`, `"203.0.113.7"`),
+		"inet filter github_v6": setJSON("inet", "filter", "github_v6", "ipv6_addr", `{"prefix": {"addr": "2606:50c0::", "len": 32}}`),
+	}}
+	rec := &nft.Recorder{Respond: f.respond}
+	client := &nft.Client{Executor: rec}
+	target := testTarget()
+
+	snap, err := TakeSnapshot(context.Background(), client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]netip.Prefix{
+		"github_v4": prefixes("192.30.252.0/22", "198.51.100.0/24", "203.0.113.7/32"),
+		"github_v6": prefixes("2606:50c0::/32"),
+	}
+	if snap.Target != "inet/filter" || !reflect.DeepEqual(snap.Sets, want) {
+		t.Fatalf("snapshot = %s %v, want inet/filter %v", snap.Target, snap.Sets, want)
+	}
+
+	// 经过 JSON 文件保存再读回
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Snapshot
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := &nft.Recorder{}
+	if err := RestoreSnapshot(context.Background(), &nft.Client{Executor: restore}, target, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	calls := restore.Calls()
+	if len(calls) != 1 || calls[0].String() != "nft -f -" {
+		t.Fatalf("calls = %v, want a single nft -f -", calls)
+	}
+	wantStdin := `flush set inet filter github_v4
+add element inet filter github_v4 { 192.30.252.0/22, 198.51.100.0/24, 203.0.113.7/32 }
+flush set inet filter github_v6
+add element inet filter github_v6 { 2606:50c0::/32 }
+`
+	if calls[0].Stdin != wantStdin {
+		t.Errorf("stdin:\n%s\nwant:\n%s", calls[0].Stdin, wantStdin)
+	}
+}
+
+func TestRestoreEmptySet(t *testing.T) {
+	snap := &Snapshot{Target: "inet/filter", Sets: map[string][]netip.Prefix{"github_v4": {}, "github_v6": prefixes("2001:db8::/32")}}
+	rec := &nft.Recorder{}
+	if err := RestoreSnapshot(context.Background(), &nft.Client{Executor: rec}, testTarget(), snap); err != nil {
+		t.Fatal(err)
+	}
+	// 空集合只清空，不写 add element
+	want := "flush set inet filter github_v4\nflush set inet filter github_v6\nadd element inet filter github_v6 { 2001:db8::/32 }\n"
+	if calls := rec.Calls(); len(calls) != 1 || calls[0].Stdin != want {
+		t.Errorf("calls = %q, want stdin %q", calls, want)
+	}
+}
+
+func TestTakeSnapshotMissingSet(t *testing.T) {
+	f := &fakeNft{sets: map[string]string{"inet filter github_v4": setJSON("inet", "filter", "github_v4", "ipv4_addr")}}
+	_, err := TakeSnapshot(context.Background(), &nft.Client{Executor: &nft.Recorder{Respond: f.respond}}, testTarget())
+	if !errors.Is(err, nft.ErrNotFound) {
+		t.Errorf("error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRestoreRejectsMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		snap Snapshot
+		want []string
+	}{
+		{
+			name: "fetched data",
+			snap: Snapshot{Categories: map[string][]netip.Prefix{"hooks": prefixes("192.0.2.0/24")}},
+			want: []string{"use reapply"},
+		},
+		{
+			name: "other table",
+			snap: Snapshot{Target: "ip/filter", Sets: map[string][]netip.Prefix{}},
+			want: []string{"snapshot is for ip/filter, the configured table is inet/filter"},
+		},
+		{
+			name: "all problems reported",
+			snap: Snapshot{Target: "inet/filter", Sets: map[string][]netip.Prefix{
+				"github_v4": prefixes("192.0.2.0/24", "2001:db8::/32"),
+				"old_v4":    prefixes("198.51.100.0/24"),
+			}},
+			want: []string{
+				`snapshot contains set "old_v4" which is not configured`,
+				"set github_v4: 2001:db8::/32 has the wrong address family",
+				"snapshot has no contents for set github_v6",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &nft.Recorder{}
+			err := RestoreSnapshot(context.Background(), &nft.Client{Executor: rec}, testTarget(), &tt.snap)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("error %q does not mention %q", err, w)
+				}
+			}
+			if calls := rec.Calls(); len(calls) != 0 {
+				t.Errorf("nft called despite the error: %v", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Summary 是一次运行的摘要，可直接编码为 JSON
+type Summary struct {
+	Source     string          `json:"source"`
+	Categories []string        `json:"categories"`
+	IPv4       int             `json:"ipv4"`
+	IPv6       int             `json:"ipv6"`
+	Applied    bool            `json:"applied"`
+	Skipped    bool            `json:"skipped,omitempty"`
+	Kept       bool            `json:"kept,omitempty"`
+	Flushed    bool            `json:"flushed,omitempty"` // 获取失败后按策略清空了集合
+	Changed    *bool           `json:"changed"`           // 未跟踪变化时为 null
+	Added      int             `json:"added"`
+	Removed    int             `json:"removed"`
+	Preserved  int             `json:"preserved,omitempty"`
+	Pruned     int             `json:"pruned,omitempty"`
+	Excluded   int             `json:"excluded,omitempty"`       // 与排除文件重叠的网段数
+	Split      int             `json:"split_prefixes,omitempty"` // 部分排除的网段拆分产生的网段数
+	Hash       string          `json:"hash,omitempty"`
+	Bytes      int64           `json:"bytes_received"` // 本次从网络读取的响应体字节数
+	Families   []FamilySummary `json:"families,omitempty"`
+	Exports    []ExportSummary `json:"exports,omitempty"`
+	Backends   []string        `json:"backends"`
+	DurationMS int64           `json:"duration_ms"`
+	Phases     []PhaseSummary  `json:"phases"`
+	Warnings   []string        `json:"warnings"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// FamilySummary 是分地址族应用时单个事务的结果
+type FamilySummary struct {
+	Family  string `json:"family"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ExportSummary 是单个导出的结果
+type ExportSummary struct {
+	Name       string `json:"name"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PhaseSummary 是单个阶段的耗时
+type PhaseSummary struct {
+	Name       string `json:"name"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Summary 生成摘要，trackChanges 表示 Added/Removed 是否有意义，err 为本次运行的错误。
+// 设置了 Options.PreviousHash 时即使不跟踪变化也给出 Changed
+func (r *Result) Summary(trackChanges bool, err error) Summary {
+	s := Summary{
+		Source:     r.Source,
+		Categories: r.Categories,
+		IPv4:       r.IPv4Count,
+		IPv6:       r.IPv6Count,
+		Applied:    r.Applied,
+		Skipped:    r.Skipped,
+		Kept:       r.Kept,
+		Flushed:    r.Flushed,
+		Added:      len(r.Added),
+		Removed:    len(r.Removed),
+		Preserved:  r.Preserved,
+		Pruned:     r.Pruned,
+		Excluded:   r.Excluded,
+		Split:      r.Split,
+		Hash:       r.Hash,
+		Bytes:      r.FetchedBytes,
+		Backends:   []string{r.Backend},
+		DurationMS: r.Duration.Milliseconds(),
+		Warnings:   r.Warnings,
+	}
+	if trackChanges || r.prevHash != "" {
+		changed := r.Changed()
+		s.Changed = &changed
+	}
+	for _, f := range r.Families {
+		fs := FamilySummary{Family: f.Family, Applied: f.Applied}
+		if f.Err != nil {
+			fs.Error = f.Err.Error()
+		}
+		s.Families = append(s.Families, fs)
+	}
+	for _, e := range r.Exports {
+		es := ExportSummary{Name: e.Name, DurationMS: e.Duration.Milliseconds()}
+		if e.Err != nil {
+			es.Error = e.Err.Error()
+		}
+		s.Exports = append(s.Exports, es)
+	}
+	for _, t := range r.Phases.Timings {
+		s.Phases = append(s.Phases, PhaseSummary{Name: t.Name, DurationMS: t.Duration.Milliseconds()})
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// Text 返回多行的可读摘要
+func (s Summary) Text() string {
+	changed := "unknown"
+	if s.Changed != nil {
+		changed = "no"
+		if *s.Changed {
+			changed = "yes"
+			if s.Added > 0 || s.Removed > 0 {
+				changed = fmt.Sprintf("yes (+%d/-%d)", s.Added, s.Removed)
+			}
+		}
+	}
+	outcome := "applied"
+	switch {
+	case s.Flushed:
+		outcome = "flushed sets after fetch failure: " + s.Error
+	case s.Error != "":
+		outcome = "failed: " + s.Error
+	case s.Skipped:
+		outcome = "skipped (unchanged)"
+	case s.Kept:
+		outcome = "kept current sets (no valid ranges)"
+	case !s.Applied:
+		outcome = "not applied"
+	}
+	warnings := "none"
+	if len(s.Warnings) > 0 {
+		warnings = strings.Join(s.Warnings, "; ")
+	}
+	lines := []string{
+		"Run summary:",
+		"  source:     " + s.Source,
+		"  categories: " + strings.Join(s.Categories, ", "),
+		fmt.Sprintf("  ranges:     IPv4 %d, IPv6 %d", s.IPv4, s.IPv6),
+		"  outcome:    " + outcome,
+		"  changed:    " + changed,
+	}
+	if len(s.Families) > 0 {
+		var parts []string
+		for _, f := range s.Families {
+			if f.Applied {
+				parts = append(parts, f.Family+" applied")
+			} else {
+				parts = append(parts, f.Family+" failed")
+			}
+		}
+		lines = append(lines, "  families:   "+strings.Join(parts, ", "))
+	}
+	if len(s.Exports) > 0 {
+		var parts []string
+		for _, e := range s.Exports {
+			if e.Error != "" {
+				parts = append(parts, e.Name+" failed")
+			} else {
+				parts = append(parts, e.Name+" ok")
+			}
+		}
+		lines = append(lines, "  exports:    "+strings.Join(parts, ", "))
+	}
+	if s.Pruned > 0 {
+		lines = append(lines, fmt.Sprintf("  pruned:     %d stale elements", s.Pruned))
+	}
+	if s.Excluded > 0 {
+		lines = append(lines, fmt.Sprintf("  excluded:   %d ranges, splitting produced %d prefixes", s.Excluded, s.Split))
+	}
+	if s.Bytes > 0 {
+		lines = append(lines, "  received:   "+FormatBytes(s.Bytes))
+	}
+	lines = append(lines,
+		"  backends:   "+strings.Join(s.Backends, ", "),
+		"  duration:   "+(time.Duration(s.DurationMS)*time.Millisecond).String(),
+		"  warnings:   "+warnings,
+	)
+	return strings.Join(lines, "\n")
+}
+
+// FormatBytes 以 B、KiB、MiB 或 GiB 显示字节数
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, suffix := float64(n)/unit, "KiB"
+	for _, s := range []string{"MiB", "GiB"} {
+		if v < unit {
+			break
+		}
+		v, suffix = v/unit, s
+	}
+	return fmt.Sprintf("%.1f %s", v, suffix)
+}
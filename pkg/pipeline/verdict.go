@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github-updater/pkg/iprange"
+	"github-updater/pkg/nft"
+)
+
+// maxConflicts 限制错误中逐条列出的冲突数
+const maxConflicts = 10
+
+// verdictOf 返回条目的动作：分类在 verdicts 中有动作时使用该动作，否则为 def。
+// 条目来自动作不同的多个分类时 ok 为 false
+func verdictOf(e Entry, verdicts map[string]string, def string) (verdict string, ok bool) {
+	for i, name := range e.Categories {
+		v := def
+		if cv, found := verdicts[name]; found {
+			v = cv
+		}
+		if i > 0 && v != verdict {
+			return verdict, false
+		}
+		verdict = v
+	}
+	return verdict, true
+}
+
+// MapElements 把条目按动作分组，每组合并重叠的网段后作为 verdict 映射的元素。
+// 同一网段或互相重叠的网段来自动作不同的分类时返回 *GuardError，列出冲突的网段和来源
+func MapElements(entries []Entry, verdicts map[string]string, def string, comment func(Entry) string) ([]nft.Element, error) {
+	type tagged struct {
+		Entry
+		verdict string
+		rng     iprange.Range
+	}
+	var (
+		conflicts []string
+		all       []tagged
+		order     []string
+	)
+	groups := make(map[string][]Entry)
+	for _, e := range entries {
+		v, ok := verdictOf(e, verdicts, def)
+		if !ok {
+			conflicts = append(conflicts, fmt.Sprintf("%s is listed by %s with different verdicts", e.Prefix, strings.Join(e.Categories, ", ")))
+			continue
+		}
+		if _, seen := groups[v]; !seen {
+			order = append(order, v)
+		}
+		groups[v] = append(groups[v], e)
+		all = append(all, tagged{e, v, iprange.FromPrefix(e.Prefix)})
+	}
+
+	// 按起始地址扫描，与仍覆盖当前地址的条目比较
+	slices.SortFunc(all, func(a, b tagged) int { return a.rng.From.Compare(b.rng.From) })
+	var active []tagged
+	for _, t := range all {
+		active = slices.DeleteFunc(active, func(a tagged) bool { return a.rng.To.Less(t.rng.From) })
+		for _, a := range active {
+			if a.verdict != t.verdict {
+				conflicts = append(conflicts, fmt.Sprintf("%s from %s (%s) overlaps %s from %s (%s)",
+					a.Prefix, strings.Join(a.Categories, ","), a.verdict, t.Prefix, strings.Join(t.Categories, ","), t.verdict))
+			}
+		}
+		active = append(active, t)
+	}
+	if len(conflicts) > 0 {
+		n := len(conflicts)
+		if n > maxConflicts {
+			conflicts = append(conflicts[:maxConflicts], fmt.Sprintf("and %d more", n-maxConflicts))
+		}
+		return nil, &GuardError{Err: fmt.Errorf("%d conflicting verdicts for overlapping prefixes: %s", n, strings.Join(conflicts, "; "))}
+	}
+
+	var elems []nft.Element
+	for _, v := range order {
+		for _, e := range Elements(Merge(groups[v]), comment) {
+			e.Verdict = v
+			elems = append(elems, e)
+		}
+	}
+	return elems, nil
+}
+
+// verdictRanges 按动作分组返回元素的区间
+func verdictRanges(elems []nft.Element) map[string][]iprange.Range {
+	ranges := make(map[string][]iprange.Range)
+	for _, e := range elems {
+		rng := e.Range
+		if e.Prefix.IsValid() {
+			rng = iprange.FromPrefix(e.Prefix)
+		}
+		ranges[e.Verdict] = append(ranges[e.Verdict], rng)
+	}
+	return ranges
+}
+
+// listedVerdictRanges 按动作分组返回映射中元素的区间
+func listedVerdictRanges(set *nft.Set) map[string][]iprange.Range {
+	ranges := make(map[string][]iprange.Range)
+	for _, e := range set.Elements {
+		ranges[e.Verdict] = append(ranges[e.Verdict], e.Range)
+	}
+	return ranges
+}
+
+// diffVerdicts 比较期望和现有的映射内容，动作改变的网段同时出现在 missing 和 unexpected 中
+func diffVerdicts(desired, live map[string][]iprange.Range) (missing, unexpected []netip.Prefix) {
+	for v, rs := range desired {
+		missing = append(missing, iprange.ToPrefixes(iprange.Subtract(rs, live[v]))...)
+	}
+	for v, rs := range live {
+		unexpected = append(unexpected, iprange.ToPrefixes(iprange.Subtract(rs, desired[v]))...)
+	}
+	SortPrefixes(missing)
+	SortPrefixes(unexpected)
+	return missing, unexpected
+}
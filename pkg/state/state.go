@@ -0,0 +1,147 @@
+// Package state 管理 -state-dir 下持久化的运行状态文件。
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDir 是默认的状态目录
+const DefaultDir = "/var/lib/github-updater"
+
+// 状态目录下的文件名，见 README
+const (
+	NotifyFile      = "notify-state.json"   // 通知限流记录
+	LastRunFile     = "last-run.json"       // 最近一次运行的摘要和时间
+	SnapshotFile    = "last-applied.json"   // 最近一次成功应用的数据，供 reapply 使用
+	AuditFile       = "audit.jsonl"         // 对集合的操作记录，每行一个 JSON
+	PendingFile     = "pending.json"        // -monitor 发现但尚未应用的变化
+	StatusFile      = "status.json"         // 供外部监控读取的最近一次运行状态
+	HashFile        = "applied-hash"        // 最近一次成功应用的期望网段哈希
+	SkipsFile       = "skipped-runs"        // 上次应用后因数据未变化而跳过的次数
+	FingerprintFile = "applied-fingerprint" // 最近一次成功应用后集合实际内容的指纹，-skip-unchanged 据此确认集合未被改动
+	ImportedFile    = "imported.json"       // 迁移时从原有 ipset 或集合导入、首次应用前使用的内容
+	MetaDateFile    = "meta-date"           // 见过的最新 meta 响应的 Date 头部，供 -stale-date 使用
+	PfTableFile     = "pf-table.txt"        // -backend pf 交给 pfctl 的表内容，可以被 pf.conf 引用
+)
+
+// knownFiles 是 Clear 允许删除的文件。PfTableFile 不在其中：pf.conf 可能在开机时读取它
+var knownFiles = []string{NotifyFile, LastRunFile, SnapshotFile, AuditFile, PendingFile, StatusFile, HashFile, SkipsFile, FingerprintFile, ImportedFile, MetaDateFile}
+
+// Dir 是状态目录。目录不可写时 Writable 为 false，读取仍然可用，写入会失败
+type Dir struct {
+	Path     string
+	Writable bool
+}
+
+// Open 在首次使用时以 0750 创建目录并检查是否可写。
+// 不可写时仍返回可用于读取的 Dir，同时返回说明原因的错误，调用方应降级而不是退出。
+func Open(path string) (*Dir, error) {
+	d := &Dir{Path: path}
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return d, fmt.Errorf("create state directory: %w", err)
+	}
+	f, err := os.CreateTemp(path, ".probe-*")
+	if err != nil {
+		return d, fmt.Errorf("state directory not writable: %w", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	d.Writable = true
+	return d, nil
+}
+
+// File 返回状态文件的完整路径
+func (d *Dir) File(name string) string { return filepath.Join(d.Path, name) }
+
+// WriteFile 先写临时文件再改名，避免中途失败留下不完整的状态
+func (d *Dir) WriteFile(name string, data []byte) error {
+	if !d.Writable {
+		return fmt.Errorf("state directory %s is not writable", d.Path)
+	}
+	return WriteFile(d.File(name), data, 0o640)
+}
+
+// WriteFile 原子地写入任意路径：先在同一目录写临时文件，再改名覆盖
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// AppendLine 向文件末尾追加一行
+func (d *Dir) AppendLine(name string, line []byte) error {
+	if !d.Writable {
+		return fmt.Errorf("state directory %s is not writable", d.Path)
+	}
+	return AppendLine(d.File(name), line)
+}
+
+// AppendLine 以追加方式向任意路径写入一行并同步到磁盘，文件不存在时创建，从不截断
+func AppendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Clear 删除目录中由本工具管理的文件（包括残留的临时文件），
+// 其他文件和目录本身保持不变。返回已删除的文件名
+func Clear(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for _, e := range entries {
+		if e.IsDir() || !managed(e.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(path, e.Name())); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, e.Name())
+	}
+	return removed, errors.Join(errs...)
+}
+
+func managed(name string) bool {
+	for _, known := range knownFiles {
+		if name == known || strings.HasPrefix(name, known+".tmp-") {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, ".probe-")
+}